@@ -0,0 +1,182 @@
+package speicher
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+)
+
+type (
+	// fieldAlias maps an old name of a struct field to its current encoded name.
+	fieldAlias struct {
+		alias string
+		name  string
+	}
+)
+
+var (
+	// aliasCache holds the []fieldAlias of every struct type seen so far.
+	aliasCache sync.Map
+	// aliasTypeCache holds whether decoding a type may involve aliases.
+	aliasTypeCache sync.Map
+
+	usedAliasMut sync.Mutex
+	usedAliases  = make(map[string]struct{})
+)
+
+// UsedAliases returns the field aliases that were applied while loading stores, sorted,
+// in the form "pkg.Type: old_name -> name".
+//
+// A struct field can declare old names with the speicher tag, so data written before the field was renamed
+// is still decoded into it:
+//
+//	type User struct {
+//		DisplayName string `json:"display_name" speicher:"alias=name,alias=nick"`
+//	}
+//
+// If the current name is present too, it wins. Once the stores were saved again and no alias shows up here anymore,
+// the alias can be removed.
+func UsedAliases() []string {
+	usedAliasMut.Lock()
+	defer usedAliasMut.Unlock()
+	used := make([]string, 0, len(usedAliases))
+	for use := range usedAliases {
+		used = append(used, use)
+	}
+	slices.Sort(used)
+	return used
+}
+
+func recordAlias(t reflect.Type, a fieldAlias) {
+	usedAliasMut.Lock()
+	defer usedAliasMut.Unlock()
+	usedAliases[fmt.Sprintf("%s: %s -> %s", t, a.alias, a.name)] = struct{}{}
+}
+
+// fieldAliases returns the aliases declared on the fields of the struct type t.
+func fieldAliases(t reflect.Type) []fieldAlias {
+	if aliases, ok := aliasCache.Load(t); ok {
+		return aliases.([]fieldAlias)
+	}
+	var aliases []fieldAlias
+	for _, f := range msgpackFields(t) {
+		tag := t.FieldByIndex(f.index).Tag.Get("speicher")
+		for _, opt := range strings.Split(tag, ",") {
+			if alias, ok := strings.CutPrefix(opt, "alias="); ok && alias != "" {
+				aliases = append(aliases, fieldAlias{alias: alias, name: f.name})
+			}
+		}
+	}
+	aliasCache.Store(t, aliases)
+	return aliases
+}
+
+// hasAliases reports whether a value of type t may contain structs with field aliases.
+func hasAliases(t reflect.Type) bool {
+	if has, ok := aliasTypeCache.Load(t); ok {
+		return has.(bool)
+	}
+	// Recursive types are assumed to have no aliases until proven otherwise
+	aliasTypeCache.Store(t, false)
+	has := false
+	switch {
+	case reflect.PointerTo(t).Implements(jsonUnmarshalerType), reflect.PointerTo(t).Implements(textUnmarshalerType):
+	case t.Kind() == reflect.Pointer, t.Kind() == reflect.Slice, t.Kind() == reflect.Array, t.Kind() == reflect.Map:
+		has = hasAliases(t.Elem())
+	case t.Kind() == reflect.Struct:
+		has = len(fieldAliases(t)) > 0
+		for _, f := range msgpackFields(t) {
+			has = has || hasAliases(t.FieldByIndex(f.index).Type)
+		}
+	}
+	aliasTypeCache.Store(t, has)
+	return has
+}
+
+// decodeJSON decodes JSON from r into the pointer v like encoding/json, applying field aliases.
+// If strict is set, unknown fields are rejected.
+func decodeJSON(r io.Reader, v any, strict bool) error {
+	if t := reflect.TypeOf(v); t == nil || t.Kind() != reflect.Pointer || !hasAliases(t.Elem()) {
+		dec := json.NewDecoder(r)
+		if strict {
+			dec.DisallowUnknownFields()
+		}
+		return dec.Decode(v)
+	}
+	var tree any
+	dec := json.NewDecoder(r)
+	dec.UseNumber()
+	if err := dec.Decode(&tree); err != nil {
+		return err
+	}
+	tree = applyAliases(tree, reflect.TypeOf(v).Elem())
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(tree); err != nil {
+		return err
+	}
+	dec = json.NewDecoder(&buf)
+	if strict {
+		dec.DisallowUnknownFields()
+	}
+	return dec.Decode(v)
+}
+
+// applyAliases renames aliased fields in the decoded JSON tree of a value of type t.
+func applyAliases(tree any, t reflect.Type) any {
+	if !hasAliases(t) {
+		return tree
+	}
+	switch t.Kind() {
+	case reflect.Pointer:
+		return applyAliases(tree, t.Elem())
+	case reflect.Slice, reflect.Array:
+		if values, ok := tree.([]any); ok {
+			for i, value := range values {
+				values[i] = applyAliases(value, t.Elem())
+			}
+		}
+	case reflect.Map:
+		if values, ok := tree.(map[string]any); ok {
+			for key, value := range values {
+				values[key] = applyAliases(value, t.Elem())
+			}
+		}
+	case reflect.Struct:
+		values, ok := tree.(map[string]any)
+		if !ok {
+			break
+		}
+		for _, a := range fieldAliases(t) {
+			value, ok := values[a.alias]
+			if !ok {
+				continue
+			}
+			delete(values, a.alias)
+			if _, exists := values[a.name]; !exists {
+				values[a.name] = value
+				recordAlias(t, a)
+			}
+		}
+		for _, f := range msgpackFields(t) {
+			if value, ok := values[f.name]; ok {
+				values[f.name] = applyAliases(value, t.FieldByIndex(f.index).Type)
+			}
+		}
+	}
+	return tree
+}
+
+// aliasedField returns the field that key is an alias of, or nil if it is none.
+func aliasedField(t reflect.Type, fields []msgpackField, key string) (*msgpackField, fieldAlias) {
+	for _, a := range fieldAliases(t) {
+		if a.alias == key {
+			return findField(fields, a.name), a
+		}
+	}
+	return nil, fieldAlias{}
+}
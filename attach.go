@@ -0,0 +1,40 @@
+package speicher
+
+import (
+	"fmt"
+	"slices"
+)
+
+// AttachReadOnly loads the Map that another process keeps at location in read-only mode,
+// so tools like sidecars and debugging scripts can inspect live data without any risk of writing to it.
+//
+// The Map reloads its data whenever the owner saves the file (see WithAutoReload), and it never takes
+// a file lock, so it neither waits for nor blocks an owner that uses WithFileLock.
+// Saves replace the file atomically, so the Map always sees a complete snapshot of the data.
+// Changes made to the Map stay in memory until the next reload, and saving it fails.
+//
+// opts must include the options of the owner that affect the format of the file,
+// like WithEncryption or WithDoubleBuffer. If the file doesn't exist, an error is returned.
+func AttachReadOnly[T any](location string, opts ...Option) (Map[T], error) {
+	opts = append(slices.Clone(opts), func(o *storeOptions) {
+		o.attached = true
+		o.fileLock = 0
+		o.noAutoSave = true
+		o.autoReload = true
+	})
+	o := newStoreOptions(opts)
+	if !o.fileExists(location) && !(o.doubleBuffer && o.fileExists(pointerLocation(location))) {
+		return nil, fmt.Errorf("unable to attach to '%s': file does not exist", location)
+	}
+	return LoadMap[T](location, opts...)
+}
+
+// fileExists reports whether the file at location can be opened.
+func (o storeOptions) fileExists(location string) bool {
+	f, err := o.files().Open(location)
+	if err != nil {
+		return false
+	}
+	_ = f.Close()
+	return true
+}
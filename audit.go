@@ -0,0 +1,242 @@
+package speicher
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+type (
+	// AuditEntry is a change of a store recorded in its audit log, see WithAuditLog.
+	AuditEntry struct {
+		// Time is when the change was made.
+		Time time.Time `json:"time"`
+		// Actor is the actor of the State that made the change (see State.SetActor), if any.
+		Actor string `json:"actor,omitempty"`
+		// Op is the kind of change.
+		Op ChangeOp `json:"op"`
+		// Key is the key of the changed Map element or the index of the changed List element.
+		// It is empty for ChangeOverwrite.
+		Key string `json:"key,omitempty"`
+		// Old is the value before the change encoded as JSON.
+		// It is the zero value if the element did not exist and empty for ChangeOverwrite.
+		Old json.RawMessage `json:"old,omitempty"`
+		// New is the value after the change encoded as JSON.
+		// It is empty for ChangeDelete and ChangeOverwrite.
+		New json.RawMessage `json:"new,omitempty"`
+	}
+
+	// auditLog appends the audit entries of a store to its sidecar file.
+	auditLog struct {
+		location string
+		// fsys is the file system of the store, or nil for the one of the operating system.
+		fsys   FileSystem
+		report func(err error)
+		mut    sync.Mutex
+	}
+
+	// auditedStore is implemented by stores that can record their changes in an audit log.
+	auditedStore interface {
+		setAuditLog(a *auditLog)
+	}
+
+	// auditFlusher is implemented by stores that buffer audit entries until their write lock is released.
+	auditFlusher interface {
+		// flushAudit writes the buffered audit entries, made by actor, to the audit log.
+		// The caller must hold a write lock.
+		flushAudit(actor string)
+	}
+)
+
+// WithAuditLog appends every change of the store to the sidecar file location.audit.jsonl,
+// one AuditEntry encoded as JSON per line, to answer who changed an element and when.
+// The entries of a change are written when its write lock is released, before other writers can continue;
+// changes rolled back by a Transaction are not recorded.
+// Errors writing the log are reported like a failed automatic save (see WithSaveErrorHandler).
+//
+// It applies to Map, OrderedMap, ShardedMap, KeyedMap, List and disk-backed Map stores; other stores ignore it.
+// Stores loaded with WithFileSystem write the log there, which rewrites the whole log for every change,
+// since a FileSystem can't append to a file.
+func WithAuditLog() Option {
+	return func(o *storeOptions) {
+		o.auditLog = true
+	}
+}
+
+// auditLocation returns the location of the sidecar file holding the audit log of a store.
+func auditLocation(location string) string {
+	return location + ".audit.jsonl"
+}
+
+// auditChanges installs the audit log configured with WithAuditLog on store.
+func auditChanges(store lockable, location string) {
+	o := optionsOf(store)
+	a, ok := store.(auditedStore)
+	if o == nil || !o.auditLog || !ok {
+		return
+	}
+	a.setAuditLog(&auditLog{location: auditLocation(location), fsys: o.fileSystem, report: o.reportError})
+}
+
+// auditEntry returns the AuditEntry of event.
+func auditEntry[T any](event ChangeEvent[T]) AuditEntry {
+	entry := AuditEntry{Time: time.Now(), Op: event.Op, Key: event.Key}
+	switch event.Op {
+	case ChangeOverwrite:
+	case ChangeDelete:
+		entry.Old = encodedValue(event.Old)
+	default:
+		entry.Old = encodedValue(event.Old)
+		entry.New = encodedValue(event.New)
+	}
+	return entry
+}
+
+// encodedValue returns value encoded as JSON, or JSON null if it can't be encoded.
+func encodedValue(value any) json.RawMessage {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return json.RawMessage("null")
+	}
+	return data
+}
+
+// write appends entries to the audit log, setting their actor.
+func (a *auditLog) write(entries []AuditEntry, actor string) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, entry := range entries {
+		entry.Actor = actor
+		if err := enc.Encode(entry); err != nil {
+			a.report(errors.Join(fmt.Errorf("failed to encode audit entry of '%s'", a.location), err))
+			return
+		}
+	}
+
+	a.mut.Lock()
+	defer a.mut.Unlock()
+	if a.fsys != nil {
+		if err := a.rewrite(buf.Bytes()); err != nil {
+			a.report(errors.Join(fmt.Errorf("failed to write file '%s'", a.location), err))
+		}
+		return
+	}
+	f, err := os.OpenFile(a.location, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		a.report(errors.Join(fmt.Errorf("failed to open file '%s'", a.location), err))
+		return
+	}
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		_ = f.Close()
+		a.report(errors.Join(fmt.Errorf("failed to write file '%s'", a.location), err))
+		return
+	}
+	if err := f.Close(); err != nil {
+		a.report(errors.Join(fmt.Errorf("failed to close file '%s'", a.location), err))
+	}
+}
+
+// rewrite appends data to the audit log on a FileSystem by writing the log again with data added.
+// The caller must hold a.mut.
+func (a *auditLog) rewrite(data []byte) error {
+	var log []byte
+	f, err := a.fsys.Open(a.location)
+	if err == nil {
+		log, err = io.ReadAll(f)
+		_ = f.Close()
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return storeOptions{fileSystem: a.fsys}.writeFile(a.location, func(w io.Writer) error {
+		if _, err := w.Write(log); err != nil {
+			return err
+		}
+		_, err := w.Write(data)
+		return err
+	})
+}
+
+// ReadAuditLog calls fn for every entry of the audit log of the store at location, oldest first,
+// until fn returns false. A store that hasn't recorded any change yet has no audit log
+// and fn is not called. Pass WithFileSystem if the store was loaded with it.
+func ReadAuditLog(location string, fn func(entry AuditEntry) bool, opts ...Option) error {
+	f, err := newStoreOptions(opts).files().Open(auditLocation(location))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return errors.Join(fmt.Errorf("failed to open file '%s' (file exists)", auditLocation(location)), err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 64<<20)
+	for line := 1; scanner.Scan(); line++ {
+		var entry AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return errors.Join(fmt.Errorf("failed to decode line %d of file '%s'", line, auditLocation(location)), err)
+		}
+		if !fn(entry) {
+			return nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return errors.Join(fmt.Errorf("failed to read file '%s'", auditLocation(location)), err)
+	}
+	return nil
+}
+
+// flushAudit writes the audit entries recorded since the last flush to the audit log.
+func (f *changeFeed[T]) flushAudit(actor string) {
+	f.mut.Lock()
+	entries := f.audits
+	f.audits = nil
+	f.mut.Unlock()
+	if len(entries) > 0 {
+		f.audit.write(entries, actor)
+	}
+}
+
+// flushAudit writes the buffered audit entries of store, if it has any, made by actor.
+// The caller must hold a write lock.
+func flushAudit(store lockable, actor string) {
+	if a, ok := store.(auditFlusher); ok {
+		a.flushAudit(actor)
+	}
+}
+
+func (m *memoryMap[T]) setAuditLog(a *auditLog) {
+	m.changes.audit = a
+}
+
+func (m *memoryMap[T]) flushAudit(actor string) {
+	m.changes.flushAudit(actor)
+}
+
+func (m *shardedMap[T]) setAuditLog(a *auditLog) {
+	for _, shard := range m.shards {
+		shard.setAuditLog(a)
+	}
+}
+
+func (l *memoryList[T]) setAuditLog(a *auditLog) {
+	l.changes.audit = a
+}
+
+func (l *memoryList[T]) flushAudit(actor string) {
+	l.changes.flushAudit(actor)
+}
+
+func (m *diskMap[T]) setAuditLog(a *auditLog) {
+	m.changes.audit = a
+}
+
+func (m *diskMap[T]) flushAudit(actor string) {
+	m.changes.flushAudit(actor)
+}
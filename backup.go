@@ -0,0 +1,204 @@
+package speicher
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	backupBaseSuffix = ".base.json"
+	backupDiffSuffix = ".diff.json"
+	backupIndexName  = "index.json"
+)
+
+type (
+	// BackupOptions configures BackupMap.
+	BackupOptions struct {
+		// Full forces a new baseline snapshot instead of a diff.
+		// Restoring only considers the latest baseline and the diffs written after it.
+		Full bool
+	}
+
+	// backupDiff holds the entries changed and removed since the previous backup.
+	backupDiff struct {
+		Set     map[string]json.RawMessage `json:"set"`
+		Deleted []string                   `json:"deleted"`
+	}
+
+	// backupIndex holds the content hash of every entry at the time of the last backup.
+	backupIndex struct {
+		Seq    int               `json:"seq"`
+		Hashes map[string]string `json:"hashes"`
+	}
+)
+
+// BackupMap writes an incremental backup of m into dir.
+//
+// The first backup (or one with opts.Full set) writes a baseline snapshot of all entries.
+// Every following backup only writes the entries that changed and the keys that were
+// removed since the previous backup. If nothing changed, no file is written.
+// Use RestoreMapBackup to fold the baseline and its diffs back together.
+//
+// This function acquires its own read lock on m.
+func BackupMap[T any](m Map[T], dir string, opts BackupOptions) error {
+	if err := os.MkdirAll(dir, 0740); err != nil {
+		return errors.Join(fmt.Errorf("failed to create backup directory '%s'", dir), err)
+	}
+
+	index, err := readBackupIndex(dir)
+	if err != nil {
+		return err
+	}
+	full := opts.Full || index.Hashes == nil
+
+	entries := make(map[string]json.RawMessage)
+	hashes := make(map[string]string)
+	err = func() error {
+		s := NewState()
+		s.RLock(m)
+		defer s.RUnlock(m)
+		for key, value := range m.Iterate {
+			raw, err := json.Marshal(value)
+			if err != nil {
+				return errors.Join(fmt.Errorf("failed to encode entry '%s'", key), err)
+			}
+			sum := sha256.Sum256(raw)
+			hash := hex.EncodeToString(sum[:])
+			hashes[key] = hash
+			if full || index.Hashes[key] != hash {
+				entries[key] = raw
+			}
+		}
+		return nil
+	}()
+	if err != nil {
+		return err
+	}
+
+	index.Seq++
+	var name string
+	var content any
+	if full {
+		name = fmt.Sprintf("%06d%s", index.Seq, backupBaseSuffix)
+		content = entries
+	} else {
+		diff := backupDiff{Set: entries}
+		for key := range index.Hashes {
+			if _, ok := hashes[key]; !ok {
+				diff.Deleted = append(diff.Deleted, key)
+			}
+		}
+		if len(diff.Set) == 0 && len(diff.Deleted) == 0 {
+			return nil
+		}
+		sort.Strings(diff.Deleted)
+		name = fmt.Sprintf("%06d%s", index.Seq, backupDiffSuffix)
+		content = diff
+	}
+
+	if err := writeBackupFile(filepath.Join(dir, name), content); err != nil {
+		return err
+	}
+	index.Hashes = hashes
+	return writeBackupFile(filepath.Join(dir, backupIndexName), index)
+}
+
+// RestoreMapBackup replaces the content of m with the state recorded in the backup directory dir.
+// The latest baseline snapshot is loaded and all diffs written after it are applied in order.
+//
+// This function acquires its own write lock on m.
+func RestoreMapBackup[T any](m Map[T], dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return errors.Join(fmt.Errorf("failed to read backup directory '%s'", dir), err)
+	}
+	var names []string
+	base := -1
+	for _, e := range entries {
+		name := e.Name()
+		if !strings.HasSuffix(name, backupBaseSuffix) && !strings.HasSuffix(name, backupDiffSuffix) {
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for i, name := range names {
+		if strings.HasSuffix(name, backupBaseSuffix) {
+			base = i
+		}
+	}
+	if base < 0 {
+		return fmt.Errorf("no baseline snapshot found in '%s'", dir)
+	}
+
+	var raw map[string]json.RawMessage
+	if err := readBackupFile(filepath.Join(dir, names[base]), &raw); err != nil {
+		return err
+	}
+	for _, name := range names[base+1:] {
+		var diff backupDiff
+		if err := readBackupFile(filepath.Join(dir, name), &diff); err != nil {
+			return err
+		}
+		for key, value := range diff.Set {
+			raw[key] = value
+		}
+		for _, key := range diff.Deleted {
+			delete(raw, key)
+		}
+	}
+
+	data := make(map[string]T, len(raw))
+	for key, value := range raw {
+		var v T
+		if err := json.Unmarshal(value, &v); err != nil {
+			return errors.Join(fmt.Errorf("failed to decode entry '%s' from backup", key), err)
+		}
+		data[key] = v
+	}
+
+	s := NewState()
+	s.Lock(m)
+	defer s.Unlock(m)
+	m.Overwrite(data)
+	return nil
+}
+
+func readBackupIndex(dir string) (backupIndex, error) {
+	var index backupIndex
+	err := readBackupFile(filepath.Join(dir, backupIndexName), &index)
+	if errors.Is(err, os.ErrNotExist) {
+		return backupIndex{}, nil
+	}
+	return index, err
+}
+
+func readBackupFile(location string, v any) error {
+	f, err := os.Open(location)
+	if err != nil {
+		return errors.Join(fmt.Errorf("failed to open backup file '%s'", location), err)
+	}
+	defer f.Close()
+	if err := json.NewDecoder(f).Decode(v); err != nil {
+		return errors.Join(fmt.Errorf("failed to decode backup file '%s'", location), err)
+	}
+	return nil
+}
+
+func writeBackupFile(location string, v any) error {
+	err := writeFileAtomic(location, func(w io.Writer) error {
+		return json.NewEncoder(w).Encode(v)
+	})
+	if err != nil {
+		return errors.Join(fmt.Errorf("failed to write backup file '%s'", location), err)
+	}
+	return nil
+}
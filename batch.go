@@ -0,0 +1,88 @@
+package speicher
+
+import "slices"
+
+func (m *memoryMap[T]) GetMany(keys ...string) map[string]T {
+	values := make(map[string]T, len(keys))
+	for _, key := range keys {
+		if value, ok := m.Get(key); ok {
+			values[key] = value
+		}
+	}
+	return values
+}
+
+func (m *memoryMap[T]) SetMany(values map[string]T) {
+	for key, value := range values {
+		m.Set(key, value)
+	}
+}
+
+func (m *memoryMap[T]) DeleteMany(keys ...string) {
+	for _, key := range keys {
+		m.Delete(key)
+	}
+}
+
+func (m *memoryOrderedMap[T]) SetMany(values map[string]T) {
+	for key, value := range values {
+		m.Set(key, value)
+	}
+}
+
+func (m *memoryOrderedMap[T]) DeleteMany(keys ...string) {
+	for _, key := range keys {
+		m.Delete(key)
+	}
+}
+
+func (m *shardedMap[T]) GetMany(keys ...string) map[string]T {
+	values := make(map[string]T, len(keys))
+	for _, key := range keys {
+		if value, ok := m.shardOf(key).Get(key); ok {
+			values[key] = value
+		}
+	}
+	return values
+}
+
+func (m *shardedMap[T]) SetMany(values map[string]T) {
+	for key, value := range values {
+		m.shardOf(key).Set(key, value)
+	}
+}
+
+func (m *shardedMap[T]) DeleteMany(keys ...string) {
+	for _, key := range keys {
+		m.shardOf(key).Delete(key)
+	}
+}
+
+func (m *diskMap[T]) GetMany(keys ...string) map[string]T {
+	values := make(map[string]T, len(keys))
+	for _, key := range keys {
+		if value, ok := m.Get(key); ok {
+			values[key] = value
+		}
+	}
+	return values
+}
+
+func (m *diskMap[T]) SetMany(values map[string]T) {
+	for key, value := range values {
+		m.Set(key, value)
+	}
+}
+
+func (m *diskMap[T]) DeleteMany(keys ...string) {
+	for _, key := range keys {
+		m.Delete(key)
+	}
+}
+
+func (l *memoryList[T]) AppendMany(values []T) {
+	l.data = slices.Grow(l.data, len(values))
+	for _, value := range values {
+		l.Append(value)
+	}
+}
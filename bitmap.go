@@ -0,0 +1,559 @@
+package speicher
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+// arrayContainerMax is the cardinality above which a container switches
+// from a sorted array to a bitset. At this size both need 8 KiB.
+const arrayContainerMax = 4096
+
+type (
+	// bitmapContainer holds the lower 16 bits of all IDs sharing the same upper 16 bits.
+	// Sparse containers use a sorted array, dense containers a bitset.
+	bitmapContainer struct {
+		array  []uint16
+		bitset []uint64
+		card   int
+	}
+
+	// memoryBitmap is a Bitmap implementation that keeps all containers in memory.
+	memoryBitmap struct {
+		id         storeID
+		containers map[uint16]*bitmapContainer
+		location   string
+		codec      codec
+		opts       storeOptions
+		mut        sync.RWMutex
+
+		timerMut     sync.Mutex
+		saveTimer    *time.Timer
+		maxSaveTimer *time.Timer
+		saveOnce     *sync.Once
+	}
+
+	// Bitmap is a thread-safe, compressed set of uint32 IDs with fast set operations.
+	// IDs are grouped into containers by their upper 16 bits, and each container
+	// is stored as a sorted array or as a bitset depending on its density,
+	// which keeps both sparse and dense sets small.
+	// The Bitmap is persisted as a JSON array of [from, to] ID runs.
+	//
+	// All operations require appropriate locking via a State object:
+	//
+	//	s := speicher.NewState()
+	//	s.Lock(rollout)
+	//	defer s.Unlock(rollout)
+	//	rollout.AddRange(0, 10_000)
+	Bitmap interface {
+		lockable
+
+		// Add inserts the ID. It returns true if the ID was not present before.
+		// Requires a write lock.
+		Add(id uint32) bool
+
+		// AddRange inserts all IDs from from (inclusive) to to (exclusive).
+		// Requires a write lock.
+		AddRange(from, to uint32)
+
+		// Remove deletes the ID. It returns true if the ID was present.
+		// Requires a write lock.
+		Remove(id uint32) bool
+
+		// Contains checks if the ID is present.
+		// Requires at least a read lock.
+		Contains(id uint32) bool
+
+		// Len returns the number of IDs.
+		// Requires at least a read lock.
+		Len() int
+
+		// UnionWith adds all IDs of other to this Bitmap.
+		// Requires a write lock on this Bitmap and at least a read lock on other.
+		UnionWith(other Bitmap)
+
+		// IntersectWith removes all IDs that are not in other from this Bitmap.
+		// Requires a write lock on this Bitmap and at least a read lock on other.
+		IntersectWith(other Bitmap)
+
+		// DifferenceWith removes all IDs that are in other from this Bitmap.
+		// Requires a write lock on this Bitmap and at least a read lock on other.
+		DifferenceWith(other Bitmap)
+
+		// IntersectionLen returns the number of IDs present in both this Bitmap and other.
+		// Requires at least a read lock on both bitmaps.
+		IntersectionLen(other Bitmap) int
+
+		// Iterate calls the provided function for each ID in ascending order.
+		// Requires at least a read lock.
+		Iterate(yield func(id uint32) bool)
+
+		// Save persists the current state of the Bitmap to its underlying data store.
+		// It returns an error if the operation fails.
+		// This method acquires its own read lock internally.
+		Save() error
+
+		// SaveCtx persists the current state of the data store like Save,
+		// but aborts when ctx is cancelled or its deadline passes.
+		// An aborted save removes its temporary files and leaves the previous file intact.
+		// This method acquires its own read lock internally.
+		SaveCtx(ctx context.Context) error
+
+		// Close stops the automatic save and the background goroutines of the store and saves it one last time.
+		// The store must not be used afterwards.
+		// This method acquires its own read lock internally.
+		Close() error
+	}
+)
+
+func (c *bitmapContainer) contains(low uint16) bool {
+	if c.bitset != nil {
+		return c.bitset[low>>6]&(1<<(low&63)) != 0
+	}
+	_, found := slices.BinarySearch(c.array, low)
+	return found
+}
+
+func (c *bitmapContainer) add(low uint16) bool {
+	if c.bitset != nil {
+		mask := uint64(1) << (low & 63)
+		if c.bitset[low>>6]&mask != 0 {
+			return false
+		}
+		c.bitset[low>>6] |= mask
+		c.card++
+		return true
+	}
+	i, found := slices.BinarySearch(c.array, low)
+	if found {
+		return false
+	}
+	c.array = slices.Insert(c.array, i, low)
+	c.card++
+	if c.card > arrayContainerMax {
+		c.toBitset()
+	}
+	return true
+}
+
+func (c *bitmapContainer) remove(low uint16) bool {
+	if c.bitset != nil {
+		mask := uint64(1) << (low & 63)
+		if c.bitset[low>>6]&mask == 0 {
+			return false
+		}
+		c.bitset[low>>6] &^= mask
+		c.card--
+		if c.card <= arrayContainerMax {
+			c.toArray()
+		}
+		return true
+	}
+	i, found := slices.BinarySearch(c.array, low)
+	if !found {
+		return false
+	}
+	c.array = slices.Delete(c.array, i, i+1)
+	c.card--
+	return true
+}
+
+func (c *bitmapContainer) toBitset() {
+	c.bitset = make([]uint64, 1024)
+	for _, low := range c.array {
+		c.bitset[low>>6] |= 1 << (low & 63)
+	}
+	c.array = nil
+}
+
+func (c *bitmapContainer) toArray() {
+	c.array = make([]uint16, 0, c.card)
+	for low := range c.iterate {
+		c.array = append(c.array, low)
+	}
+	c.bitset = nil
+}
+
+// normalize recounts the cardinality after word-wise operations and picks the smaller representation.
+func (c *bitmapContainer) normalize() {
+	if c.bitset == nil {
+		c.card = len(c.array)
+		return
+	}
+	c.card = 0
+	for _, w := range c.bitset {
+		c.card += bits.OnesCount64(w)
+	}
+	if c.card <= arrayContainerMax {
+		c.toArray()
+	}
+}
+
+func (c *bitmapContainer) iterate(yield func(low uint16) bool) {
+	if c.bitset == nil {
+		for _, low := range c.array {
+			if !yield(low) {
+				return
+			}
+		}
+		return
+	}
+	for i, w := range c.bitset {
+		for w != 0 {
+			t := bits.TrailingZeros64(w)
+			if !yield(uint16(i<<6 + t)) {
+				return
+			}
+			w &= w - 1
+		}
+	}
+}
+
+func split(id uint32) (uint16, uint16) {
+	return uint16(id >> 16), uint16(id)
+}
+
+func (b *memoryBitmap) Add(id uint32) bool {
+	high, low := split(id)
+	c, ok := b.containers[high]
+	if !ok {
+		c = &bitmapContainer{}
+		b.containers[high] = c
+	}
+	return c.add(low)
+}
+
+func (b *memoryBitmap) AddRange(from, to uint32) {
+	for id := uint64(from); id < uint64(to); id++ {
+		b.Add(uint32(id))
+	}
+}
+
+func (b *memoryBitmap) Remove(id uint32) bool {
+	high, low := split(id)
+	c, ok := b.containers[high]
+	if !ok || !c.remove(low) {
+		return false
+	}
+	if c.card == 0 {
+		delete(b.containers, high)
+	}
+	return true
+}
+
+func (b *memoryBitmap) Contains(id uint32) bool {
+	high, low := split(id)
+	c, ok := b.containers[high]
+	return ok && c.contains(low)
+}
+
+func (b *memoryBitmap) Len() int {
+	n := 0
+	for _, c := range b.containers {
+		n += c.card
+	}
+	return n
+}
+
+// highKeys returns the sorted upper 16 bits of all containers.
+func (b *memoryBitmap) highKeys() []uint16 {
+	keys := make([]uint16, 0, len(b.containers))
+	for high := range b.containers {
+		keys = append(keys, high)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+func (b *memoryBitmap) UnionWith(other Bitmap) {
+	o, ok := other.(*memoryBitmap)
+	if !ok {
+		for id := range other.Iterate {
+			b.Add(id)
+		}
+		return
+	}
+	for high, oc := range o.containers {
+		c, ok := b.containers[high]
+		if !ok {
+			c = &bitmapContainer{}
+			b.containers[high] = c
+		}
+		if c.bitset != nil && oc.bitset != nil {
+			for i := range c.bitset {
+				c.bitset[i] |= oc.bitset[i]
+			}
+			c.normalize()
+			continue
+		}
+		for low := range oc.iterate {
+			c.add(low)
+		}
+	}
+}
+
+func (b *memoryBitmap) IntersectWith(other Bitmap) {
+	o, isMemory := other.(*memoryBitmap)
+	for high, c := range b.containers {
+		if isMemory {
+			oc, ok := o.containers[high]
+			if !ok {
+				delete(b.containers, high)
+				continue
+			}
+			if c.bitset != nil && oc.bitset != nil {
+				for i := range c.bitset {
+					c.bitset[i] &= oc.bitset[i]
+				}
+				c.normalize()
+				if c.card == 0 {
+					delete(b.containers, high)
+				}
+				continue
+			}
+		}
+		var remove []uint16
+		for low := range c.iterate {
+			if !other.Contains(uint32(high)<<16 | uint32(low)) {
+				remove = append(remove, low)
+			}
+		}
+		for _, low := range remove {
+			c.remove(low)
+		}
+		if c.card == 0 {
+			delete(b.containers, high)
+		}
+	}
+}
+
+func (b *memoryBitmap) DifferenceWith(other Bitmap) {
+	o, ok := other.(*memoryBitmap)
+	if !ok {
+		for id := range other.Iterate {
+			b.Remove(id)
+		}
+		return
+	}
+	for high, oc := range o.containers {
+		c, ok := b.containers[high]
+		if !ok {
+			continue
+		}
+		if c.bitset != nil && oc.bitset != nil {
+			for i := range c.bitset {
+				c.bitset[i] &^= oc.bitset[i]
+			}
+			c.normalize()
+		} else {
+			for low := range oc.iterate {
+				c.remove(low)
+			}
+		}
+		if c.card == 0 {
+			delete(b.containers, high)
+		}
+	}
+}
+
+func (b *memoryBitmap) IntersectionLen(other Bitmap) int {
+	o, isMemory := other.(*memoryBitmap)
+	n := 0
+	for high, c := range b.containers {
+		if isMemory {
+			oc, ok := o.containers[high]
+			if !ok {
+				continue
+			}
+			if c.bitset != nil && oc.bitset != nil {
+				for i := range c.bitset {
+					n += bits.OnesCount64(c.bitset[i] & oc.bitset[i])
+				}
+				continue
+			}
+			if oc.card < c.card {
+				c, oc = oc, c
+			}
+			for low := range c.iterate {
+				if oc.contains(low) {
+					n++
+				}
+			}
+			continue
+		}
+		for low := range c.iterate {
+			if other.Contains(uint32(high)<<16 | uint32(low)) {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+func (b *memoryBitmap) Iterate(yield func(id uint32) bool) {
+	for _, high := range b.highKeys() {
+		for low := range b.containers[high].iterate {
+			if !yield(uint32(high)<<16 | uint32(low)) {
+				return
+			}
+		}
+	}
+}
+
+// runs returns the IDs as sorted, inclusive [from, to] ranges.
+func (b *memoryBitmap) runs() [][2]uint32 {
+	runs := make([][2]uint32, 0)
+	for id := range b.Iterate {
+		if n := len(runs); n > 0 && runs[n-1][1]+1 == id {
+			runs[n-1][1] = id
+			continue
+		}
+		runs = append(runs, [2]uint32{id, id})
+	}
+	return runs
+}
+
+func (b *memoryBitmap) getStoreID() storeID {
+	return b.id
+}
+
+func (b *memoryBitmap) getMutex() *sync.RWMutex {
+	return &b.mut
+}
+
+func (b *memoryBitmap) getOptions() *storeOptions {
+	return &b.opts
+}
+
+func (b *memoryBitmap) Save() error {
+	return b.SaveCtx(context.Background())
+}
+
+func (b *memoryBitmap) SaveCtx(ctx context.Context) error {
+	s := saveState(ctx)
+	s.RLock(b)
+	defer s.RUnlock(b)
+
+	h := sha256.New()
+	err := b.opts.saveFile(ctx, b.location, func(w io.Writer) error {
+		return b.codec.encode(io.MultiWriter(w, h), b.runs())
+	})
+	if err != nil {
+		return errors.Join(fmt.Errorf("failed to write file '%s'", b.location), err)
+	}
+	if err := b.opts.recordHash(b.location, h.Sum(nil)); err != nil {
+		return errors.Join(fmt.Errorf("failed to update manifest for '%s'", b.location), err)
+	}
+	return nil
+}
+
+func (b *memoryBitmap) encodeData(w io.Writer, c codec) error {
+	return c.encode(w, b.runs())
+}
+
+func (b *memoryBitmap) decodedEquals(r io.Reader, c codec) (bool, error) {
+	var runs [][2]uint32
+	if err := c.decode(r, &runs); err != nil {
+		return false, err
+	}
+	return slices.Equal(runs, b.runs()), nil
+}
+
+// LoadBitmap loads a Bitmap from location.
+// If the file does not exist, an empty Bitmap is returned.
+func LoadBitmap(location string, opts ...Option) (Bitmap, error) {
+	options := newStoreOptions(opts)
+	lock, err := lockFile(location, options)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.releaseUnclaimed()
+	c, err := resolveCodec(location, options)
+	if err != nil {
+		return nil, err
+	}
+	if b, err := loadBitmapFromFile(location, c, options); err != nil {
+		return nil, errors.Join(fmt.Errorf("unable to load bitmap from file '%s'", location), err)
+	} else {
+		opened(b, location)
+		return b, nil
+	}
+}
+
+func loadBitmapFromFile(location string, c codec, o storeOptions) (Bitmap, error) {
+	b := &memoryBitmap{
+		id:         newStoreID(),
+		containers: make(map[uint16]*bitmapContainer),
+		location:   location,
+		codec:      c,
+		opts:       o,
+	}
+	f, err := o.openFile(location)
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = o.files().MkdirAll(filepath.Dir(location), 0740)
+			return b, err
+		}
+		return nil, errors.Join(fmt.Errorf("failed to open file '%s' (file exists)", location), err)
+	}
+	defer f.Close()
+	var runs [][2]uint32
+	if err := c.decode(f, &runs); err != nil {
+		return nil, errors.Join(fmt.Errorf("failed to decode file '%s'", location), err)
+	}
+	sort.Slice(runs, func(i, j int) bool { return runs[i][0] < runs[j][0] })
+	for _, run := range runs {
+		if run[0] > run[1] {
+			return nil, fmt.Errorf("invalid run [%d, %d] in file '%s'", run[0], run[1], location)
+		}
+		b.AddRange(run[0], run[1])
+		b.Add(run[1])
+	}
+	return b, nil
+}
+
+func (b *memoryBitmap) getSaveTimer() *time.Timer {
+	b.timerMut.Lock()
+	defer b.timerMut.Unlock()
+	return b.saveTimer
+}
+
+func (b *memoryBitmap) setSaveTimer(t *time.Timer) {
+	b.timerMut.Lock()
+	defer b.timerMut.Unlock()
+	b.saveTimer = t
+}
+
+func (b *memoryBitmap) getMaxSaveTimer() *time.Timer {
+	b.timerMut.Lock()
+	defer b.timerMut.Unlock()
+	return b.maxSaveTimer
+}
+
+func (b *memoryBitmap) setMaxSaveTimer(t *time.Timer) {
+	b.timerMut.Lock()
+	defer b.timerMut.Unlock()
+	b.maxSaveTimer = t
+}
+
+func (b *memoryBitmap) getSaveOnce() *sync.Once {
+	b.timerMut.Lock()
+	defer b.timerMut.Unlock()
+	return b.saveOnce
+}
+
+func (b *memoryBitmap) setSaveOnce(o *sync.Once) {
+	b.timerMut.Lock()
+	defer b.timerMut.Unlock()
+	b.saveOnce = o
+}
@@ -0,0 +1,127 @@
+package speicher
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/maphash"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// entrySums holds a checksum of the encoded value of every element of a Map for WithEntryChecksums.
+type entrySums[T any] struct {
+	mut  sync.Mutex
+	sums map[string]uint64
+	// stale is set when the elements were replaced as a whole, so the checksums are rebuilt on the next check
+	stale bool
+}
+
+var checksumSeed = maphash.MakeSeed()
+
+// WithEntryChecksums makes a Map remember a checksum of the JSON encoding of every element when it is set
+// and compare it on every save, to catch values that were changed without a write lock,
+// for example through a pointer that was returned by Get and kept around.
+// Changed elements are reported like a failed automatic save (see WithSaveErrorHandler) with their keys,
+// once per change, and are saved as they are.
+//
+// Checksums cost an encoding of every value that is set, so the option is meant for tests and debugging.
+// Elements replaced as a whole, for example by Overwrite or a rolled back transaction,
+// are checked from the next save on. Fields that are not encoded are not checked.
+// It applies to Map, OrderedMap and sharded Map stores; other stores ignore it.
+func WithEntryChecksums() Option {
+	return func(o *storeOptions) {
+		o.entryChecksums = true
+	}
+}
+
+// newEntrySums returns checksums of data if the store uses WithEntryChecksums, or nil otherwise.
+func newEntrySums[T any](o storeOptions, data map[string]T) *entrySums[T] {
+	if !o.entryChecksums {
+		return nil
+	}
+	s := &entrySums[T]{stale: true}
+	s.check(data)
+	return s
+}
+
+// checksumOf returns the checksum of value, or false if it can't be encoded.
+func checksumOf[T any](value T) (uint64, bool) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return 0, false
+	}
+	return maphash.Bytes(checksumSeed, data), true
+}
+
+// changed updates the checksums for a change of the element with the given key to value.
+func (s *entrySums[T]) changed(op ChangeOp, key string, value T) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	switch op {
+	case ChangeSet:
+		if sum, ok := checksumOf(value); ok {
+			s.sums[key] = sum
+		} else {
+			delete(s.sums, key)
+		}
+	case ChangeDelete:
+		delete(s.sums, key)
+	default:
+		s.stale = true
+	}
+}
+
+// invalidate makes the next check rebuild the checksums. Does nothing if s is nil.
+func (s *entrySums[T]) invalidate() {
+	if s == nil {
+		return
+	}
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	s.stale = true
+}
+
+// check returns the sorted keys of the elements of data whose checksum changed since they were set
+// and records their new checksums, so every change is only reported once.
+// If the checksums are stale, they are rebuilt instead. Does nothing if s is nil.
+func (s *entrySums[T]) check(data map[string]T) []string {
+	if s == nil {
+		return nil
+	}
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	if s.stale {
+		s.sums = make(map[string]uint64, len(data))
+		for key, value := range data {
+			if sum, ok := checksumOf(value); ok {
+				s.sums[key] = sum
+			}
+		}
+		s.stale = false
+		return nil
+	}
+	var changed []string
+	for key, value := range data {
+		want, ok := s.sums[key]
+		if !ok {
+			continue
+		}
+		if sum, _ := checksumOf(value); sum != want {
+			changed = append(changed, key)
+			s.sums[key] = sum
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+// verifyChecksums reports the elements that were changed without a write lock, for WithEntryChecksums.
+// The caller must hold at least a read lock.
+func (m *memoryMap[T]) verifyChecksums() {
+	keys := m.changes.sums.check(m.data)
+	if len(keys) == 0 {
+		return
+	}
+	m.opts.reportError(fmt.Errorf("elements '%s' of '%s' were changed without a write lock", strings.Join(keys, "', '"), m.location))
+}
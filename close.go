@@ -0,0 +1,207 @@
+package speicher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// openStore is a store that was loaded and not closed yet.
+type openStore struct {
+	store    savable
+	location string
+	// lock is the file lock acquired with WithFileLock, if any.
+	lock *fileLock
+	// done is closed when the store is closed, which stops its background goroutines.
+	done chan struct{}
+}
+
+var (
+	openMut    sync.Mutex
+	openStores = make(map[storeID]*openStore)
+)
+
+// opened registers a store that was just loaded from location, so FlushAll and Close can reach it.
+func opened(store lockable, location string) {
+	trackStats(store, location)
+	sampleChanges(store, location)
+	auditChanges(store, location)
+	afterLoaded(store)
+	if l := debugLogger(); l != nil {
+		l.Debug("speicher: store loaded", "location", location, "type", fmt.Sprintf("%T", store))
+	}
+	sav, ok := store.(savable)
+	if !ok {
+		return
+	}
+	openMut.Lock()
+	defer openMut.Unlock()
+	openStores[store.getStoreID()] = &openStore{store: sav, location: location, lock: claimLock(location), done: make(chan struct{})}
+}
+
+// closedChan returns a channel that is closed when the store with the given id is closed.
+func closedChan(id storeID) <-chan struct{} {
+	openMut.Lock()
+	defer openMut.Unlock()
+	if o, ok := openStores[id]; ok {
+		return o.done
+	}
+	return nil
+}
+
+// cancelAutoSave stops the scheduled automatic save of s, if any.
+func cancelAutoSave(s savable) {
+	if t := s.getSaveTimer(); t != nil {
+		t.Stop()
+	}
+	if t := s.getMaxSaveTimer(); t != nil {
+		t.Stop()
+	}
+	s.setSaveTimer(nil)
+	s.setMaxSaveTimer(nil)
+	s.setSaveOnce(nil)
+}
+
+// flush saves s in place of its scheduled automatic save.
+func flush(ctx context.Context, s savable) error {
+	cancelAutoSave(s)
+	changes := startSave(s.getStoreID())
+	var err error
+	if sc, ok := s.(interface{ SaveCtx(context.Context) error }); ok {
+		err = sc.SaveCtx(ctx)
+	} else {
+		err = s.Save()
+	}
+	recordSave(s, err)
+	if err != nil {
+		return err
+	}
+	finishSave(s.getStoreID(), changes)
+	return nil
+}
+
+// closeStore stops the automatic save and the background goroutines of s, saves it one last time
+// and releases its file lock.
+func closeStore(s savable) error {
+	o := forget(s)
+	var err error
+	if opts := optionsOf(s); opts != nil && opts.readOnly() {
+		cancelAutoSave(s)
+	} else {
+		err = flush(context.Background(), s)
+	}
+	releaseStore(s, o)
+	return err
+}
+
+// forget removes s from the open stores and stops its background goroutines.
+// Returns the entry of s, or nil if it was not open.
+func forget(s savable) *openStore {
+	openMut.Lock()
+	defer openMut.Unlock()
+	o, ok := openStores[s.getStoreID()]
+	if !ok {
+		return nil
+	}
+	close(o.done)
+	delete(openStores, s.getStoreID())
+	return o
+}
+
+// releaseStore waits for the running mirror copies of s and releases the file lock of its entry o, if any,
+// once s was saved for the last time.
+func releaseStore(s savable, o *openStore) {
+	waitForMirror(s)
+	if o != nil {
+		o.lock.release()
+	}
+}
+
+// FlushAll saves every open store with changes that were not saved yet (see Dirty)
+// instead of waiting for its automatic save, for example in a signal handler before the process exits.
+// Saves are aborted when ctx is done, keeping the previous files; the errors of all failed saves are joined.
+// Stores loaded with WithoutAutoSave are not tracked as dirty and have to be saved by the application.
+func FlushAll(ctx context.Context) error {
+	openMut.Lock()
+	stores := make([]savable, 0, len(openStores))
+	for _, o := range openStores {
+		stores = append(stores, o.store)
+	}
+	openMut.Unlock()
+
+	var errs []error
+	for _, store := range stores {
+		if !Dirty(store) {
+			continue
+		}
+		if err := flush(ctx, store); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (m *memoryMap[T]) Close() error {
+	return closeStore(m)
+}
+
+func (m *memoryOrderedMap[T]) Close() error {
+	return closeStore(m)
+}
+
+func (m *shardedMap[T]) Close() error {
+	return closeStore(m)
+}
+
+func (l *memoryList[T]) Close() error {
+	return closeStore(l)
+}
+
+func (s *memorySet[T]) Close() error {
+	return closeStore(s)
+}
+
+func (g *memoryGraph[N, E]) Close() error {
+	return closeStore(g)
+}
+
+func (b *memoryBitmap) Close() error {
+	return closeStore(b)
+}
+
+func (m *memoryMetrics) Close() error {
+	return closeStore(m)
+}
+
+func (o *memoryOutbox[T]) Close() error {
+	return closeStore(o)
+}
+
+func (d *memoryDocument) Close() error {
+	return closeStore(d)
+}
+
+func (ts *memoryTimeSeries[T]) Close() error {
+	return closeStore(ts)
+}
+
+func (h *memoryHeap[T]) Close() error {
+	return closeStore(h)
+}
+
+func (q *memoryQueue[T]) Close() error {
+	return closeStore(q)
+}
+
+func (s *memorySecrets) Close() error {
+	return closeStore(s)
+}
+
+func (b *memoryLeaderboard) Close() error {
+	return closeStore(b)
+}
+
+func (h *memoryHyperLogLog) Close() error {
+	return closeStore(h)
+}
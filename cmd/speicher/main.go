@@ -0,0 +1,320 @@
+// Command speicher inspects and edits the files of Map stores without hand-editing them.
+//
+//	speicher [flags] keys FILE
+//	speicher [flags] get FILE KEY
+//	speicher [flags] set FILE KEY JSON
+//	speicher [flags] delete FILE KEY
+//	speicher [flags] validate FILE
+//	speicher [flags] print FILE
+//	speicher [flags] compact FILE
+//	speicher [flags] convert SRC DST
+//	speicher [flags] diff FILE1 FILE2
+//
+// The format of a file is chosen by its suffix like in the library. Reading commands attach to the file
+// read-only (see speicher.AttachReadOnly). Writing commands load the store with an exclusive file lock,
+// so they fail instead of racing a service that uses WithFileLock, and replace the file atomically like every save.
+// Values are handled as raw JSON, so numbers keep their precision and entries a command doesn't touch are written back as they were.
+// convert migrates the store with speicher.Migrate: the flags prefixed with dst select the options of the destination,
+// so a plain store can be converted into an encrypted one or the other way around, and the written file is read back
+// and compared to the source unless -skip-verify is set. An existing destination is only replaced with -overwrite.
+// diff exits with status 1 if the files differ and 2 on errors.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strconv"
+
+	"github.com/bloodmagesoftware/speicher/v2"
+)
+
+var (
+	doubleBuffer = flag.Bool("double-buffer", false, "the store uses WithDoubleBuffer")
+	keyFile      = flag.String("key-file", "", "file holding the raw key the store is encrypted with")
+	dstKeyFile   = flag.String("dst-key-file", "", "convert: file holding the raw key to encrypt the destination with")
+	overwrite    = flag.Bool("overwrite", false, "convert: replace an existing destination")
+	skipVerify   = flag.Bool("skip-verify", false, "convert: don't read the destination back to compare it to the source")
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: speicher [flags] keys|get|set|delete|validate|print|compact|convert|diff ARGS...\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	args := flag.Args()
+	if len(args) == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	opts, err := options()
+	if err != nil {
+		fail(err)
+	}
+	command, args := args[0], args[1:]
+	switch command {
+	case "keys":
+		need(args, 1)
+		read(args[0], opts, func(m speicher.Map[json.RawMessage]) {
+			keys := m.Keys()
+			slices.Sort(keys)
+			for _, key := range keys {
+				fmt.Println(key)
+			}
+		})
+	case "get":
+		need(args, 2)
+		read(args[0], opts, func(m speicher.Map[json.RawMessage]) {
+			value, ok := m.Get(args[1])
+			if !ok {
+				fail(fmt.Errorf("key '%s' not found", args[1]))
+			}
+			printJSON(value)
+		})
+	case "set":
+		need(args, 3)
+		value := json.RawMessage(args[2])
+		if !json.Valid(value) {
+			fail(fmt.Errorf("value is not valid JSON, quote strings like '\"text\"'"))
+		}
+		write(args[0], opts, func(m speicher.Map[json.RawMessage]) {
+			m.Set(args[1], value)
+		})
+	case "delete":
+		need(args, 2)
+		write(args[0], opts, func(m speicher.Map[json.RawMessage]) {
+			if !m.Has(args[1]) {
+				fail(fmt.Errorf("key '%s' not found", args[1]))
+			}
+			m.Delete(args[1])
+		})
+	case "validate":
+		need(args, 1)
+		read(args[0], opts, func(m speicher.Map[json.RawMessage]) {
+			fmt.Printf("%s: ok, %d entries\n", args[0], m.Len())
+		})
+	case "print":
+		need(args, 1)
+		read(args[0], opts, func(m speicher.Map[json.RawMessage]) {
+			printJSON(entries(m))
+		})
+	case "compact":
+		need(args, 1)
+		// Saving rewrites the file without the formatting and fields the store doesn't know
+		write(args[0], opts, func(speicher.Map[json.RawMessage]) {})
+	case "convert":
+		need(args, 2)
+		var dstOpts []speicher.Option
+		if *dstKeyFile != "" {
+			key, err := os.ReadFile(*dstKeyFile)
+			if err != nil {
+				fail(errors.Join(fmt.Errorf("failed to read key file '%s'", *dstKeyFile), err))
+			}
+			dstOpts = append(dstOpts, speicher.WithEncryption(key))
+		}
+		m := attach[convertValue](args[0], opts)
+		defer m.Close()
+		err := speicher.Migrate(m, args[1], speicher.MigrateOptions{
+			Overwrite:  *overwrite,
+			SkipVerify: *skipVerify,
+			Options:    dstOpts,
+		})
+		if err != nil {
+			fail(err)
+		}
+	case "diff":
+		need(args, 2)
+		os.Exit(diff(args[0], args[1], opts))
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+}
+
+// options returns the store options selected by the flags.
+func options() ([]speicher.Option, error) {
+	var opts []speicher.Option
+	if *doubleBuffer {
+		opts = append(opts, speicher.WithDoubleBuffer())
+	}
+	if *keyFile != "" {
+		key, err := os.ReadFile(*keyFile)
+		if err != nil {
+			return nil, errors.Join(fmt.Errorf("failed to read key file '%s'", *keyFile), err)
+		}
+		opts = append(opts, speicher.WithEncryption(key))
+	}
+	return opts, nil
+}
+
+// need exits with the usage if args doesn't hold n arguments.
+func need(args []string, n int) {
+	if len(args) != n {
+		flag.Usage()
+		os.Exit(2)
+	}
+}
+
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, "speicher:", err)
+	os.Exit(2)
+}
+
+// attach loads the Map at location read-only.
+func attach[T any](location string, opts []speicher.Option) speicher.Map[T] {
+	m, err := speicher.AttachReadOnly[T](location, opts...)
+	if err != nil {
+		fail(err)
+	}
+	return m
+}
+
+// read calls fn with the Map at location, loaded read-only and read locked.
+func read(location string, opts []speicher.Option, fn func(m speicher.Map[json.RawMessage])) {
+	m := attach[json.RawMessage](location, opts)
+	defer m.Close()
+	s := speicher.NewState()
+	s.RLock(m)
+	defer s.RUnlock(m)
+	fn(m)
+}
+
+// write calls fn with the Map at location, write locked, and saves it afterwards.
+func write(location string, opts []speicher.Option, fn func(m speicher.Map[json.RawMessage])) {
+	opts = append(opts, speicher.WithoutAutoSave(), speicher.WithFileLock(speicher.FileLockExclusive, false))
+	m, err := speicher.LoadMap[json.RawMessage](location, opts...)
+	if err != nil {
+		fail(err)
+	}
+	s := speicher.NewState()
+	s.Lock(m)
+	fn(m)
+	s.Unlock(m)
+	// Close saves the Map and releases the file lock
+	if err := m.Close(); err != nil {
+		fail(err)
+	}
+}
+
+// entries returns the entries of m as a map, which encoding/json sorts by key.
+// The caller must hold a read lock.
+func entries(m speicher.Map[json.RawMessage]) map[string]json.RawMessage {
+	result := make(map[string]json.RawMessage)
+	m.Iterate(func(key string, value json.RawMessage) bool {
+		result[key] = value
+		return true
+	})
+	return result
+}
+
+func printJSON(v any) {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		fail(err)
+	}
+	fmt.Println(string(b))
+}
+
+// diff prints the keys that were added, removed or changed from the Map at a to the one at b
+// and returns the exit status.
+func diff(a, b string, opts []speicher.Option) int {
+	var old, cur map[string]json.RawMessage
+	read(a, opts, func(m speicher.Map[json.RawMessage]) {
+		old = entries(m)
+	})
+	read(b, opts, func(m speicher.Map[json.RawMessage]) {
+		cur = entries(m)
+	})
+	status := 0
+	for _, key := range slices.Sorted(maps.Keys(old)) {
+		if value, ok := cur[key]; !ok {
+			fmt.Printf("- %s: %s\n", key, compactJSON(old[key]))
+			status = 1
+		} else if !sameJSON(old[key], value) {
+			fmt.Printf("~ %s: %s -> %s\n", key, compactJSON(old[key]), compactJSON(value))
+			status = 1
+		}
+	}
+	for _, key := range slices.Sorted(maps.Keys(cur)) {
+		if _, ok := old[key]; !ok {
+			fmt.Printf("+ %s: %s\n", key, compactJSON(cur[key]))
+			status = 1
+		}
+	}
+	return status
+}
+
+// sameJSON reports whether a and b hold the same value, ignoring formatting, the order of object keys
+// and the precision a number loses as a float64 unless it is an integer.
+func sameJSON(a, b json.RawMessage) bool {
+	ca, errA := canonicalJSON(a)
+	cb, errB := canonicalJSON(b)
+	if errA != nil || errB != nil {
+		return compactJSON(a) == compactJSON(b)
+	}
+	return bytes.Equal(ca, cb)
+}
+
+// compactJSON returns value without insignificant whitespace.
+func compactJSON(value json.RawMessage) string {
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, value); err != nil {
+		return string(value)
+	}
+	return buf.String()
+}
+
+// convertValue is a JSON value as convert copies it, in the form of canonicalJSON, so the destination
+// can be verified against the source whatever its format.
+type convertValue struct {
+	json.RawMessage
+}
+
+func (v convertValue) MarshalJSON() ([]byte, error) {
+	return canonicalJSON(v.RawMessage)
+}
+
+func (v *convertValue) UnmarshalJSON(b []byte) error {
+	v.RawMessage = bytes.Clone(b)
+	return nil
+}
+
+// canonicalJSON returns value with sorted object keys and numbers in the form MessagePack reads them back in:
+// integers exactly and other numbers as the shortest float64.
+func canonicalJSON(value json.RawMessage) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(value))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	return json.Marshal(normalizeNumbers(v))
+}
+
+// normalizeNumbers rewrites the numbers in a value decoded with json.Decoder.UseNumber like canonicalJSON describes.
+func normalizeNumbers(value any) any {
+	switch value := value.(type) {
+	case json.Number:
+		if _, err := value.Int64(); err == nil {
+			return value
+		}
+		if f, err := value.Float64(); err == nil {
+			return json.Number(strconv.FormatFloat(f, 'g', -1, 64))
+		}
+	case map[string]any:
+		for key, element := range value {
+			value[key] = normalizeNumbers(element)
+		}
+	case []any:
+		for i, element := range value {
+			value[i] = normalizeNumbers(element)
+		}
+	}
+	return value
+}
@@ -0,0 +1,162 @@
+package speicher
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/cipher"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// codec encodes and decodes the data of a store for one file format.
+type codec interface {
+	encode(w io.Writer, v any) error
+	decode(r io.Reader, v any) error
+}
+
+// jsonCodec persists data as plain JSON.
+type jsonCodec struct {
+	// strict rejects fields that don't exist in the decoded type.
+	strict bool
+}
+
+func (jsonCodec) encode(w io.Writer, v any) error {
+	return json.NewEncoder(w).Encode(v)
+}
+
+func (c jsonCodec) decode(r io.Reader, v any) error {
+	return decodeJSON(r, v, c.strict)
+}
+
+// gzipCodec compresses the output of another codec using gzip.
+type gzipCodec struct {
+	inner codec
+}
+
+func (c gzipCodec) encode(w io.Writer, v any) error {
+	zw := gzip.NewWriter(w)
+	if err := c.inner.encode(zw, v); err != nil {
+		_ = zw.Close()
+		return err
+	}
+	return zw.Close()
+}
+
+func (c gzipCodec) decode(r io.Reader, v any) error {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+	return c.inner.decode(zr, v)
+}
+
+// codecSuffix returns the file suffix of location that selects its codec.
+// Returns false if no codec supports the location.
+func codecSuffix(location string) (string, bool) {
+	for _, suffix := range []string{".json.gz", ".json", ".msgpack.gz", ".msgpack"} {
+		if strings.HasSuffix(location, suffix) {
+			return suffix, true
+		}
+	}
+	return "", false
+}
+
+// codecFor returns the codec matching the file suffix of location.
+// Returns false if no codec supports the location.
+func codecFor(location string) (codec, bool) {
+	suffix, _ := codecSuffix(location)
+	switch suffix {
+	case ".json.gz":
+		return gzipCodec{inner: jsonCodec{}}, true
+	case ".json":
+		return jsonCodec{}, true
+	case ".msgpack.gz":
+		return gzipCodec{inner: msgpackCodec{}}, true
+	case ".msgpack":
+		return msgpackCodec{}, true
+	}
+	return nil, false
+}
+
+// WithStrictDecode makes loading fail if the file doesn't match the Go types of the store,
+// instead of silently leaving fields zeroed:
+// fields in the file that don't exist in the struct are rejected, and MessagePack files
+// may not store floats in integer fields or more elements than an array holds.
+// Fields renamed with an alias (see UsedAliases) are still accepted.
+func WithStrictDecode() Option {
+	return func(o *storeOptions) {
+		o.strictDecode = true
+	}
+}
+
+// strictCodec returns c with strict decoding enabled for its format.
+func strictCodec(c codec) codec {
+	switch c := c.(type) {
+	case jsonCodec:
+		c.strict = true
+		return c
+	case msgpackCodec:
+		c.strict = true
+		return c
+	case gzipCodec:
+		c.inner = strictCodec(c.inner)
+		return c
+	}
+	return c
+}
+
+// resolveCodec returns the codec for location, wrapped according to the store options.
+func resolveCodec(location string, o storeOptions) (codec, error) {
+	c, ok := codecFor(location)
+	if !ok {
+		return nil, fmt.Errorf("unable to find loader for '%s'", location)
+	}
+	if o.strictDecode {
+		c = strictCodec(c)
+	}
+	if o.encryptionKey != nil {
+		aead, err := newAEAD(o.encryptionKey)
+		if err != nil {
+			return nil, err
+		}
+		c = encryptedCodec{inner: c, aead: aead}
+	}
+	return c, nil
+}
+
+// encryptedCodec encrypts the output of another codec using AES-GCM.
+// Every write uses a new random nonce, which is stored in front of the ciphertext.
+type encryptedCodec struct {
+	inner codec
+	aead  cipher.AEAD
+}
+
+func (c encryptedCodec) encode(w io.Writer, v any) error {
+	var buf bytes.Buffer
+	if err := c.inner.encode(&buf, v); err != nil {
+		return err
+	}
+	sealed, err := seal(c.aead, buf.Bytes())
+	clear(buf.Bytes())
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(sealed)
+	return err
+}
+
+func (c encryptedCodec) decode(r io.Reader, v any) error {
+	sealed, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	plaintext, err := unseal(c.aead, sealed)
+	if err != nil {
+		return err
+	}
+	defer clear(plaintext)
+	return c.inner.decode(bytes.NewReader(plaintext), v)
+}
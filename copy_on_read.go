@@ -0,0 +1,53 @@
+package speicher
+
+import (
+	"encoding/json"
+	"errors"
+)
+
+// WithCopyOnRead makes a Map return deep copies from Get, Find, FindAll, Iterate and the other read operations,
+// so readers can't change the stored values by accident, for example through pointers outside a write lock.
+// Copies are made by encoding and decoding the value as JSON, which is the data the store persists anyway;
+// fields that are not encoded are not copied. Values that can't be encoded, like a NaN float,
+// are handed out as they are, and the error is reported like a failed automatic save (see WithSaveErrorHandler).
+// Use SetCloned to store a copy that the caller keeps no reference to.
+// Other stores ignore it.
+func WithCopyOnRead() Option {
+	return func(o *storeOptions) {
+		o.copyOnRead = true
+	}
+}
+
+// cloneValue returns a deep copy of value made by a JSON round trip.
+// If value can't be copied, it is returned as it is and the error is reported with o.
+func cloneValue[T any](o *storeOptions, value T) T {
+	data, err := json.Marshal(value)
+	if err == nil {
+		var c T
+		if err = json.Unmarshal(data, &c); err == nil {
+			return c
+		}
+	}
+	o.reportError(errors.Join(errors.New("failed to copy value"), err))
+	return value
+}
+
+// read returns value as handed out to readers: a deep copy if WithCopyOnRead is set.
+func (m *memoryMap[T]) read(value T) T {
+	if !m.opts.copyOnRead {
+		return value
+	}
+	return cloneValue(&m.opts, value)
+}
+
+func (m *memoryMap[T]) SetCloned(key string, value T) {
+	m.Set(key, cloneValue(&m.opts, value))
+}
+
+func (m *memoryOrderedMap[T]) SetCloned(key string, value T) {
+	m.Set(key, cloneValue(&m.opts, value))
+}
+
+func (m *shardedMap[T]) SetCloned(key string, value T) {
+	m.shardOf(key).SetCloned(key, value)
+}
@@ -0,0 +1,13 @@
+//go:build !plan9
+
+package speicher
+
+import (
+	"errors"
+	"syscall"
+)
+
+// crossDevice reports whether err was returned by a rename between volumes.
+func crossDevice(err error) bool {
+	return errors.Is(err, syscall.EXDEV)
+}
@@ -0,0 +1,9 @@
+//go:build plan9
+
+package speicher
+
+// crossDevice reports whether err was returned by a rename between volumes.
+// Plan 9 has no such error, renames only change the name of a file within its directory.
+func crossDevice(err error) bool {
+	return false
+}
@@ -0,0 +1,42 @@
+package speicher
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+)
+
+// newAEAD creates an AES-GCM cipher from key.
+// The key must be 16, 24 or 32 bytes long to select AES-128, AES-192 or AES-256.
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.Join(fmt.Errorf("invalid encryption key"), err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts plaintext with a random nonce.
+// The nonce is prepended to the returned ciphertext.
+func seal(aead cipher.AEAD, plaintext []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, errors.Join(fmt.Errorf("failed to generate nonce"), err)
+	}
+	return aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+// unseal decrypts data produced by seal.
+func unseal(aead cipher.AEAD, sealed []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, fmt.Errorf("ciphertext too short")
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, errors.Join(fmt.Errorf("failed to decrypt data"), err)
+	}
+	return plaintext, nil
+}
@@ -0,0 +1,196 @@
+package speicher
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type (
+	// waitGraph records which States hold and wait for which stores.
+	waitGraph struct {
+		mut     sync.Mutex
+		holders map[storeID]map[*State]struct{}
+		waiting map[*State]storeWait
+	}
+
+	// storeWait is a State blocked on acquiring the lock of a store.
+	storeWait struct {
+		store storeID
+		stack []byte
+	}
+)
+
+// deadlockGrace is how long a detected cycle must persist before it is reported,
+// so a lock that is just being handed over is not mistaken for a deadlock.
+const deadlockGrace = 100 * time.Millisecond
+
+var (
+	deadlockDetection atomic.Bool
+	waits             = waitGraph{
+		holders: make(map[storeID]map[*State]struct{}),
+		waiting: make(map[*State]storeWait),
+	}
+)
+
+// EnableDeadlockDetection makes every State record the stores it holds and waits for.
+// When a State blocks on a store and the States form a cycle
+// (for example one locked A and waits for B while another locked B and waits for A),
+// the program panics with the stacks of all goroutines in the cycle instead of hanging silently.
+//
+// Detection costs a global bookkeeping step per lock operation; enable it in development and tests.
+// Locks acquired before it was enabled are not known to the detector.
+func EnableDeadlockDetection() {
+	deadlockDetection.Store(true)
+}
+
+// acquire acquires the mutex of store for s by calling lock, which takes a write lock if write is set.
+// tryLock is attempted first so that blocking acquisitions can be counted and checked for deadlocks.
+func (s *State) acquire(store lockable, ls *lockState, write bool, tryLock func() bool, lock func()) {
+	st := statsOf(store)
+	detect := deadlockDetection.Load()
+	if st == nil && !detect {
+		lock()
+		return
+	}
+	if tryLock() {
+		if detect {
+			waits.hold(s, store.getStoreID())
+		}
+		st.locked(ls, write, 0)
+		return
+	}
+
+	start := time.Now()
+	if detect {
+		waits.wait(s, store.getStoreID())
+	}
+	lock()
+	if detect {
+		waits.acquired(s, store.getStoreID())
+	}
+	if st != nil {
+		wait := time.Since(start)
+		st.lockWaits.Add(1)
+		st.waitNanos.Add(int64(wait))
+		st.locked(ls, write, wait)
+	}
+}
+
+// acquired records that s holds the mutex of store, which it acquired without acquire after waiting for wait.
+func (s *State) acquired(store lockable, ls *lockState, write bool, wait time.Duration) {
+	if deadlockDetection.Load() {
+		waits.hold(s, store.getStoreID())
+	}
+	statsOf(store).locked(ls, write, wait)
+}
+
+// released records that s no longer holds the mutex of store.
+func (s *State) released(store lockable, ls *lockState, write bool) {
+	if deadlockDetection.Load() {
+		waits.release(s, store.getStoreID())
+	}
+	statsOf(store).unlocked(ls, write)
+}
+
+func (g *waitGraph) hold(s *State, id storeID) {
+	g.mut.Lock()
+	defer g.mut.Unlock()
+	if g.holders[id] == nil {
+		g.holders[id] = make(map[*State]struct{})
+	}
+	g.holders[id][s] = struct{}{}
+}
+
+func (g *waitGraph) release(s *State, id storeID) {
+	g.mut.Lock()
+	defer g.mut.Unlock()
+	delete(g.holders[id], s)
+	if len(g.holders[id]) == 0 {
+		delete(g.holders, id)
+	}
+}
+
+// wait records that s is blocked on store id and checks whether this closes a cycle.
+func (g *waitGraph) wait(s *State, id storeID) {
+	stack := make([]byte, 64<<10)
+	stack = stack[:runtime.Stack(stack, false)]
+
+	g.mut.Lock()
+	defer g.mut.Unlock()
+	g.waiting[s] = storeWait{store: id, stack: stack}
+	if g.cycle(s) != nil {
+		time.AfterFunc(deadlockGrace, func() {
+			g.report(s, id)
+		})
+	}
+}
+
+// acquired records that s stopped waiting for and now holds store id.
+func (g *waitGraph) acquired(s *State, id storeID) {
+	g.mut.Lock()
+	defer g.mut.Unlock()
+	delete(g.waiting, s)
+	if g.holders[id] == nil {
+		g.holders[id] = make(map[*State]struct{})
+	}
+	g.holders[id][s] = struct{}{}
+}
+
+// cycle returns the States of a wait cycle through s or nil if there is none.
+// The caller must hold g.mut.
+func (g *waitGraph) cycle(s *State) []*State {
+	visited := make(map[*State]bool)
+	var path []*State
+	var visit func(current *State) bool
+	visit = func(current *State) bool {
+		w, ok := g.waiting[current]
+		if !ok {
+			return false
+		}
+		path = append(path, current)
+		for holder := range g.holders[w.store] {
+			if holder == current {
+				continue
+			}
+			if holder == s {
+				return true
+			}
+			if !visited[holder] {
+				visited[holder] = true
+				if visit(holder) {
+					return true
+				}
+			}
+		}
+		path = path[:len(path)-1]
+		return false
+	}
+	if visit(s) {
+		return path
+	}
+	return nil
+}
+
+// report panics if s is still waiting for store id as part of a cycle.
+func (g *waitGraph) report(s *State, id storeID) {
+	g.mut.Lock()
+	w, ok := g.waiting[s]
+	var cycle []*State
+	if ok && w.store == id {
+		cycle = g.cycle(s)
+	}
+	var b strings.Builder
+	for _, state := range cycle {
+		w := g.waiting[state]
+		fmt.Fprintf(&b, "\n--- waiting for store %d:\n%s", w.store, w.stack)
+	}
+	g.mut.Unlock()
+
+	if cycle != nil {
+		panic("speicher: deadlock detected between States" + b.String())
+	}
+}
@@ -0,0 +1,85 @@
+package speicher
+
+import (
+	"sync"
+	"time"
+)
+
+// dirtyState tracks the unsaved changes of a single store.
+type dirtyState struct {
+	// changes counts the notifications of changes, so a save only clears the changes it covered.
+	changes uint64
+	// burstStart is the time of the first change since the last automatic save was scheduled.
+	burstStart time.Time
+	// dueAt is the time the scheduled automatic save fires, or zero if none is scheduled.
+	dueAt time.Time
+}
+
+var (
+	dirtyMut    sync.Mutex
+	dirtyStores = make(map[storeID]*dirtyState)
+)
+
+// Dirty reports whether store has changes that were not saved automatically yet.
+// A store stays dirty if its last automatic save failed, until the next one succeeds.
+// Changes are tracked when a write lock is released.
+func Dirty(store Store) bool {
+	dirtyMut.Lock()
+	defer dirtyMut.Unlock()
+	_, ok := dirtyStores[store.getStoreID()]
+	return ok
+}
+
+// PendingSaveAt returns when the scheduled automatic save of store fires.
+// Returns the zero time if no save is scheduled.
+func PendingSaveAt(store Store) time.Time {
+	dirtyMut.Lock()
+	defer dirtyMut.Unlock()
+	if d, ok := dirtyStores[store.getStoreID()]; ok {
+		return d.dueAt
+	}
+	return time.Time{}
+}
+
+// markDirty records a change of the store with the given id and the time its automatic save is due.
+func markDirty(id storeID, debounceDelay, maxDelay time.Duration) {
+	now := time.Now()
+	dirtyMut.Lock()
+	defer dirtyMut.Unlock()
+	d, ok := dirtyStores[id]
+	if !ok {
+		d = &dirtyState{}
+		dirtyStores[id] = d
+	}
+	if d.dueAt.IsZero() {
+		d.burstStart = now
+	}
+	d.changes++
+	d.dueAt = now.Add(debounceDelay)
+	if limit := d.burstStart.Add(maxDelay); limit.Before(d.dueAt) {
+		d.dueAt = limit
+	}
+}
+
+// startSave marks the scheduled automatic save of the store with the given id as running.
+// Returns the change count to pass to finishSave.
+func startSave(id storeID) uint64 {
+	dirtyMut.Lock()
+	defer dirtyMut.Unlock()
+	d, ok := dirtyStores[id]
+	if !ok {
+		return 0
+	}
+	d.dueAt = time.Time{}
+	return d.changes
+}
+
+// finishSave marks the store with the given id as clean
+// unless it changed again after startSave returned changes.
+func finishSave(id storeID, changes uint64) {
+	dirtyMut.Lock()
+	defer dirtyMut.Unlock()
+	if d, ok := dirtyStores[id]; ok && d.changes == changes {
+		delete(dirtyStores, id)
+	}
+}
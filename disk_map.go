@@ -0,0 +1,997 @@
+package speicher
+
+import (
+	"bufio"
+	"bytes"
+	"container/list"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+type (
+	// diskEntry locates the value of a diskMap element.
+	diskEntry[T any] struct {
+		// segment, offset and size locate the record of the element in a segment file.
+		segment int
+		offset  int64
+		size    int64
+		// dirty is set while the value was not written to a segment yet and is held in value.
+		dirty bool
+		value T
+	}
+
+	// diskRecord is a line of a segment file.
+	diskRecord struct {
+		Key   string          `json:"k"`
+		Value json.RawMessage `json:"v,omitempty"`
+		// Compressed holds the value instead of Value if it was compressed with the dictionary of the Map.
+		Compressed []byte     `json:"z,omitempty"`
+		Expires    *time.Time `json:"e,omitempty"`
+		Deleted    bool       `json:"d,omitempty"`
+	}
+
+	// diskManifest is the content of the file at the location of a diskMap.
+	diskManifest struct {
+		Segments []int `json:"segments"`
+		Next     int   `json:"next"`
+		// Dictionary is the segment whose dictionary compressed values use, see WithValueDictionary.
+		Dictionary int `json:"dictionary,omitempty"`
+	}
+
+	// diskMap is a Map implementation that keeps only its keys in memory and reads values from disk.
+	// Values are appended to segment files as JSON lines; the file at location lists the segments in use.
+	diskMap[T any] struct {
+		id       storeID
+		location string
+		opts     storeOptions
+		changes  changeFeed[T]
+		mut      sync.RWMutex
+
+		entries map[string]*diskEntry[T]
+		expires map[string]time.Time
+		// pending holds the keys of dirty entries.
+		pending map[string]struct{}
+		// deleted holds the keys that were deleted since the last save and still have a record on disk.
+		deleted map[string]struct{}
+		// rewrite makes the next save write all entries to a new segment, set by Overwrite and Rekey.
+		rewrite  bool
+		manifest diskManifest
+		// total is the size of all segments, live the size of the records entries point to.
+		total int64
+		live  int64
+		// dict is the dictionary of compressed values, dictTried is set once a dictionary was trained.
+		dict      []byte
+		dictTried bool
+		// saveMut serializes saves, which only hold a read lock on the Map.
+		saveMut sync.Mutex
+
+		// diskMut guards the cache and the open segment files, which readers share,
+		// and the entries while a save updates them.
+		diskMut sync.Mutex
+		cache   *valueCache[T]
+		files   map[int]io.ReadCloser
+
+		timerMut     sync.Mutex
+		saveTimer    *time.Timer
+		maxSaveTimer *time.Timer
+		saveOnce     *sync.Once
+	}
+
+	// valueCache keeps the most recently used values up to a size.
+	valueCache[T any] struct {
+		size  int
+		order *list.List
+		items map[string]*list.Element
+	}
+
+	// cachedValue is an element of valueCache.order.
+	cachedValue[T any] struct {
+		key   string
+		value T
+	}
+)
+
+const (
+	// defaultCacheSize is the number of values a disk-backed Map caches without WithCacheSize.
+	defaultCacheSize = 1024
+	// minCompactSize is the size of the segments below which a disk-backed Map is not compacted.
+	minCompactSize = 1 << 20
+)
+
+// WithCacheSize sets how many values a Map loaded with LoadMapOnDisk keeps in memory.
+// The least recently used values are evicted first. The default is 1024.
+// Other stores ignore it.
+func WithCacheSize(n int) Option {
+	return func(o *storeOptions) {
+		o.cacheSize = n
+	}
+}
+
+// LoadMapOnDisk loads a Map from location that keeps only its keys and the most recently used values in memory
+// (see WithCacheSize), for data sets that don't fit into memory.
+//
+// Values are appended to segment files next to location (see WithSegmentDir) when the Map is saved,
+// and location lists the segments in use.
+// Once more than half of the data on disk is outdated, saving rewrites all values into a single segment.
+// Changes that were not saved yet are held in memory.
+// Values are read from disk on every cache miss and on every iteration, so Find, FindAll, Iterate and Query
+// read the whole data set. Reading a value fails with a panic if the segment can't be read.
+//
+// The files are always JSON lines, independent of the suffix of location. WithEncryption and WithValueCompression
+// are not supported, and the Map can't be used with WriteSnapshot or Migrate.
+// Small values can be compressed with a trained dictionary instead, see WithValueDictionary.
+func LoadMapOnDisk[T any](location string, opts ...Option) (Map[T], error) {
+	options := newStoreOptions(opts)
+	lock, err := lockFile(location, options)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.releaseUnclaimed()
+	if options.encryptionKey != nil || options.valueCompression > 0 {
+		return nil, fmt.Errorf("unable to load map from '%s': encryption and value compression are not supported on disk", location)
+	}
+	if options.cacheSize <= 0 {
+		options.cacheSize = defaultCacheSize
+	}
+	m := &diskMap[T]{
+		id:       newStoreID(),
+		location: location,
+		opts:     options,
+		entries:  map[string]*diskEntry[T]{},
+		pending:  map[string]struct{}{},
+		deleted:  map[string]struct{}{},
+		cache:    newValueCache[T](options.cacheSize),
+		files:    map[int]io.ReadCloser{},
+	}
+	if err := m.load(); err != nil {
+		m.closeFiles()
+		return nil, errors.Join(fmt.Errorf("unable to load map from '%s'", location), err)
+	}
+	if m.changes.revs, err = options.loadRevisions(location, jsonCodec{}); err != nil {
+		m.closeFiles()
+		return nil, errors.Join(fmt.Errorf("unable to load map from '%s'", location), err)
+	}
+	opened(m, location)
+	startReaper(m, options.reaperInterval)
+	return m, nil
+}
+
+func newValueCache[T any](size int) *valueCache[T] {
+	return &valueCache[T]{size: size, order: list.New(), items: map[string]*list.Element{}}
+}
+
+func (c *valueCache[T]) get(key string) (value T, found bool) {
+	el, ok := c.items[key]
+	if !ok {
+		return
+	}
+	c.order.MoveToFront(el)
+	return el.Value.(*cachedValue[T]).value, true
+}
+
+func (c *valueCache[T]) put(key string, value T) {
+	if el, ok := c.items[key]; ok {
+		el.Value.(*cachedValue[T]).value = value
+		c.order.MoveToFront(el)
+		return
+	}
+	c.items[key] = c.order.PushFront(&cachedValue[T]{key: key, value: value})
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.items, oldest.Value.(*cachedValue[T]).key)
+	}
+}
+
+func (c *valueCache[T]) remove(key string) {
+	if el, ok := c.items[key]; ok {
+		c.order.Remove(el)
+		delete(c.items, key)
+	}
+}
+
+func (c *valueCache[T]) clear() {
+	c.order.Init()
+	clear(c.items)
+}
+
+// segmentLocation returns the location of the segment file with the given number.
+func (m *diskMap[T]) segmentLocation(segment int) string {
+	return fmt.Sprintf("%s.%d.seg", m.opts.segmentBase(m.location), segment)
+}
+
+// load reads the manifest and indexes the records of all segments.
+func (m *diskMap[T]) load() error {
+	if err := m.opts.prepareSegmentDir(); err != nil {
+		return err
+	}
+	f, err := m.opts.files().Open(m.location)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return m.opts.files().MkdirAll(filepath.Dir(m.location), 0740)
+		}
+		return errors.Join(fmt.Errorf("failed to open file '%s' (but exists)", m.location), err)
+	}
+	defer f.Close()
+	if err := json.NewDecoder(f).Decode(&m.manifest); err != nil {
+		return errors.Join(fmt.Errorf("failed to decode file '%s'", m.location), err)
+	}
+	if err := m.loadDictionary(); err != nil {
+		return err
+	}
+	m.dictTried = m.dict != nil
+	for _, segment := range m.manifest.Segments {
+		if err := m.loadSegment(segment); err != nil {
+			return err
+		}
+	}
+	for key, t := range m.expires {
+		if !time.Now().Before(t) {
+			m.remove(key)
+		}
+	}
+	return nil
+}
+
+// loadSegment indexes the records of a segment, replacing the records of earlier segments.
+func (m *diskMap[T]) loadSegment(segment int) error {
+	location := m.segmentLocation(segment)
+	f, err := m.opts.files().Open(location)
+	if err != nil {
+		return errors.Join(fmt.Errorf("failed to open file '%s'", location), err)
+	}
+	defer f.Close()
+	r := bufio.NewReader(m.opts.withProgress(f))
+	var offset int64
+	for {
+		line, err := r.ReadBytes('\n')
+		if len(line) > 0 {
+			var record struct {
+				Key     string     `json:"k"`
+				Expires *time.Time `json:"e"`
+				Deleted bool       `json:"d"`
+			}
+			if err := json.Unmarshal(line, &record); err != nil {
+				return errors.Join(fmt.Errorf("failed to decode record at offset %d of file '%s'", offset, location), err)
+			}
+			if old, ok := m.entries[record.Key]; ok {
+				m.live -= old.size
+			}
+			size := int64(len(line))
+			if record.Deleted {
+				delete(m.entries, record.Key)
+				delete(m.expires, record.Key)
+			} else {
+				m.entries[record.Key] = &diskEntry[T]{segment: segment, offset: offset, size: size}
+				m.live += size
+				if record.Expires != nil {
+					if m.expires == nil {
+						m.expires = make(map[string]time.Time)
+					}
+					m.expires[record.Key] = *record.Expires
+				} else {
+					delete(m.expires, record.Key)
+				}
+			}
+			offset += size
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errors.Join(fmt.Errorf("failed to read file '%s'", location), err)
+		}
+	}
+	m.total += offset
+	return nil
+}
+
+// readRecord reads the record of a clean entry from its segment.
+// The caller must hold diskMut.
+func (m *diskMap[T]) readRecord(e *diskEntry[T]) ([]byte, error) {
+	buf := make([]byte, e.size)
+	f, ok := m.files[e.segment]
+	if !ok {
+		var err error
+		if f, err = m.opts.files().Open(m.segmentLocation(e.segment)); err != nil {
+			return nil, err
+		}
+		if _, ok := f.(io.ReaderAt); !ok {
+			// Without random access, the segment has to be read from the start every time
+			defer f.Close()
+			if _, err := io.CopyN(io.Discard, f, e.offset); err != nil {
+				return nil, err
+			}
+			_, err := io.ReadFull(f, buf)
+			return buf, err
+		}
+		m.files[e.segment] = f
+	}
+	_, err := f.(io.ReaderAt).ReadAt(buf, e.offset)
+	return buf, err
+}
+
+// readValue decodes the value of a clean entry from its segment.
+// The caller must hold diskMut.
+func (m *diskMap[T]) readValue(key string, e *diskEntry[T]) T {
+	var value T
+	line, err := m.readRecord(e)
+	if err == nil {
+		var record diskRecord
+		if err = json.Unmarshal(line, &record); err == nil {
+			var raw json.RawMessage
+			if raw, err = plainValue(record, m.dict); err == nil {
+				err = decodeJSON(bytes.NewReader(raw), &value, m.opts.strictDecode)
+			}
+		}
+	}
+	if err != nil {
+		panic(fmt.Sprintf("speicher: failed to read value '%s' from '%s': %v", key, m.segmentLocation(e.segment), err))
+	}
+	return value
+}
+
+// value returns the value of an entry, from memory if possible.
+// If cache is false, a value read from disk is not added to the cache.
+func (m *diskMap[T]) value(key string, e *diskEntry[T], cache bool) T {
+	m.diskMut.Lock()
+	defer m.diskMut.Unlock()
+	if e.dirty {
+		return m.read(e.value)
+	}
+	if value, ok := m.cache.get(key); ok {
+		return m.read(value)
+	}
+	value := m.readValue(key, e)
+	if cache {
+		m.cache.put(key, value)
+		return m.read(value)
+	}
+	return value
+}
+
+// read returns value as handed out to readers: a deep copy if WithCopyOnRead is set.
+func (m *diskMap[T]) read(value T) T {
+	if !m.opts.copyOnRead {
+		return value
+	}
+	return cloneValue(&m.opts, value)
+}
+
+// closeFiles closes the open segment files.
+func (m *diskMap[T]) closeFiles() {
+	m.diskMut.Lock()
+	defer m.diskMut.Unlock()
+	for segment, f := range m.files {
+		_ = f.Close()
+		delete(m.files, segment)
+	}
+}
+
+// isExpired reports whether key has an expiry time that has passed.
+func (m *diskMap[T]) isExpired(key string) bool {
+	if len(m.expires) == 0 {
+		return false
+	}
+	t, ok := m.expires[key]
+	return ok && !time.Now().Before(t)
+}
+
+// keys returns the keys of all elements that are not expired in the order of their records on disk,
+// which makes reading all values sequential.
+func (m *diskMap[T]) keys() []string {
+	keys := make([]string, 0, len(m.entries))
+	for key := range m.entries {
+		if !m.isExpired(key) {
+			keys = append(keys, key)
+		}
+	}
+	m.sortByLocation(keys)
+	return keys
+}
+
+// sortByLocation sorts keys in the order of their records on disk, with dirty entries first.
+func (m *diskMap[T]) sortByLocation(keys []string) {
+	m.diskMut.Lock()
+	defer m.diskMut.Unlock()
+	slices.SortFunc(keys, func(a, b string) int {
+		ea, eb := m.entries[a], m.entries[b]
+		if ea.segment != eb.segment {
+			return ea.segment - eb.segment
+		}
+		switch {
+		case ea.offset < eb.offset:
+			return -1
+		case ea.offset > eb.offset:
+			return 1
+		}
+		return 0
+	})
+}
+
+// remove deletes the entry of key and remembers to write a tombstone if it has a record on disk.
+func (m *diskMap[T]) remove(key string) {
+	e, ok := m.entries[key]
+	if !ok {
+		return
+	}
+	if e.segment != 0 {
+		m.deleted[key] = struct{}{}
+		m.live -= e.size
+	}
+	delete(m.entries, key)
+	delete(m.pending, key)
+	delete(m.expires, key)
+	m.diskMut.Lock()
+	m.cache.remove(key)
+	m.diskMut.Unlock()
+}
+
+func (m *diskMap[T]) Get(key string) (value T, found bool) {
+	e, ok := m.entries[key]
+	if !ok || m.isExpired(key) {
+		return
+	}
+	return m.value(key, e, true), true
+}
+
+func (m *diskMap[T]) Find(f func(T) bool) (value T, found bool) {
+	for _, value := range m.Iterate {
+		if f(value) {
+			return value, true
+		}
+	}
+	return
+}
+
+func (m *diskMap[T]) FindAll(f func(T) bool) (values []T) {
+	for _, value := range m.Iterate {
+		if f(value) {
+			values = append(values, value)
+		}
+	}
+	return
+}
+
+func (m *diskMap[T]) Query() *Query[T] {
+	return newQuery(func(yield func(T) bool) {
+		for _, value := range m.Iterate {
+			if !yield(value) {
+				return
+			}
+		}
+	})
+}
+
+func (m *diskMap[T]) Has(key string) bool {
+	_, ok := m.entries[key]
+	return ok && !m.isExpired(key)
+}
+
+func (m *diskMap[T]) Set(key string, value T) {
+	if err := m.TrySet(key, value); err != nil {
+		m.opts.reportError(err)
+	}
+}
+
+func (m *diskMap[T]) TrySet(key string, value T) error {
+	value, err := limitEntry(&m.opts, key, value)
+	if err != nil {
+		return err
+	}
+	// Reading the old value from disk is skipped if nobody watches
+	var old T
+	if m.changes.watched() {
+		old, _ = m.Get(key)
+	}
+	m.changes.record(ChangeEvent[T]{Op: ChangeSet, Key: key, Old: old, New: value})
+	if e, ok := m.entries[key]; ok && e.segment != 0 {
+		m.live -= e.size
+	}
+	m.entries[key] = &diskEntry[T]{dirty: true, value: value}
+	m.pending[key] = struct{}{}
+	delete(m.expires, key)
+	m.diskMut.Lock()
+	m.cache.remove(key)
+	m.diskMut.Unlock()
+	return nil
+}
+
+func (m *diskMap[T]) SetCloned(key string, value T) {
+	m.Set(key, cloneValue(&m.opts, value))
+}
+
+func (m *diskMap[T]) GetOrSet(key string, create func() T) T {
+	if value, ok := m.Get(key); ok {
+		return value
+	}
+	value := create()
+	m.Set(key, value)
+	return value
+}
+
+func (m *diskMap[T]) Update(key string, fn func(old T, exists bool) T) T {
+	value := fn(m.Get(key))
+	m.Set(key, value)
+	return value
+}
+
+func (m *diskMap[T]) SetWithTTL(key string, value T, ttl time.Duration) {
+	m.Set(key, value)
+	if m.expires == nil {
+		m.expires = make(map[string]time.Time)
+	}
+	m.expires[key] = time.Now().Add(ttl)
+}
+
+func (m *diskMap[T]) ExpiresAt(key string) (time.Time, bool) {
+	t, ok := m.expires[key]
+	return t, ok
+}
+
+func (m *diskMap[T]) hasExpired() bool {
+	now := time.Now()
+	for _, t := range m.expires {
+		if !now.Before(t) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *diskMap[T]) DeleteExpired() int {
+	var keys []string
+	for key := range m.expires {
+		if m.isExpired(key) {
+			keys = append(keys, key)
+		}
+	}
+	for _, key := range keys {
+		m.Delete(key)
+	}
+	return len(keys)
+}
+
+func (m *diskMap[T]) Delete(key string) {
+	if _, exists := m.entries[key]; !exists {
+		return
+	}
+	var old T
+	if m.changes.watched() {
+		old = m.value(key, m.entries[key], false)
+	}
+	m.changes.record(ChangeEvent[T]{Op: ChangeDelete, Key: key, Old: old})
+	m.remove(key)
+}
+
+func (m *diskMap[T]) Overwrite(values map[string]T) {
+	m.changes.record(ChangeEvent[T]{Op: ChangeOverwrite})
+	m.entries = make(map[string]*diskEntry[T], len(values))
+	m.pending = make(map[string]struct{}, len(values))
+	for key, value := range values {
+		m.entries[key] = &diskEntry[T]{dirty: true, value: value}
+		m.pending[key] = struct{}{}
+	}
+	m.expires = nil
+	m.deleted = map[string]struct{}{}
+	m.rewrite = true
+	m.live = 0
+	m.diskMut.Lock()
+	m.cache.clear()
+	m.diskMut.Unlock()
+}
+
+// Rekey reads every value to pass it to fn, so it costs a full iteration.
+// All elements are rewritten to a new segment on the next save.
+func (m *diskMap[T]) Rekey(fn func(oldKey string, value T) string) error {
+	renamed := make(map[string]string, len(m.entries))
+	from := make(map[string]string, len(m.entries))
+	for _, key := range m.keys() {
+		newKey := fn(key, m.value(key, m.entries[key], false))
+		if other, exists := from[newKey]; exists {
+			if other > key {
+				other, key = key, other
+			}
+			return fmt.Errorf("keys '%s' and '%s' are both renamed to '%s'", other, key, newKey)
+		}
+		from[newKey] = key
+		renamed[key] = newKey
+	}
+	m.changes.record(ChangeEvent[T]{Op: ChangeOverwrite})
+	entries := make(map[string]*diskEntry[T], len(renamed))
+	var expires map[string]time.Time
+	for key, newKey := range renamed {
+		entries[newKey] = m.entries[key]
+		if t, ok := m.expires[key]; ok {
+			if expires == nil {
+				expires = make(map[string]time.Time)
+			}
+			expires[newKey] = t
+		}
+	}
+	// Records on disk hold the old keys, so all entries have to be written again
+	m.diskMut.Lock()
+	for key, e := range entries {
+		if !e.dirty {
+			e.value, e.dirty = m.readValue(key, e), true
+		}
+	}
+	m.cache.clear()
+	m.diskMut.Unlock()
+	m.entries = entries
+	m.expires = expires
+	m.pending = make(map[string]struct{}, len(entries))
+	for key := range entries {
+		m.pending[key] = struct{}{}
+	}
+	m.deleted = map[string]struct{}{}
+	m.rewrite = true
+	m.live = 0
+	return nil
+}
+
+// RangeKV reads all values before it returns.
+//
+// Deprecated: use Iterate if you need to iterate over the entire data store.
+func (m *diskMap[T]) RangeKV() (<-chan MapRangeEl[T], func()) {
+	ch := make(chan MapRangeEl[T], len(m.entries))
+	for key, value := range m.Iterate {
+		ch <- MapRangeEl[T]{Key: key, Value: value}
+	}
+	close(ch)
+	return ch, func() {}
+}
+
+// RangeV reads all values before it returns.
+//
+// Deprecated: use Iterate if you need to iterate over the entire data store.
+func (m *diskMap[T]) RangeV() (<-chan T, func()) {
+	ch := make(chan T, len(m.entries))
+	for _, value := range m.Iterate {
+		ch <- value
+	}
+	close(ch)
+	return ch, func() {}
+}
+
+func (m *diskMap[T]) Len() int {
+	if len(m.expires) == 0 {
+		return len(m.entries)
+	}
+	n := 0
+	for key := range m.entries {
+		if !m.isExpired(key) {
+			n++
+		}
+	}
+	return n
+}
+
+func (m *diskMap[T]) Keys() []string {
+	return m.keys()
+}
+
+// Values reads the values that are not cached from disk, like Iterate.
+func (m *diskMap[T]) Values() []T {
+	keys := m.keys()
+	values := make([]T, len(keys))
+	for i, key := range keys {
+		values[i] = m.value(key, m.entries[key], false)
+	}
+	return values
+}
+
+// Iterate reads the values in the order they are stored on disk without adding them to the cache.
+func (m *diskMap[T]) Iterate(yield func(key string, value T) bool) {
+	for _, key := range m.keys() {
+		if !yield(key, m.value(key, m.entries[key], false)) {
+			break
+		}
+	}
+}
+
+func (m *diskMap[T]) Watch(ctx context.Context) <-chan ChangeEvent[T] {
+	return m.changes.watch(ctx)
+}
+
+func (m *diskMap[T]) publishChanges() {
+	m.changes.publishChanges()
+}
+
+func (m *diskMap[T]) getStoreID() storeID {
+	return m.id
+}
+
+func (m *diskMap[T]) getMutex() *sync.RWMutex {
+	return &m.mut
+}
+
+func (m *diskMap[T]) getOptions() *storeOptions {
+	return &m.opts
+}
+
+func (m *diskMap[T]) entryCount() int {
+	return len(m.entries)
+}
+
+func (m *diskMap[T]) snapshot() func() {
+	entries := make(map[string]*diskEntry[T], len(m.entries))
+	for key, e := range m.entries {
+		c := *e
+		entries[key] = &c
+	}
+	expires, pending, deleted := maps.Clone(m.expires), maps.Clone(m.pending), maps.Clone(m.deleted)
+	rewrite, live, changes := m.rewrite, m.live, m.changes.pendingLen()
+	restoreRevisions := m.changes.snapshotRevisions()
+	return func() {
+		m.entries, m.expires, m.pending, m.deleted = entries, expires, pending, deleted
+		m.rewrite, m.live = rewrite, live
+		m.changes.discardSince(changes)
+		restoreRevisions()
+		m.diskMut.Lock()
+		m.cache.clear()
+		m.diskMut.Unlock()
+	}
+}
+
+func (m *diskMap[T]) Save() error {
+	return m.SaveCtx(context.Background())
+}
+
+// SaveCtx appends the changes since the last save to a new segment
+// or, if more than half of the data on disk is outdated, rewrites all values into a single segment.
+func (m *diskMap[T]) SaveCtx(ctx context.Context) error {
+	s := saveState(ctx)
+	s.RLock(m)
+	defer s.RUnlock(m)
+	m.saveMut.Lock()
+	defer m.saveMut.Unlock()
+
+	if !m.rewrite && len(m.pending) == 0 && len(m.deleted) == 0 {
+		return nil
+	}
+	compact := m.rewrite || (m.total > minCompactSize && m.total-m.live > m.live)
+	// The first dictionary is trained as soon as there is enough data, which takes a compaction
+	if m.opts.valueDictionary > 0 && !m.dictTried && m.total >= minDictionaryData {
+		compact = true
+	}
+	var keys []string
+	if compact {
+		// Expired entries are kept, since they are only removed with a write lock
+		keys = slices.Collect(maps.Keys(m.entries))
+		m.sortByLocation(keys)
+	} else {
+		keys = slices.Sorted(maps.Keys(m.pending))
+	}
+
+	segment := m.manifest.Next + 1
+	location := m.segmentLocation(segment)
+	written := make(map[string]*diskEntry[T], len(keys))
+	var size int64
+	dict := m.dict
+	if compact {
+		dict = nil
+		if m.opts.valueDictionary > 0 {
+			samples, err := m.sampleValues(keys)
+			if err != nil {
+				return err
+			}
+			dict = trainDictionary(samples, m.opts.valueDictionary)
+		}
+	}
+	var compressor *valueCompressor
+	if dict != nil && m.opts.valueDictionary > 0 {
+		compressor = newValueCompressor(dict)
+	}
+	// The new segment holds the data of the save, so it is what instrumentation measures
+	err := m.opts.instrumentSave(m.location, func(w io.Writer) error {
+		bw := bufio.NewWriter(w)
+		write := func(record diskRecord) error {
+			line, err := json.Marshal(record)
+			if err != nil {
+				return errors.Join(fmt.Errorf("failed to encode entry '%s'", record.Key), err)
+			}
+			line = append(line, '\n')
+			written[record.Key] = &diskEntry[T]{segment: segment, offset: size, size: int64(len(line))}
+			size += int64(len(line))
+			_, err = bw.Write(line)
+			return err
+		}
+		for _, key := range keys {
+			record := diskRecord{Key: key}
+			if t, ok := m.expires[key]; ok {
+				record.Expires = &t
+			}
+			value, err := m.rawValue(key, m.entries[key])
+			if err != nil {
+				return err
+			}
+			record.Value = value
+			if compressor != nil {
+				if err := compressor.compress(&record, value); err != nil {
+					return errors.Join(fmt.Errorf("failed to compress entry '%s'", key), err)
+				}
+			}
+			if err := write(record); err != nil {
+				return err
+			}
+		}
+		if !compact {
+			for _, key := range slices.Sorted(maps.Keys(m.deleted)) {
+				if err := write(diskRecord{Key: key, Deleted: true}); err != nil {
+					return err
+				}
+			}
+		}
+		return bw.Flush()
+	}, func(write func(w io.Writer) error) error {
+		return m.opts.writeFileContext(ctx, location, write)
+	})
+	if err != nil {
+		return errors.Join(fmt.Errorf("failed to write file '%s'", location), err)
+	}
+
+	manifest := diskManifest{Segments: append(slices.Clone(m.manifest.Segments), segment), Next: segment, Dictionary: m.manifest.Dictionary}
+	if compact {
+		manifest.Segments = []int{segment}
+		manifest.Dictionary = 0
+		if dict != nil {
+			manifest.Dictionary = segment
+			dictLocation := m.dictionaryLocation(segment)
+			err := m.opts.writeFileContext(ctx, dictLocation, func(w io.Writer) error {
+				_, err := w.Write(dict)
+				return err
+			})
+			if err != nil {
+				_ = m.opts.files().Remove(location)
+				return errors.Join(fmt.Errorf("failed to write file '%s'", dictLocation), err)
+			}
+		}
+	}
+	err = m.opts.writeFileContext(ctx, m.location, func(w io.Writer) error {
+		return json.NewEncoder(w).Encode(manifest)
+	})
+	if err != nil {
+		_ = m.opts.files().Remove(location)
+		if manifest.Dictionary != m.manifest.Dictionary {
+			_ = m.opts.files().Remove(m.dictionaryLocation(segment))
+		}
+		return errors.Join(fmt.Errorf("failed to write file '%s'", m.location), err)
+	}
+
+	m.diskMut.Lock()
+	defer m.diskMut.Unlock()
+	for key, e := range m.entries {
+		if w, ok := written[key]; ok {
+			if e.dirty {
+				m.cache.put(key, e.value)
+			}
+			*e = *w
+		}
+	}
+	if compact {
+		for _, old := range m.manifest.Segments {
+			if f, ok := m.files[old]; ok {
+				_ = f.Close()
+				delete(m.files, old)
+			}
+			_ = m.opts.files().Remove(m.segmentLocation(old))
+		}
+		if m.manifest.Dictionary != 0 && m.manifest.Dictionary != manifest.Dictionary {
+			_ = m.opts.files().Remove(m.dictionaryLocation(m.manifest.Dictionary))
+		}
+		m.dict = dict
+		m.dictTried = m.opts.valueDictionary > 0
+		m.total, m.live = size, 0
+		for _, w := range written {
+			m.live += w.size
+		}
+	} else {
+		m.total += size
+		for key := range m.pending {
+			m.live += written[key].size
+		}
+	}
+	m.manifest = manifest
+	m.rewrite = false
+	clear(m.pending)
+	clear(m.deleted)
+	return m.opts.saveRevisions(ctx, m.location, jsonCodec{}, m.changes.revs)
+}
+
+// rawValue returns the JSON value of an entry without decoding it, uncompressed.
+func (m *diskMap[T]) rawValue(key string, e *diskEntry[T]) (json.RawMessage, error) {
+	if e.dirty {
+		value, err := json.Marshal(e.value)
+		if err != nil {
+			return nil, errors.Join(fmt.Errorf("failed to encode entry '%s'", key), err)
+		}
+		return value, nil
+	}
+	m.diskMut.Lock()
+	defer m.diskMut.Unlock()
+	line, err := m.readRecord(e)
+	if err != nil {
+		return nil, errors.Join(fmt.Errorf("failed to read entry '%s'", key), err)
+	}
+	var record diskRecord
+	if err := json.Unmarshal(line, &record); err != nil {
+		return nil, errors.Join(fmt.Errorf("failed to read entry '%s'", key), err)
+	}
+	value, err := plainValue(record, m.dict)
+	if err != nil {
+		return nil, errors.Join(fmt.Errorf("failed to read entry '%s'", key), err)
+	}
+	return value, nil
+}
+
+// sampleValues returns the JSON values of keys to train a dictionary on, up to dictionarySampleSize in total.
+// Values are taken evenly from all keys, so the sample doesn't only hold the oldest ones.
+func (m *diskMap[T]) sampleValues(keys []string) ([][]byte, error) {
+	step := 1
+	if m.live > dictionarySampleSize {
+		step = int(m.live/dictionarySampleSize) + 1
+	}
+	var samples [][]byte
+	var size int
+	for i := 0; i < len(keys) && size < dictionarySampleSize; i += step {
+		value, err := m.rawValue(keys[i], m.entries[keys[i]])
+		if err != nil {
+			return nil, err
+		}
+		samples = append(samples, value)
+		size += len(value)
+	}
+	return samples, nil
+}
+
+func (m *diskMap[T]) Close() error {
+	err := closeStore(m)
+	m.closeFiles()
+	return err
+}
+
+func (m *diskMap[T]) getSaveTimer() *time.Timer {
+	m.timerMut.Lock()
+	defer m.timerMut.Unlock()
+	return m.saveTimer
+}
+
+func (m *diskMap[T]) setSaveTimer(t *time.Timer) {
+	m.timerMut.Lock()
+	defer m.timerMut.Unlock()
+	m.saveTimer = t
+}
+
+func (m *diskMap[T]) getMaxSaveTimer() *time.Timer {
+	m.timerMut.Lock()
+	defer m.timerMut.Unlock()
+	return m.maxSaveTimer
+}
+
+func (m *diskMap[T]) setMaxSaveTimer(t *time.Timer) {
+	m.timerMut.Lock()
+	defer m.timerMut.Unlock()
+	m.maxSaveTimer = t
+}
+
+func (m *diskMap[T]) getSaveOnce() *sync.Once {
+	m.timerMut.Lock()
+	defer m.timerMut.Unlock()
+	return m.saveOnce
+}
+
+func (m *diskMap[T]) setSaveOnce(o *sync.Once) {
+	m.timerMut.Lock()
+	defer m.timerMut.Unlock()
+	m.saveOnce = o
+}
@@ -0,0 +1,420 @@
+package speicher
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type (
+	// memoryDocument is a Document implementation that keeps the decoded tree in memory.
+	memoryDocument struct {
+		id       storeID
+		data     map[string]any
+		location string
+		codec    codec
+		opts     storeOptions
+		mut      sync.RWMutex
+
+		timerMut     sync.Mutex
+		saveTimer    *time.Timer
+		maxSaveTimer *time.Timer
+		saveOnce     *sync.Once
+	}
+
+	// Document is a thread-safe store of nested, schemaless data like a JSON object,
+	// for config-like data where defining Go types for every level is impractical.
+	//
+	// Values are addressed by paths of object keys and array indices separated by dots,
+	// like "users.42.address.city". The empty path addresses the whole Document.
+	// Keys containing dots can't be addressed. Numbers are held as float64,
+	// so integers beyond 2^53 lose precision.
+	//
+	// All operations require appropriate locking via a State object:
+	//
+	//	s := speicher.NewState()
+	//	s.Lock(config)
+	//	err := config.Set("users.42.address.city", "Berlin")
+	//	s.Unlock(config)
+	Document interface {
+		lockable
+
+		// Get returns the value at path encoded as JSON.
+		// If the path doesn't exist, the bool result will be false.
+		// Requires at least a read lock.
+		Get(path string) (value json.RawMessage, found bool)
+
+		// Decode decodes the value at path into v like json.Unmarshal.
+		// If the path doesn't exist, v is left unchanged and the bool result will be false.
+		// Requires at least a read lock.
+		Decode(path string, v any) (found bool, err error)
+
+		// Has reports whether the path exists.
+		// Requires at least a read lock.
+		Has(path string) bool
+
+		// Keys returns the sorted keys of the object at path.
+		// If the path doesn't exist or isn't an object, the bool result will be false.
+		// Requires at least a read lock.
+		Keys(path string) (keys []string, found bool)
+
+		// Set stores value at path, encoded like json.Marshal.
+		// Missing objects along the path are created. An array index may be the length of the array to append.
+		// It returns an error if the value can't be encoded or the path runs through a value
+		// that is neither an object nor an array; the Document is unchanged then.
+		// The empty path replaces the whole Document, which requires value to encode to an object.
+		// Requires a write lock.
+		Set(path string, value any) error
+
+		// Delete removes the value at path, moving later elements of an array forward.
+		// It returns false if the path doesn't exist or is empty.
+		// Requires a write lock.
+		Delete(path string) bool
+
+		// Save persists the current state of the Document to its underlying data store.
+		// It returns an error if the operation fails.
+		// This method acquires its own read lock internally.
+		Save() error
+
+		// SaveCtx persists the current state of the data store like Save,
+		// but aborts when ctx is cancelled or its deadline passes.
+		// An aborted save removes its temporary files and leaves the previous file intact.
+		// This method acquires its own read lock internally.
+		SaveCtx(ctx context.Context) error
+
+		// Close stops the automatic save and the background goroutines of the store and saves it one last time.
+		// The store must not be used afterwards.
+		// This method acquires its own read lock internally.
+		Close() error
+	}
+)
+
+// splitPath returns the segments of a Document path.
+func splitPath(path string) []string {
+	if path == "" {
+		return nil
+	}
+	return strings.Split(path, ".")
+}
+
+// lookup returns the node at path.
+func (d *memoryDocument) lookup(path string) (any, bool) {
+	return lookupPath(d.data, path)
+}
+
+// lookupPath returns the node at path below node, a tree of values decoded from JSON.
+func lookupPath(node any, path string) (any, bool) {
+	for _, seg := range splitPath(path) {
+		switch n := node.(type) {
+		case map[string]any:
+			child, ok := n[seg]
+			if !ok {
+				return nil, false
+			}
+			node = child
+		case []any:
+			i, err := strconv.Atoi(seg)
+			if err != nil || i < 0 || i >= len(n) {
+				return nil, false
+			}
+			node = n[i]
+		default:
+			return nil, false
+		}
+	}
+	return node, true
+}
+
+func (d *memoryDocument) Get(path string) (json.RawMessage, bool) {
+	node, ok := d.lookup(path)
+	if !ok {
+		return nil, false
+	}
+	// The tree only holds values decoded from JSON, which always encode
+	b, _ := json.Marshal(node)
+	return b, true
+}
+
+func (d *memoryDocument) Decode(path string, v any) (bool, error) {
+	b, ok := d.Get(path)
+	if !ok {
+		return false, nil
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return true, errors.Join(fmt.Errorf("failed to decode '%s'", path), err)
+	}
+	return true, nil
+}
+
+func (d *memoryDocument) Has(path string) bool {
+	_, ok := d.lookup(path)
+	return ok
+}
+
+func (d *memoryDocument) Keys(path string) ([]string, bool) {
+	node, _ := d.lookup(path)
+	obj, ok := node.(map[string]any)
+	if !ok {
+		return nil, false
+	}
+	return slices.Sorted(maps.Keys(obj)), true
+}
+
+func (d *memoryDocument) Set(path string, value any) error {
+	b, err := json.Marshal(value)
+	if err != nil {
+		return errors.Join(fmt.Errorf("failed to encode value for '%s'", path), err)
+	}
+	var node any
+	if err := json.Unmarshal(b, &node); err != nil {
+		return errors.Join(fmt.Errorf("failed to encode value for '%s'", path), err)
+	}
+	segs := splitPath(path)
+	if len(segs) == 0 {
+		obj, ok := node.(map[string]any)
+		if !ok {
+			return fmt.Errorf("the root of a document must be an object")
+		}
+		d.data = obj
+		return nil
+	}
+	root, err := setPath(d.data, segs, 0, node)
+	if err != nil {
+		return err
+	}
+	d.data = root.(map[string]any)
+	return nil
+}
+
+// setPath stores value at segs[i:] below node and returns the updated node.
+// Missing nodes are created as objects. Nothing is changed if it returns an error.
+func setPath(node any, segs []string, i int, value any) (any, error) {
+	if i == len(segs) {
+		return value, nil
+	}
+	seg := segs[i]
+	switch n := node.(type) {
+	case nil:
+		return setPath(map[string]any{}, segs, i, value)
+	case map[string]any:
+		child, err := setPath(n[seg], segs, i+1, value)
+		if err != nil {
+			return nil, err
+		}
+		n[seg] = child
+		return n, nil
+	case []any:
+		index, err := strconv.Atoi(seg)
+		if err != nil || index < 0 || index > len(n) {
+			return nil, fmt.Errorf("index '%s' of '%s' is out of range", seg, strings.Join(segs[:i], "."))
+		}
+		var old any
+		if index < len(n) {
+			old = n[index]
+		}
+		child, err := setPath(old, segs, i+1, value)
+		if err != nil {
+			return nil, err
+		}
+		if index == len(n) {
+			return append(n, child), nil
+		}
+		n[index] = child
+		return n, nil
+	default:
+		return nil, fmt.Errorf("'%s' is neither an object nor an array", strings.Join(segs[:i], "."))
+	}
+}
+
+func (d *memoryDocument) Delete(path string) bool {
+	segs := splitPath(path)
+	if len(segs) == 0 {
+		return false
+	}
+	parentPath := strings.Join(segs[:len(segs)-1], ".")
+	parent, ok := d.lookup(parentPath)
+	if !ok {
+		return false
+	}
+	last := segs[len(segs)-1]
+	switch n := parent.(type) {
+	case map[string]any:
+		if _, ok := n[last]; !ok {
+			return false
+		}
+		delete(n, last)
+		return true
+	case []any:
+		i, err := strconv.Atoi(last)
+		if err != nil || i < 0 || i >= len(n) {
+			return false
+		}
+		// The parent holds the slice header, so it is set again with the shorter slice
+		root, _ := setPath(d.data, segs[:len(segs)-1], 0, slices.Delete(n, i, i+1))
+		d.data = root.(map[string]any)
+		return true
+	}
+	return false
+}
+
+// cloneTree returns a deep copy of a decoded JSON tree.
+func cloneTree(node any) any {
+	switch n := node.(type) {
+	case map[string]any:
+		c := make(map[string]any, len(n))
+		for k, v := range n {
+			c[k] = cloneTree(v)
+		}
+		return c
+	case []any:
+		c := make([]any, len(n))
+		for i, v := range n {
+			c[i] = cloneTree(v)
+		}
+		return c
+	default:
+		return n
+	}
+}
+
+func (d *memoryDocument) getStoreID() storeID {
+	return d.id
+}
+
+func (d *memoryDocument) getMutex() *sync.RWMutex {
+	return &d.mut
+}
+
+func (d *memoryDocument) getOptions() *storeOptions {
+	return &d.opts
+}
+
+func (d *memoryDocument) Save() error {
+	return d.SaveCtx(context.Background())
+}
+
+func (d *memoryDocument) SaveCtx(ctx context.Context) error {
+	s := saveState(ctx)
+	s.RLock(d)
+	defer s.RUnlock(d)
+
+	h := sha256.New()
+	err := d.opts.saveFile(ctx, d.location, func(w io.Writer) error {
+		return d.codec.encode(io.MultiWriter(w, h), d.data)
+	})
+	if err != nil {
+		return errors.Join(fmt.Errorf("failed to write file '%s'", d.location), err)
+	}
+	if err := d.opts.recordHash(d.location, h.Sum(nil)); err != nil {
+		return errors.Join(fmt.Errorf("failed to update manifest for '%s'", d.location), err)
+	}
+	return nil
+}
+
+func (d *memoryDocument) encodeData(w io.Writer, c codec) error {
+	return c.encode(w, d.data)
+}
+
+func (d *memoryDocument) decodedEquals(r io.Reader, c codec) (bool, error) {
+	var data map[string]any
+	if err := c.decode(r, &data); err != nil {
+		return false, err
+	}
+	return sameData(d.data, data)
+}
+
+// LoadDocument loads a Document from location. The file must hold an object.
+// If the file does not exist, an empty Document is returned.
+func LoadDocument(location string, opts ...Option) (Document, error) {
+	options := newStoreOptions(opts)
+	lock, err := lockFile(location, options)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.releaseUnclaimed()
+	c, err := resolveCodec(location, options)
+	if err != nil {
+		return nil, err
+	}
+	if d, err := loadDocumentFromFile(location, c, options); err != nil {
+		return nil, errors.Join(fmt.Errorf("unable to load document from file '%s'", location), err)
+	} else {
+		opened(d, location)
+		return d, nil
+	}
+}
+
+func loadDocumentFromFile(location string, c codec, o storeOptions) (Document, error) {
+	d := &memoryDocument{
+		id:       newStoreID(),
+		data:     make(map[string]any),
+		location: location,
+		codec:    c,
+		opts:     o,
+	}
+	f, err := o.openFile(location)
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = o.files().MkdirAll(filepath.Dir(location), 0740)
+			return d, err
+		}
+		return nil, errors.Join(fmt.Errorf("failed to open file '%s' (file exists)", location), err)
+	}
+	defer f.Close()
+	var data any
+	if err := c.decode(o.withProgress(f), &data); err != nil {
+		return nil, errors.Join(fmt.Errorf("failed to decode file '%s'", location), err)
+	}
+	// Other codecs than JSON may decode into other types, like integers, so the tree is normalized
+	if err := d.Set("", data); err != nil {
+		return nil, errors.Join(fmt.Errorf("failed to decode file '%s'", location), err)
+	}
+	return d, nil
+}
+
+func (d *memoryDocument) getSaveTimer() *time.Timer {
+	d.timerMut.Lock()
+	defer d.timerMut.Unlock()
+	return d.saveTimer
+}
+
+func (d *memoryDocument) setSaveTimer(t *time.Timer) {
+	d.timerMut.Lock()
+	defer d.timerMut.Unlock()
+	d.saveTimer = t
+}
+
+func (d *memoryDocument) getMaxSaveTimer() *time.Timer {
+	d.timerMut.Lock()
+	defer d.timerMut.Unlock()
+	return d.maxSaveTimer
+}
+
+func (d *memoryDocument) setMaxSaveTimer(t *time.Timer) {
+	d.timerMut.Lock()
+	defer d.timerMut.Unlock()
+	d.maxSaveTimer = t
+}
+
+func (d *memoryDocument) getSaveOnce() *sync.Once {
+	d.timerMut.Lock()
+	defer d.timerMut.Unlock()
+	return d.saveOnce
+}
+
+func (d *memoryDocument) setSaveOnce(once *sync.Once) {
+	d.timerMut.Lock()
+	defer d.timerMut.Unlock()
+	d.saveOnce = once
+}
@@ -0,0 +1,175 @@
+package speicher
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// bufferPointer is the content of the pointer file of a double buffered store.
+type bufferPointer struct {
+	// Current is the slot holding the latest complete save, "a" or "b".
+	Current string `json:"current"`
+	// Hashes holds the SHA-256 sum of each slot as written, hex encoded.
+	Hashes map[string]string `json:"hashes"`
+}
+
+// WithDoubleBuffer makes the store alternate its saves between two files, location.a and location.b,
+// and record the latest complete one in the pointer file location.current.
+// A save overwrites the older file in place and only then updates the pointer,
+// so a crash at any point leaves one complete file, even on file systems where renames are not atomic.
+// The pointer records a checksum of each file; if the latest file doesn't match it, the store loads the other one.
+// A file at location from before the option was used is loaded until the first save, which removes it.
+//
+// It applies to the main file of Map, OrderedMap, List, Set, Graph, Bitmap, MetricsStore, Outbox, Queue, Heap, TimeSeries, Document, Leaderboard and HyperLogLog stores.
+// Sidecar files like the expiry times are still replaced by renaming.
+// Segmented Lists, Secrets and disk-backed Maps ignore it.
+func WithDoubleBuffer() Option {
+	return func(o *storeOptions) {
+		o.doubleBuffer = true
+	}
+}
+
+func pointerLocation(location string) string {
+	return location + ".current"
+}
+
+func slotLocation(location, slot string) string {
+	return location + "." + slot
+}
+
+func otherSlot(slot string) string {
+	if slot == "a" {
+		return "b"
+	}
+	return "a"
+}
+
+// readPointer reads the pointer file of the double buffered store at location.
+// Returns false if it doesn't exist or can't be decoded.
+func (o storeOptions) readPointer(location string) (bufferPointer, bool) {
+	var p bufferPointer
+	f, err := o.files().Open(pointerLocation(location))
+	if err != nil {
+		return p, false
+	}
+	defer f.Close()
+	if err := json.NewDecoder(f).Decode(&p); err != nil || (p.Current != "a" && p.Current != "b") {
+		return bufferPointer{}, false
+	}
+	return p, true
+}
+
+// openFile opens the main file of the store at location for loading.
+// For double buffered stores, it opens the latest slot that matches its checksum.
+func (o storeOptions) openFile(location string) (io.ReadCloser, error) {
+	if !o.doubleBuffer {
+		return o.files().Open(location)
+	}
+	p, ok := o.readPointer(location)
+	if !ok {
+		// The first save removes the file at location, so if it exists no save completed yet.
+		// Otherwise the pointer was torn while both slots were complete.
+		f, err := o.files().Open(location)
+		if !os.IsNotExist(err) {
+			return f, err
+		}
+		for _, slot := range []string{"a", "b"} {
+			if f, err := o.files().Open(slotLocation(location, slot)); err == nil {
+				return f, nil
+			}
+		}
+		return nil, err
+	}
+	var errs []error
+	for _, slot := range []string{p.Current, otherSlot(p.Current)} {
+		data, err := o.readSlot(location, slot, p.Hashes[slot])
+		if err == nil {
+			return io.NopCloser(bytes.NewReader(data)), nil
+		}
+		errs = append(errs, err)
+	}
+	return nil, errors.Join(fmt.Errorf("no valid file for '%s'", location), errors.Join(errs...))
+}
+
+// readSlot reads a slot of the double buffered store at location and checks it against the hex encoded SHA-256 sum.
+// An empty sum is not checked.
+func (o storeOptions) readSlot(location, slot, sum string) ([]byte, error) {
+	f, err := o.files().Open(slotLocation(location, slot))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	if h := sha256.Sum256(data); sum != "" && hex.EncodeToString(h[:]) != sum {
+		return nil, fmt.Errorf("checksum mismatch in file '%s'", slotLocation(location, slot))
+	}
+	return data, nil
+}
+
+// saveDoubleBuffered writes the main file of the store at location into the older slot
+// and points the pointer file to it once it is complete.
+func (o storeOptions) saveDoubleBuffered(ctx context.Context, location string, write func(w io.Writer) error) error {
+	p, ok := o.readPointer(location)
+	if !ok {
+		p = bufferPointer{Current: "b"}
+	}
+	if p.Hashes == nil {
+		p.Hashes = make(map[string]string)
+	}
+	slot := otherSlot(p.Current)
+
+	h := sha256.New()
+	err := o.writeInPlace(slotLocation(location, slot), func(w io.Writer) error {
+		if err := write(contextWriter{ctx: ctx, w: io.MultiWriter(w, h)}); err != nil {
+			return err
+		}
+		return ctx.Err()
+	})
+	if err != nil {
+		return err
+	}
+
+	p.Current = slot
+	p.Hashes[slot] = hex.EncodeToString(h.Sum(nil))
+	err = o.writeInPlace(pointerLocation(location), func(w io.Writer) error {
+		return json.NewEncoder(w).Encode(p)
+	})
+	if err != nil {
+		return err
+	}
+	if !ok {
+		if err := o.files().Remove(location); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeInPlace overwrites the file at location and flushes it to disk if the file system supports it.
+func (o storeOptions) writeInPlace(location string, write func(w io.Writer) error) error {
+	f, err := o.files().Create(location)
+	if err != nil {
+		return err
+	}
+	if err := write(f); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if s, ok := f.(interface{ Sync() error }); ok {
+		if err := s.Sync(); err != nil {
+			_ = f.Close()
+			return err
+		}
+	}
+	return f.Close()
+}
@@ -0,0 +1,112 @@
+package speicher
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// OversizePolicy decides what happens to a value whose JSON encoding exceeds the limit set with WithMaxEntrySize.
+// It receives the key (or index) and the encoded value and returns the encoding to store instead,
+// which must fit the limit, or an error to reject the value.
+type OversizePolicy func(key string, encoded []byte) ([]byte, error)
+
+// ErrEntryTooLarge is returned for values rejected by RejectOversized.
+var ErrEntryTooLarge = errors.New("entry too large")
+
+// WithMaxEntrySize limits the size of each value of a Map or List, measured by encoding it as JSON,
+// so a single huge value can't slow down every save. Values written by Set, TrySet, Append, TryAppend,
+// Insert and the operations built on them are checked; Overwrite and loading are not.
+//
+// Values over the limit are passed to policy. If it rejects a value, TrySet, TryAppend, Set and Insert of a List
+// return the error; Set of a Map, Append and AppendUnique drop the value and report the error
+// like a failed automatic save (see WithSaveErrorHandler).
+// Other stores ignore it.
+func WithMaxEntrySize(limit int, policy OversizePolicy) Option {
+	return func(o *storeOptions) {
+		o.maxEntrySize = limit
+		o.oversizePolicy = policy
+	}
+}
+
+// RejectOversized is an OversizePolicy that rejects every value over the limit with ErrEntryTooLarge.
+func RejectOversized(key string, encoded []byte) ([]byte, error) {
+	return nil, ErrEntryTooLarge
+}
+
+// TruncateOversized returns an OversizePolicy that stores the value returned by fn instead of a value over the limit,
+// for example with a long text field cut short.
+func TruncateOversized[T any](fn func(key string, value T) T) OversizePolicy {
+	return func(key string, encoded []byte) ([]byte, error) {
+		var value T
+		if err := json.Unmarshal(encoded, &value); err != nil {
+			return nil, err
+		}
+		return json.Marshal(fn(key, value))
+	}
+}
+
+// SpillOversized returns an OversizePolicy that writes values over the limit to a file in dir,
+// named by the SHA-256 sum of the value, and stores the encoding returned by placeholder instead,
+// which should reference the file location, for example in a field of the value type.
+// Spilled files are not removed when the entry changes.
+func SpillOversized(dir string, placeholder func(key, location string) []byte) OversizePolicy {
+	return func(key string, encoded []byte) ([]byte, error) {
+		sum := sha256.Sum256(encoded)
+		location := filepath.Join(dir, hex.EncodeToString(sum[:])+".json")
+		if err := os.MkdirAll(dir, 0740); err != nil {
+			return nil, err
+		}
+		err := writeFileAtomic(location, func(w io.Writer) error {
+			_, err := w.Write(encoded)
+			return err
+		})
+		if err != nil {
+			return nil, errors.Join(fmt.Errorf("failed to write file '%s'", location), err)
+		}
+		return placeholder(key, location), nil
+	}
+}
+
+// limitEntry applies the entry size limit of o to value and returns the value to store.
+// Values that can't be encoded are accepted, since saving reports them anyway.
+func limitEntry[T any](o *storeOptions, key string, value T) (T, error) {
+	if o.maxEntrySize <= 0 {
+		return value, nil
+	}
+	encoded, err := json.Marshal(value)
+	if err != nil || len(encoded) <= o.maxEntrySize {
+		return value, nil
+	}
+	tooLarge := fmt.Errorf("entry '%s' has %d bytes, more than the limit of %d", key, len(encoded), o.maxEntrySize)
+	if o.oversizePolicy == nil {
+		return value, errors.Join(tooLarge, ErrEntryTooLarge)
+	}
+	replacement, err := o.oversizePolicy(key, encoded)
+	if err != nil {
+		return value, errors.Join(tooLarge, err)
+	}
+	if len(replacement) > o.maxEntrySize {
+		return value, errors.Join(tooLarge, fmt.Errorf("replacement has %d bytes", len(replacement)), ErrEntryTooLarge)
+	}
+	var limited T
+	if err := json.Unmarshal(replacement, &limited); err != nil {
+		return value, errors.Join(tooLarge, fmt.Errorf("failed to decode replacement"), err)
+	}
+	return limited, nil
+}
+
+// reportError reports an error of an operation without an error result
+// to the handler set with WithSaveErrorHandler or to the Err channel.
+func (o *storeOptions) reportError(err error) {
+	if o.onSaveError != nil {
+		o.onSaveError(err)
+		return
+	}
+	log(err)
+}
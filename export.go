@@ -0,0 +1,105 @@
+package speicher
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ExportFormat is the format ExportWhere writes entries in.
+type ExportFormat int
+
+const (
+	// ExportNDJSON writes one object of the form {"key": "...", "value": ...} per line,
+	// which ImportNDJSON reads back.
+	ExportNDJSON ExportFormat = iota
+	// ExportJSON writes a single JSON object that maps the keys to their values, like the file of a Map.
+	ExportJSON
+)
+
+// ExportWhere writes every entry of m that satisfies pred to w in the given format
+// and returns the number of exported entries, for example to pull all records of a customer into a file:
+//
+//	f, _ := os.Create("customer-42.ndjson")
+//	defer f.Close()
+//	n, err := speicher.ExportWhere(users, f, func(key string, u User) bool {
+//		return u.CustomerID == 42
+//	}, speicher.ExportNDJSON)
+//
+// Entries are written in the order of Iterate. The matching entries are collected under the read lock
+// and encoded after releasing it, so a slow writer doesn't hold up writers of the store.
+// The export counts against the scan limit of m (see WithScanLimit) and may fail with ErrScanLimit.
+//
+// This function acquires its own read lock on m.
+func ExportWhere[T any](m Map[T], w io.Writer, pred func(key string, value T) bool, format ExportFormat) (int, error) {
+	if format != ExportNDJSON && format != ExportJSON {
+		return 0, fmt.Errorf("unknown export format %d", format)
+	}
+
+	var entries []ndjsonEntry[T]
+	release, err := acquireScan(context.Background(), m)
+	if err != nil {
+		return 0, err
+	}
+	func() {
+		defer release()
+		s := borrowState()
+		defer returnState(s)
+		s.RLock(m)
+		defer s.RUnlock(m)
+		m.Iterate(func(key string, value T) bool {
+			if pred(key, value) {
+				entries = append(entries, ndjsonEntry[T]{Key: key, Value: value})
+			}
+			return true
+		})
+	}()
+
+	bw := bufio.NewWriter(w)
+	if format == ExportNDJSON {
+		err = exportNDJSON(bw, entries)
+	} else {
+		err = exportJSON(bw, entries)
+	}
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err != nil {
+		return 0, errors.Join(fmt.Errorf("failed to export %d entries", len(entries)), err)
+	}
+	return len(entries), nil
+}
+
+func exportNDJSON[T any](w io.Writer, entries []ndjsonEntry[T]) error {
+	enc := json.NewEncoder(w)
+	for _, e := range entries {
+		if err := enc.Encode(e); err != nil {
+			return errors.Join(fmt.Errorf("failed to encode value of key '%s'", e.Key), err)
+		}
+	}
+	return nil
+}
+
+func exportJSON[T any](w *bufio.Writer, entries []ndjsonEntry[T]) error {
+	// The object is written entry by entry to keep the order of the entries,
+	// which encoding a Go map would sort
+	_ = w.WriteByte('{')
+	for i, e := range entries {
+		if i > 0 {
+			_ = w.WriteByte(',')
+		}
+		key, _ := json.Marshal(e.Key)
+		value, err := json.Marshal(e.Value)
+		if err != nil {
+			return errors.Join(fmt.Errorf("failed to encode value of key '%s'", e.Key), err)
+		}
+		_, _ = w.Write(key)
+		_ = w.WriteByte(':')
+		_, _ = w.Write(value)
+	}
+	_, err := w.WriteString("}\n")
+	return err
+}
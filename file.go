@@ -0,0 +1,241 @@
+package speicher
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+type (
+	// FileSystem is the storage that stores read and write their files with.
+	// By default stores use the file system of the operating system.
+	//
+	// Open must return an error matching fs.ErrNotExist if the file does not exist.
+	// Create truncates an existing file. Rename replaces an existing file at newpath.
+	FileSystem interface {
+		Open(name string) (io.ReadCloser, error)
+		Create(name string) (io.WriteCloser, error)
+		Remove(name string) error
+		Rename(oldpath, newpath string) error
+		MkdirAll(path string, perm fs.FileMode) error
+		ReadDir(name string) ([]fs.DirEntry, error)
+	}
+
+	// osFileSystem is the FileSystem of the operating system.
+	osFileSystem struct{}
+
+	// contextWriter fails writes once its context is done.
+	contextWriter struct {
+		ctx context.Context
+		w   io.Writer
+	}
+)
+
+func (osFileSystem) Open(name string) (io.ReadCloser, error) {
+	return os.Open(name)
+}
+
+func (osFileSystem) Create(name string) (io.WriteCloser, error) {
+	return os.Create(name)
+}
+
+func (osFileSystem) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (osFileSystem) Rename(oldpath, newpath string) error {
+	return os.Rename(oldpath, newpath)
+}
+
+func (osFileSystem) MkdirAll(path string, perm fs.FileMode) error {
+	return os.MkdirAll(path, perm)
+}
+
+func (osFileSystem) ReadDir(name string) ([]fs.DirEntry, error) {
+	return os.ReadDir(name)
+}
+
+// WithFileSystem makes the store read and write its files with fsys instead of the operating system.
+// Integrity manifests (see CreateManifest) are only maintained for the operating system.
+func WithFileSystem(fsys FileSystem) Option {
+	return func(o *storeOptions) {
+		o.fileSystem = fsys
+	}
+}
+
+// files returns the FileSystem the store uses.
+func (o storeOptions) files() FileSystem {
+	if o.fileSystem == nil {
+		return osFileSystem{}
+	}
+	return o.fileSystem
+}
+
+// recordHash stores the hash of the file at location in the manifest of its directory,
+// if the store uses the file system of the operating system.
+func (o storeOptions) recordHash(location string, sum []byte) error {
+	if o.fileSystem != nil || o.doubleBuffer {
+		return nil
+	}
+	return recordHash(location, sum)
+}
+
+// writeFile writes a file of the store by calling write with a temporary file next to location
+// and renaming it to location afterwards. Readers never observe a partially written file.
+func (o storeOptions) writeFile(location string, write func(w io.Writer) error) error {
+	if o.fileSystem == nil {
+		return writeFileAtomicIn(location, o.tempDir, write)
+	}
+	tmp := location + ".tmp"
+	f, err := o.fileSystem.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if err := write(f); err != nil {
+		_ = f.Close()
+		_ = o.fileSystem.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		_ = o.fileSystem.Remove(tmp)
+		return err
+	}
+	return o.fileSystem.Rename(tmp, location)
+}
+
+// saveFile writes the file of a store at location by calling write.
+// The data is written to a temporary file first, which is removed if ctx is done before the write completed,
+// so the previous file stays intact. If the data equals what the store saved last and the file wasn't modified since,
+// the temporary file is discarded as well, so saving an unchanged store doesn't rewrite its file.
+// Stores using WithDoubleBuffer always write their inactive slot, which keeps both slots verifiable.
+// During a save of a Group, the file is staged and only replaces location when the Group commits.
+func (o storeOptions) saveFile(ctx context.Context, location string, write func(w io.Writer) error) error {
+	var skipped bool
+	h := sha256.New()
+	err := o.instrumentSave(location, write, func(write func(w io.Writer) error) error {
+		if o.readOnly() {
+			return errReadOnly(location)
+		}
+		if o.saved != nil && !o.doubleBuffer {
+			write = o.unchangedWrite(location, h, write)
+		}
+		var err error
+		switch {
+		case o.doubleBuffer:
+			err = o.saveDoubleBuffered(ctx, location, write)
+		case o.saved == nil && ctx.Done() == nil && stagingOf(ctx) == nil:
+			f, err := o.files().Create(location)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			return write(f)
+		default:
+			err = o.writeFileContext(ctx, location, write)
+		}
+		if errors.Is(err, errUnchanged) {
+			skipped = true
+			return nil
+		}
+		return err
+	})
+	if skipped {
+		if l := debugLogger(); l != nil {
+			l.Debug("speicher: save skipped, the store is unchanged", "location", location)
+		}
+		return nil
+	}
+	if err != nil {
+		if o.saved != nil {
+			o.saved.forget(location)
+		}
+		return err
+	}
+	committed := func() {
+		if o.saved != nil {
+			// The version is remembered for double-buffered stores too, so WithAutoReload can tell their saves apart
+			var sum []byte
+			if !o.doubleBuffer {
+				sum = h.Sum(nil)
+			}
+			o.saved.remember(o, location, sum)
+		}
+		o.mirrorSave(location)
+	}
+	if g := stagingOf(ctx); g != nil {
+		g.onCommit(committed)
+	} else {
+		committed()
+	}
+	return nil
+}
+
+// writeFileContext writes a file like writeFile but aborts as soon as ctx is done.
+func (o storeOptions) writeFileContext(ctx context.Context, location string, write func(w io.Writer) error) error {
+	if o.readOnly() {
+		return errReadOnly(location)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if g := stagingOf(ctx); g != nil {
+		return g.stage(ctx, o, location, write)
+	}
+	return o.writeFile(location, func(w io.Writer) error {
+		if err := write(contextWriter{ctx: ctx, w: w}); err != nil {
+			return err
+		}
+		return ctx.Err()
+	})
+}
+
+func (w contextWriter) Write(p []byte) (int, error) {
+	if err := w.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return w.w.Write(p)
+}
+
+// writeFileAtomic writes a file by calling write with a temporary file next to location
+// and renaming it to location afterwards. Readers never observe a partially written file.
+func writeFileAtomic(location string, write func(w io.Writer) error) error {
+	return writeFileAtomicIn(location, "", write)
+}
+
+// writeFileAtomicIn writes a file like writeFileAtomic, but creates the temporary file in dir, if set.
+// If dir is on another volume, the finished file is copied next to location first,
+// since renames are only atomic within a volume.
+func writeFileAtomicIn(location, dir string, write func(w io.Writer) error) error {
+	if dir == "" {
+		dir = filepath.Dir(location)
+	}
+	tmp, err := os.CreateTemp(dir, filepath.Base(location)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := write(tmp); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	err = os.Rename(tmp.Name(), location)
+	if !crossDevice(err) {
+		return err
+	}
+	f, err := os.Open(tmp.Name())
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return writeFileAtomic(location, func(w io.Writer) error {
+		_, err := io.Copy(w, f)
+		return err
+	})
+}
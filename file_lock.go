@@ -0,0 +1,131 @@
+package speicher
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+type (
+	// FileLockMode selects how a store locks its file against other processes, see WithFileLock.
+	FileLockMode int
+
+	// fileLock is an advisory lock on the lock file of a store location.
+	fileLock struct {
+		f        *os.File
+		location string
+		claimed  bool
+	}
+)
+
+const (
+	// FileLockExclusive makes the store the only one that may load the file until it is closed.
+	FileLockExclusive FileLockMode = iota + 1
+	// FileLockShared loads the store read-only: any number of processes may load it with FileLockShared,
+	// but none with FileLockExclusive. Saving fails and automatic saves are disabled.
+	FileLockShared
+)
+
+// ErrLocked is returned when loading a store with WithFileLock without waiting
+// while another store holds a conflicting lock on its file.
+var ErrLocked = errors.New("store file is locked by another process")
+
+var (
+	lockMut   sync.Mutex
+	heldLocks = make(map[string]*fileLock)
+)
+
+// WithFileLock locks the file of the store while it is open, so two processes can't clobber each other's saves.
+// The lock is advisory and held on a file next to location with the suffix ".lock" until the store is closed;
+// processes that load the store without WithFileLock are not stopped.
+// If wait is true, loading blocks until a conflicting lock is released, otherwise it fails with ErrLocked.
+//
+// Locks conflict within one process too, so each location must only be loaded once at a time.
+// It is only supported for the file system of the operating system on Unix and Windows; elsewhere it has no effect.
+func WithFileLock(mode FileLockMode, wait bool) Option {
+	return func(o *storeOptions) {
+		o.fileLock = mode
+		o.fileLockWait = wait
+		if mode == FileLockShared {
+			o.noAutoSave = true
+		}
+	}
+}
+
+// readOnly reports whether the store must not write its files.
+func (o storeOptions) readOnly() bool {
+	return o.fileLock == FileLockShared || o.attached
+}
+
+// errReadOnly is returned by saves of a store loaded with FileLockShared or AttachReadOnly.
+func errReadOnly(location string) error {
+	return fmt.Errorf("store '%s' is loaded read-only", location)
+}
+
+// lockFile acquires the file lock for location selected by WithFileLock, if any.
+// The lock is handed to the store by opened and released by releaseUnclaimed if loading fails.
+// Once the store holds the lock, an interrupted commit of its Group is finished, see finishGroupCommit.
+func lockFile(location string, o storeOptions) (*fileLock, error) {
+	if o.fileLock == 0 || o.fileSystem != nil {
+		return nil, finishGroupCommit(location, o)
+	}
+	lockLocation := location + ".lock"
+	if err := os.MkdirAll(filepath.Dir(lockLocation), 0740); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(lockLocation, os.O_CREATE|os.O_RDWR, 0640)
+	if err != nil {
+		return nil, errors.Join(fmt.Errorf("failed to open lock file '%s'", lockLocation), err)
+	}
+	if err := lockOSFile(f, o.fileLock == FileLockExclusive, o.fileLockWait); err != nil {
+		_ = f.Close()
+		return nil, errors.Join(fmt.Errorf("failed to lock file '%s'", lockLocation), err)
+	}
+	if err := finishGroupCommit(location, o); err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	l := &fileLock{f: f, location: location}
+	lockMut.Lock()
+	defer lockMut.Unlock()
+	heldLocks[location] = l
+	return l, nil
+}
+
+// claimLock hands the lock acquired for location to the store loaded from it.
+func claimLock(location string) *fileLock {
+	lockMut.Lock()
+	defer lockMut.Unlock()
+	l, ok := heldLocks[location]
+	if !ok {
+		return nil
+	}
+	l.claimed = true
+	delete(heldLocks, location)
+	return l
+}
+
+// releaseUnclaimed releases the lock if no store claimed it because loading failed.
+func (l *fileLock) releaseUnclaimed() {
+	if l == nil {
+		return
+	}
+	lockMut.Lock()
+	claimed := l.claimed
+	if !claimed {
+		delete(heldLocks, l.location)
+	}
+	lockMut.Unlock()
+	if !claimed {
+		l.release()
+	}
+}
+
+// release unlocks the lock file by closing it.
+func (l *fileLock) release() {
+	if l != nil {
+		_ = l.f.Close()
+	}
+}
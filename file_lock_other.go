@@ -0,0 +1,10 @@
+//go:build !(darwin || dragonfly || freebsd || linux || netbsd || openbsd || windows)
+
+package speicher
+
+import "os"
+
+// lockOSFile does nothing on platforms without file locking support.
+func lockOSFile(f *os.File, exclusive, wait bool) error {
+	return nil
+}
@@ -0,0 +1,143 @@
+package speicher
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// Flags is a feature-flag store on top of a Map of JSON values, one per flag name.
+// Flag files are plain JSON objects like {"new-ui": true, "max-uploads": 5} that can be edited by hand.
+//
+// All methods acquire their own locks internally.
+type Flags struct {
+	flags Map[json.RawMessage]
+}
+
+// LoadFlags loads the flags stored at location.
+// The file is reloaded whenever another program changes it (see WithAutoReload).
+func LoadFlags(location string, opts ...Option) (*Flags, error) {
+	opts = append([]Option{WithAutoReload()}, opts...)
+	m, err := LoadMap[json.RawMessage](location, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return NewFlags(m), nil
+}
+
+// NewFlags returns Flags that keep the value of each flag in m.
+func NewFlags(m Map[json.RawMessage]) *Flags {
+	return &Flags{flags: m}
+}
+
+// Map returns the Map holding the flags.
+func (f *Flags) Map() Map[json.RawMessage] {
+	return f.flags
+}
+
+// Flag returns the value of the flag with the given name decoded as T.
+// If the flag is not set or its value can't be decoded as T, def is returned.
+func Flag[T any](f *Flags, name string, def T) T {
+	s := borrowState()
+	defer returnState(s)
+	s.RLock(f.flags)
+	raw, ok := f.flags.Get(name)
+	s.RUnlock(f.flags)
+	if !ok {
+		return def
+	}
+	var value T
+	if err := json.Unmarshal(raw, &value); err != nil {
+		return def
+	}
+	return value
+}
+
+// Bool returns the value of the flag with the given name, or def if it is not set or not a boolean.
+func (f *Flags) Bool(name string, def bool) bool {
+	return Flag(f, name, def)
+}
+
+// Int returns the value of the flag with the given name, or def if it is not set or not an integer.
+func (f *Flags) Int(name string, def int) int {
+	return Flag(f, name, def)
+}
+
+// String returns the value of the flag with the given name, or def if it is not set or not a string.
+func (f *Flags) String(name string, def string) string {
+	return Flag(f, name, def)
+}
+
+// Set sets the flag with the given name to value, which must be encodable as JSON.
+func (f *Flags) Set(name string, value any) error {
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return errors.Join(fmt.Errorf("failed to encode flag '%s'", name), err)
+	}
+	s := borrowState()
+	defer returnState(s)
+	s.Lock(f.flags)
+	defer s.Unlock(f.flags)
+	return f.flags.TrySet(name, raw)
+}
+
+// Unset removes the flag with the given name, so its getters return their default.
+func (f *Flags) Unset(name string) {
+	s := borrowState()
+	defer returnState(s)
+	s.Lock(f.flags)
+	defer s.Unlock(f.flags)
+	f.flags.Delete(name)
+}
+
+// Subscribe calls fn with the name of every flag that was set, changed or removed,
+// whether by Set, Unset or a reload of the file, until ctx is done.
+// Flags changed together are reported in the order of their names.
+// fn is called from a separate goroutine, one change at a time.
+func (f *Flags) Subscribe(ctx context.Context, fn func(name string)) {
+	events := f.flags.Watch(ctx)
+	last := f.values()
+	go func() {
+		for range events {
+			// Reloads don't report which flags changed, so compare all values instead
+			current := f.values()
+			var changed []string
+			for name, raw := range current {
+				if old, ok := last[name]; !ok || !bytes.Equal(old, raw) {
+					changed = append(changed, name)
+				}
+			}
+			for name := range last {
+				if _, ok := current[name]; !ok {
+					changed = append(changed, name)
+				}
+			}
+			last = current
+			sort.Strings(changed)
+			for _, name := range changed {
+				fn(name)
+			}
+		}
+	}()
+}
+
+// values returns the raw values of all flags.
+func (f *Flags) values() map[string]json.RawMessage {
+	s := borrowState()
+	defer returnState(s)
+	s.RLock(f.flags)
+	defer s.RUnlock(f.flags)
+	values := make(map[string]json.RawMessage)
+	for name, raw := range f.flags.Iterate {
+		values[name] = raw
+	}
+	return values
+}
+
+// Close closes the Map holding the flags, saving it one last time.
+func (f *Flags) Close() error {
+	return f.flags.Close()
+}
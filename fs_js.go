@@ -0,0 +1,151 @@
+//go:build js && wasm
+
+package speicher
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+	"strings"
+	"syscall/js"
+	"time"
+)
+
+type (
+	// localStorageFileSystem is a FileSystem that keeps every file as one entry of the browser's localStorage.
+	localStorageFileSystem struct {
+		prefix  string
+		storage js.Value
+	}
+
+	// localStorageFile buffers a file created in localStorage until it is closed.
+	localStorageFile struct {
+		bytes.Buffer
+		fsys *localStorageFileSystem
+		name string
+	}
+
+	// localStorageEntry is a file listed by ReadDir.
+	localStorageEntry struct {
+		name string
+	}
+)
+
+// LocalStorage returns a FileSystem that keeps files in the browser's localStorage,
+// so stores keep working in a WebAssembly frontend, for example in offline mode.
+// The key of every file is prefix followed by its cleaned path; the content is base64 encoded.
+// Directories are implicit.
+//
+// localStorage is small (usually about 5 MB per origin), so use it for small stores.
+//
+//	m, err := speicher.LoadMap[Todo]("todos.json", speicher.WithFileSystem(speicher.LocalStorage("app:")))
+func LocalStorage(prefix string) FileSystem {
+	return &localStorageFileSystem{prefix: prefix, storage: js.Global().Get("localStorage")}
+}
+
+func (l *localStorageFileSystem) key(name string) string {
+	return l.prefix + path.Clean(name)
+}
+
+func (l *localStorageFileSystem) Open(name string) (io.ReadCloser, error) {
+	item := l.storage.Call("getItem", l.key(name))
+	if item.IsNull() {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	data, err := base64.StdEncoding.DecodeString(item.String())
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (l *localStorageFileSystem) Create(name string) (io.WriteCloser, error) {
+	return &localStorageFile{fsys: l, name: name}, nil
+}
+
+func (f *localStorageFile) Close() (err error) {
+	// setItem throws if the quota is exceeded
+	defer func() {
+		if r := recover(); r != nil {
+			err = &fs.PathError{Op: "write", Path: f.name, Err: errors.New("localStorage quota exceeded")}
+		}
+	}()
+	f.fsys.storage.Call("setItem", f.fsys.key(f.name), base64.StdEncoding.EncodeToString(f.Bytes()))
+	return nil
+}
+
+func (l *localStorageFileSystem) Remove(name string) error {
+	key := l.key(name)
+	if l.storage.Call("getItem", key).IsNull() {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrNotExist}
+	}
+	l.storage.Call("removeItem", key)
+	return nil
+}
+
+func (l *localStorageFileSystem) Rename(oldpath, newpath string) error {
+	item := l.storage.Call("getItem", l.key(oldpath))
+	if item.IsNull() {
+		return &fs.PathError{Op: "rename", Path: oldpath, Err: fs.ErrNotExist}
+	}
+	l.storage.Call("setItem", l.key(newpath), item)
+	l.storage.Call("removeItem", l.key(oldpath))
+	return nil
+}
+
+func (l *localStorageFileSystem) MkdirAll(string, fs.FileMode) error {
+	return nil
+}
+
+func (l *localStorageFileSystem) ReadDir(name string) ([]fs.DirEntry, error) {
+	dir := l.key(name) + "/"
+	if path.Clean(name) == "." {
+		dir = l.prefix
+	}
+	var entries []fs.DirEntry
+	for i := range l.storage.Get("length").Int() {
+		key := l.storage.Call("key", i).String()
+		rest, ok := strings.CutPrefix(key, dir)
+		if !ok || rest == "" || strings.Contains(rest, "/") {
+			continue
+		}
+		entries = append(entries, localStorageEntry{name: rest})
+	}
+	return entries, nil
+}
+
+func (e localStorageEntry) Name() string {
+	return e.name
+}
+
+func (e localStorageEntry) IsDir() bool {
+	return false
+}
+
+func (e localStorageEntry) Type() fs.FileMode {
+	return 0
+}
+
+// Info returns the entry itself; sizes and times are not tracked.
+func (e localStorageEntry) Info() (fs.FileInfo, error) {
+	return e, nil
+}
+
+func (e localStorageEntry) Size() int64 {
+	return 0
+}
+
+func (e localStorageEntry) Mode() fs.FileMode {
+	return 0
+}
+
+func (e localStorageEntry) ModTime() time.Time {
+	return time.Time{}
+}
+
+func (e localStorageEntry) Sys() any {
+	return nil
+}
@@ -0,0 +1,445 @@
+package speicher
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+type (
+	// memoryGraph is a Graph implementation that keeps all nodes and edges in memory.
+	memoryGraph[N any, E any] struct {
+		id       storeID
+		nodes    map[string]N
+		out      map[string]map[string]E
+		in       map[string]map[string]struct{}
+		location string
+		codec    codec
+		opts     storeOptions
+		mut      sync.RWMutex
+
+		timerMut     sync.Mutex
+		saveTimer    *time.Timer
+		maxSaveTimer *time.Timer
+		saveOnce     *sync.Once
+	}
+
+	// GraphEdge is a directed edge between two nodes of a Graph.
+	GraphEdge[E any] struct {
+		From string
+		To   string
+		Attr E
+	}
+
+	// graphFile is the persisted representation of a Graph.
+	graphFile[N any, E any] struct {
+		Nodes map[string]N   `json:"nodes"`
+		Edges []GraphEdge[E] `json:"edges"`
+	}
+
+	// Graph is a thread-safe store for a directed graph of nodes with values of type N
+	// connected by edges with attributes of type E.
+	// Model undirected relationships by adding an edge in each direction.
+	//
+	// All operations require appropriate locking via a State object:
+	//
+	//	s := speicher.NewState()
+	//	s.Lock(myGraph)
+	//	defer s.Unlock(myGraph)
+	//	myGraph.SetNode("alice", alice)
+	//	myGraph.SetNode("bob", bob)
+	//	err := myGraph.SetEdge("alice", "bob", Follows{Since: now})
+	Graph[N any, E any] interface {
+		lockable
+
+		// SetNode adds or updates the node with the given ID.
+		// Requires a write lock.
+		SetNode(id string, value N)
+
+		// GetNode returns the value of the node with the given ID.
+		// Requires at least a read lock.
+		GetNode(id string) (N, bool)
+
+		// HasNode checks if a node with the given ID exists.
+		// Requires at least a read lock.
+		HasNode(id string) bool
+
+		// DeleteNode removes the node with the given ID and all its incoming and outgoing edges.
+		// Requires a write lock.
+		DeleteNode(id string)
+
+		// SetEdge adds or updates the edge from one node to another.
+		// Both nodes must exist.
+		// Requires a write lock.
+		SetEdge(from, to string, attr E) error
+
+		// GetEdge returns the attribute of the edge from one node to another.
+		// Requires at least a read lock.
+		GetEdge(from, to string) (E, bool)
+
+		// DeleteEdge removes the edge from one node to another.
+		// It returns false if the edge did not exist.
+		// Requires a write lock.
+		DeleteEdge(from, to string) bool
+
+		// Neighbors returns the sorted IDs of all nodes the given node has an edge to.
+		// Requires at least a read lock.
+		Neighbors(id string) []string
+
+		// InNeighbors returns the sorted IDs of all nodes that have an edge to the given node.
+		// Requires at least a read lock.
+		InNeighbors(id string) []string
+
+		// BFS visits all nodes reachable from start in breadth-first order, including start.
+		// Requires at least a read lock.
+		BFS(start string, yield func(id string, value N) bool)
+
+		// DFS visits all nodes reachable from start in depth-first order, including start.
+		// Requires at least a read lock.
+		DFS(start string, yield func(id string, value N) bool)
+
+		// IterateNodes calls the provided function for each node.
+		// Requires at least a read lock.
+		IterateNodes(yield func(id string, value N) bool)
+
+		// IterateEdges calls the provided function for each edge.
+		// Requires at least a read lock.
+		IterateEdges(yield func(edge GraphEdge[E]) bool)
+
+		// NodeCount returns the number of nodes.
+		// Requires at least a read lock.
+		NodeCount() int
+
+		// EdgeCount returns the number of edges.
+		// Requires at least a read lock.
+		EdgeCount() int
+
+		// Save persists the current state of the Graph to its underlying data store.
+		// It returns an error if the operation fails.
+		// This method acquires its own read lock internally.
+		Save() error
+
+		// SaveCtx persists the current state of the data store like Save,
+		// but aborts when ctx is cancelled or its deadline passes.
+		// An aborted save removes its temporary files and leaves the previous file intact.
+		// This method acquires its own read lock internally.
+		SaveCtx(ctx context.Context) error
+
+		// Close stops the automatic save and the background goroutines of the store and saves it one last time.
+		// The store must not be used afterwards.
+		// This method acquires its own read lock internally.
+		Close() error
+	}
+)
+
+func (g *memoryGraph[N, E]) SetNode(id string, value N) {
+	g.nodes[id] = value
+}
+
+func (g *memoryGraph[N, E]) GetNode(id string) (N, bool) {
+	value, ok := g.nodes[id]
+	return value, ok
+}
+
+func (g *memoryGraph[N, E]) HasNode(id string) bool {
+	_, ok := g.nodes[id]
+	return ok
+}
+
+func (g *memoryGraph[N, E]) DeleteNode(id string) {
+	for to := range g.out[id] {
+		delete(g.in[to], id)
+	}
+	for from := range g.in[id] {
+		delete(g.out[from], id)
+	}
+	delete(g.out, id)
+	delete(g.in, id)
+	delete(g.nodes, id)
+}
+
+func (g *memoryGraph[N, E]) SetEdge(from, to string, attr E) error {
+	if !g.HasNode(from) {
+		return fmt.Errorf("node '%s' does not exist", from)
+	}
+	if !g.HasNode(to) {
+		return fmt.Errorf("node '%s' does not exist", to)
+	}
+	if g.out[from] == nil {
+		g.out[from] = make(map[string]E)
+	}
+	if g.in[to] == nil {
+		g.in[to] = make(map[string]struct{})
+	}
+	g.out[from][to] = attr
+	g.in[to][from] = struct{}{}
+	return nil
+}
+
+func (g *memoryGraph[N, E]) GetEdge(from, to string) (E, bool) {
+	attr, ok := g.out[from][to]
+	return attr, ok
+}
+
+func (g *memoryGraph[N, E]) DeleteEdge(from, to string) bool {
+	if _, ok := g.out[from][to]; !ok {
+		return false
+	}
+	delete(g.out[from], to)
+	delete(g.in[to], from)
+	return true
+}
+
+func (g *memoryGraph[N, E]) Neighbors(id string) []string {
+	ids := make([]string, 0, len(g.out[id]))
+	for to := range g.out[id] {
+		ids = append(ids, to)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func (g *memoryGraph[N, E]) InNeighbors(id string) []string {
+	ids := make([]string, 0, len(g.in[id]))
+	for from := range g.in[id] {
+		ids = append(ids, from)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func (g *memoryGraph[N, E]) BFS(start string, yield func(id string, value N) bool) {
+	if !g.HasNode(start) {
+		return
+	}
+	visited := map[string]bool{start: true}
+	queue := []string{start}
+	for len(queue) > 0 {
+		id := queue[0]
+		queue = queue[1:]
+		if !yield(id, g.nodes[id]) {
+			return
+		}
+		for _, to := range g.Neighbors(id) {
+			if !visited[to] {
+				visited[to] = true
+				queue = append(queue, to)
+			}
+		}
+	}
+}
+
+func (g *memoryGraph[N, E]) DFS(start string, yield func(id string, value N) bool) {
+	if !g.HasNode(start) {
+		return
+	}
+	visited := make(map[string]bool)
+	stack := []string{start}
+	for len(stack) > 0 {
+		id := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if visited[id] {
+			continue
+		}
+		visited[id] = true
+		if !yield(id, g.nodes[id]) {
+			return
+		}
+		// Push in reverse so the smallest neighbor is visited first
+		neighbors := g.Neighbors(id)
+		for i := len(neighbors) - 1; i >= 0; i-- {
+			if !visited[neighbors[i]] {
+				stack = append(stack, neighbors[i])
+			}
+		}
+	}
+}
+
+func (g *memoryGraph[N, E]) IterateNodes(yield func(id string, value N) bool) {
+	for id, value := range g.nodes {
+		if !yield(id, value) {
+			break
+		}
+	}
+}
+
+func (g *memoryGraph[N, E]) IterateEdges(yield func(edge GraphEdge[E]) bool) {
+	for from, edges := range g.out {
+		for to, attr := range edges {
+			if !yield(GraphEdge[E]{From: from, To: to, Attr: attr}) {
+				return
+			}
+		}
+	}
+}
+
+func (g *memoryGraph[N, E]) NodeCount() int {
+	return len(g.nodes)
+}
+
+func (g *memoryGraph[N, E]) EdgeCount() int {
+	n := 0
+	for _, edges := range g.out {
+		n += len(edges)
+	}
+	return n
+}
+
+func (g *memoryGraph[N, E]) getStoreID() storeID {
+	return g.id
+}
+
+func (g *memoryGraph[N, E]) getMutex() *sync.RWMutex {
+	return &g.mut
+}
+
+func (g *memoryGraph[N, E]) getOptions() *storeOptions {
+	return &g.opts
+}
+
+// file returns the persisted representation with edges sorted for stable output.
+func (g *memoryGraph[N, E]) file() graphFile[N, E] {
+	f := graphFile[N, E]{Nodes: g.nodes, Edges: make([]GraphEdge[E], 0, g.EdgeCount())}
+	for edge := range g.IterateEdges {
+		f.Edges = append(f.Edges, edge)
+	}
+	sort.Slice(f.Edges, func(i, j int) bool {
+		if f.Edges[i].From != f.Edges[j].From {
+			return f.Edges[i].From < f.Edges[j].From
+		}
+		return f.Edges[i].To < f.Edges[j].To
+	})
+	return f
+}
+
+func (g *memoryGraph[N, E]) Save() error {
+	return g.SaveCtx(context.Background())
+}
+
+func (g *memoryGraph[N, E]) SaveCtx(ctx context.Context) error {
+	s := saveState(ctx)
+	s.RLock(g)
+	defer s.RUnlock(g)
+
+	h := sha256.New()
+	err := g.opts.saveFile(ctx, g.location, func(w io.Writer) error {
+		return g.codec.encode(io.MultiWriter(w, h), g.file())
+	})
+	if err != nil {
+		return errors.Join(fmt.Errorf("failed to write file '%s'", g.location), err)
+	}
+	if err := g.opts.recordHash(g.location, h.Sum(nil)); err != nil {
+		return errors.Join(fmt.Errorf("failed to update manifest for '%s'", g.location), err)
+	}
+	return nil
+}
+
+func (g *memoryGraph[N, E]) encodeData(w io.Writer, c codec) error {
+	return c.encode(w, g.file())
+}
+
+func (g *memoryGraph[N, E]) decodedEquals(r io.Reader, c codec) (bool, error) {
+	var data graphFile[N, E]
+	if err := c.decode(r, &data); err != nil {
+		return false, err
+	}
+	return sameData(g.file(), data)
+}
+
+// LoadGraph loads a Graph from location.
+// If the file does not exist, an empty Graph is returned.
+func LoadGraph[N any, E any](location string, opts ...Option) (Graph[N, E], error) {
+	options := newStoreOptions(opts)
+	lock, err := lockFile(location, options)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.releaseUnclaimed()
+	c, err := resolveCodec(location, options)
+	if err != nil {
+		return nil, err
+	}
+	if g, err := loadGraphFromFile[N, E](location, c, options); err != nil {
+		return nil, errors.Join(fmt.Errorf("unable to load graph from file '%s'", location), err)
+	} else {
+		opened(g, location)
+		return g, nil
+	}
+}
+
+func loadGraphFromFile[N any, E any](location string, c codec, o storeOptions) (Graph[N, E], error) {
+	g := &memoryGraph[N, E]{
+		id:       newStoreID(),
+		nodes:    make(map[string]N),
+		out:      make(map[string]map[string]E),
+		in:       make(map[string]map[string]struct{}),
+		location: location,
+		codec:    c,
+		opts:     o,
+	}
+	f, err := o.openFile(location)
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = o.files().MkdirAll(filepath.Dir(location), 0740)
+			return g, err
+		}
+		return nil, errors.Join(fmt.Errorf("failed to open file '%s' (file exists)", location), err)
+	}
+	defer f.Close()
+	var data graphFile[N, E]
+	if err := c.decode(f, &data); err != nil {
+		return nil, errors.Join(fmt.Errorf("failed to decode file '%s'", location), err)
+	}
+	for id, value := range data.Nodes {
+		g.SetNode(id, value)
+	}
+	for _, edge := range data.Edges {
+		if err := g.SetEdge(edge.From, edge.To, edge.Attr); err != nil {
+			return nil, errors.Join(fmt.Errorf("invalid edge in file '%s'", location), err)
+		}
+	}
+	return g, nil
+}
+
+func (g *memoryGraph[N, E]) getSaveTimer() *time.Timer {
+	g.timerMut.Lock()
+	defer g.timerMut.Unlock()
+	return g.saveTimer
+}
+
+func (g *memoryGraph[N, E]) setSaveTimer(t *time.Timer) {
+	g.timerMut.Lock()
+	defer g.timerMut.Unlock()
+	g.saveTimer = t
+}
+
+func (g *memoryGraph[N, E]) getMaxSaveTimer() *time.Timer {
+	g.timerMut.Lock()
+	defer g.timerMut.Unlock()
+	return g.maxSaveTimer
+}
+
+func (g *memoryGraph[N, E]) setMaxSaveTimer(t *time.Timer) {
+	g.timerMut.Lock()
+	defer g.timerMut.Unlock()
+	g.maxSaveTimer = t
+}
+
+func (g *memoryGraph[N, E]) getSaveOnce() *sync.Once {
+	g.timerMut.Lock()
+	defer g.timerMut.Unlock()
+	return g.saveOnce
+}
+
+func (g *memoryGraph[N, E]) setSaveOnce(o *sync.Once) {
+	g.timerMut.Lock()
+	defer g.timerMut.Unlock()
+	g.saveOnce = o
+}
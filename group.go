@@ -0,0 +1,576 @@
+package speicher
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+type (
+	// Group bundles related stores, like the users and the sessions of an application,
+	// so they are locked, saved, backed up and closed as a unit and their files stay consistent with each other.
+	//
+	// Locking the Group with a State locks all of its stores in a fixed order.
+	// Changes made to a store of the Group schedule an automatic save of the whole Group instead of the store,
+	// which uses the debounce and delay options of the changed store. Use Dirty and PendingSaveAt with the Group
+	// to observe it, and FlushAll saves it like any other store.
+	//
+	// A save of the Group holds a read lock on all of its stores, so every file reflects the same point in time,
+	// for example the end of a Transaction over several of them. The files are written to temporary files first
+	// and only replace the previous ones once all of them were written, so a save that fails before that changes none of them.
+	// The Group then records the commit in a journal next to the file of every store before it replaces the files.
+	// If the process crashes or a file can't be replaced midway, loading any store of the Group finishes the commit,
+	// so the files never stay a mix of two saves. Saving or closing a store of the Group directly bypasses this.
+	Group struct {
+		id     storeID
+		stores []Store
+		mut    sync.RWMutex
+		// saveMut serializes saves, which only hold a read lock on the stores.
+		saveMut sync.Mutex
+
+		timerMut     sync.Mutex
+		saveTimer    *time.Timer
+		maxSaveTimer *time.Timer
+		saveOnce     *sync.Once
+	}
+
+	// staging collects the files written during a save of a Group, so they replace their locations together.
+	staging struct {
+		mut   sync.Mutex
+		files []stagedFile
+		// journals are written before the staged files replace their locations, see groupJournal.
+		journals []stagedFile
+		// commits are called after the files were committed.
+		commits []func()
+	}
+
+	// stagedFile is a file that was written to tmp and replaces location when its Group commits.
+	stagedFile struct {
+		fsys          FileSystem
+		tmp, location string
+	}
+
+	// groupJournal is the content of the journal that a Group writes next to the file of every store
+	// before its staged files replace their locations. Once all journals are complete, the commit is decided
+	// and loading any store finishes it; otherwise loading a store discards the staged files.
+	groupJournal struct {
+		Journals []string      `json:"journals"`
+		Files    []journalFile `json:"files"`
+	}
+
+	// journalFile is a staged file listed in a groupJournal.
+	journalFile struct {
+		Tmp      string `json:"tmp"`
+		Location string `json:"location"`
+	}
+
+	// saveStateKey is the context key of the State that holds the locks of a save of a Group.
+	saveStateKey struct{}
+
+	// stagingKey is the context key of the staging of a save of a Group.
+	stagingKey struct{}
+)
+
+var (
+	groupMut sync.Mutex
+	// groups maps the stores that belong to a Group to it.
+	groups = make(map[storeID]*Group)
+)
+
+// NewGroup bundles stores into a Group. Every store can belong to only one Group at a time.
+// Returns an error if a store can't be saved as part of a Group:
+// disk-backed Maps and stores loaded with WithDoubleBuffer write their files in place.
+// Stores loaded read-only may be part of a Group, but are not saved.
+func NewGroup(stores ...Store) (*Group, error) {
+	g := &Group{id: newStoreID()}
+	seen := make(map[storeID]bool, len(stores))
+	for _, store := range stores {
+		store := unwrap(store)
+		if seen[store.getStoreID()] {
+			continue
+		}
+		seen[store.getStoreID()] = true
+		if err := groupable(store); err != nil {
+			return nil, err
+		}
+		g.stores = append(g.stores, store)
+	}
+	slices.SortFunc(g.stores, func(a, b Store) int {
+		return cmp.Compare(a.getStoreID(), b.getStoreID())
+	})
+
+	groupMut.Lock()
+	for _, store := range g.stores {
+		if _, ok := groups[store.getStoreID()]; ok {
+			groupMut.Unlock()
+			return nil, fmt.Errorf("store %T already belongs to a group", store)
+		}
+	}
+	for _, store := range g.stores {
+		groups[store.getStoreID()] = g
+	}
+	groupMut.Unlock()
+
+	openMut.Lock()
+	openStores[g.id] = &openStore{store: g, done: make(chan struct{})}
+	openMut.Unlock()
+
+	// Unsaved changes made before the stores were grouped are saved with the Group
+	for _, store := range g.stores {
+		if sav := store.(savable); Dirty(sav) {
+			cancelAutoSave(sav)
+			notifyChanged(g)
+		}
+	}
+	return g, nil
+}
+
+// groupable returns an error if store can't be part of a Group.
+func groupable(store lockable) error {
+	if _, ok := store.(*Group); ok {
+		return errors.New("groups can't be nested")
+	}
+	if _, ok := store.(partOf); ok {
+		return fmt.Errorf("store %T is persisted by another store", store)
+	}
+	if _, ok := store.(interface{ segmentLocation(segment int) string }); ok {
+		return errors.New("disk-backed maps can't be part of a group")
+	}
+	if _, ok := store.(savable); !ok {
+		return fmt.Errorf("store %T can't be saved", store)
+	}
+	if _, ok := store.(interface{ SaveCtx(context.Context) error }); !ok {
+		return fmt.Errorf("store %T can't be saved", store)
+	}
+	if o := optionsOf(store); o != nil && o.doubleBuffer {
+		return fmt.Errorf("store at '%s' is double-buffered and can't be part of a group", locationOf(store))
+	}
+	return nil
+}
+
+// groupOf returns the Group that the store with the given id belongs to, or nil.
+func groupOf(id storeID) *Group {
+	groupMut.Lock()
+	defer groupMut.Unlock()
+	return groups[id]
+}
+
+// Stores returns the stores of the Group in locking order.
+func (g *Group) Stores() []Store {
+	return slices.Clone(g.stores)
+}
+
+// Save saves all stores of the Group, see SaveCtx.
+//
+// This method acquires its own read lock internally.
+func (g *Group) Save() error {
+	return g.SaveCtx(context.Background())
+}
+
+// SaveCtx saves all stores of the Group while holding a read lock on all of them,
+// so their files reflect the same point in time. If a store fails to save or ctx is done
+// before all files were written, no file is changed and the error is returned.
+//
+// This method acquires its own read lock internally.
+func (g *Group) SaveCtx(ctx context.Context) error {
+	s := saveState(ctx)
+	s.RLock(g)
+	defer s.RUnlock(g)
+	return g.save(context.WithValue(ctx, saveStateKey{}, s))
+}
+
+// save saves all stores of the Group with staged files and commits them.
+// The State in ctx must hold at least a read lock on the Group.
+func (g *Group) save(ctx context.Context) error {
+	g.saveMut.Lock()
+	defer g.saveMut.Unlock()
+	st := &staging{}
+	for _, store := range g.stores {
+		var fsys FileSystem = osFileSystem{}
+		if o := optionsOf(store); o != nil {
+			fsys = o.files()
+		}
+		st.journals = append(st.journals, stagedFile{fsys: fsys, location: journalLocation(locationOf(store))})
+	}
+	ctx = context.WithValue(ctx, stagingKey{}, st)
+	changes := make([]uint64, len(g.stores))
+	for i, store := range g.stores {
+		if o := optionsOf(store); o != nil && o.readOnly() {
+			continue
+		}
+		cancelAutoSave(store.(savable))
+		changes[i] = startSave(store.getStoreID())
+		err := store.(interface{ SaveCtx(context.Context) error }).SaveCtx(ctx)
+		recordSave(store, err)
+		if err != nil {
+			st.abort()
+			return errors.Join(errors.New("failed to save group, no file was changed"), err)
+		}
+	}
+	if err := st.commit(); err != nil {
+		return errors.Join(errors.New("failed to commit group save"), err)
+	}
+	for i, store := range g.stores {
+		finishSave(store.getStoreID(), changes[i])
+	}
+	return nil
+}
+
+// Backup writes a copy of the file of every store of the Group to dir, taken while all of them are read locked,
+// so the copies are consistent with each other like the files after a save of the Group.
+// The copies have the same names and formats as the files, so they can be loaded like them.
+// Sidecar files like expiry times are not copied. Returns an error if two stores have files with the same name.
+// The live files, the auto-save schedule and Dirty are not affected.
+//
+// This method acquires its own read lock internally.
+func (g *Group) Backup(dir string) error {
+	targets := make([]string, len(g.stores))
+	seen := make(map[string]bool, len(g.stores))
+	for i, store := range g.stores {
+		name := filepath.Base(locationOf(store))
+		if seen[name] {
+			return fmt.Errorf("more than one store of the group has a file named '%s'", name)
+		}
+		seen[name] = true
+		targets[i] = filepath.Join(dir, name)
+	}
+
+	bufs := make([]bytes.Buffer, len(g.stores))
+	err := func() error {
+		s := NewState()
+		s.RLock(g)
+		defer s.RUnlock(g)
+		for i, store := range g.stores {
+			m, ok := store.(migratable)
+			if !ok {
+				return fmt.Errorf("store %T does not support snapshots", store)
+			}
+			var opts storeOptions
+			if o := optionsOf(store); o != nil {
+				opts = *o
+			}
+			c, err := resolveCodec(targets[i], opts)
+			if err != nil {
+				return err
+			}
+			if err := m.encodeData(&bufs[i], c); err != nil {
+				return errors.Join(fmt.Errorf("failed to encode backup '%s'", targets[i]), err)
+			}
+		}
+		return nil
+	}()
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(dir, 0740); err != nil {
+		return errors.Join(fmt.Errorf("failed to create directory '%s'", dir), err)
+	}
+	for i, target := range targets {
+		err := writeFileAtomic(target, func(w io.Writer) error {
+			_, err := bufs[i].WriteTo(w)
+			return err
+		})
+		if err != nil {
+			return errors.Join(fmt.Errorf("failed to write backup '%s'", target), err)
+		}
+	}
+	return nil
+}
+
+// Close saves the Group one last time like SaveCtx and closes all of its stores,
+// which stops their background goroutines and releases their file locks.
+// The stores no longer belong to the Group afterwards.
+func (g *Group) Close() error {
+	cancelAutoSave(g)
+	forget(g)
+
+	s := NewState()
+	s.RLock(g)
+	groupMut.Lock()
+	for _, store := range g.stores {
+		delete(groups, store.getStoreID())
+	}
+	groupMut.Unlock()
+	entries := make([]*openStore, len(g.stores))
+	for i, store := range g.stores {
+		entries[i] = forget(store.(savable))
+	}
+	err := g.save(context.WithValue(context.Background(), saveStateKey{}, s))
+	s.RUnlock(g)
+
+	for i, store := range g.stores {
+		cancelAutoSave(store.(savable))
+		releaseStore(store.(savable), entries[i])
+	}
+	return err
+}
+
+func (g *Group) getStoreID() storeID {
+	return g.id
+}
+
+// getMutex returns a mutex that is not used for locking; State locks the stores of the Group instead.
+func (g *Group) getMutex() *sync.RWMutex {
+	return &g.mut
+}
+
+func (g *Group) parts() []lockable {
+	parts := make([]lockable, len(g.stores))
+	for i, store := range g.stores {
+		parts[i] = store
+	}
+	return parts
+}
+
+func (g *Group) getSaveTimer() *time.Timer {
+	g.timerMut.Lock()
+	defer g.timerMut.Unlock()
+	return g.saveTimer
+}
+
+func (g *Group) setSaveTimer(t *time.Timer) {
+	g.timerMut.Lock()
+	defer g.timerMut.Unlock()
+	g.saveTimer = t
+}
+
+func (g *Group) getMaxSaveTimer() *time.Timer {
+	g.timerMut.Lock()
+	defer g.timerMut.Unlock()
+	return g.maxSaveTimer
+}
+
+func (g *Group) setMaxSaveTimer(t *time.Timer) {
+	g.timerMut.Lock()
+	defer g.timerMut.Unlock()
+	g.maxSaveTimer = t
+}
+
+func (g *Group) getSaveOnce() *sync.Once {
+	g.timerMut.Lock()
+	defer g.timerMut.Unlock()
+	return g.saveOnce
+}
+
+func (g *Group) setSaveOnce(once *sync.Once) {
+	g.timerMut.Lock()
+	defer g.timerMut.Unlock()
+	g.saveOnce = once
+}
+
+// saveState returns the State a save locks its store with:
+// the State of the Group saving it, which already holds the lock, or a new one.
+func saveState(ctx context.Context) *State {
+	if s, ok := ctx.Value(saveStateKey{}).(*State); ok {
+		return s
+	}
+	return NewState()
+}
+
+// stagingOf returns the staging of the Group save that ctx belongs to, or nil.
+func stagingOf(ctx context.Context) *staging {
+	st, _ := ctx.Value(stagingKey{}).(*staging)
+	return st
+}
+
+// stage writes the file at location to a temporary file next to it, which replaces location on commit.
+func (st *staging) stage(ctx context.Context, o storeOptions, location string, write func(w io.Writer) error) error {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	tmp := fmt.Sprintf("%s.%s%s", location, hex.EncodeToString(b), stagedSuffix)
+	err := o.writeInPlace(tmp, func(w io.Writer) error {
+		if err := write(contextWriter{ctx: ctx, w: w}); err != nil {
+			return err
+		}
+		return ctx.Err()
+	})
+	if err != nil {
+		_ = o.files().Remove(tmp)
+		return err
+	}
+	st.mut.Lock()
+	defer st.mut.Unlock()
+	if !slices.ContainsFunc(st.files, func(f stagedFile) bool { return f.location == location }) {
+		st.files = append(st.files, stagedFile{fsys: o.files(), tmp: tmp, location: location})
+	}
+	return nil
+}
+
+// onCommit registers fn to be called once the staged files were committed.
+func (st *staging) onCommit(fn func()) {
+	st.mut.Lock()
+	defer st.mut.Unlock()
+	st.commits = append(st.commits, fn)
+}
+
+// commit writes the journals and moves all staged files to their locations.
+// If writing a journal fails, the staged files are discarded and no file is changed.
+// If moving a file fails, the journals are kept, so the commit is finished when a store of the Group is loaded.
+func (st *staging) commit() error {
+	st.mut.Lock()
+	defer st.mut.Unlock()
+	if len(st.files) > 0 {
+		if err := st.writeJournals(); err != nil {
+			return err
+		}
+		var errs []error
+		for _, f := range st.files {
+			if err := f.fsys.Rename(f.tmp, f.location); err != nil {
+				errs = append(errs, errors.Join(fmt.Errorf("failed to replace file '%s'", f.location), err))
+			}
+		}
+		if len(errs) > 0 {
+			return errors.Join(append(errs, errors.New("the remaining files are replaced when a store of the group is loaded"))...)
+		}
+		for _, j := range st.journals {
+			_ = j.fsys.Remove(j.location)
+		}
+	}
+	for _, fn := range st.commits {
+		fn()
+	}
+	return nil
+}
+
+// writeJournals writes the journal of the commit next to the file of every store.
+// The caller must hold st.mut.
+func (st *staging) writeJournals() error {
+	journal := groupJournal{}
+	for _, j := range st.journals {
+		journal.Journals = append(journal.Journals, j.location)
+	}
+	for _, f := range st.files {
+		journal.Files = append(journal.Files, journalFile{Tmp: f.tmp, Location: f.location})
+	}
+	for i, j := range st.journals {
+		err := storeOptions{fileSystem: j.fsys}.writeInPlace(j.location, func(w io.Writer) error {
+			return json.NewEncoder(w).Encode(journal)
+		})
+		if err != nil {
+			for _, written := range st.journals[:i+1] {
+				_ = written.fsys.Remove(written.location)
+			}
+			for _, f := range st.files {
+				_ = f.fsys.Remove(f.tmp)
+			}
+			return errors.Join(fmt.Errorf("failed to write file '%s', no file was changed", j.location), err)
+		}
+	}
+	return nil
+}
+
+// stagedSuffix ends the names of the temporary files that a save of a Group stages.
+const stagedSuffix = ".group.tmp"
+
+// removeStaged removes the files staged for location by saves of a Group that never reached their commit.
+func removeStaged(fsys FileSystem, location string) {
+	entries, err := fsys.ReadDir(filepath.Dir(location))
+	if err != nil {
+		return
+	}
+	prefix := filepath.Base(location) + "."
+	for _, entry := range entries {
+		name, ok := strings.CutPrefix(entry.Name(), prefix)
+		if !ok {
+			continue
+		}
+		if id, ok := strings.CutSuffix(name, stagedSuffix); ok && !strings.Contains(id, ".") {
+			_ = fsys.Remove(filepath.Join(filepath.Dir(location), entry.Name()))
+		}
+	}
+}
+
+// journalLocation returns the location of the journal of a Group commit next to the file at location.
+func journalLocation(location string) string {
+	return location + ".group.journal"
+}
+
+// finishGroupCommit finishes or discards a commit of a Group that was interrupted,
+// if the store at location belongs to it. The commit is finished if the journals of all stores are complete,
+// since the crash happened while the staged files replaced their locations or the journals were removed.
+// Otherwise the crash happened while the journals were written, and the staged files are discarded.
+// Stores loaded read-only leave the files as they are.
+func finishGroupCommit(location string, o storeOptions) error {
+	if o.readOnly() {
+		return nil
+	}
+	fsys := o.files()
+	readJournal := func(location string) (groupJournal, bool) {
+		var journal groupJournal
+		f, err := fsys.Open(location)
+		if err != nil {
+			return journal, false
+		}
+		defer f.Close()
+		return journal, json.NewDecoder(f).Decode(&journal) == nil
+	}
+	exists := func(location string) (bool, error) {
+		f, err := fsys.Open(location)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return false, nil
+			}
+			return false, errors.Join(fmt.Errorf("failed to open file '%s'", location), err)
+		}
+		return true, f.Close()
+	}
+	own := journalLocation(location)
+	if ok, err := exists(own); err != nil || !ok {
+		if err == nil {
+			// A staged file without a journal is left from a save that never reached its commit
+			removeStaged(fsys, location)
+		}
+		return err
+	}
+	journal, ok := readJournal(own)
+	complete := ok
+	for _, other := range journal.Journals {
+		if j, ok := readJournal(other); !ok || !slices.Equal(j.Files, journal.Files) {
+			complete = false
+		}
+	}
+	if !ok {
+		removeStaged(fsys, location)
+	}
+	for _, f := range journal.Files {
+		if ok, err := exists(f.Tmp); err != nil {
+			return err
+		} else if !ok {
+			continue
+		}
+		if !complete {
+			_ = fsys.Remove(f.Tmp)
+		} else if err := fsys.Rename(f.Tmp, f.Location); err != nil {
+			return errors.Join(fmt.Errorf("failed to finish group commit, unable to replace file '%s'", f.Location), err)
+		}
+	}
+	for _, other := range journal.Journals {
+		_ = fsys.Remove(other)
+	}
+	if err := fsys.Remove(own); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// abort removes all staged files, keeping the previous files.
+func (st *staging) abort() {
+	st.mut.Lock()
+	defer st.mut.Unlock()
+	for _, f := range st.files {
+		_ = f.fsys.Remove(f.tmp)
+	}
+}
@@ -0,0 +1,301 @@
+package speicher
+
+import (
+	"container/heap"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+type (
+	// memoryHeap is a Heap implementation that keeps all elements in memory.
+	memoryHeap[T any] struct {
+		id       storeID
+		data     heapSlice[T]
+		location string
+		codec    codec
+		opts     storeOptions
+		mut      sync.RWMutex
+
+		timerMut     sync.Mutex
+		saveTimer    *time.Timer
+		maxSaveTimer *time.Timer
+		saveOnce     *sync.Once
+	}
+
+	// heapSlice is a binary min-heap ordered by less, implementing heap.Interface.
+	heapSlice[T any] struct {
+		values []T
+		less   func(a, b T) bool
+	}
+
+	// Heap is a thread-safe, persistent priority queue that orders its elements with a less function,
+	// for example to schedule tasks by timestamp.
+	// Push and PopMin take logarithmic time; PeekMax and PopMax look at every other element.
+	//
+	// All operations require appropriate locking via a State object:
+	//
+	//	s := speicher.NewState()
+	//	s.Lock(tasks)
+	//	next, ok := tasks.PopMin()
+	//	s.Unlock(tasks)
+	Heap[T any] interface {
+		lockable
+
+		// Push adds the value to the Heap.
+		// Requires a write lock.
+		Push(value T)
+
+		// PopMin removes and returns the smallest element of the Heap.
+		// If several elements are equally small, any of them is returned.
+		// If the Heap is empty, the bool result will be false.
+		// Requires a write lock.
+		PopMin() (value T, found bool)
+
+		// PopMax removes and returns the largest element of the Heap.
+		// If several elements are equally large, any of them is returned.
+		// If the Heap is empty, the bool result will be false.
+		// Requires a write lock.
+		PopMax() (value T, found bool)
+
+		// PeekMin returns the smallest element of the Heap without removing it.
+		// If the Heap is empty, the bool result will be false.
+		// Requires at least a read lock.
+		PeekMin() (value T, found bool)
+
+		// PeekMax returns the largest element of the Heap without removing it.
+		// If the Heap is empty, the bool result will be false.
+		// Requires at least a read lock.
+		PeekMax() (value T, found bool)
+
+		// Len returns the number of elements in the Heap.
+		// Requires at least a read lock.
+		Len() int
+
+		// Iterate iterates over the elements of the Heap in no particular order.
+		// Requires at least a read lock.
+		Iterate(yield func(v T) bool)
+
+		// Save persists the current state of the Heap to its underlying data store.
+		// It returns an error if the operation fails.
+		// This method acquires its own read lock internally.
+		Save() error
+
+		// SaveCtx persists the current state of the data store like Save,
+		// but aborts when ctx is cancelled or its deadline passes.
+		// An aborted save removes its temporary files and leaves the previous file intact.
+		// This method acquires its own read lock internally.
+		SaveCtx(ctx context.Context) error
+
+		// Close stops the automatic save and the background goroutines of the store and saves it one last time.
+		// The store must not be used afterwards.
+		// This method acquires its own read lock internally.
+		Close() error
+	}
+)
+
+func (h *heapSlice[T]) Len() int           { return len(h.values) }
+func (h *heapSlice[T]) Less(i, j int) bool { return h.less(h.values[i], h.values[j]) }
+func (h *heapSlice[T]) Swap(i, j int)      { h.values[i], h.values[j] = h.values[j], h.values[i] }
+func (h *heapSlice[T]) Push(x any)         { h.values = append(h.values, x.(T)) }
+
+func (h *heapSlice[T]) Pop() any {
+	last := len(h.values) - 1
+	value := h.values[last]
+	// Clear the slot, so the backing array doesn't keep the value alive
+	var zero T
+	h.values[last] = zero
+	h.values = h.values[:last]
+	return value
+}
+
+// maxIndex returns the index of the largest element, which is one of the leaves of the heap.
+func (h *heapSlice[T]) maxIndex() int {
+	n := len(h.values)
+	i := n / 2
+	for j := i + 1; j < n; j++ {
+		if h.less(h.values[i], h.values[j]) {
+			i = j
+		}
+	}
+	return i
+}
+
+func (h *memoryHeap[T]) Push(value T) {
+	heap.Push(&h.data, value)
+}
+
+func (h *memoryHeap[T]) PopMin() (value T, found bool) {
+	if len(h.data.values) == 0 {
+		return
+	}
+	return heap.Pop(&h.data).(T), true
+}
+
+func (h *memoryHeap[T]) PopMax() (value T, found bool) {
+	if len(h.data.values) == 0 {
+		return
+	}
+	return heap.Remove(&h.data, h.data.maxIndex()).(T), true
+}
+
+func (h *memoryHeap[T]) PeekMin() (value T, found bool) {
+	if len(h.data.values) == 0 {
+		return
+	}
+	return h.data.values[0], true
+}
+
+func (h *memoryHeap[T]) PeekMax() (value T, found bool) {
+	if len(h.data.values) == 0 {
+		return
+	}
+	return h.data.values[h.data.maxIndex()], true
+}
+
+func (h *memoryHeap[T]) Len() int {
+	return len(h.data.values)
+}
+
+func (h *memoryHeap[T]) Iterate(yield func(v T) bool) {
+	for _, value := range h.data.values {
+		if !yield(value) {
+			break
+		}
+	}
+}
+
+func (h *memoryHeap[T]) getStoreID() storeID {
+	return h.id
+}
+
+func (h *memoryHeap[T]) getMutex() *sync.RWMutex {
+	return &h.mut
+}
+
+func (h *memoryHeap[T]) getOptions() *storeOptions {
+	return &h.opts
+}
+
+func (h *memoryHeap[T]) Save() error {
+	return h.SaveCtx(context.Background())
+}
+
+func (h *memoryHeap[T]) SaveCtx(ctx context.Context) error {
+	s := saveState(ctx)
+	s.RLock(h)
+	defer s.RUnlock(h)
+
+	sum := sha256.New()
+	err := h.opts.saveFile(ctx, h.location, func(w io.Writer) error {
+		return h.codec.encode(io.MultiWriter(w, sum), h.data.values)
+	})
+	if err != nil {
+		return errors.Join(fmt.Errorf("failed to write file '%s'", h.location), err)
+	}
+	if err := h.opts.recordHash(h.location, sum.Sum(nil)); err != nil {
+		return errors.Join(fmt.Errorf("failed to update manifest for '%s'", h.location), err)
+	}
+	return nil
+}
+
+func (h *memoryHeap[T]) encodeData(w io.Writer, c codec) error {
+	return c.encode(w, h.data.values)
+}
+
+func (h *memoryHeap[T]) decodedEquals(r io.Reader, c codec) (bool, error) {
+	var data []T
+	if err := c.decode(r, &data); err != nil {
+		return false, err
+	}
+	return sameData(h.data.values, data)
+}
+
+// LoadHeap loads a Heap from location that orders its elements with less.
+// The file holds the elements as a list, so less may change between runs;
+// the elements are reordered when they are loaded.
+// If the file does not exist, an empty Heap is returned.
+func LoadHeap[T any](location string, less func(a, b T) bool, opts ...Option) (Heap[T], error) {
+	options := newStoreOptions(opts)
+	lock, err := lockFile(location, options)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.releaseUnclaimed()
+	c, err := resolveCodec(location, options)
+	if err != nil {
+		return nil, err
+	}
+	if h, err := loadHeapFromFile(location, less, c, options); err != nil {
+		return nil, errors.Join(fmt.Errorf("unable to load heap from file '%s'", location), err)
+	} else {
+		opened(h, location)
+		return h, nil
+	}
+}
+
+func loadHeapFromFile[T any](location string, less func(a, b T) bool, c codec, opts storeOptions) (Heap[T], error) {
+	h := &memoryHeap[T]{
+		id:       newStoreID(),
+		location: location,
+		codec:    c,
+		opts:     opts,
+		data:     heapSlice[T]{values: make([]T, 0), less: less},
+	}
+	f, err := h.opts.openFile(location)
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = h.opts.files().MkdirAll(filepath.Dir(location), 0740)
+			return h, err
+		}
+		return nil, errors.Join(fmt.Errorf("failed to open file '%s' (file exists)", location), err)
+	}
+	defer f.Close()
+	if err := c.decode(h.opts.withProgress(f), &h.data.values); err != nil {
+		return nil, errors.Join(fmt.Errorf("failed to decode file '%s'", location), err)
+	}
+	heap.Init(&h.data)
+	return h, nil
+}
+
+func (h *memoryHeap[T]) getSaveTimer() *time.Timer {
+	h.timerMut.Lock()
+	defer h.timerMut.Unlock()
+	return h.saveTimer
+}
+
+func (h *memoryHeap[T]) setSaveTimer(t *time.Timer) {
+	h.timerMut.Lock()
+	defer h.timerMut.Unlock()
+	h.saveTimer = t
+}
+
+func (h *memoryHeap[T]) getMaxSaveTimer() *time.Timer {
+	h.timerMut.Lock()
+	defer h.timerMut.Unlock()
+	return h.maxSaveTimer
+}
+
+func (h *memoryHeap[T]) setMaxSaveTimer(t *time.Timer) {
+	h.timerMut.Lock()
+	defer h.timerMut.Unlock()
+	h.maxSaveTimer = t
+}
+
+func (h *memoryHeap[T]) getSaveOnce() *sync.Once {
+	h.timerMut.Lock()
+	defer h.timerMut.Unlock()
+	return h.saveOnce
+}
+
+func (h *memoryHeap[T]) setSaveOnce(once *sync.Once) {
+	h.timerMut.Lock()
+	defer h.timerMut.Unlock()
+	h.saveOnce = once
+}
@@ -1,43 +1,203 @@
 package speicher
 
+import "context"
+
 // Store is a common interface for all speicher data stores.
 // Use State.Lock/State.Unlock/State.RLock/State.RUnlock for locking operations.
 type Store interface {
 	lockable
 }
 
+// direct reports whether a helper can lock store through its mutex directly instead of through a State.
+// This skips the bookkeeping of the State, which the helpers don't need since they never lock recursively.
+// Composite stores and locks observed by deadlock detection, statistics or instrumentation still go through a State.
+// Wrapped stores are locked like the store they wrap, see unwrap.
+func direct(store lockable) bool {
+	if _, ok := store.(composite); ok {
+		return false
+	}
+	return !deadlockDetection.Load() && !statsEnabled.Load() && !instrumented.Load()
+}
+
+// lockHelper acquires a write lock on store for a helper.
+// It returns the State holding the lock, or nil if the lock was acquired directly.
+func lockHelper(store lockable) *State {
+	store = unwrap(store)
+	if direct(store) {
+		store.getMutex().Lock()
+		return nil
+	}
+	state := borrowState()
+	state.Lock(store)
+	return state
+}
+
+// unlockHelper releases a write lock acquired with lockHelper.
+func unlockHelper(store lockable, state *State) {
+	store = unwrap(store)
+	if state == nil {
+		flushAudit(store, "")
+		store.getMutex().Unlock()
+		written(store)
+		return
+	}
+	state.Unlock(store)
+	returnState(state)
+}
+
+// rLockHelper acquires a read lock on store for a helper.
+// It returns the State holding the lock, or nil if the lock was acquired directly.
+func rLockHelper(store lockable) *State {
+	store = unwrap(store)
+	if direct(store) {
+		store.getMutex().RLock()
+		return nil
+	}
+	state := borrowState()
+	state.RLock(store)
+	return state
+}
+
+// rUnlockHelper releases a read lock acquired with rLockHelper.
+func rUnlockHelper(store lockable, state *State) {
+	store = unwrap(store)
+	if state == nil {
+		store.getMutex().RUnlock()
+		return
+	}
+	state.RUnlock(store)
+	returnState(state)
+}
+
 // WriteE acquires a write lock on the store, executes f, then releases the lock.
 // Returns the result of f and any error.
 func WriteE[S Store, R any](store S, f func(s S) (R, error)) (R, error) {
-	state := NewState()
-	state.Lock(store)
-	defer state.Unlock(store)
+	state := lockHelper(store)
+	defer unlockHelper(store, state)
 	return f(store)
 }
 
 // Write acquires a write lock on the store, executes f, then releases the lock.
 // Returns the result of f.
 func Write[S Store, R any](store S, f func(s S) R) R {
-	state := NewState()
-	state.Lock(store)
-	defer state.Unlock(store)
+	state := lockHelper(store)
+	defer unlockHelper(store, state)
 	return f(store)
 }
 
 // ReadE acquires a read lock on the store, executes f, then releases the lock.
 // Returns the result of f and any error.
 func ReadE[S Store, R any](store S, f func(s S) (R, error)) (R, error) {
-	state := NewState()
-	state.RLock(store)
-	defer state.RUnlock(store)
+	state := rLockHelper(store)
+	defer rUnlockHelper(store, state)
 	return f(store)
 }
 
 // Read acquires a read lock on the store, executes f, then releases the lock.
 // Returns the result of f.
 func Read[S Store, R any](store S, f func(s S) R) R {
-	state := NewState()
-	state.RLock(store)
-	defer state.RUnlock(store)
+	state := rLockHelper(store)
+	defer rUnlockHelper(store, state)
 	return f(store)
 }
+
+// keyLock returns the store to lock for an operation on key of m:
+// the shard holding key for a ShardedMap, also if it is wrapped, m itself otherwise.
+func keyLock[T any](m Map[T], key string) Store {
+	if s, ok := unwrap(m).(ShardedMap[T]); ok {
+		return s.Shard(key)
+	}
+	return m
+}
+
+// GetKey acquires a read lock on m, returns the element associated with key, then releases the lock.
+// For a ShardedMap, only the shard holding key is locked.
+// Must not be called while the calling goroutine holds a lock on m through a State.
+func GetKey[T any](m Map[T], key string) (T, bool) {
+	store := keyLock(m, key)
+	state := rLockHelper(store)
+	defer rUnlockHelper(store, state)
+	return m.Get(key)
+}
+
+// SetKey acquires a write lock on m, sets the element associated with key, then releases the lock.
+// For a ShardedMap, only the shard holding key is locked.
+// Must not be called while the calling goroutine holds a lock on m through a State.
+func SetKey[T any](m Map[T], key string, value T) {
+	store := keyLock(m, key)
+	state := lockHelper(store)
+	defer unlockHelper(store, state)
+	m.Set(key, value)
+}
+
+// UpdateKey acquires a write lock on m, stores the value returned by fn for key like Map.Update,
+// then releases the lock. Returns the stored value.
+// For a ShardedMap, only the shard holding key is locked.
+// Must not be called while the calling goroutine holds a lock on m through a State.
+func UpdateKey[T any](m Map[T], key string, fn func(old T, exists bool) T) T {
+	store := keyLock(m, key)
+	state := lockHelper(store)
+	defer unlockHelper(store, state)
+	return m.Update(key, fn)
+}
+
+// DeleteKey acquires a write lock on m, removes the element associated with key, then releases the lock.
+// For a ShardedMap, only the shard holding key is locked.
+// Must not be called while the calling goroutine holds a lock on m through a State.
+func DeleteKey[T any](m Map[T], key string) {
+	store := keyLock(m, key)
+	state := lockHelper(store)
+	defer unlockHelper(store, state)
+	m.Delete(key)
+}
+
+// GetKeyContext is like GetKey, but consults the authorization hook of m (see WithAuthz) with key
+// and gives up when ctx is cancelled while waiting for the lock.
+func GetKeyContext[T any](ctx context.Context, m Map[T], key string) (value T, found bool, err error) {
+	if err := Authorize(ctx, m, AccessRead, key); err != nil {
+		return value, false, err
+	}
+	store := unwrap(keyLock(m, key))
+	state := borrowState()
+	defer returnState(state)
+	if err := state.rLockContext(ctx, store); err != nil {
+		return value, false, err
+	}
+	defer state.RUnlock(store)
+	value, found = m.Get(key)
+	return value, found, nil
+}
+
+// SetKeyContext is like SetKey, but consults the authorization hook of m (see WithAuthz) with key
+// and gives up when ctx is cancelled while waiting for the lock.
+// Returns the error of the hook, of ctx or of Map.TrySet.
+func SetKeyContext[T any](ctx context.Context, m Map[T], key string, value T) error {
+	if err := Authorize(ctx, m, AccessWrite, key); err != nil {
+		return err
+	}
+	store := unwrap(keyLock(m, key))
+	state := borrowState()
+	defer returnState(state)
+	if err := state.lockContext(ctx, store); err != nil {
+		return err
+	}
+	defer state.Unlock(store)
+	return m.TrySet(key, value)
+}
+
+// DeleteKeyContext is like DeleteKey, but consults the authorization hook of m (see WithAuthz) with key
+// and gives up when ctx is cancelled while waiting for the lock.
+func DeleteKeyContext[T any](ctx context.Context, m Map[T], key string) error {
+	if err := Authorize(ctx, m, AccessWrite, key); err != nil {
+		return err
+	}
+	store := unwrap(keyLock(m, key))
+	state := borrowState()
+	defer returnState(state)
+	if err := state.lockContext(ctx, store); err != nil {
+		return err
+	}
+	defer state.Unlock(store)
+	m.Delete(key)
+	return nil
+}
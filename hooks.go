@@ -0,0 +1,45 @@
+package speicher
+
+// WithAfterLoad sets a function that is called with the store after it was loaded
+// and after every reload (see WithAutoReload), for example to derive computed fields.
+// fn may read and change the store through its methods as if it held a write lock, but must not lock it.
+// Like reloads, its changes don't trigger an automatic save.
+func WithAfterLoad(fn func(store Store)) Option {
+	return func(o *storeOptions) {
+		o.afterLoad = fn
+	}
+}
+
+// WithBeforeSave sets a function that is called with the store before every save writes its file,
+// whether automatic or not, for example to validate the data or emit metrics.
+// fn is called while the save holds a read lock, so it may read the store but must not change or lock it.
+// Fields that shouldn't be persisted are best excluded from encoding, for example with a `json:"-"` tag.
+func WithBeforeSave(fn func(store Store)) Option {
+	return func(o *storeOptions) {
+		o.beforeSave = fn
+	}
+}
+
+// WithAfterSave sets a function that is called with the store and the result of every save,
+// whether automatic or not, while the save still holds a read lock.
+// fn may read the store but must not change or lock it.
+func WithAfterSave(fn func(store Store, err error)) Option {
+	return func(o *storeOptions) {
+		o.afterSave = fn
+	}
+}
+
+// afterLoaded calls the WithAfterLoad function of store, if any, after it was loaded.
+// Nobody else can access the store yet, so it is not locked.
+func afterLoaded(store lockable) {
+	o := optionsOf(store)
+	if o == nil {
+		return
+	}
+	// Saves only know the options, so they find the store through them
+	o.hooked = store
+	if o.afterLoad != nil {
+		o.afterLoad(store)
+		flushAudit(store, "")
+	}
+}
@@ -0,0 +1,402 @@
+package speicher
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// HandlerFunc handles an HTTP request with the store locked by Handler.
+type HandlerFunc[S Store] func(w http.ResponseWriter, r *http.Request, store S)
+
+// Handler returns an http.Handler that locks store for each request and calls read or write with it.
+// GET, HEAD and OPTIONS requests are served by read with a read lock, all other methods by write with a write lock.
+// If the function for a method is nil, the request is answered with 405 Method Not Allowed.
+//
+//	http.Handle("/users/", speicher.Handler(users,
+//		func(w http.ResponseWriter, r *http.Request, users speicher.Map[User]) {
+//			user, _ := users.Get(r.PathValue("id"))
+//			json.NewEncoder(w).Encode(user)
+//		},
+//		nil,
+//	))
+//
+// Locks are acquired with the request context, so the authorization hook of the store (see WithAuthz) is consulted
+// and requests that are cancelled while waiting for the lock give up; they are answered with 403 Forbidden
+// or 503 Service Unavailable. If read or write panics, the lock is released, the panic is reported
+// like a failed automatic save (see WithSaveErrorHandler) and the request is answered with 500 Internal Server Error
+// if nothing was written yet.
+//
+// If store tracks revisions (see WithRevisions), responses carry its revision in the RevisionHeader,
+// so clients can present the revision returned by a write to a replica of the store in the same header.
+// The replica then waits until it has reached that revision before serving the read (see WaitForRevision),
+// so clients always read their own writes. Invalid revisions are answered with 400 Bad Request.
+func Handler[S Store](store S, read, write HandlerFunc[S]) http.Handler {
+	return handler(store, read, write, nil)
+}
+
+// handler implements Handler. If keyOf is set, the authorization hook is consulted
+// with the key it returns for the request instead of with an empty key.
+func handler[S Store](store S, read, write HandlerFunc[S], keyOf func(r *http.Request) string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reads := r.Method == http.MethodGet || r.Method == http.MethodHead || r.Method == http.MethodOptions
+		handle := write
+		if reads {
+			handle = read
+		}
+		if handle == nil {
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+
+		if header := r.Header.Get(RevisionHeader); header != "" && revisionsOf(store) != nil {
+			rev, err := strconv.ParseUint(header, 10, 64)
+			if err != nil {
+				http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+				return
+			}
+			if err := WaitForRevision(r.Context(), store, rev); err != nil {
+				http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+				return
+			}
+		}
+
+		access, key := AccessWrite, ""
+		if reads {
+			access = AccessRead
+		}
+		if keyOf != nil {
+			key = keyOf(r)
+		}
+		err := Authorize(r.Context(), store, access, key)
+		if err == nil {
+			s := NewState()
+			if reads {
+				if err = s.rLockContext(r.Context(), unwrap(store)); err == nil {
+					defer s.RUnlock(store)
+				}
+			} else if err = s.lockContext(r.Context(), unwrap(store)); err == nil {
+				defer s.Unlock(store)
+			}
+		}
+		if err != nil {
+			lockFailed(w, r)
+			return
+		}
+
+		rw := &responseRecorder{ResponseWriter: w}
+		if revisionsOf(store) != nil {
+			rw.start = func(h http.Header) {
+				h.Set(RevisionHeader, strconv.FormatUint(Revision(store), 10))
+			}
+		}
+		// Deferred after the unlock, so it runs first and the lock is released afterwards
+		defer func() {
+			p := recover()
+			if p == nil {
+				return
+			}
+			if p == http.ErrAbortHandler {
+				panic(p)
+			}
+			err := fmt.Errorf("panic in handler for %s %s: %v", r.Method, r.URL.Path, p)
+			if o := optionsOf(store); o != nil {
+				o.reportError(err)
+			} else {
+				log(err)
+			}
+			if !rw.written {
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			}
+		}()
+		handle(rw, r, store)
+		// Responses without a body are sent after the handler returns, so set their headers while the store is locked
+		rw.started()
+	})
+}
+
+// lockFailed answers a request whose lock couldn't be acquired,
+// either because it was cancelled while waiting or because the authorization hook denied it.
+func lockFailed(w http.ResponseWriter, r *http.Request) {
+	if r.Context().Err() != nil {
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+	} else {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+	}
+}
+
+// responseRecorder remembers whether a response was started.
+type responseRecorder struct {
+	http.ResponseWriter
+	written bool
+	// start is called with the headers before the response is started, if set.
+	start func(h http.Header)
+}
+
+// started marks the response as started, calling start the first time.
+func (w *responseRecorder) started() {
+	if w.written {
+		return
+	}
+	w.written = true
+	if w.start != nil {
+		w.start(w.Header())
+	}
+}
+
+func (w *responseRecorder) WriteHeader(status int) {
+	w.started()
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *responseRecorder) Write(b []byte) (int, error) {
+	w.started()
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the underlying ResponseWriter.
+func (w *responseRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// EntryHandler returns an http.Handler that serves the elements of m as JSON resources,
+// with the key taken from the {key} wildcard of the route:
+//
+//	http.Handle("/users/{key}", speicher.EntryHandler(users))
+//
+// GET and HEAD return the element or 404 Not Found, PUT stores the JSON body (201 Created for a new element,
+// 204 No Content otherwise) and DELETE removes the element (204 No Content or 404 Not Found).
+// Locking and errors are handled like by Handler. The authorization hook of m (see WithAuthz)
+// is consulted with the requested key, so it can allow or deny access to single elements.
+//
+// If m tracks revisions (see WithRevisions), the revision of an element is its ETag.
+// PUT and DELETE honor If-Match, and PUT honors If-None-Match: *, using SetIfRevision,
+// so concurrent editors of the same element get 412 Precondition Failed instead of overwriting each other.
+// Without revisions, elements have no ETag and only If-Match: * matches, for any existing element.
+// PUT bodies larger than 16 MiB are rejected with 413 Request Entity Too Large.
+func EntryHandler[T any](m Map[T]) http.Handler {
+	read := func(w http.ResponseWriter, r *http.Request, m Map[T]) {
+		value, rev, ok := m.GetWithRevision(r.PathValue("key"))
+		if !ok {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+		if rev != 0 {
+			w.Header().Set("ETag", formatETag(rev))
+			if matchETag(r.Header.Get("If-None-Match"), rev) {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method == http.MethodHead {
+			return
+		}
+		_ = json.NewEncoder(w).Encode(value)
+	}
+	write := func(w http.ResponseWriter, r *http.Request, m Map[T]) {
+		key := r.PathValue("key")
+		_, rev, exists := m.GetWithRevision(key)
+		if ifMatch := r.Header.Get("If-Match"); ifMatch != "" && (!exists || !matchETag(ifMatch, rev)) {
+			http.Error(w, http.StatusText(http.StatusPreconditionFailed), http.StatusPreconditionFailed)
+			return
+		}
+		switch r.Method {
+		case http.MethodPut:
+			if strings.TrimSpace(r.Header.Get("If-None-Match")) == "*" && exists {
+				http.Error(w, http.StatusText(http.StatusPreconditionFailed), http.StatusPreconditionFailed)
+				return
+			}
+			var value T
+			if err := json.NewDecoder(r.Body).Decode(&value); err != nil {
+				http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+				return
+			}
+			var err error
+			if revisionsOf(m) != nil {
+				err = m.SetIfRevision(key, value, rev)
+			} else {
+				err = m.TrySet(key, value)
+			}
+			switch {
+			case errors.Is(err, ErrRevisionMismatch):
+				http.Error(w, http.StatusText(http.StatusPreconditionFailed), http.StatusPreconditionFailed)
+				return
+			case errors.Is(err, ErrEntryTooLarge):
+				http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+				return
+			case err != nil:
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				return
+			}
+			if _, rev, _ := m.GetWithRevision(key); rev != 0 {
+				w.Header().Set("ETag", formatETag(rev))
+			}
+			if exists {
+				w.WriteHeader(http.StatusNoContent)
+			} else {
+				w.WriteHeader(http.StatusCreated)
+			}
+		case http.MethodDelete:
+			if !exists {
+				http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+				return
+			}
+			m.Delete(key)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.Header().Set("Allow", "GET, HEAD, PUT, DELETE")
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		}
+	}
+	h := handler(m, read, write, func(r *http.Request) string { return r.PathValue("key") })
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut {
+			// Read the body before locking, so slow clients don't hold up other requests
+			body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxEntryBodySize))
+			if err != nil {
+				status := http.StatusBadRequest
+				var tooLarge *http.MaxBytesError
+				if errors.As(err, &tooLarge) {
+					status = http.StatusRequestEntityTooLarge
+				}
+				http.Error(w, http.StatusText(status), status)
+				return
+			}
+			r.Body = io.NopCloser(bytes.NewReader(body))
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// maxEntryBodySize is the largest PUT body EntryHandler accepts.
+const maxEntryBodySize = 16 << 20
+
+// formatETag returns the ETag of an element with revision rev.
+func formatETag(rev uint64) string {
+	return `"` + strconv.FormatUint(rev, 10) + `"`
+}
+
+// matchETag reports whether the If-Match or If-None-Match header value matches an existing element with revision rev,
+// which is 0 if the Map has no revisions, so only * matches.
+// Weak ETags are compared like strong ones, since revisions change with every change of the element.
+func matchETag(header string, rev uint64) bool {
+	for tag := range strings.SplitSeq(header, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == "*" || rev != 0 && tag == formatETag(rev) {
+			return true
+		}
+	}
+	return false
+}
+
+// streamBatchSize is how many elements StreamHandler encodes per read lock.
+const streamBatchSize = 256
+
+// StreamHandler returns an http.Handler that streams the elements of m as NDJSON
+// in the format written by ExportWhere, for listing large Maps without buffering the whole response.
+// filter is called with every GET or HEAD request to select the elements, for example from query parameters;
+// if it returns an error, the request is answered with 400 Bad Request. A nil filter selects all elements.
+//
+// The keys of the selected elements are collected under a read lock first. Their values are then encoded
+// in small batches under short read locks and written to the client without holding a lock,
+// so a slow client only slows down its own response and never holds up writers of the Map.
+// Elements that are deleted or stop matching in between are left out.
+// The response ends early when the request is cancelled.
+//
+// Collecting the keys counts against the scan limit of m (see WithScanLimit);
+// requests that wait too long for a slot are answered with 503 Service Unavailable.
+// Locking and authorization are handled like by Handler.
+func StreamHandler[T any](m Map[T], filter func(r *http.Request) (func(key string, value T) bool, error)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		match := func(string, T) bool { return true }
+		if filter != nil {
+			f, err := filter(r)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			match = f
+		}
+
+		release, err := acquireScan(r.Context(), m)
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+			return
+		}
+		s := NewState()
+		var keys []string
+		err = func() error {
+			defer release()
+			if err := s.RLockContext(r.Context(), m); err != nil {
+				return err
+			}
+			defer s.RUnlock(m)
+			m.Iterate(func(key string, value T) bool {
+				if match(key, value) {
+					keys = append(keys, key)
+				}
+				return true
+			})
+			return nil
+		}()
+		if err != nil {
+			lockFailed(w, r)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.WriteHeader(http.StatusOK)
+		if r.Method == http.MethodHead {
+			return
+		}
+		rc := http.NewResponseController(w)
+		var buf bytes.Buffer
+		enc := json.NewEncoder(&buf)
+		for len(keys) > 0 {
+			batch := keys[:min(streamBatchSize, len(keys))]
+			keys = keys[len(batch):]
+			err := func() error {
+				if err := s.RLockContext(r.Context(), m); err != nil {
+					return err
+				}
+				defer s.RUnlock(m)
+				for _, key := range batch {
+					value, ok := m.Get(key)
+					if !ok || !match(key, value) {
+						continue
+					}
+					if err := enc.Encode(ndjsonEntry[T]{Key: key, Value: value}); err != nil {
+						return errors.Join(fmt.Errorf("failed to encode value of key '%s'", key), err)
+					}
+				}
+				return nil
+			}()
+			if err != nil {
+				if r.Context().Err() == nil {
+					if o := optionsOf(m); o != nil {
+						o.reportError(err)
+					} else {
+						log(err)
+					}
+				}
+				// The status was sent already, so the response is aborted to tell the client it is incomplete
+				panic(http.ErrAbortHandler)
+			}
+			if _, err := buf.WriteTo(w); err != nil {
+				return
+			}
+			_ = rc.Flush()
+		}
+	})
+}
@@ -0,0 +1,389 @@
+package speicher
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"maps"
+	"math"
+	"math/bits"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultHyperLogLogPrecision is the precision of a HyperLogLog without WithHyperLogLogPrecision.
+	// It uses 16 KiB per key for a standard error of about 0.8%.
+	defaultHyperLogLogPrecision = 14
+	minHyperLogLogPrecision     = 4
+	maxHyperLogLogPrecision     = 18
+)
+
+type (
+	// memoryHyperLogLog is a HyperLogLog implementation that keeps all sketches in memory.
+	memoryHyperLogLog struct {
+		id        storeID
+		precision int
+		sketches  map[string][]byte
+		location  string
+		codec     codec
+		opts      storeOptions
+		mut       sync.RWMutex
+
+		timerMut     sync.Mutex
+		saveTimer    *time.Timer
+		maxSaveTimer *time.Timer
+		saveOnce     *sync.Once
+	}
+
+	// HyperLogLog is a thread-safe data store that estimates the number of distinct members added to each key,
+	// for example unique visitors per page and day, using a fixed amount of memory per key
+	// instead of storing the members themselves.
+	// Estimates have a standard error of 1.04/sqrt(2^precision), see WithHyperLogLogPrecision.
+	//
+	// All operations require appropriate locking via a State object:
+	//
+	//	s := speicher.NewState()
+	//	s.Lock(visitors)
+	//	defer s.Unlock(visitors)
+	//	visitors.Add(page, visitorID)
+	HyperLogLog interface {
+		lockable
+
+		// Add adds member to the members of key.
+		// It returns true if the estimate of key may have changed.
+		// Requires a write lock.
+		Add(key string, member string) bool
+
+		// Estimate returns the estimated number of distinct members added to key.
+		// Requires at least a read lock.
+		Estimate(key string) uint64
+
+		// EstimateUnion returns the estimated number of distinct members added to any of keys.
+		// Requires at least a read lock.
+		EstimateUnion(keys ...string) uint64
+
+		// Merge adds the members of all src keys to dst, so its estimate covers their union.
+		// Requires a write lock.
+		Merge(dst string, src ...string)
+
+		// Delete removes key and its members.
+		// Requires a write lock.
+		Delete(key string)
+
+		// Has checks if any member was added to key.
+		// Requires at least a read lock.
+		Has(key string) bool
+
+		// Keys returns all keys in no particular order.
+		// Requires at least a read lock.
+		Keys() []string
+
+		// Len returns the number of keys.
+		// Requires at least a read lock.
+		Len() int
+
+		// Save persists the current state of the HyperLogLog to its underlying data store.
+		// It returns an error if the operation fails.
+		// This method acquires its own read lock internally.
+		Save() error
+
+		// SaveCtx persists the current state of the data store like Save,
+		// but aborts when ctx is cancelled or its deadline passes.
+		// An aborted save removes its temporary files and leaves the previous file intact.
+		// This method acquires its own read lock internally.
+		SaveCtx(ctx context.Context) error
+
+		// Close stops the automatic save and the background goroutines of the store and saves it one last time.
+		// The store must not be used afterwards.
+		// This method acquires its own read lock internally.
+		Close() error
+	}
+
+	// hyperLogLogFile is the persisted form of a HyperLogLog.
+	hyperLogLogFile struct {
+		Precision int               `json:"precision"`
+		Sketches  map[string][]byte `json:"sketches"`
+	}
+)
+
+// WithHyperLogLogPrecision sets the number of index bits p of the sketches of a new HyperLogLog store,
+// between 4 and 18. Every key uses 2^p bytes for a standard error of 1.04/sqrt(2^p).
+// Existing files keep the precision they were created with.
+// Other stores ignore it.
+func WithHyperLogLogPrecision(p int) Option {
+	return func(o *storeOptions) {
+		o.hllPrecision = p
+	}
+}
+
+// hashMember returns a 64 bit hash of member that is the same in every process.
+func hashMember(member string) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(member))
+	// FNV alone doesn't spread short inputs over the high bits well enough, so finalize it like SplitMix64
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+func (h *memoryHyperLogLog) Add(key string, member string) bool {
+	x := hashMember(member)
+	index := x >> (64 - h.precision)
+	// The guard bit limits the rank if all remaining bits are zero
+	rank := byte(bits.LeadingZeros64(x<<h.precision|1<<(h.precision-1)) + 1)
+	sketch, ok := h.sketches[key]
+	if !ok {
+		sketch = make([]byte, 1<<h.precision)
+		h.sketches[key] = sketch
+	}
+	if sketch[index] >= rank {
+		return false
+	}
+	sketch[index] = rank
+	return true
+}
+
+func (h *memoryHyperLogLog) Estimate(key string) uint64 {
+	return h.EstimateUnion(key)
+}
+
+func (h *memoryHyperLogLog) EstimateUnion(keys ...string) uint64 {
+	var union []byte
+	for _, key := range keys {
+		sketch, ok := h.sketches[key]
+		if !ok {
+			continue
+		}
+		if union == nil {
+			union = slices.Clone(sketch)
+			continue
+		}
+		mergeSketch(union, sketch)
+	}
+	if union == nil {
+		return 0
+	}
+	return estimateSketch(union)
+}
+
+func (h *memoryHyperLogLog) Merge(dst string, src ...string) {
+	for _, key := range src {
+		sketch, ok := h.sketches[key]
+		if !ok || key == dst {
+			continue
+		}
+		if d, ok := h.sketches[dst]; ok {
+			mergeSketch(d, sketch)
+		} else {
+			h.sketches[dst] = slices.Clone(sketch)
+		}
+	}
+}
+
+func (h *memoryHyperLogLog) Delete(key string) {
+	delete(h.sketches, key)
+}
+
+func (h *memoryHyperLogLog) Has(key string) bool {
+	_, ok := h.sketches[key]
+	return ok
+}
+
+func (h *memoryHyperLogLog) Keys() []string {
+	return slices.Collect(maps.Keys(h.sketches))
+}
+
+func (h *memoryHyperLogLog) Len() int {
+	return len(h.sketches)
+}
+
+// mergeSketch sets every register of dst to the maximum of it and the one of src.
+func mergeSketch(dst, src []byte) {
+	for i, r := range src {
+		if r > dst[i] {
+			dst[i] = r
+		}
+	}
+}
+
+// estimateSketch returns the cardinality estimated from the registers of a sketch,
+// using linear counting while many registers are still empty.
+func estimateSketch(sketch []byte) uint64 {
+	m := float64(len(sketch))
+	sum := 0.0
+	zeros := 0
+	for _, r := range sketch {
+		sum += math.Ldexp(1, -int(r))
+		if r == 0 {
+			zeros++
+		}
+	}
+	alpha := 0.7213 / (1 + 1.079/m)
+	estimate := alpha * m * m / sum
+	if estimate <= 2.5*m && zeros > 0 {
+		estimate = m * math.Log(m/float64(zeros))
+	}
+	return uint64(estimate + 0.5)
+}
+
+func (h *memoryHyperLogLog) getStoreID() storeID {
+	return h.id
+}
+
+func (h *memoryHyperLogLog) getMutex() *sync.RWMutex {
+	return &h.mut
+}
+
+func (h *memoryHyperLogLog) getOptions() *storeOptions {
+	return &h.opts
+}
+
+func (h *memoryHyperLogLog) Save() error {
+	return h.SaveCtx(context.Background())
+}
+
+func (h *memoryHyperLogLog) SaveCtx(ctx context.Context) error {
+	s := saveState(ctx)
+	s.RLock(h)
+	defer s.RUnlock(h)
+
+	sum := sha256.New()
+	err := h.opts.saveFile(ctx, h.location, func(w io.Writer) error {
+		return h.encodeData(io.MultiWriter(w, sum), h.codec)
+	})
+	if err != nil {
+		return errors.Join(fmt.Errorf("failed to write file '%s'", h.location), err)
+	}
+	if err := h.opts.recordHash(h.location, sum.Sum(nil)); err != nil {
+		return errors.Join(fmt.Errorf("failed to update manifest for '%s'", h.location), err)
+	}
+	return nil
+}
+
+func (h *memoryHyperLogLog) encodeData(w io.Writer, c codec) error {
+	return c.encode(w, hyperLogLogFile{Precision: h.precision, Sketches: h.sketches})
+}
+
+func (h *memoryHyperLogLog) decodedEquals(r io.Reader, c codec) (bool, error) {
+	var file hyperLogLogFile
+	if err := c.decode(r, &file); err != nil {
+		return false, err
+	}
+	return sameData(hyperLogLogFile{Precision: h.precision, Sketches: h.sketches}, file)
+}
+
+// LoadHyperLogLog loads a HyperLogLog from location.
+// If the file does not exist, an empty HyperLogLog is returned.
+func LoadHyperLogLog(location string, opts ...Option) (HyperLogLog, error) {
+	options := newStoreOptions(opts)
+	lock, err := lockFile(location, options)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.releaseUnclaimed()
+	c, err := resolveCodec(location, options)
+	if err != nil {
+		return nil, err
+	}
+	if h, err := loadHyperLogLogFromFile(location, c, options); err != nil {
+		return nil, errors.Join(fmt.Errorf("unable to load hyperloglog from file '%s'", location), err)
+	} else {
+		opened(h, location)
+		return h, nil
+	}
+}
+
+func loadHyperLogLogFromFile(location string, c codec, o storeOptions) (HyperLogLog, error) {
+	h := &memoryHyperLogLog{
+		id:        newStoreID(),
+		precision: defaultHyperLogLogPrecision,
+		location:  location,
+		codec:     c,
+		opts:      o,
+		sketches:  make(map[string][]byte),
+	}
+	if o.hllPrecision != 0 {
+		h.precision = o.hllPrecision
+	}
+	f, err := o.openFile(location)
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = h.checkPrecision()
+			if err == nil {
+				err = o.files().MkdirAll(filepath.Dir(location), 0740)
+			}
+			return h, err
+		}
+		return nil, errors.Join(fmt.Errorf("failed to open file '%s' (file exists)", location), err)
+	}
+	defer f.Close()
+	var file hyperLogLogFile
+	if err := c.decode(f, &file); err != nil {
+		return nil, errors.Join(fmt.Errorf("failed to decode file '%s'", location), err)
+	}
+	h.precision = file.Precision
+	if err := h.checkPrecision(); err != nil {
+		return nil, err
+	}
+	for key, sketch := range file.Sketches {
+		if len(sketch) != 1<<h.precision {
+			return nil, fmt.Errorf("sketch of key '%s' has %d registers instead of %d", key, len(sketch), 1<<h.precision)
+		}
+		h.sketches[key] = sketch
+	}
+	return h, nil
+}
+
+func (h *memoryHyperLogLog) checkPrecision() error {
+	if h.precision < minHyperLogLogPrecision || h.precision > maxHyperLogLogPrecision {
+		return fmt.Errorf("precision %d is not between %d and %d", h.precision, minHyperLogLogPrecision, maxHyperLogLogPrecision)
+	}
+	return nil
+}
+
+func (h *memoryHyperLogLog) getSaveTimer() *time.Timer {
+	h.timerMut.Lock()
+	defer h.timerMut.Unlock()
+	return h.saveTimer
+}
+
+func (h *memoryHyperLogLog) setSaveTimer(t *time.Timer) {
+	h.timerMut.Lock()
+	defer h.timerMut.Unlock()
+	h.saveTimer = t
+}
+
+func (h *memoryHyperLogLog) getMaxSaveTimer() *time.Timer {
+	h.timerMut.Lock()
+	defer h.timerMut.Unlock()
+	return h.maxSaveTimer
+}
+
+func (h *memoryHyperLogLog) setMaxSaveTimer(t *time.Timer) {
+	h.timerMut.Lock()
+	defer h.timerMut.Unlock()
+	h.maxSaveTimer = t
+}
+
+func (h *memoryHyperLogLog) getSaveOnce() *sync.Once {
+	h.timerMut.Lock()
+	defer h.timerMut.Unlock()
+	return h.saveOnce
+}
+
+func (h *memoryHyperLogLog) setSaveOnce(o *sync.Once) {
+	h.timerMut.Lock()
+	defer h.timerMut.Unlock()
+	h.saveOnce = o
+}
@@ -0,0 +1,180 @@
+package speicher
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+type (
+	// ConflictStrategy decides what happens when an imported key already exists in the store.
+	ConflictStrategy int
+
+	// ImportResult describes what happened to a single imported key.
+	ImportResult string
+
+	// ImportOptions configures how entries are imported into a Map.
+	ImportOptions[T any] struct {
+		// Conflict is the strategy used for keys that already exist. Defaults to ConflictSkip.
+		Conflict ConflictStrategy
+		// Merge combines the existing and the incoming value. Required for ConflictMerge.
+		Merge func(key string, existing, incoming T) T
+	}
+
+	// ImportSummary reports the outcome of an import per key.
+	ImportSummary struct {
+		Results map[string]ImportResult
+		// Errors holds why the keys with ImportRejected were not stored.
+		Errors map[string]error
+	}
+
+	// ndjsonEntry is a single line of an NDJSON import.
+	ndjsonEntry[T any] struct {
+		Key   string `json:"key"`
+		Value T      `json:"value"`
+	}
+)
+
+const (
+	// ConflictSkip keeps the existing value and ignores the imported one.
+	ConflictSkip ConflictStrategy = iota
+	// ConflictOverwrite replaces the existing value with the imported one.
+	ConflictOverwrite
+	// ConflictMerge combines both values using ImportOptions.Merge.
+	ConflictMerge
+	// ConflictFail aborts the import without applying any entry.
+	ConflictFail
+)
+
+// Results reported per key in an ImportSummary.
+const (
+	ImportAdded       ImportResult = "added"
+	ImportSkipped     ImportResult = "skipped"
+	ImportOverwritten ImportResult = "overwritten"
+	ImportMerged      ImportResult = "merged"
+	ImportConflict    ImportResult = "conflict"
+	// ImportRejected is reported for values the Map refused to store, like values over WithMaxEntrySize.
+	ImportRejected ImportResult = "rejected"
+	// ImportReplaced is reported by ImportNDJSON for keys that occur on more than one line;
+	// the value of the last line was applied.
+	ImportReplaced ImportResult = "replaced"
+)
+
+// Count returns how many keys had the given result.
+func (s ImportSummary) Count(result ImportResult) int {
+	n := 0
+	for _, r := range s.Results {
+		if r == result {
+			n++
+		}
+	}
+	return n
+}
+
+// ImportEntries imports entries into m using the conflict strategy from opts.
+// With ConflictFail, the import is aborted before any entry is applied if a key already exists;
+// the summary then marks every conflicting key with ImportConflict.
+// Values the Map refuses to store are marked with ImportRejected and their errors are kept in the summary,
+// the other entries are still imported.
+//
+// This function acquires its own write lock on m, so all entries are applied
+// under one lock and trigger a single auto-save.
+func ImportEntries[T any](m Map[T], entries map[string]T, opts ImportOptions[T]) (ImportSummary, error) {
+	return importEntries(m, entries, nil, opts)
+}
+
+// importEntries implements ImportEntries. duplicates holds the keys that occurred more than once in the input.
+func importEntries[T any](m Map[T], entries map[string]T, duplicates map[string]bool, opts ImportOptions[T]) (ImportSummary, error) {
+	summary := ImportSummary{Results: make(map[string]ImportResult, len(entries))}
+	if opts.Conflict == ConflictMerge && opts.Merge == nil {
+		return summary, fmt.Errorf("ConflictMerge requires a Merge function")
+	}
+
+	s := NewState()
+	s.Lock(m)
+	defer s.Unlock(m)
+
+	if opts.Conflict == ConflictFail {
+		for key := range entries {
+			if m.Has(key) {
+				summary.Results[key] = ImportConflict
+			}
+		}
+		if n := len(summary.Results); n > 0 {
+			return summary, fmt.Errorf("import aborted: %d keys already exist", n)
+		}
+		for key := range duplicates {
+			summary.Results[key] = ImportConflict
+		}
+		if n := len(duplicates); n > 0 {
+			return summary, fmt.Errorf("import aborted: %d keys occur more than once", n)
+		}
+	}
+
+	set := func(key string, value T, result ImportResult) {
+		if err := m.TrySet(key, value); err != nil {
+			if summary.Errors == nil {
+				summary.Errors = make(map[string]error)
+			}
+			summary.Errors[key] = err
+			summary.Results[key] = ImportRejected
+			return
+		}
+		if duplicates[key] {
+			result = ImportReplaced
+		}
+		summary.Results[key] = result
+	}
+	for key, value := range entries {
+		existing, exists := m.Get(key)
+		if !exists {
+			set(key, value, ImportAdded)
+			continue
+		}
+		switch opts.Conflict {
+		case ConflictOverwrite:
+			set(key, value, ImportOverwritten)
+		case ConflictMerge:
+			set(key, opts.Merge(key, existing, value), ImportMerged)
+		default:
+			summary.Results[key] = ImportSkipped
+		}
+	}
+	return summary, nil
+}
+
+// ImportNDJSON reads newline-delimited JSON from r and imports it into m.
+// Each line must be an object of the form {"key": "...", "value": ...}, as written by ExportWhere.
+// Conflicts are handled as described for ImportEntries.
+// If a key occurs on more than one line, the last value is imported and the key is marked with ImportReplaced,
+// unless the value was skipped or rejected; with ConflictFail, such keys abort the import like existing keys.
+func ImportNDJSON[T any](m Map[T], r io.Reader, opts ImportOptions[T]) (ImportSummary, error) {
+	entries := make(map[string]T)
+	var duplicates map[string]bool
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var entry ndjsonEntry[T]
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return ImportSummary{}, errors.Join(fmt.Errorf("failed to decode line %d", line), err)
+		}
+		if _, ok := entries[entry.Key]; ok {
+			if duplicates == nil {
+				duplicates = make(map[string]bool)
+			}
+			duplicates[entry.Key] = true
+		}
+		entries[entry.Key] = entry.Value
+	}
+	if err := scanner.Err(); err != nil {
+		return ImportSummary{}, errors.Join(fmt.Errorf("failed to read import data"), err)
+	}
+	return importEntries(m, entries, duplicates, opts)
+}
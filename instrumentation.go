@@ -0,0 +1,129 @@
+package speicher
+
+import (
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// Instrumentation receives measurements of the stores loaded with WithInstrumentation,
+// for example to export them as Prometheus histograms:
+//
+//	type promInstrumentation struct{ lockWait, save *prometheus.HistogramVec }
+//
+//	func (p promInstrumentation) LockWaited(location string, write bool, wait time.Duration) {
+//		p.lockWait.WithLabelValues(location, strconv.FormatBool(write)).Observe(wait.Seconds())
+//	}
+//
+// Its methods are called synchronously, partly while the store is locked,
+// so they must be fast and safe for concurrent use.
+type Instrumentation interface {
+	// LockWaited is called when a lock of the store at location was acquired, with how long it took.
+	LockWaited(location string, write bool, wait time.Duration)
+
+	// LockHeld is called when a lock of the store at location was released, with how long it was held.
+	// Recursive locks of the same State are reported once, when the mutex is released.
+	LockHeld(location string, write bool, held time.Duration)
+
+	// Saved is called after the store at location was saved, with how long writing the file took,
+	// the number of bytes written and the error, if the save failed.
+	// Sidecar files like expiry times are not included.
+	Saved(location string, duration time.Duration, size int64, err error)
+}
+
+// instrumented is set once a store with an Instrumentation is loaded,
+// so locks can't bypass the State bookkeeping that measures them.
+var instrumented atomic.Bool
+
+// WithInstrumentation reports lock wait and hold times and the duration and size of saves of the store to i.
+// Use EntryCount to observe the number of entries, for example from a gauge function.
+func WithInstrumentation(i Instrumentation) Option {
+	return func(o *storeOptions) {
+		o.instrumentation = i
+	}
+}
+
+// EntryCount returns the number of entries of store, like elements of a Map or List or keys of a HyperLogLog.
+// The bool result is false if the store can't report it.
+//
+// This function acquires its own read lock on store.
+func EntryCount(store Store) (int, bool) {
+	c, ok := store.(counted)
+	if !ok {
+		return 0, false
+	}
+	s := borrowState()
+	defer returnState(s)
+	s.RLock(c)
+	defer s.RUnlock(c)
+	return c.entryCount(), true
+}
+
+// locked reports that the mutex of the store was acquired after waiting for wait.
+// Does nothing if st is nil or the store has no Instrumentation.
+func (st *storeStats) locked(ls *lockState, write bool, wait time.Duration) {
+	if st == nil || st.instr == nil {
+		return
+	}
+	ls.since = time.Now()
+	st.instr.LockWaited(st.location, write, wait)
+}
+
+// unlocked reports that the mutex of the store was released.
+// Does nothing if st is nil or the store has no Instrumentation.
+func (st *storeStats) unlocked(ls *lockState, write bool) {
+	if st == nil || st.instr == nil || ls.since.IsZero() {
+		return
+	}
+	st.instr.LockHeld(st.location, write, time.Since(ls.since))
+	ls.since = time.Time{}
+}
+
+// instrumentSave calls save with write and reports the duration and the bytes written to the Instrumentation
+// and the logger set with SetLogger, if any. It also calls the save hooks (see WithBeforeSave and WithAfterSave).
+func (o storeOptions) instrumentSave(location string, write func(w io.Writer) error, save func(write func(w io.Writer) error) error) (err error) {
+	if o.beforeSave != nil && o.hooked != nil {
+		o.beforeSave(o.hooked)
+	}
+	if o.afterSave != nil && o.hooked != nil {
+		defer func() {
+			o.afterSave(o.hooked, err)
+		}()
+	}
+	l := debugLogger()
+	if o.instrumentation == nil && l == nil {
+		return save(write)
+	}
+	start := time.Now()
+	var size int64
+	err = save(func(w io.Writer) error {
+		cw := &countingWriter{w: w}
+		err := write(cw)
+		size = cw.n
+		return err
+	})
+	duration := time.Since(start)
+	if o.instrumentation != nil {
+		o.instrumentation.Saved(location, duration, size, err)
+	}
+	if l != nil {
+		if err != nil {
+			l.Debug("speicher: save failed", "location", location, "duration", duration, "error", err)
+		} else {
+			l.Debug("speicher: store saved", "location", location, "duration", duration, "size", size)
+		}
+	}
+	return err
+}
+
+// countingWriter counts the bytes written to w.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	return n, err
+}
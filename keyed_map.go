@@ -0,0 +1,247 @@
+package speicher
+
+import (
+	"context"
+	"encoding"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+type (
+	// KeyCodec converts the keys of a KeyedMap to and from the string keys of the persisted Map.
+	// Encode must be injective, so that different keys never share a string.
+	KeyCodec[K comparable] struct {
+		Encode func(key K) string
+		Decode func(s string) (K, error)
+	}
+
+	// integer is the set of integer types usable as keys with IntKeys.
+	integer interface {
+		~int | ~int8 | ~int16 | ~int32 | ~int64 | ~uint | ~uint8 | ~uint16 | ~uint32 | ~uint64
+	}
+
+	// keyedMap is a KeyedMap implementation that stores its elements in a memoryMap under encoded keys.
+	keyedMap[K comparable, V any] struct {
+		*memoryMap[V]
+		keys KeyCodec[K]
+	}
+
+	// KeyedMap is a Map with keys of type K instead of string.
+	// Keys are converted with a KeyCodec, so the persisted file is the same as the one of a Map[V].
+	//
+	// All operations require appropriate locking via a State object, like Map:
+	//
+	//	s := speicher.NewState()
+	//	s.Lock(users)
+	//	defer s.Unlock(users)
+	//	users.Set(42, user)
+	KeyedMap[K comparable, V any] interface {
+		lockable
+
+		// Get retrieves an element associated with the given key.
+		// It returns the value and a boolean indicating whether the key exists.
+		// Requires at least a read lock.
+		Get(key K) (V, bool)
+
+		// Find searches for an element that satisfies the given predicate.
+		// It returns the found value and a boolean indicating if a match was found.
+		// Requires at least a read lock.
+		Find(func(V) bool) (value V, found bool)
+
+		// FindAll retrieves all elements that satisfy the given predicate.
+		// Requires at least a read lock.
+		FindAll(func(V) bool) (values []V)
+
+		// Has checks if an element with the given key exists in the data store.
+		// Requires at least a read lock.
+		Has(key K) bool
+
+		// Set adds or updates the element associated with the given key.
+		// Requires a write lock.
+		Set(key K, value V)
+
+		// GetOrSet returns the element associated with the given key.
+		// If the key does not exist, the value returned by create is stored and returned.
+		// Requires a write lock.
+		GetOrSet(key K, create func() V) V
+
+		// Update stores the value returned by fn for the given key and returns it.
+		// fn receives the current value and whether the key exists.
+		// Requires a write lock.
+		Update(key K, fn func(old V, exists bool) V) V
+
+		// SetWithTTL adds or updates the element associated with the given key
+		// and lets it expire after ttl, like Map.SetWithTTL.
+		// Requires a write lock.
+		SetWithTTL(key K, value V, ttl time.Duration)
+
+		// Delete removes the element associated with the given key.
+		// Requires a write lock.
+		Delete(key K)
+
+		// Overwrite replaces the entire data store with the provided map.
+		// Requires a write lock.
+		Overwrite(map[K]V)
+
+		// Iterate iterates over the KeyedMap and calls the provided function for each element.
+		// Requires at least a read lock.
+		Iterate(yield func(key K, value V) bool)
+
+		// Save persists the current state of the data store.
+		// It returns an error if the save operation fails.
+		// This method acquires its own read lock internally.
+		Save() error
+
+		// SaveCtx persists the current state of the data store like Save,
+		// but aborts when ctx is cancelled or its deadline passes.
+		// An aborted save removes its temporary files and leaves the previous file intact.
+		// This method acquires its own read lock internally.
+		SaveCtx(ctx context.Context) error
+
+		// Close stops the automatic save and the background goroutines of the store and saves it one last time.
+		// The store must not be used afterwards.
+		// This method acquires its own read lock internally.
+		Close() error
+	}
+)
+
+// StringKeys returns a KeyCodec for keys with an underlying string type.
+func StringKeys[K ~string]() KeyCodec[K] {
+	return KeyCodec[K]{
+		Encode: func(key K) string {
+			return string(key)
+		},
+		Decode: func(s string) (K, error) {
+			return K(s), nil
+		},
+	}
+}
+
+// IntKeys returns a KeyCodec for integer keys, which are stored in decimal.
+func IntKeys[K integer]() KeyCodec[K] {
+	return KeyCodec[K]{
+		Encode: func(key K) string {
+			if K(0)-1 > 0 {
+				return strconv.FormatUint(uint64(key), 10)
+			}
+			return strconv.FormatInt(int64(key), 10)
+		},
+		Decode: func(s string) (K, error) {
+			if K(0)-1 > 0 {
+				u, err := strconv.ParseUint(s, 10, 64)
+				if err != nil || uint64(K(u)) != u {
+					return 0, fmt.Errorf("invalid key '%s'", s)
+				}
+				return K(u), nil
+			}
+			i, err := strconv.ParseInt(s, 10, 64)
+			if err != nil || int64(K(i)) != i {
+				return 0, fmt.Errorf("invalid key '%s'", s)
+			}
+			return K(i), nil
+		},
+	}
+}
+
+// TextKeys returns a KeyCodec for keys implementing encoding.TextMarshaler and encoding.TextUnmarshaler,
+// like UUID types.
+func TextKeys[K comparable, P interface {
+	*K
+	encoding.TextMarshaler
+	encoding.TextUnmarshaler
+}]() KeyCodec[K] {
+	return KeyCodec[K]{
+		Encode: func(key K) string {
+			text, err := P(&key).MarshalText()
+			if err != nil {
+				panic(fmt.Sprintf("speicher: failed to encode key: %v", err))
+			}
+			return string(text)
+		},
+		Decode: func(s string) (K, error) {
+			var key K
+			err := P(&key).UnmarshalText([]byte(s))
+			return key, err
+		},
+	}
+}
+
+func (m *keyedMap[K, V]) Get(key K) (V, bool) {
+	return m.memoryMap.Get(m.keys.Encode(key))
+}
+
+func (m *keyedMap[K, V]) Has(key K) bool {
+	return m.memoryMap.Has(m.keys.Encode(key))
+}
+
+func (m *keyedMap[K, V]) Set(key K, value V) {
+	m.memoryMap.Set(m.keys.Encode(key), value)
+}
+
+func (m *keyedMap[K, V]) GetOrSet(key K, create func() V) V {
+	return m.memoryMap.GetOrSet(m.keys.Encode(key), create)
+}
+
+func (m *keyedMap[K, V]) Update(key K, fn func(old V, exists bool) V) V {
+	return m.memoryMap.Update(m.keys.Encode(key), fn)
+}
+
+func (m *keyedMap[K, V]) SetWithTTL(key K, value V, ttl time.Duration) {
+	m.memoryMap.SetWithTTL(m.keys.Encode(key), value, ttl)
+}
+
+func (m *keyedMap[K, V]) Delete(key K) {
+	m.memoryMap.Delete(m.keys.Encode(key))
+}
+
+func (m *keyedMap[K, V]) Overwrite(values map[K]V) {
+	data := make(map[string]V, len(values))
+	for key, value := range values {
+		data[m.keys.Encode(key)] = value
+	}
+	m.memoryMap.Overwrite(data)
+}
+
+func (m *keyedMap[K, V]) Iterate(yield func(key K, value V) bool) {
+	for s, value := range m.memoryMap.Iterate {
+		// All keys were validated on load and encoded by the codec afterwards
+		key, _ := m.keys.Decode(s)
+		if !yield(key, value) {
+			break
+		}
+	}
+}
+
+// LoadKeyedMap loads a KeyedMap from location, converting keys with the given KeyCodec.
+// Returns an error if a key in the file can't be decoded.
+// If the file does not exist, an empty KeyedMap is returned.
+func LoadKeyedMap[K comparable, V any](location string, keys KeyCodec[K], opts ...Option) (KeyedMap[K, V], error) {
+	if keys.Encode == nil || keys.Decode == nil {
+		return nil, fmt.Errorf("key codec must have Encode and Decode")
+	}
+	options := newStoreOptions(opts)
+	lock, err := lockFile(location, options)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.releaseUnclaimed()
+	c, err := resolveCodec(location, options)
+	if err != nil {
+		return nil, err
+	}
+	m, err := loadMapFromFile[V](location, c, options)
+	if err != nil {
+		return nil, errors.Join(fmt.Errorf("unable to load keyed map from file '%s'", location), err)
+	}
+	km := &keyedMap[K, V]{memoryMap: m.(*memoryMap[V]), keys: keys}
+	for s := range km.memoryMap.data {
+		if _, err := keys.Decode(s); err != nil {
+			return nil, errors.Join(fmt.Errorf("unable to load keyed map from file '%s'", location), err)
+		}
+	}
+	opened(km, location)
+	startReaper(km, options.reaperInterval)
+	return km, nil
+}
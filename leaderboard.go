@@ -0,0 +1,471 @@
+package speicher
+
+import (
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+type (
+	// memoryLeaderboard is a Leaderboard implementation that keeps all scores in memory,
+	// indexed by a skip list in rank order.
+	memoryLeaderboard struct {
+		id       storeID
+		scores   map[string]float64
+		ranking  *skipList
+		location string
+		codec    codec
+		opts     storeOptions
+		mut      sync.RWMutex
+
+		timerMut     sync.Mutex
+		saveTimer    *time.Timer
+		maxSaveTimer *time.Timer
+		saveOnce     *sync.Once
+	}
+
+	// Leaderboard is a thread-safe data store of scores by key, kept sorted by score
+	// so ranks and the top entries are found without sorting.
+	// Higher scores rank first, equal scores are ordered by key. The first entry has rank 0.
+	// The Leaderboard is persisted as a JSON object of scores by key.
+	//
+	// All operations require appropriate locking via a State object:
+	//
+	//	s := speicher.NewState()
+	//	s.Lock(board)
+	//	defer s.Unlock(board)
+	//	board.SetScore(player, 1200)
+	Leaderboard interface {
+		lockable
+
+		// SetScore sets the score of key, adding it if it doesn't exist.
+		// Scores must be finite, otherwise the Leaderboard can't be saved.
+		// Requires a write lock.
+		SetScore(key string, score float64)
+
+		// AddScore adds delta to the score of key, adding it with a score of delta if it doesn't exist.
+		// It returns the new score.
+		// Requires a write lock.
+		AddScore(key string, delta float64) float64
+
+		// Score returns the score of key.
+		// The bool result is false if key doesn't exist.
+		// Requires at least a read lock.
+		Score(key string) (float64, bool)
+
+		// Remove deletes key from the Leaderboard.
+		// It returns true if key was present.
+		// Requires a write lock.
+		Remove(key string) bool
+
+		// Rank returns the rank of key, 0 for the highest score.
+		// The bool result is false if key doesn't exist.
+		// Requires at least a read lock.
+		Rank(key string) (int, bool)
+
+		// Top returns the n entries with the highest scores in rank order.
+		// Requires at least a read lock.
+		Top(n int) []LeaderboardEntry
+
+		// Range returns the entries with a rank from start up to (excluding) end in rank order.
+		// Requires at least a read lock.
+		Range(start, end int) []LeaderboardEntry
+
+		// Around returns key and up to n entries ranked directly above and below it in rank order.
+		// It returns nil if key doesn't exist.
+		// Requires at least a read lock.
+		Around(key string, n int) []LeaderboardEntry
+
+		// Len returns the number of entries in the Leaderboard.
+		// Requires at least a read lock.
+		Len() int
+
+		// Overwrite replaces the entire Leaderboard with the provided scores.
+		// Requires a write lock.
+		Overwrite(scores map[string]float64)
+
+		// Iterate iterates over the Leaderboard in rank order and calls the provided function for each entry.
+		// Requires at least a read lock.
+		Iterate(yield func(key string, score float64) bool)
+
+		// Save persists the current state of the Leaderboard to its underlying data store.
+		// It returns an error if the operation fails.
+		// This method acquires its own read lock internally.
+		Save() error
+
+		// SaveCtx persists the current state of the data store like Save,
+		// but aborts when ctx is cancelled or its deadline passes.
+		// An aborted save removes its temporary files and leaves the previous file intact.
+		// This method acquires its own read lock internally.
+		SaveCtx(ctx context.Context) error
+
+		// Close stops the automatic save and the background goroutines of the store and saves it one last time.
+		// The store must not be used afterwards.
+		// This method acquires its own read lock internally.
+		Close() error
+	}
+
+	// LeaderboardEntry is an entry of a Leaderboard returned by its queries.
+	LeaderboardEntry struct {
+		Key   string
+		Score float64
+		Rank  int
+	}
+)
+
+func (b *memoryLeaderboard) SetScore(key string, score float64) {
+	if old, ok := b.scores[key]; ok {
+		if old == score {
+			return
+		}
+		b.ranking.remove(key, old)
+	}
+	b.scores[key] = score
+	b.ranking.insert(key, score)
+}
+
+func (b *memoryLeaderboard) AddScore(key string, delta float64) float64 {
+	score := b.scores[key] + delta
+	b.SetScore(key, score)
+	return score
+}
+
+func (b *memoryLeaderboard) Score(key string) (float64, bool) {
+	score, ok := b.scores[key]
+	return score, ok
+}
+
+func (b *memoryLeaderboard) Remove(key string) bool {
+	score, ok := b.scores[key]
+	if !ok {
+		return false
+	}
+	delete(b.scores, key)
+	b.ranking.remove(key, score)
+	return true
+}
+
+func (b *memoryLeaderboard) Rank(key string) (int, bool) {
+	score, ok := b.scores[key]
+	if !ok {
+		return 0, false
+	}
+	return b.ranking.rank(key, score), true
+}
+
+func (b *memoryLeaderboard) Top(n int) []LeaderboardEntry {
+	return b.Range(0, n)
+}
+
+func (b *memoryLeaderboard) Range(start, end int) []LeaderboardEntry {
+	start = max(start, 0)
+	end = min(end, b.ranking.length)
+	if start >= end {
+		return nil
+	}
+	entries := make([]LeaderboardEntry, 0, end-start)
+	for x := b.ranking.byRank(start); x != nil && len(entries) < end-start; x = x.next[0].node {
+		entries = append(entries, LeaderboardEntry{Key: x.key, Score: x.score, Rank: start + len(entries)})
+	}
+	return entries
+}
+
+func (b *memoryLeaderboard) Around(key string, n int) []LeaderboardEntry {
+	rank, ok := b.Rank(key)
+	if !ok {
+		return nil
+	}
+	return b.Range(rank-n, rank+n+1)
+}
+
+func (b *memoryLeaderboard) Len() int {
+	return len(b.scores)
+}
+
+func (b *memoryLeaderboard) Overwrite(scores map[string]float64) {
+	b.scores = make(map[string]float64, len(scores))
+	b.ranking = newSkipList()
+	for key, score := range scores {
+		b.scores[key] = score
+		b.ranking.insert(key, score)
+	}
+}
+
+func (b *memoryLeaderboard) Iterate(yield func(key string, score float64) bool) {
+	for x := b.ranking.head.next[0].node; x != nil; x = x.next[0].node {
+		if !yield(x.key, x.score) {
+			break
+		}
+	}
+}
+
+func (b *memoryLeaderboard) getStoreID() storeID {
+	return b.id
+}
+
+func (b *memoryLeaderboard) getMutex() *sync.RWMutex {
+	return &b.mut
+}
+
+func (b *memoryLeaderboard) getOptions() *storeOptions {
+	return &b.opts
+}
+
+func (b *memoryLeaderboard) Save() error {
+	return b.SaveCtx(context.Background())
+}
+
+func (b *memoryLeaderboard) SaveCtx(ctx context.Context) error {
+	s := saveState(ctx)
+	s.RLock(b)
+	defer s.RUnlock(b)
+
+	h := sha256.New()
+	err := b.opts.saveFile(ctx, b.location, func(w io.Writer) error {
+		return b.codec.encode(io.MultiWriter(w, h), b.scores)
+	})
+	if err != nil {
+		return errors.Join(fmt.Errorf("failed to write file '%s'", b.location), err)
+	}
+	if err := b.opts.recordHash(b.location, h.Sum(nil)); err != nil {
+		return errors.Join(fmt.Errorf("failed to update manifest for '%s'", b.location), err)
+	}
+	return nil
+}
+
+func (b *memoryLeaderboard) encodeData(w io.Writer, c codec) error {
+	return c.encode(w, b.scores)
+}
+
+func (b *memoryLeaderboard) decodedEquals(r io.Reader, c codec) (bool, error) {
+	var scores map[string]float64
+	if err := c.decode(r, &scores); err != nil {
+		return false, err
+	}
+	return sameData(b.scores, scores)
+}
+
+// LoadLeaderboard loads a Leaderboard from location.
+// If the file does not exist, an empty Leaderboard is returned.
+func LoadLeaderboard(location string, opts ...Option) (Leaderboard, error) {
+	options := newStoreOptions(opts)
+	lock, err := lockFile(location, options)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.releaseUnclaimed()
+	c, err := resolveCodec(location, options)
+	if err != nil {
+		return nil, err
+	}
+	if b, err := loadLeaderboardFromFile(location, c, options); err != nil {
+		return nil, errors.Join(fmt.Errorf("unable to load leaderboard from file '%s'", location), err)
+	} else {
+		opened(b, location)
+		return b, nil
+	}
+}
+
+func loadLeaderboardFromFile(location string, c codec, o storeOptions) (Leaderboard, error) {
+	b := &memoryLeaderboard{
+		id:       newStoreID(),
+		location: location,
+		codec:    c,
+		opts:     o,
+		scores:   make(map[string]float64),
+		ranking:  newSkipList(),
+	}
+	f, err := o.openFile(location)
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = o.files().MkdirAll(filepath.Dir(location), 0740)
+			return b, err
+		}
+		return nil, errors.Join(fmt.Errorf("failed to open file '%s' (file exists)", location), err)
+	}
+	defer f.Close()
+	var scores map[string]float64
+	if err := c.decode(f, &scores); err != nil {
+		return nil, errors.Join(fmt.Errorf("failed to decode file '%s'", location), err)
+	}
+	b.Overwrite(scores)
+	return b, nil
+}
+
+func (b *memoryLeaderboard) getSaveTimer() *time.Timer {
+	b.timerMut.Lock()
+	defer b.timerMut.Unlock()
+	return b.saveTimer
+}
+
+func (b *memoryLeaderboard) setSaveTimer(t *time.Timer) {
+	b.timerMut.Lock()
+	defer b.timerMut.Unlock()
+	b.saveTimer = t
+}
+
+func (b *memoryLeaderboard) getMaxSaveTimer() *time.Timer {
+	b.timerMut.Lock()
+	defer b.timerMut.Unlock()
+	return b.maxSaveTimer
+}
+
+func (b *memoryLeaderboard) setMaxSaveTimer(t *time.Timer) {
+	b.timerMut.Lock()
+	defer b.timerMut.Unlock()
+	b.maxSaveTimer = t
+}
+
+func (b *memoryLeaderboard) getSaveOnce() *sync.Once {
+	b.timerMut.Lock()
+	defer b.timerMut.Unlock()
+	return b.saveOnce
+}
+
+func (b *memoryLeaderboard) setSaveOnce(o *sync.Once) {
+	b.timerMut.Lock()
+	defer b.timerMut.Unlock()
+	b.saveOnce = o
+}
+
+// skipListMaxLevel is the number of levels of a skipList, enough for 4^32 entries.
+const skipListMaxLevel = 32
+
+type (
+	// skipList orders entries by descending score and ascending key.
+	// Every link records how many entries it skips, so entries can be found by rank and ranks computed
+	// in logarithmic time.
+	skipList struct {
+		head   *skipNode
+		level  int
+		length int
+	}
+
+	skipNode struct {
+		key   string
+		score float64
+		next  []skipLink
+	}
+
+	skipLink struct {
+		node *skipNode
+		// span is the number of entries between the node holding the link and node, including node.
+		span int
+	}
+)
+
+func newSkipList() *skipList {
+	return &skipList{head: &skipNode{next: make([]skipLink, skipListMaxLevel)}, level: 1}
+}
+
+// before reports whether n is ranked before the entry with the given key and score.
+func (n *skipNode) before(key string, score float64) bool {
+	if c := cmp.Compare(n.score, score); c != 0 {
+		return c > 0
+	}
+	return n.key < key
+}
+
+func (l *skipList) insert(key string, score float64) {
+	var update [skipListMaxLevel]*skipNode
+	var rank [skipListMaxLevel]int
+	x := l.head
+	for i := l.level - 1; i >= 0; i-- {
+		if i < l.level-1 {
+			rank[i] = rank[i+1]
+		}
+		for x.next[i].node != nil && x.next[i].node.before(key, score) {
+			rank[i] += x.next[i].span
+			x = x.next[i].node
+		}
+		update[i] = x
+	}
+
+	level := 1
+	for level < skipListMaxLevel && rand.IntN(4) == 0 {
+		level++
+	}
+	if level > l.level {
+		for i := l.level; i < level; i++ {
+			update[i] = l.head
+			update[i].next[i].span = l.length
+		}
+		l.level = level
+	}
+
+	n := &skipNode{key: key, score: score, next: make([]skipLink, level)}
+	for i := 0; i < level; i++ {
+		n.next[i] = skipLink{node: update[i].next[i].node, span: update[i].next[i].span - (rank[0] - rank[i])}
+		update[i].next[i] = skipLink{node: n, span: rank[0] - rank[i] + 1}
+	}
+	for i := level; i < l.level; i++ {
+		update[i].next[i].span++
+	}
+	l.length++
+}
+
+func (l *skipList) remove(key string, score float64) {
+	var update [skipListMaxLevel]*skipNode
+	x := l.head
+	for i := l.level - 1; i >= 0; i-- {
+		for x.next[i].node != nil && x.next[i].node.before(key, score) {
+			x = x.next[i].node
+		}
+		update[i] = x
+	}
+	x = x.next[0].node
+	if x == nil || x.key != key {
+		return
+	}
+	for i := 0; i < l.level; i++ {
+		if update[i].next[i].node == x {
+			update[i].next[i] = skipLink{node: x.next[i].node, span: update[i].next[i].span + x.next[i].span - 1}
+		} else {
+			update[i].next[i].span--
+		}
+	}
+	for l.level > 1 && l.head.next[l.level-1].node == nil {
+		l.level--
+	}
+	l.length--
+}
+
+// rank returns the 0-based rank of the entry with the given key and score, which must exist.
+func (l *skipList) rank(key string, score float64) int {
+	rank := 0
+	x := l.head
+	for i := l.level - 1; i >= 0; i-- {
+		for x.next[i].node != nil && (x.next[i].node.before(key, score) || x.next[i].node.key == key) {
+			rank += x.next[i].span
+			x = x.next[i].node
+		}
+		if x.key == key && x != l.head {
+			return rank - 1
+		}
+	}
+	return rank - 1
+}
+
+// byRank returns the entry with the given 0-based rank, or nil if there is none.
+func (l *skipList) byRank(rank int) *skipNode {
+	traversed := 0
+	x := l.head
+	for i := l.level - 1; i >= 0; i-- {
+		for x.next[i].node != nil && traversed+x.next[i].span <= rank+1 {
+			traversed += x.next[i].span
+			x = x.next[i].node
+		}
+		if traversed == rank+1 {
+			return x
+		}
+	}
+	return nil
+}
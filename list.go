@@ -1,12 +1,16 @@
 package speicher
 
 import (
-	"encoding/json"
+	"context"
+	"crypto/sha256"
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
-	"strings"
+	"slices"
+	"sort"
+	"strconv"
 	"sync"
 	"time"
 )
@@ -17,6 +21,12 @@ type (
 		id       storeID
 		data     []T
 		location string
+		codec    codec
+		opts     storeOptions
+		segments *listSegments
+		ids      *listIDs
+		unique   map[any]int // counts the elements by value for WithUniqueIndex, nil until it is needed
+		changes  changeFeed[T]
 		mut      sync.RWMutex
 
 		timerMut     sync.Mutex
@@ -52,10 +62,44 @@ type (
 		// Requires at least a read lock.
 		FindAll(func(T) bool) (values []T)
 
+		// Query returns a Query over the elements of the List to filter, sort and paginate them.
+		// Requires at least a read lock while the Query runs.
+		Query() *Query[T]
+
+		// IDOf returns the stable ID of the element at the specified index (see WithElementIDs).
+		// If the index is out of bounds or the List has no element IDs, the bool result will be false.
+		// Requires at least a read lock.
+		IDOf(index int) (id uint64, found bool)
+
+		// IndexOfID returns the current index of the element with the given stable ID.
+		// If no element has the ID, the bool result will be false.
+		// Requires at least a read lock.
+		IndexOfID(id uint64) (index int, found bool)
+
+		// GetByID returns the element with the given stable ID.
+		// If no element has the ID, the bool result will be false.
+		// Requires at least a read lock.
+		GetByID(id uint64) (value T, found bool)
+
+		// RemoveByID deletes the element with the given stable ID, moving later elements forward.
+		// It returns false if no element has the ID.
+		// Requires a write lock.
+		RemoveByID(id uint64) bool
+
 		// Append adds the provided value to the end of the List.
 		// Requires a write lock.
 		Append(value T)
 
+		// TryAppend adds the value like Append, but returns an error instead of reporting it
+		// if the value exceeds the limit set with WithMaxEntrySize and is rejected.
+		// Requires a write lock.
+		TryAppend(value T) error
+
+		// AppendMany adds all values to the end of the List like Append, in order.
+		// Like every other change made under the same write lock, it triggers a single automatic save.
+		// Requires a write lock.
+		AppendMany(values []T)
+
 		// AppendUnique adds the provided value to the List only if no existing element is equal to it,
 		// based on the supplied equality function. It returns true if the value was added,
 		// and false otherwise.
@@ -67,6 +111,43 @@ type (
 		// Requires a write lock.
 		Set(index int, value T) error
 
+		// Insert inserts the provided value at the specified index, moving later elements back.
+		// An index equal to Len appends the value.
+		// If the index is out of bounds, it returns an error.
+		// Requires a write lock.
+		Insert(index int, value T) error
+
+		// InsertSorted inserts the provided value into a List sorted by less, after all elements equal to it,
+		// so the List stays sorted. The List must already be sorted by less, for example with Sort.
+		// Requires a write lock.
+		InsertSorted(value T, less func(a, b T) bool)
+
+		// Sort sorts the elements of the List in place by less, keeping the order of equal elements.
+		// Element IDs (see WithElementIDs) move along with their elements.
+		// Like any other change, it triggers an automatic save, unless the List was already sorted.
+		// Requires a write lock.
+		Sort(less func(a, b T) bool)
+
+		// Remove deletes the element at the specified index, moving later elements forward.
+		// If the index is out of bounds, it returns an error.
+		// Requires a write lock.
+		Remove(index int) error
+
+		// RemoveWhere deletes all elements that satisfy the provided predicate function
+		// and returns how many were removed.
+		// Requires a write lock.
+		RemoveWhere(func(T) bool) int
+
+		// Pop removes and returns the last element of the List.
+		// If the List is empty, the bool result will be false.
+		// Requires a write lock.
+		Pop() (value T, found bool)
+
+		// Shift removes and returns the first element of the List.
+		// If the List is empty, the bool result will be false.
+		// Requires a write lock.
+		Shift() (value T, found bool)
+
 		// Overwrite replaces the entire List with the data provided in the slice.
 		// Requires a write lock.
 		Overwrite([]T)
@@ -86,10 +167,40 @@ type (
 		// Requires at least a read lock.
 		Iterate(yield func(v T) bool)
 
+		// IterateSegments calls the provided function for each segment with its number and elements.
+		// A List without WithSegments is reported as a single segment 0.
+		// The values slice must not be modified or retained.
+		// Requires at least a read lock.
+		IterateSegments(yield func(segment int, values []T) bool)
+
+		// PruneSegments removes the oldest segments so that at most keep segments remain
+		// and returns the number of removed elements. Their files are deleted on the next save.
+		// Does nothing for a List without WithSegments.
+		// Requires a write lock.
+		PruneSegments(keep int) int
+
+		// Watch returns a channel that receives a ChangeEvent for every change of the List.
+		// The Key of an event is the index of the changed element.
+		// Events are delivered in order once the write lock of the change is released.
+		// The channel is closed when ctx is done.
+		// Watch does not require a lock.
+		Watch(ctx context.Context) <-chan ChangeEvent[T]
+
 		// Save persists the current state of the List to its underlying data store.
 		// It returns an error if the operation fails.
 		// This method acquires its own read lock internally.
 		Save() error
+
+		// SaveCtx persists the current state of the data store like Save,
+		// but aborts when ctx is cancelled or its deadline passes.
+		// An aborted save removes its temporary files and leaves the previous file intact.
+		// This method acquires its own read lock internally.
+		SaveCtx(ctx context.Context) error
+
+		// Close stops the automatic save and the background goroutines of the store and saves it one last time.
+		// The store must not be used afterwards.
+		// This method acquires its own read lock internally.
+		Close() error
 	}
 )
 
@@ -104,7 +215,22 @@ func (l *memoryList[T]) Get(index int) (value T, found bool) {
 }
 
 func (l *memoryList[T]) Append(value T) {
+	if err := l.TryAppend(value); err != nil {
+		l.opts.reportError(err)
+	}
+}
+
+func (l *memoryList[T]) TryAppend(value T) error {
+	value, err := limitEntry(&l.opts, strconv.Itoa(len(l.data)), value)
+	if err != nil {
+		return err
+	}
+	l.changes.record(ChangeEvent[T]{Op: ChangeSet, Key: strconv.Itoa(len(l.data)), New: value})
 	l.data = append(l.data, value)
+	l.inserted(len(l.data) - 1)
+	l.indexAdd(value)
+	l.touch(len(l.data) - 1)
+	return nil
 }
 
 func (l *memoryList[T]) AppendUnique(value T, equal func(a, b T) bool) bool {
@@ -113,7 +239,16 @@ func (l *memoryList[T]) AppendUnique(value T, equal func(a, b T) bool) bool {
 			return false
 		}
 	}
+	value, err := limitEntry(&l.opts, strconv.Itoa(len(l.data)), value)
+	if err != nil {
+		l.opts.reportError(err)
+		return false
+	}
+	l.changes.record(ChangeEvent[T]{Op: ChangeSet, Key: strconv.Itoa(len(l.data)), New: value})
 	l.data = append(l.data, value)
+	l.inserted(len(l.data) - 1)
+	l.indexAdd(value)
+	l.touch(len(l.data) - 1)
 	return true
 }
 
@@ -141,12 +276,145 @@ func (l *memoryList[T]) Set(index int, value T) error {
 	if index < 0 || index >= len(l.data) {
 		return fmt.Errorf("index out of range")
 	}
+	value, err := limitEntry(&l.opts, strconv.Itoa(index), value)
+	if err != nil {
+		return err
+	}
+	l.changes.record(ChangeEvent[T]{Op: ChangeSet, Key: strconv.Itoa(index), Old: l.data[index], New: value})
+	l.indexRemove(l.data[index])
+	l.indexAdd(value)
 	l.data[index] = value
+	l.touch(index)
+	return nil
+}
+
+func (l *memoryList[T]) Insert(index int, value T) error {
+	if index < 0 || index > len(l.data) {
+		return fmt.Errorf("index out of range")
+	}
+	value, err := limitEntry(&l.opts, strconv.Itoa(index), value)
+	if err != nil {
+		return err
+	}
+	l.changes.record(ChangeEvent[T]{Op: ChangeInsert, Key: strconv.Itoa(index), New: value})
+	l.data = slices.Insert(l.data, index, value)
+	l.inserted(index)
+	l.indexAdd(value)
+	l.touch(index)
+	return nil
+}
+
+func (l *memoryList[T]) InsertSorted(value T, less func(a, b T) bool) {
+	index := sort.Search(len(l.data), func(i int) bool {
+		return less(value, l.data[i])
+	})
+	if err := l.Insert(index, value); err != nil {
+		l.opts.reportError(err)
+	}
+}
+
+func (l *memoryList[T]) Sort(less func(a, b T) bool) {
+	cmp := func(a, b T) int {
+		if less(a, b) {
+			return -1
+		}
+		if less(b, a) {
+			return 1
+		}
+		return 0
+	}
+	if slices.IsSortedFunc(l.data, cmp) {
+		return
+	}
+	l.changes.record(ChangeEvent[T]{Op: ChangeOverwrite})
+	if l.ids == nil {
+		slices.SortStableFunc(l.data, cmp)
+	} else {
+		// Sort the positions instead of the elements, so the IDs can follow them
+		order := make([]int, len(l.data))
+		for i := range order {
+			order[i] = i
+		}
+		slices.SortStableFunc(order, func(i, j int) int {
+			return cmp(l.data[i], l.data[j])
+		})
+		data := make([]T, len(l.data))
+		ids := make([]uint64, len(l.data))
+		for to, from := range order {
+			data[to] = l.data[from]
+			ids[to] = l.ids.IDs[from]
+		}
+		l.data = data
+		l.ids.IDs = ids
+	}
+	l.touch(0)
+}
+
+func (l *memoryList[T]) Remove(index int) error {
+	if index < 0 || index >= len(l.data) {
+		return fmt.Errorf("index out of range")
+	}
+	l.changes.record(ChangeEvent[T]{Op: ChangeDelete, Key: strconv.Itoa(index), Old: l.data[index]})
+	l.indexRemove(l.data[index])
+	l.data = slices.Delete(l.data, index, index+1)
+	l.removed(index)
+	l.touch(index)
 	return nil
 }
 
+func (l *memoryList[T]) RemoveWhere(f func(T) bool) int {
+	n := 0
+	for i, value := range l.data {
+		if f(value) {
+			// Report indices as they are at the time of each single removal
+			l.changes.record(ChangeEvent[T]{Op: ChangeDelete, Key: strconv.Itoa(i - n), Old: value})
+			l.indexRemove(value)
+			l.touch(i - n)
+			n++
+			continue
+		}
+		l.data[i-n] = value
+		if l.ids != nil {
+			l.ids.IDs[i-n] = l.ids.IDs[i]
+		}
+	}
+	clear(l.data[len(l.data)-n:])
+	l.data = l.data[:len(l.data)-n]
+	if l.ids != nil {
+		l.ids.IDs = l.ids.IDs[:len(l.ids.IDs)-n]
+	}
+	return n
+}
+
+func (l *memoryList[T]) Pop() (value T, found bool) {
+	if len(l.data) == 0 {
+		return
+	}
+	value = l.data[len(l.data)-1]
+	_ = l.Remove(len(l.data) - 1)
+	return value, true
+}
+
+func (l *memoryList[T]) Shift() (value T, found bool) {
+	if len(l.data) == 0 {
+		return
+	}
+	value = l.data[0]
+	_ = l.Remove(0)
+	return value, true
+}
+
 func (l *memoryList[T]) Overwrite(values []T) {
+	if l.segments != nil {
+		for i := range l.segmentCount() {
+			l.segments.stale = append(l.segments.stale, l.segments.first+i)
+		}
+		l.segments.dirtyFrom = 0
+	}
+	l.changes.record(ChangeEvent[T]{Op: ChangeOverwrite})
 	l.data = values
+	l.unique = nil
+	l.renumbered()
 }
 
 func (l *memoryList[T]) Len() int {
@@ -190,6 +458,14 @@ func (l *memoryList[T]) Iterate(yield func(v T) bool) {
 	}
 }
 
+func (l *memoryList[T]) Watch(ctx context.Context) <-chan ChangeEvent[T] {
+	return l.changes.watch(ctx)
+}
+
+func (l *memoryList[T]) publishChanges() {
+	l.changes.publishChanges()
+}
+
 func (l *memoryList[T]) getStoreID() storeID {
 	return l.id
 }
@@ -198,54 +474,122 @@ func (l *memoryList[T]) getMutex() *sync.RWMutex {
 	return &l.mut
 }
 
+func (l *memoryList[T]) getOptions() *storeOptions {
+	return &l.opts
+}
+
 func (l *memoryList[T]) Save() error {
-	s := NewState()
+	return l.SaveCtx(context.Background())
+}
+
+func (l *memoryList[T]) SaveCtx(ctx context.Context) error {
+	s := saveState(ctx)
 	s.RLock(l)
 	defer s.RUnlock(l)
 
-	f, err := os.Create(l.location)
+	if err := l.saveIDs(ctx); err != nil {
+		return err
+	}
+	if l.segments != nil {
+		return l.saveSegments(ctx)
+	}
+
+	h := sha256.New()
+	err := l.opts.saveFile(ctx, l.location, func(w io.Writer) error {
+		return l.codec.encode(io.MultiWriter(w, h), l.data)
+	})
 	if err != nil {
-		return errors.Join(fmt.Errorf("failed to open file '%s'", l.location), err)
+		return errors.Join(fmt.Errorf("failed to write file '%s'", l.location), err)
 	}
-	defer f.Close()
-	encoder := json.NewEncoder(f)
-	if err := encoder.Encode(l.data); err != nil {
-		return errors.Join(fmt.Errorf("failed to encode json file '%s'", l.location), err)
+	if err := l.opts.recordHash(l.location, h.Sum(nil)); err != nil {
+		return errors.Join(fmt.Errorf("failed to update manifest for '%s'", l.location), err)
 	}
 	return nil
 }
 
-func LoadList[T any](location string) (List[T], error) {
-	if strings.HasSuffix(location, ".json") {
-		if l, err := loadListFromJsonFile[T](location); err != nil {
-			return nil, errors.Join(fmt.Errorf("unable to load list from file '%s'", location), err)
-		} else {
-			return l, nil
-		}
+func (l *memoryList[T]) encodeData(w io.Writer, c codec) error {
+	return c.encode(w, l.data)
+}
+
+func (l *memoryList[T]) decodedEquals(r io.Reader, c codec) (bool, error) {
+	var data []T
+	if err := c.decode(r, &data); err != nil {
+		return false, err
+	}
+	return sameData(l.data, data)
+}
+
+func LoadList[T any](location string, opts ...Option) (List[T], error) {
+	options := newStoreOptions(opts)
+	lock, err := lockFile(location, options)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.releaseUnclaimed()
+	c, err := resolveCodec(location, options)
+	if err != nil {
+		return nil, err
+	}
+	if l, err := loadListFromFile[T](location, c, options); err != nil {
+		return nil, errors.Join(fmt.Errorf("unable to load list from file '%s'", location), err)
+	} else {
+		opened(l, location)
+		startAutoReload(l, location, options)
+		return l, nil
 	}
-	return nil, fmt.Errorf("unable to find loader for '%s'", location)
 }
 
-func loadListFromJsonFile[T any](location string) (List[T], error) {
+func loadListFromFile[T any](location string, c codec, o storeOptions) (List[T], error) {
 	l := &memoryList[T]{
 		id:       newStoreID(),
 		location: location,
+		codec:    c,
+		opts:     o,
 		data:     make([]T, 0),
 	}
-	f, err := os.Open(location)
+	if o.segmentSize > 0 {
+		l.segments = &listSegments{size: o.segmentSize}
+		if err := l.loadSegments(); err != nil {
+			return nil, err
+		}
+	} else if err := l.loadData(); err != nil {
+		return nil, err
+	}
+	if o.elementIDs {
+		if err := l.loadIDs(); err != nil {
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+// loadData reads the elements from the unsegmented List file.
+func (l *memoryList[T]) loadData() error {
+	f, err := l.opts.openFile(l.location)
 	if err != nil {
 		if os.IsNotExist(err) {
-			err = os.MkdirAll(filepath.Dir(location), 0740)
-			return l, err
+			return l.opts.files().MkdirAll(filepath.Dir(l.location), 0740)
 		}
-		return nil, errors.Join(fmt.Errorf("failed to open file '%s' (file exists)", location), err)
+		return errors.Join(fmt.Errorf("failed to open file '%s' (file exists)", l.location), err)
 	}
 	defer f.Close()
-	decoder := json.NewDecoder(f)
-	if err := decoder.Decode(&l.data); err != nil {
-		return nil, errors.Join(fmt.Errorf("failed to decode json file '%s'", location), err)
+	r := l.opts.withProgress(f)
+	if canStream(l.codec) {
+		err = streamDecode(l.codec, r, false, func(_ string, decode func(v any) error) error {
+			var value T
+			if err := decode(&value); err != nil {
+				return errors.Join(fmt.Errorf("failed to decode element %d", len(l.data)), err)
+			}
+			l.data = append(l.data, value)
+			return nil
+		})
+	} else {
+		err = l.codec.decode(r, &l.data)
 	}
-	return l, nil
+	if err != nil {
+		return errors.Join(fmt.Errorf("failed to decode file '%s'", l.location), err)
+	}
+	return nil
 }
 
 func (l *memoryList[T]) getSaveTimer() *time.Timer {
@@ -0,0 +1,136 @@
+package speicher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+)
+
+// listIDs holds the stable IDs of the elements of a List, in the order of the elements.
+type listIDs struct {
+	IDs  []uint64 `json:"ids"`
+	Next uint64   `json:"next"`
+}
+
+// WithElementIDs assigns every element of a List a stable ID that is kept when elements before it
+// are inserted or removed, so other stores can reference elements by ID instead of by index.
+// IDs are unique within the List, never reused and persisted in a sidecar file next to the List file.
+// Elements of a List that was saved without IDs are numbered when it is loaded.
+// Other stores ignore it.
+func WithElementIDs() Option {
+	return func(o *storeOptions) {
+		o.elementIDs = true
+	}
+}
+
+// idsLocation returns the location of the sidecar file holding the element IDs of a List.
+func idsLocation(location string) string {
+	return location + ".ids"
+}
+
+// newID returns a new unique ID.
+func (ids *listIDs) newID() uint64 {
+	ids.Next++
+	return ids.Next
+}
+
+// fill assigns new IDs so that there is one for each of n elements.
+func (ids *listIDs) fill(n int) {
+	for len(ids.IDs) < n {
+		ids.IDs = append(ids.IDs, ids.newID())
+	}
+}
+
+// inserted assigns an ID to the element that was inserted at index.
+func (l *memoryList[T]) inserted(index int) {
+	if l.ids != nil {
+		l.ids.IDs = slices.Insert(l.ids.IDs, index, l.ids.newID())
+	}
+}
+
+// removed drops the ID of the element that was removed from index.
+func (l *memoryList[T]) removed(index int) {
+	if l.ids != nil {
+		l.ids.IDs = slices.Delete(l.ids.IDs, index, index+1)
+	}
+}
+
+// renumbered assigns new IDs to all elements after the List was replaced.
+func (l *memoryList[T]) renumbered() {
+	if l.ids != nil {
+		l.ids.IDs = l.ids.IDs[:0]
+		l.ids.fill(len(l.data))
+	}
+}
+
+func (l *memoryList[T]) IDOf(index int) (uint64, bool) {
+	if l.ids == nil || index < 0 || index >= len(l.ids.IDs) {
+		return 0, false
+	}
+	return l.ids.IDs[index], true
+}
+
+func (l *memoryList[T]) IndexOfID(id uint64) (int, bool) {
+	if l.ids == nil {
+		return 0, false
+	}
+	i := slices.Index(l.ids.IDs, id)
+	return i, i >= 0
+}
+
+func (l *memoryList[T]) GetByID(id uint64) (value T, found bool) {
+	if i, ok := l.IndexOfID(id); ok {
+		return l.data[i], true
+	}
+	return
+}
+
+func (l *memoryList[T]) RemoveByID(id uint64) bool {
+	i, ok := l.IndexOfID(id)
+	if !ok {
+		return false
+	}
+	_ = l.Remove(i)
+	return true
+}
+
+// saveIDs writes the element IDs next to the List file using the store codec.
+// The caller must hold at least a read lock.
+func (l *memoryList[T]) saveIDs(ctx context.Context) error {
+	if l.ids == nil {
+		return nil
+	}
+	location := idsLocation(l.location)
+	err := l.opts.writeFileContext(ctx, location, func(w io.Writer) error {
+		return l.codec.encode(w, l.ids)
+	})
+	if err != nil {
+		return errors.Join(fmt.Errorf("failed to write file '%s'", location), err)
+	}
+	return nil
+}
+
+// loadIDs reads the element IDs written by saveIDs.
+// If the file is missing or doesn't match the elements, the elements are numbered anew.
+func (l *memoryList[T]) loadIDs() error {
+	l.ids = &listIDs{}
+	location := idsLocation(l.location)
+	f, err := l.opts.files().Open(location)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return errors.Join(fmt.Errorf("failed to open file '%s' (file exists)", location), err)
+		}
+	} else {
+		defer f.Close()
+		if err := l.codec.decode(f, l.ids); err != nil {
+			return errors.Join(fmt.Errorf("failed to decode file '%s'", location), err)
+		}
+	}
+	if len(l.ids.IDs) != len(l.data) {
+		l.renumbered()
+	}
+	return nil
+}
@@ -0,0 +1,256 @@
+package speicher
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// listSegments holds the bookkeeping of a List that is persisted as segments.
+// Segment files are numbered; data[0] is always the first element of segment first.
+type listSegments struct {
+	// size is the maximum number of elements per segment.
+	size int
+	// first is the number of the segment holding the first element in memory.
+	first int
+	// dirtyFrom is the index of the first element changed since the last save.
+	dirtyFrom int
+	// stale lists segment files that have to be removed on the next save.
+	stale []int
+	// persisted is the number of segment files from first on that exist on disk.
+	persisted int
+	// legacy is true if the List was loaded from a single unsegmented file.
+	legacy bool
+	// mut serializes saves, which only hold a read lock on the List.
+	mut sync.Mutex
+}
+
+// WithSegments persists a List as segments of at most size elements instead of a single file.
+// For a List at "events.json" the segments are written to "events.000000.json", "events.000001.json" and so on.
+// Segments use the same format as the List file, so "events.json.gz" gives "events.000000.json.gz".
+// Save only writes segments that changed since the last save, so appending to a long List
+// only rewrites its last segment. Use PruneSegments to drop old segments.
+// An existing unsegmented file at the location is split into segments on the next save.
+// Only Lists support this option.
+func WithSegments(size int) Option {
+	return func(o *storeOptions) {
+		o.segmentSize = size
+	}
+}
+
+// segmentSuffix returns the file suffix shared by the List file at location and its segments.
+func segmentSuffix(location string) string {
+	if suffix, ok := codecSuffix(location); ok {
+		return suffix
+	}
+	return filepath.Ext(location)
+}
+
+// segmentLocation returns the location of segment n of the List at location.
+func segmentLocation(location string, n int) string {
+	ext := segmentSuffix(location)
+	return fmt.Sprintf("%s.%06d%s", strings.TrimSuffix(location, ext), n, ext)
+}
+
+// segmentNumbers returns the sorted numbers of all segment files of the List at location.
+func segmentNumbers(fsys FileSystem, location string) ([]int, error) {
+	ext := segmentSuffix(location)
+	prefix := strings.TrimSuffix(filepath.Base(location), ext) + "."
+	entries, err := fsys.ReadDir(filepath.Dir(location))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var numbers []int
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, ext) {
+			continue
+		}
+		n, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(name, prefix), ext))
+		if err != nil || n < 0 {
+			continue
+		}
+		numbers = append(numbers, n)
+	}
+	sort.Ints(numbers)
+	return numbers, nil
+}
+
+// touch marks the element at index as changed since the last save.
+func (l *memoryList[T]) touch(index int) {
+	if l.segments != nil && index < l.segments.dirtyFrom {
+		l.segments.dirtyFrom = index
+	}
+}
+
+// segmentCount returns the number of segments the elements in memory occupy.
+func (l *memoryList[T]) segmentCount() int {
+	return (len(l.data) + l.segments.size - 1) / l.segments.size
+}
+
+func (l *memoryList[T]) IterateSegments(yield func(segment int, values []T) bool) {
+	if l.segments == nil {
+		if len(l.data) > 0 {
+			yield(0, l.data)
+		}
+		return
+	}
+	size := l.segments.size
+	for i := 0; i < len(l.data); i += size {
+		if !yield(l.segments.first+i/size, l.data[i:min(i+size, len(l.data))]) {
+			break
+		}
+	}
+}
+
+func (l *memoryList[T]) PruneSegments(keep int) int {
+	if l.segments == nil {
+		return 0
+	}
+	n := l.segmentCount() - max(keep, 0)
+	if n <= 0 {
+		return 0
+	}
+	seg := l.segments
+	for i := range n {
+		seg.stale = append(seg.stale, seg.first+i)
+	}
+	removed := min(n*seg.size, len(l.data))
+	l.changes.record(ChangeEvent[T]{Op: ChangeOverwrite})
+	l.data = slices.Clone(l.data[removed:])
+	l.unique = nil
+	if l.ids != nil {
+		l.ids.IDs = slices.Clone(l.ids.IDs[removed:])
+	}
+	seg.first += n
+	seg.persisted = max(seg.persisted-n, 0)
+	seg.dirtyFrom = max(seg.dirtyFrom-removed, 0)
+	return removed
+}
+
+// saveSegments writes all segments that changed since the last save and removes stale segment files.
+// The caller must hold at least a read lock.
+func (l *memoryList[T]) saveSegments(ctx context.Context) error {
+	seg := l.segments
+	seg.mut.Lock()
+	defer seg.mut.Unlock()
+
+	for i := seg.dirtyFrom / seg.size * seg.size; i < len(l.data); i += seg.size {
+		location := segmentLocation(l.opts.segmentBase(l.location), seg.first+i/seg.size)
+		h := sha256.New()
+		err := l.opts.writeFileContext(ctx, location, func(w io.Writer) error {
+			return l.codec.encode(io.MultiWriter(w, h), l.data[i:min(i+seg.size, len(l.data))])
+		})
+		if err != nil {
+			return errors.Join(fmt.Errorf("failed to write file '%s'", location), err)
+		}
+		if err := l.opts.recordHash(location, h.Sum(nil)); err != nil {
+			return errors.Join(fmt.Errorf("failed to update manifest for '%s'", location), err)
+		}
+	}
+	seg.dirtyFrom = len(l.data)
+
+	// Segments behind the end are left over when elements were removed
+	last := seg.first + l.segmentCount()
+	for n := last; n < seg.first+seg.persisted; n++ {
+		seg.stale = append(seg.stale, n)
+	}
+	seg.persisted = l.segmentCount()
+	for _, n := range seg.stale {
+		if n >= seg.first && n < last {
+			continue
+		}
+		location := segmentLocation(l.opts.segmentBase(l.location), n)
+		if err := l.opts.files().Remove(location); err != nil && !os.IsNotExist(err) {
+			return errors.Join(fmt.Errorf("failed to remove file '%s'", location), err)
+		}
+	}
+	seg.stale = nil
+
+	if seg.legacy {
+		if err := l.opts.files().Remove(l.location); err != nil && !os.IsNotExist(err) {
+			return errors.Join(fmt.Errorf("failed to remove file '%s'", l.location), err)
+		}
+		seg.legacy = false
+	}
+	return nil
+}
+
+// loadSegments reads all segment files of the List.
+// If there are no segments, an existing unsegmented file is read instead.
+// Segments written with a different size are rewritten on the next save.
+func (l *memoryList[T]) loadSegments() error {
+	seg := l.segments
+	if err := l.opts.prepareSegmentDir(); err != nil {
+		return err
+	}
+	numbers, err := segmentNumbers(l.opts.files(), l.opts.segmentBase(l.location))
+	if err != nil {
+		return errors.Join(fmt.Errorf("failed to list segments of '%s'", l.location), err)
+	}
+	if len(numbers) == 0 {
+		f, err := l.opts.files().Open(l.location)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return l.opts.files().MkdirAll(filepath.Dir(l.location), 0740)
+			}
+			return errors.Join(fmt.Errorf("failed to open file '%s' (file exists)", l.location), err)
+		}
+		defer f.Close()
+		if err := l.codec.decode(f, &l.data); err != nil {
+			return errors.Join(fmt.Errorf("failed to decode file '%s'", l.location), err)
+		}
+		seg.legacy = true
+		return nil
+	}
+
+	seg.first = numbers[0]
+	resegment := false
+	for i, n := range numbers {
+		if n != seg.first+i {
+			return fmt.Errorf("segment %d of '%s' is missing", seg.first+i, l.location)
+		}
+		location := segmentLocation(l.opts.segmentBase(l.location), n)
+		values, err := l.loadSegment(location)
+		if err != nil {
+			return err
+		}
+		if i < len(numbers)-1 && len(values) != seg.size || len(values) > seg.size {
+			resegment = true
+		}
+		l.data = append(l.data, values...)
+	}
+	seg.dirtyFrom = len(l.data)
+	seg.persisted = len(numbers)
+	if resegment {
+		seg.dirtyFrom = 0
+		seg.stale = numbers
+	}
+	return nil
+}
+
+// loadSegment decodes a single segment file.
+func (l *memoryList[T]) loadSegment(location string) ([]T, error) {
+	f, err := l.opts.files().Open(location)
+	if err != nil {
+		return nil, errors.Join(fmt.Errorf("failed to open file '%s' (file exists)", location), err)
+	}
+	defer f.Close()
+	var values []T
+	if err := l.codec.decode(f, &values); err != nil {
+		return nil, errors.Join(fmt.Errorf("failed to decode file '%s'", location), err)
+	}
+	return values, nil
+}
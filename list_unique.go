@@ -0,0 +1,58 @@
+package speicher
+
+// WithUniqueIndex makes a List keep an index of its values for AppendUniqueComparable,
+// so checking whether a value is already present doesn't scan the whole List.
+// The index is built on the first call of AppendUniqueComparable and kept up to date by all changes.
+// Other stores ignore it.
+func WithUniqueIndex() Option {
+	return func(o *storeOptions) {
+		o.uniqueIndex = true
+	}
+}
+
+// AppendUniqueComparable adds value to l only if no existing element is equal to it using ==.
+// It returns true if the value was added, and false otherwise.
+// Lists loaded with WithUniqueIndex find existing elements in constant time,
+// others compare value with every element like AppendUnique.
+// Requires a write lock.
+func AppendUniqueComparable[T comparable](l List[T], value T) bool {
+	ml, ok := l.(*memoryList[T])
+	if !ok || !ml.opts.uniqueIndex {
+		return l.AppendUnique(value, func(a, b T) bool {
+			return a == b
+		})
+	}
+	if ml.unique == nil {
+		ml.unique = make(map[any]int, len(ml.data))
+		for _, v := range ml.data {
+			ml.unique[v]++
+		}
+	}
+	if ml.unique[value] > 0 {
+		return false
+	}
+	if err := ml.TryAppend(value); err != nil {
+		ml.opts.reportError(err)
+		return false
+	}
+	return true
+}
+
+// indexAdd records that value was added to the List in the unique index, if it is built.
+func (l *memoryList[T]) indexAdd(value T) {
+	if l.unique != nil {
+		l.unique[value]++
+	}
+}
+
+// indexRemove records that value was removed from the List in the unique index, if it is built.
+func (l *memoryList[T]) indexRemove(value T) {
+	if l.unique == nil {
+		return
+	}
+	if n := l.unique[value]; n > 1 {
+		l.unique[value] = n - 1
+	} else {
+		delete(l.unique, value)
+	}
+}
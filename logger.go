@@ -0,0 +1,36 @@
+package speicher
+
+import (
+	"context"
+	"log/slog"
+	"sync/atomic"
+)
+
+var logger atomic.Pointer[slog.Logger]
+
+// SetLogger makes all stores log what they do to l at debug level: loads, saves and failed saves,
+// lock upgrades and the scheduling of automatic saves, for example to find out why a change wasn't persisted.
+// Pass nil to stop logging, which is the default.
+func SetLogger(l *slog.Logger) {
+	logger.Store(l)
+}
+
+// debugLogger returns the logger set with SetLogger if it logs at debug level, or nil otherwise,
+// so callers can skip collecting attributes nobody reads.
+func debugLogger() *slog.Logger {
+	l := logger.Load()
+	if l == nil || !l.Enabled(context.Background(), slog.LevelDebug) {
+		return nil
+	}
+	return l
+}
+
+// locationOf returns the location an open store was loaded from, or "" if it is not open.
+func locationOf(store lockable) string {
+	openMut.Lock()
+	defer openMut.Unlock()
+	if o, ok := openStores[store.getStoreID()]; ok {
+		return o.location
+	}
+	return ""
+}
@@ -0,0 +1,176 @@
+package speicher
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// manifestName is the file name of the integrity manifest inside a data directory.
+const manifestName = "speicher.manifest"
+
+// manifest records the SHA-256 content hash of every store file in a directory.
+type manifest struct {
+	Files map[string]string `json:"files"`
+}
+
+// manifestMut serializes manifest updates of stores saving into the same directory.
+var manifestMut sync.Mutex
+
+// CreateManifest creates (or replaces) the integrity manifest of a data directory.
+// All store files in dir with a known format are hashed and recorded.
+//
+// Once a directory has a manifest, every save of a store in that directory
+// updates the recorded hash. Use VerifyDirectory to check the files against it.
+func CreateManifest(dir string) error {
+	manifestMut.Lock()
+	defer manifestMut.Unlock()
+
+	files, err := storeFiles(dir)
+	if err != nil {
+		return err
+	}
+	mf := manifest{Files: make(map[string]string, len(files))}
+	for _, name := range files {
+		sum, err := hashFile(filepath.Join(dir, name))
+		if err != nil {
+			return err
+		}
+		mf.Files[name] = sum
+	}
+	return writeManifest(dir, mf)
+}
+
+// VerifyDirectory compares every store file in dir against the integrity manifest.
+// It reports files whose content hash changed, files that are missing,
+// and store files that are not tracked by the manifest.
+// Returns nil if the whole directory matches the manifest.
+func VerifyDirectory(dir string) error {
+	manifestMut.Lock()
+	defer manifestMut.Unlock()
+
+	mf, err := readManifest(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("no manifest found in '%s'", dir)
+		}
+		return err
+	}
+
+	var errs []error
+	names := make([]string, 0, len(mf.Files))
+	for name := range mf.Files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		sum, err := hashFile(filepath.Join(dir, name))
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				errs = append(errs, fmt.Errorf("file '%s' is missing", name))
+				continue
+			}
+			errs = append(errs, err)
+			continue
+		}
+		if sum != mf.Files[name] {
+			errs = append(errs, fmt.Errorf("file '%s' does not match its recorded hash", name))
+		}
+	}
+
+	files, err := storeFiles(dir)
+	if err != nil {
+		return err
+	}
+	for _, name := range files {
+		if _, ok := mf.Files[name]; !ok {
+			errs = append(errs, fmt.Errorf("file '%s' is not tracked by the manifest", name))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// recordHash stores the hash of the file at location in the manifest of its directory.
+// Does nothing if the directory has no manifest.
+func recordHash(location string, sum []byte) error {
+	manifestMut.Lock()
+	defer manifestMut.Unlock()
+
+	dir := filepath.Dir(location)
+	mf, err := readManifest(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if mf.Files == nil {
+		mf.Files = make(map[string]string)
+	}
+	mf.Files[filepath.Base(location)] = hex.EncodeToString(sum)
+	return writeManifest(dir, mf)
+}
+
+func readManifest(dir string) (manifest, error) {
+	var mf manifest
+	f, err := os.Open(filepath.Join(dir, manifestName))
+	if err != nil {
+		return mf, err
+	}
+	defer f.Close()
+	if err := json.NewDecoder(f).Decode(&mf); err != nil {
+		return mf, errors.Join(fmt.Errorf("failed to decode manifest in '%s'", dir), err)
+	}
+	return mf, nil
+}
+
+func writeManifest(dir string, mf manifest) error {
+	location := filepath.Join(dir, manifestName)
+	err := writeFileAtomic(location, func(w io.Writer) error {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(mf)
+	})
+	if err != nil {
+		return errors.Join(fmt.Errorf("failed to write manifest '%s'", location), err)
+	}
+	return nil
+}
+
+// storeFiles returns the names of all files in dir that have a known store format.
+func storeFiles(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, errors.Join(fmt.Errorf("failed to read directory '%s'", dir), err)
+	}
+	var names []string
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		if _, ok := codecFor(e.Name()); ok {
+			names = append(names, e.Name())
+		}
+	}
+	return names, nil
+}
+
+func hashFile(location string) (string, error) {
+	f, err := os.Open(location)
+	if err != nil {
+		return "", errors.Join(fmt.Errorf("failed to open file '%s'", location), err)
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", errors.Join(fmt.Errorf("failed to read file '%s'", location), err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -1,12 +1,14 @@
 package speicher
 
 import (
-	"encoding/json"
+	"context"
+	"crypto/sha256"
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
-	"strings"
+	"reflect"
 	"sync"
 	"time"
 )
@@ -17,7 +19,13 @@ type (
 		id       storeID
 		data     map[string]T
 		location string
-		mut      sync.RWMutex
+		codec    codec
+		opts     storeOptions
+		expires  map[string]time.Time
+		// expiresField is the index of the field of T holding the expiry time of a value, see expiryField.
+		expiresField []int
+		changes      changeFeed[T]
+		mut          sync.RWMutex
 
 		timerMut     sync.Mutex
 		saveTimer    *time.Timer
@@ -42,6 +50,11 @@ type (
 		// Requires at least a read lock.
 		Get(key string) (T, bool)
 
+		// GetMany retrieves the elements associated with the given keys.
+		// Keys that don't exist are missing from the returned map.
+		// Requires at least a read lock.
+		GetMany(keys ...string) map[string]T
+
 		// Find searches for an element that satisfies the given predicate.
 		// It returns the found value and a boolean indicating if a match was found.
 		// Requires at least a read lock.
@@ -52,24 +65,108 @@ type (
 		// Requires at least a read lock.
 		FindAll(func(T) bool) (values []T)
 
+		// Query returns a Query over the values of the Map to filter, sort and paginate them.
+		// Requires at least a read lock while the Query runs.
+		Query() *Query[T]
+
 		// Has checks if an element with the given key exists in the data store.
 		// It returns true if the key exists.
 		// Requires at least a read lock.
 		Has(key string) bool
 
+		// Len returns the number of elements in the Map. Expired elements are not counted.
+		// Requires at least a read lock.
+		Len() int
+
+		// Keys returns the keys of all elements, in no particular order unless the Map keeps one, like an OrderedMap.
+		// Requires at least a read lock.
+		Keys() []string
+
+		// Values returns the values of all elements, in the same kind of order as Keys.
+		// Requires at least a read lock.
+		Values() []T
+
 		// Set adds or updates the element associated with the given key.
-		// If the key already exists, its value is overwritten.
+		// If the key already exists, its value is overwritten and its expiry time is removed.
 		// Requires a write lock.
 		Set(key string, value T)
 
+		// TrySet stores the value like Set, but returns an error instead of reporting it
+		// if the value exceeds the limit set with WithMaxEntrySize and is rejected.
+		// Requires a write lock.
+		TrySet(key string, value T) error
+
+		// SetMany stores all values like Set, for example to import many elements at once.
+		// Like every other change made under the same write lock, it triggers a single automatic save.
+		// Requires a write lock.
+		SetMany(values map[string]T)
+
+		// GetWithRevision returns the element associated with the given key like Get, along with its revision.
+		// The revision changes whenever the element does and is 0 if the element doesn't exist
+		// or the Map was loaded without WithRevisions.
+		// Requires at least a read lock.
+		GetWithRevision(key string) (value T, revision uint64, found bool)
+
+		// SetIfRevision stores the value like TrySet, but only if the element still has the given revision,
+		// as returned by GetWithRevision. A revision of 0 requires that the element doesn't exist.
+		// Otherwise, it returns an error matching ErrRevisionMismatch and leaves the element unchanged.
+		// Returns an error if the Map was loaded without WithRevisions.
+		// Requires a write lock.
+		SetIfRevision(key string, value T, revision uint64) error
+
+		// SetCloned stores a deep copy of value like Set, so the caller keeps no reference to the stored data.
+		// See WithCopyOnRead for how copies are made.
+		// Requires a write lock.
+		SetCloned(key string, value T)
+
+		// GetOrSet returns the element associated with the given key.
+		// If the key does not exist, the value returned by create is stored and returned.
+		// Requires a write lock.
+		GetOrSet(key string, create func() T) T
+
+		// Update stores the value returned by fn for the given key and returns it.
+		// fn receives the current value and whether the key exists.
+		// Requires a write lock.
+		Update(key string, fn func(old T, exists bool) T) T
+
+		// SetWithTTL adds or updates the element associated with the given key
+		// and lets it expire after ttl.
+		// Expired elements are hidden from all read operations and removed by DeleteExpired
+		// or by the background reaper enabled with WithExpiryReaper.
+		// Requires a write lock.
+		SetWithTTL(key string, value T, ttl time.Duration)
+
+		// ExpiresAt returns the expiry time of the element associated with the given key.
+		// Besides SetWithTTL, a value can carry its own expiry time in a time.Time or *time.Time field
+		// tagged `speicher:"expiresAt"`, which is saved, exported and imported along with the value.
+		// A zero or nil time means the value doesn't expire, and SetWithTTL takes precedence.
+		// Disk-backed Maps ignore the tag.
+		// The bool result is false if the element does not expire.
+		// Requires at least a read lock.
+		ExpiresAt(key string) (time.Time, bool)
+
+		// DeleteExpired removes all expired elements and returns how many were removed.
+		// Requires a write lock.
+		DeleteExpired() int
+
 		// Delete removes the element associated with the given key.
 		// Requires a write lock.
 		Delete(key string)
 
+		// DeleteMany removes the elements associated with the given keys.
+		// Requires a write lock.
+		DeleteMany(keys ...string)
+
 		// Overwrite replaces the entire data store with the provided map.
 		// Requires a write lock.
 		Overwrite(map[string]T)
 
+		// Rekey replaces the key of every element with the one fn returns for it, keeping values and expiry times,
+		// for example to migrate from email keys to ID keys. Expired elements are removed.
+		// If fn returns the same key for two elements, an error is returned and the Map is left unchanged.
+		// Requires a write lock.
+		Rekey(fn func(oldKey string, value T) (newKey string)) error
+
 		// RangeKV returns a read-only channel that emits key-value pair elements
 		// (as MapRangeEl) from the data store, along with a cancellation function
 		// to terminate the iteration when desired.
@@ -89,10 +186,27 @@ type (
 		// Requires at least a read lock.
 		Iterate(yield func(key string, value T) bool)
 
+		// Watch returns a channel that receives a ChangeEvent for every change of the Map.
+		// Events are delivered in order once the write lock of the change is released.
+		// The channel is closed when ctx is done.
+		// Watch does not require a lock.
+		Watch(ctx context.Context) <-chan ChangeEvent[T]
+
 		// Save persists the current state of the data store.
 		// It returns an error if the save operation fails.
 		// This method acquires its own read lock internally.
 		Save() error
+
+		// SaveCtx persists the current state of the data store like Save,
+		// but aborts when ctx is cancelled or its deadline passes.
+		// An aborted save removes its temporary files and leaves the previous file intact.
+		// This method acquires its own read lock internally.
+		SaveCtx(ctx context.Context) error
+
+		// Close stops the automatic save and the background goroutines of the store and saves it one last time.
+		// The store must not be used afterwards.
+		// This method acquires its own read lock internally.
+		Close() error
 	}
 
 	// MapRangeEl represents a key-value pair element emitted by the Map's RangeKV method.
@@ -107,7 +221,10 @@ func (m *memoryMap[T]) RangeKV() (<-chan MapRangeEl[T], func()) {
 	// The caller is expected to hold a read lock during this call
 	elements := make([]MapRangeEl[T], 0, len(m.data))
 	for key, value := range m.data {
-		elements = append(elements, MapRangeEl[T]{Key: key, Value: value})
+		if m.isExpired(key) {
+			continue
+		}
+		elements = append(elements, MapRangeEl[T]{Key: key, Value: m.read(value)})
 	}
 
 	ch := make(chan MapRangeEl[T])
@@ -137,8 +254,11 @@ func (m *memoryMap[T]) RangeV() (<-chan T, func()) {
 	// Copy data to a slice to avoid data race with goroutine
 	// The caller is expected to hold a read lock during this call
 	values := make([]T, 0, len(m.data))
-	for _, value := range m.data {
-		values = append(values, value)
+	for key, value := range m.data {
+		if m.isExpired(key) {
+			continue
+		}
+		values = append(values, m.read(value))
 	}
 
 	ch := make(chan T)
@@ -166,22 +286,32 @@ func (m *memoryMap[T]) RangeV() (<-chan T, func()) {
 
 func (m *memoryMap[T]) Iterate(yield func(key string, value T) bool) {
 	for key, value := range m.data {
-		if !yield(key, value) {
+		if m.isExpired(key) {
+			continue
+		}
+		if !yield(key, m.read(value)) {
 			break
 		}
 	}
 }
 
 func (m *memoryMap[T]) Get(key string) (value T, found bool) {
+	if m.isExpired(key) {
+		found = false
+		return
+	}
 	value, found = m.data[key]
-	return
+	return m.read(value), found
 }
 
 func (m *memoryMap[T]) Find(f func(T) bool) (value T, found bool) {
-	for _, value = range m.data {
+	var key string
+	for key, value = range m.data {
+		if m.isExpired(key) {
+			continue
+		}
 		if f(value) {
-			found = true
-			return
+			return m.read(value), true
 		}
 	}
 	found = false
@@ -189,9 +319,12 @@ func (m *memoryMap[T]) Find(f func(T) bool) (value T, found bool) {
 }
 
 func (m *memoryMap[T]) FindAll(f func(T) bool) (values []T) {
-	for _, value := range m.data {
+	for key, value := range m.data {
+		if m.isExpired(key) {
+			continue
+		}
 		if f(value) {
-			values = append(values, value)
+			values = append(values, m.read(value))
 		}
 	}
 	return
@@ -199,19 +332,94 @@ func (m *memoryMap[T]) FindAll(f func(T) bool) (values []T) {
 
 func (m *memoryMap[T]) Has(key string) bool {
 	_, ok := m.data[key]
-	return ok
+	return ok && !m.isExpired(key)
+}
+
+func (m *memoryMap[T]) Len() int {
+	if len(m.expires) == 0 && m.expiresField == nil {
+		return len(m.data)
+	}
+	n := 0
+	for key := range m.data {
+		if !m.isExpired(key) {
+			n++
+		}
+	}
+	return n
+}
+
+func (m *memoryMap[T]) Keys() []string {
+	keys := make([]string, 0, len(m.data))
+	for key := range m.data {
+		if !m.isExpired(key) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+func (m *memoryMap[T]) Values() []T {
+	values := make([]T, 0, len(m.data))
+	for key, value := range m.data {
+		if !m.isExpired(key) {
+			values = append(values, m.read(value))
+		}
+	}
+	return values
 }
 
 func (m *memoryMap[T]) Set(key string, value T) {
+	if err := m.TrySet(key, value); err != nil {
+		m.opts.reportError(err)
+	}
+}
+
+func (m *memoryMap[T]) TrySet(key string, value T) error {
+	value, err := limitEntry(&m.opts, key, value)
+	if err != nil {
+		return err
+	}
+	m.changes.record(ChangeEvent[T]{Op: ChangeSet, Key: key, Old: m.data[key], New: value})
 	m.data[key] = value
+	delete(m.expires, key)
+	return nil
+}
+
+func (m *memoryMap[T]) GetOrSet(key string, create func() T) T {
+	if value, ok := m.Get(key); ok {
+		return value
+	}
+	value := create()
+	m.Set(key, value)
+	return value
+}
+
+func (m *memoryMap[T]) Update(key string, fn func(old T, exists bool) T) T {
+	value := fn(m.Get(key))
+	m.Set(key, value)
+	return value
 }
 
 func (m *memoryMap[T]) Delete(key string) {
+	if old, exists := m.data[key]; exists {
+		m.changes.record(ChangeEvent[T]{Op: ChangeDelete, Key: key, Old: old})
+	}
 	delete(m.data, key)
+	delete(m.expires, key)
 }
 
 func (m *memoryMap[T]) Overwrite(values map[string]T) {
+	m.changes.record(ChangeEvent[T]{Op: ChangeOverwrite})
 	m.data = values
+	m.expires = nil
+}
+
+func (m *memoryMap[T]) Watch(ctx context.Context) <-chan ChangeEvent[T] {
+	return m.changes.watch(ctx)
+}
+
+func (m *memoryMap[T]) publishChanges() {
+	m.changes.publishChanges()
 }
 
 func (m *memoryMap[T]) getStoreID() storeID {
@@ -222,49 +430,105 @@ func (m *memoryMap[T]) getMutex() *sync.RWMutex {
 	return &m.mut
 }
 
+func (m *memoryMap[T]) getOptions() *storeOptions {
+	return &m.opts
+}
+
 func (m *memoryMap[T]) Save() error {
-	s := NewState()
+	return m.SaveCtx(context.Background())
+}
+
+func (m *memoryMap[T]) SaveCtx(ctx context.Context) error {
+	s := saveState(ctx)
 	s.RLock(m)
 	defer s.RUnlock(m)
 
-	f, err := os.Create(m.location)
+	m.verifyChecksums()
+	data, err := m.fileData()
 	if err != nil {
-		return errors.Join(fmt.Errorf("failed to open file '%s'", m.location), err)
+		return errors.Join(fmt.Errorf("failed to encode file '%s'", m.location), err)
 	}
-	defer f.Close()
-	encoder := json.NewEncoder(f)
-	if err := encoder.Encode(m.data); err != nil {
-		return errors.Join(fmt.Errorf("failed to encode json file '%s'", m.location), err)
+	h := sha256.New()
+	err = m.opts.saveFile(ctx, m.location, func(w io.Writer) error {
+		return m.codec.encode(io.MultiWriter(w, h), data)
+	})
+	if err != nil {
+		return errors.Join(fmt.Errorf("failed to write file '%s'", m.location), err)
 	}
-	return nil
+	if err := m.opts.recordHash(m.location, h.Sum(nil)); err != nil {
+		return errors.Join(fmt.Errorf("failed to update manifest for '%s'", m.location), err)
+	}
+	if err := m.saveExpiry(ctx); err != nil {
+		return err
+	}
+	return m.opts.saveRevisions(ctx, m.location, m.codec, m.changes.revs)
+}
+
+func (m *memoryMap[T]) encodeData(w io.Writer, c codec) error {
+	return c.encode(w, m.liveData())
 }
 
-func LoadMap[T any](location string) (Map[T], error) {
-	if strings.HasSuffix(location, ".json") {
-		if m, err := loadMapFromJsonFile[T](location); err != nil {
-			return nil, errors.Join(fmt.Errorf("unable to load map from file '%s'", location), err)
-		} else {
-			return m, nil
+func (m *memoryMap[T]) decodedEquals(r io.Reader, c codec) (bool, error) {
+	var data map[string]T
+	if err := c.decode(r, &data); err != nil {
+		return false, err
+	}
+	// Elements that expired were not written, and expired elements never come back
+	want := make(map[string]T, len(data))
+	for key, value := range m.data {
+		if _, ok := data[key]; ok || !m.isExpired(key) {
+			want[key] = value
 		}
 	}
-	return nil, fmt.Errorf("unable to find loader for '%s'", location)
+	return sameData(want, data)
+}
+
+func LoadMap[T any](location string, opts ...Option) (Map[T], error) {
+	options := newStoreOptions(opts)
+	lock, err := lockFile(location, options)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.releaseUnclaimed()
+	c, err := resolveCodec(location, options)
+	if err != nil {
+		return nil, err
+	}
+	if m, err := loadMapFromFile[T](location, c, options); err != nil {
+		return nil, errors.Join(fmt.Errorf("unable to load map from file '%s'", location), err)
+	} else {
+		opened(m, location)
+		startReaper(m, options.reaperInterval)
+		startAutoReload(m, location, options)
+		return m, nil
+	}
 }
 
-func loadMapFromJsonFile[T any](location string) (Map[T], error) {
-	m := &memoryMap[T]{id: newStoreID(), data: map[string]T{}, location: location}
-	f, err := os.Open(location)
+func loadMapFromFile[T any](location string, c codec, o storeOptions) (Map[T], error) {
+	m := &memoryMap[T]{id: newStoreID(), data: map[string]T{}, location: location, codec: c, opts: o, expiresField: expiryField(reflect.TypeFor[T]())}
+	revs, err := o.loadRevisions(location, c)
+	if err != nil {
+		return nil, err
+	}
+	m.changes.revs = revs
+	f, err := o.openFile(location)
 	if err != nil {
 		if os.IsNotExist(err) {
-			err = os.MkdirAll(filepath.Dir(location), 0740)
+			m.changes.sums = newEntrySums(o, m.data)
+			err = o.files().MkdirAll(filepath.Dir(location), 0740)
 			return m, err
 		}
 		return nil, errors.Join(fmt.Errorf("failed to open file '%s' (but exists)", location), err)
 	}
 	defer f.Close()
-	decoder := json.NewDecoder(f)
-	if err := decoder.Decode(&m.data); err != nil {
-		return nil, errors.Join(fmt.Errorf("failed to decode json file '%s'", location), err)
+	if err := m.decodeData(o.withProgress(f), c); err != nil {
+		return nil, errors.Join(fmt.Errorf("failed to decode file '%s'", location), err)
+	}
+	if err := m.loadExpiry(); err != nil {
+		return nil, err
 	}
+	m.DeleteExpired()
+	m.changes.sums = newEntrySums(o, m.data)
 	return m, nil
 }
 
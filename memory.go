@@ -0,0 +1,72 @@
+package speicher
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"slices"
+)
+
+// discardFileSystem is a FileSystem without files that discards everything written to it.
+type discardFileSystem struct{}
+
+func (discardFileSystem) Open(name string) (io.ReadCloser, error) {
+	return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+}
+
+func (discardFileSystem) Create(string) (io.WriteCloser, error) {
+	return nopWriteCloser{io.Discard}, nil
+}
+
+func (discardFileSystem) Remove(string) error {
+	return nil
+}
+
+func (discardFileSystem) Rename(string, string) error {
+	return nil
+}
+
+func (discardFileSystem) MkdirAll(string, fs.FileMode) error {
+	return nil
+}
+
+func (discardFileSystem) ReadDir(string) ([]fs.DirEntry, error) {
+	return nil, nil
+}
+
+// nopWriteCloser adds a Close method that does nothing to a Writer.
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// inMemory makes a store start empty and discard its saves, with automatic saves disabled.
+func inMemory(opts []Option) []Option {
+	return append(slices.Clone(opts), WithFileSystem(discardFileSystem{}), WithoutAutoSave())
+}
+
+// NewMemoryMap returns an empty Map that is never persisted, for example to test business logic
+// without temporary directories. It behaves like a Map returned by LoadMap and accepts the same options,
+// but Save, SaveCtx and Close succeed without writing anything. Values are still encoded on save,
+// so values that couldn't be persisted make them fail as usual.
+// Close the Map to stop its background goroutines, like the expiry reaper.
+// It panics if opts are invalid, for example an encryption key of the wrong length.
+func NewMemoryMap[T any](opts ...Option) Map[T] {
+	m, err := LoadMap[T]("memory.json", inMemory(opts)...)
+	if err != nil {
+		panic(fmt.Sprintf("speicher: failed to create memory map: %v", err))
+	}
+	return m
+}
+
+// NewMemoryList returns an empty List that is never persisted, like NewMemoryMap.
+func NewMemoryList[T any](opts ...Option) List[T] {
+	l, err := LoadList[T]("memory.json", inMemory(opts)...)
+	if err != nil {
+		panic(fmt.Sprintf("speicher: failed to create memory list: %v", err))
+	}
+	return l
+}
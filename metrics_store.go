@@ -0,0 +1,337 @@
+package speicher
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+type (
+	// MetricBucket holds the values accumulated for one metric during one time bucket.
+	MetricBucket struct {
+		// Start is the beginning of the bucket.
+		Start time.Time
+		// Count is the number of observations.
+		Count int64
+		// Sum is the sum of all observed values. For counters it holds the counter value.
+		Sum float64
+		// Min is the smallest observed value.
+		Min float64
+		// Max is the largest observed value.
+		Max float64
+	}
+
+	// memoryMetrics is a Metrics implementation that keeps all buckets in memory.
+	memoryMetrics struct {
+		id       storeID
+		data     map[string][]MetricBucket
+		bucket   time.Duration
+		location string
+		codec    codec
+		opts     storeOptions
+		mut      sync.RWMutex
+
+		timerMut     sync.Mutex
+		saveTimer    *time.Timer
+		maxSaveTimer *time.Timer
+		saveOnce     *sync.Once
+	}
+
+	// metricsFile is the persisted representation of a Metrics store.
+	metricsFile struct {
+		Bucket  time.Duration             `json:"bucket"`
+		Metrics map[string][]MetricBucket `json:"metrics"`
+	}
+
+	// Metrics is a thread-safe store that accumulates counters and value distributions
+	// per metric name in fixed time buckets, so applications can keep usage statistics
+	// without an external time series database.
+	//
+	// All operations require appropriate locking via a State object:
+	//
+	//	s := speicher.NewState()
+	//	s.Lock(stats)
+	//	defer s.Unlock(stats)
+	//	stats.Observe("request_ms", time.Now(), 12.5)
+	Metrics interface {
+		lockable
+
+		// Inc adds delta to the counter of the named metric in the bucket containing t.
+		// Requires a write lock.
+		Inc(name string, t time.Time, delta float64)
+
+		// Observe records a single value for the named metric in the bucket containing t.
+		// Requires a write lock.
+		Observe(name string, t time.Time, value float64)
+
+		// Query returns the buckets of the named metric that start within [from, to), in chronological order.
+		// Requires at least a read lock.
+		Query(name string, from, to time.Time) []MetricBucket
+
+		// Summary folds all buckets of the named metric that start within [from, to) into one.
+		// Start of the result is from.
+		// Requires at least a read lock.
+		Summary(name string, from, to time.Time) MetricBucket
+
+		// Names returns the sorted names of all metrics.
+		// Requires at least a read lock.
+		Names() []string
+
+		// Prune removes all buckets that started before the given time.
+		// Requires a write lock.
+		Prune(before time.Time)
+
+		// Save persists the current state of the Metrics store.
+		// It returns an error if the operation fails.
+		// This method acquires its own read lock internally.
+		Save() error
+
+		// SaveCtx persists the current state of the data store like Save,
+		// but aborts when ctx is cancelled or its deadline passes.
+		// An aborted save removes its temporary files and leaves the previous file intact.
+		// This method acquires its own read lock internally.
+		SaveCtx(ctx context.Context) error
+
+		// Close stops the automatic save and the background goroutines of the store and saves it one last time.
+		// The store must not be used afterwards.
+		// This method acquires its own read lock internally.
+		Close() error
+	}
+)
+
+// Mean returns the average observed value or 0 if there are no observations.
+func (b MetricBucket) Mean() float64 {
+	if b.Count == 0 {
+		return 0
+	}
+	return b.Sum / float64(b.Count)
+}
+
+// merge folds other into b.
+func (b *MetricBucket) merge(other MetricBucket) {
+	if other.Count == 0 {
+		return
+	}
+	if b.Count == 0 {
+		b.Min, b.Max = other.Min, other.Max
+	} else {
+		b.Min = math.Min(b.Min, other.Min)
+		b.Max = math.Max(b.Max, other.Max)
+	}
+	b.Count += other.Count
+	b.Sum += other.Sum
+}
+
+// bucketAt returns the bucket of the named metric that contains t, creating it if needed.
+func (m *memoryMetrics) bucketAt(name string, t time.Time) *MetricBucket {
+	start := t.Truncate(m.bucket)
+	buckets := m.data[name]
+	i := sort.Search(len(buckets), func(i int) bool {
+		return !buckets[i].Start.Before(start)
+	})
+	if i == len(buckets) || !buckets[i].Start.Equal(start) {
+		buckets = append(buckets, MetricBucket{})
+		copy(buckets[i+1:], buckets[i:])
+		buckets[i] = MetricBucket{Start: start}
+		m.data[name] = buckets
+	}
+	return &m.data[name][i]
+}
+
+func (m *memoryMetrics) Inc(name string, t time.Time, delta float64) {
+	b := m.bucketAt(name, t)
+	b.Count++
+	b.Sum += delta
+}
+
+func (m *memoryMetrics) Observe(name string, t time.Time, value float64) {
+	b := m.bucketAt(name, t)
+	b.merge(MetricBucket{Count: 1, Sum: value, Min: value, Max: value})
+}
+
+func (m *memoryMetrics) Query(name string, from, to time.Time) []MetricBucket {
+	var result []MetricBucket
+	for _, b := range m.data[name] {
+		if !b.Start.Before(from) && b.Start.Before(to) {
+			result = append(result, b)
+		}
+	}
+	return result
+}
+
+func (m *memoryMetrics) Summary(name string, from, to time.Time) MetricBucket {
+	summary := MetricBucket{Start: from}
+	for _, b := range m.Query(name, from, to) {
+		summary.merge(b)
+	}
+	return summary
+}
+
+func (m *memoryMetrics) Names() []string {
+	names := make([]string, 0, len(m.data))
+	for name := range m.data {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (m *memoryMetrics) Prune(before time.Time) {
+	for name, buckets := range m.data {
+		i := sort.Search(len(buckets), func(i int) bool {
+			return !buckets[i].Start.Before(before)
+		})
+		if i == len(buckets) {
+			delete(m.data, name)
+			continue
+		}
+		m.data[name] = buckets[i:]
+	}
+}
+
+func (m *memoryMetrics) getStoreID() storeID {
+	return m.id
+}
+
+func (m *memoryMetrics) getMutex() *sync.RWMutex {
+	return &m.mut
+}
+
+func (m *memoryMetrics) getOptions() *storeOptions {
+	return &m.opts
+}
+
+func (m *memoryMetrics) file() metricsFile {
+	return metricsFile{Bucket: m.bucket, Metrics: m.data}
+}
+
+func (m *memoryMetrics) Save() error {
+	return m.SaveCtx(context.Background())
+}
+
+func (m *memoryMetrics) SaveCtx(ctx context.Context) error {
+	s := saveState(ctx)
+	s.RLock(m)
+	defer s.RUnlock(m)
+
+	h := sha256.New()
+	err := m.opts.saveFile(ctx, m.location, func(w io.Writer) error {
+		return m.codec.encode(io.MultiWriter(w, h), m.file())
+	})
+	if err != nil {
+		return errors.Join(fmt.Errorf("failed to write file '%s'", m.location), err)
+	}
+	if err := m.opts.recordHash(m.location, h.Sum(nil)); err != nil {
+		return errors.Join(fmt.Errorf("failed to update manifest for '%s'", m.location), err)
+	}
+	return nil
+}
+
+func (m *memoryMetrics) encodeData(w io.Writer, c codec) error {
+	return c.encode(w, m.file())
+}
+
+func (m *memoryMetrics) decodedEquals(r io.Reader, c codec) (bool, error) {
+	var data metricsFile
+	if err := c.decode(r, &data); err != nil {
+		return false, err
+	}
+	return sameData(m.file(), data)
+}
+
+// LoadMetrics loads a Metrics store from location that accumulates values in buckets of the given width.
+// If the file was written with a different bucket width, its buckets are kept as they are.
+// If the file does not exist, an empty store is returned.
+func LoadMetrics(location string, bucket time.Duration, opts ...Option) (Metrics, error) {
+	if bucket <= 0 {
+		return nil, fmt.Errorf("bucket width must be positive")
+	}
+	options := newStoreOptions(opts)
+	lock, err := lockFile(location, options)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.releaseUnclaimed()
+	c, err := resolveCodec(location, options)
+	if err != nil {
+		return nil, err
+	}
+	if m, err := loadMetricsFromFile(location, bucket, c, options); err != nil {
+		return nil, errors.Join(fmt.Errorf("unable to load metrics from file '%s'", location), err)
+	} else {
+		opened(m, location)
+		return m, nil
+	}
+}
+
+func loadMetricsFromFile(location string, bucket time.Duration, c codec, o storeOptions) (Metrics, error) {
+	m := &memoryMetrics{
+		id:       newStoreID(),
+		data:     make(map[string][]MetricBucket),
+		bucket:   bucket,
+		location: location,
+		codec:    c,
+		opts:     o,
+	}
+	f, err := o.openFile(location)
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = o.files().MkdirAll(filepath.Dir(location), 0740)
+			return m, err
+		}
+		return nil, errors.Join(fmt.Errorf("failed to open file '%s' (file exists)", location), err)
+	}
+	defer f.Close()
+	var data metricsFile
+	if err := c.decode(f, &data); err != nil {
+		return nil, errors.Join(fmt.Errorf("failed to decode file '%s'", location), err)
+	}
+	if data.Metrics != nil {
+		m.data = data.Metrics
+	}
+	return m, nil
+}
+
+func (m *memoryMetrics) getSaveTimer() *time.Timer {
+	m.timerMut.Lock()
+	defer m.timerMut.Unlock()
+	return m.saveTimer
+}
+
+func (m *memoryMetrics) setSaveTimer(t *time.Timer) {
+	m.timerMut.Lock()
+	defer m.timerMut.Unlock()
+	m.saveTimer = t
+}
+
+func (m *memoryMetrics) getMaxSaveTimer() *time.Timer {
+	m.timerMut.Lock()
+	defer m.timerMut.Unlock()
+	return m.maxSaveTimer
+}
+
+func (m *memoryMetrics) setMaxSaveTimer(t *time.Timer) {
+	m.timerMut.Lock()
+	defer m.timerMut.Unlock()
+	m.maxSaveTimer = t
+}
+
+func (m *memoryMetrics) getSaveOnce() *sync.Once {
+	m.timerMut.Lock()
+	defer m.timerMut.Unlock()
+	return m.saveOnce
+}
+
+func (m *memoryMetrics) setSaveOnce(o *sync.Once) {
+	m.timerMut.Lock()
+	defer m.timerMut.Unlock()
+	m.saveOnce = o
+}
@@ -0,0 +1,129 @@
+package speicher
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// migratable is implemented by stores whose data can be written to another location.
+type migratable interface {
+	lockable
+	encodeData(w io.Writer, c codec) error
+	decodedEquals(r io.Reader, c codec) (bool, error)
+}
+
+// MigrateOptions configures Migrate.
+type MigrateOptions struct {
+	// Overwrite allows replacing an existing file at the destination.
+	Overwrite bool
+	// SkipVerify disables reading the written file back and comparing it to the source data.
+	SkipVerify bool
+	// Options configure the destination format, e.g. WithEncryption to migrate
+	// a plain store into an encrypted one. They must match the options used to load
+	// the destination afterward.
+	Options []Option
+}
+
+// Migrate writes the contents of src to dstLocation using the format that matches
+// the destination file suffix. This converts a store from one format or location to another.
+//
+// The data is written to a temporary file next to dstLocation first. Unless
+// opts.SkipVerify is set, the temporary file is decoded again and compared to the
+// source data. Only after that the temporary file is renamed to dstLocation,
+// so a failed migration never leaves a partially written destination behind.
+//
+// Expired elements are left out, and the expiry times of the others are written to a sidecar file
+// next to dstLocation like a save writes them.
+// The source store is not modified and keeps using its original location.
+// This function acquires its own read lock on src.
+func Migrate(src Store, dstLocation string, opts MigrateOptions) error {
+	store, ok := src.(migratable)
+	if !ok {
+		return fmt.Errorf("store does not support migration")
+	}
+	c, err := resolveCodec(dstLocation, newStoreOptions(opts.Options))
+	if err != nil {
+		return err
+	}
+	if !opts.Overwrite {
+		if _, err := os.Stat(dstLocation); err == nil {
+			return fmt.Errorf("destination '%s' already exists", dstLocation)
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(dstLocation), 0740); err != nil {
+		return errors.Join(fmt.Errorf("failed to create directory for '%s'", dstLocation), err)
+	}
+
+	s := NewState()
+	s.RLock(store)
+	defer s.RUnlock(store)
+
+	tmp, err := os.CreateTemp(filepath.Dir(dstLocation), filepath.Base(dstLocation)+".*.tmp")
+	if err != nil {
+		return errors.Join(fmt.Errorf("failed to create temporary file for '%s'", dstLocation), err)
+	}
+	tmpLocation := tmp.Name()
+	defer os.Remove(tmpLocation)
+
+	h := sha256.New()
+	if err := store.encodeData(io.MultiWriter(tmp, h), c); err != nil {
+		_ = tmp.Close()
+		return errors.Join(fmt.Errorf("failed to encode file '%s'", tmpLocation), err)
+	}
+	if err := tmp.Close(); err != nil {
+		return errors.Join(fmt.Errorf("failed to close file '%s'", tmpLocation), err)
+	}
+
+	if !opts.SkipVerify {
+		f, err := os.Open(tmpLocation)
+		if err != nil {
+			return errors.Join(fmt.Errorf("failed to open file '%s'", tmpLocation), err)
+		}
+		equal, err := store.decodedEquals(f, c)
+		_ = f.Close()
+		if err != nil {
+			return errors.Join(fmt.Errorf("failed to verify file '%s'", tmpLocation), err)
+		}
+		if !equal {
+			return fmt.Errorf("verification of '%s' failed: written data differs from source", dstLocation)
+		}
+	}
+
+	// The expiry times are written first, so the destination never holds elements without them
+	expiry, carries, err := encodeExpiryOf(store, c)
+	if err != nil {
+		return errors.Join(fmt.Errorf("failed to encode expiry times of '%s'", dstLocation), err)
+	}
+	if carries {
+		if err := writeExpiryFile(dstLocation, expiry); err != nil {
+			return err
+		}
+	}
+	if err := os.Rename(tmpLocation, dstLocation); err != nil {
+		return errors.Join(fmt.Errorf("failed to move migrated data to '%s'", dstLocation), err)
+	}
+	if err := recordHash(dstLocation, h.Sum(nil)); err != nil {
+		return errors.Join(fmt.Errorf("failed to update manifest for '%s'", dstLocation), err)
+	}
+	return nil
+}
+
+// sameData compares a and b by their canonical JSON representation.
+// Map keys are sorted by encoding/json, which makes the comparison independent of ordering.
+func sameData(a, b any) (bool, error) {
+	aj, err := json.Marshal(a)
+	if err != nil {
+		return false, err
+	}
+	bj, err := json.Marshal(b)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(aj, bj), nil
+}
@@ -0,0 +1,104 @@
+package speicher
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// mirror copies the files of stores to a secondary directory after they were saved.
+type mirror struct {
+	dir     string
+	onError func(err error)
+	mut     sync.Mutex
+	// pending holds the locations being copied, mapped to whether they were saved again since their copy started.
+	pending map[string]bool
+	running sync.WaitGroup
+}
+
+// WithMirror copies the file of the store into the directory dir after every successful save,
+// for example to another disk or a network share, as simple redundancy for a single machine.
+// The copy has the same name as the file and can be loaded like it, even if the store uses WithDoubleBuffer.
+//
+// Copies are made in the background, so a slow mirror doesn't hold up the store;
+// if the store is saved again while its copy is running, only the latest file is copied afterwards.
+// Close waits for running copies. Errors are passed to onError, or reported like a failed automatic save
+// (see WithSaveErrorHandler) if onError is nil.
+//
+// Sidecar files like expiry times are not mirrored. Disk-backed Map stores ignore it.
+func WithMirror(dir string, onError func(err error)) Option {
+	m := &mirror{dir: dir, onError: onError, pending: make(map[string]bool)}
+	return func(o *storeOptions) {
+		o.mirror = m
+	}
+}
+
+// mirrorSave starts copying the file at location to the mirror directory, if the store has one.
+func (o storeOptions) mirrorSave(location string) {
+	m := o.mirror
+	if m == nil {
+		return
+	}
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	if _, ok := m.pending[location]; ok {
+		m.pending[location] = true
+		return
+	}
+	m.pending[location] = false
+	m.running.Add(1)
+	go func() {
+		defer m.running.Done()
+		for {
+			if err := o.copyToMirror(location); err != nil {
+				if m.onError != nil {
+					m.onError(err)
+				} else {
+					o.reportError(err)
+				}
+			}
+			m.mut.Lock()
+			again := m.pending[location]
+			if !again {
+				delete(m.pending, location)
+			} else {
+				m.pending[location] = false
+			}
+			m.mut.Unlock()
+			if !again {
+				return
+			}
+		}
+	}()
+}
+
+// copyToMirror copies the current file of the store at location to the mirror directory.
+func (o storeOptions) copyToMirror(location string) error {
+	target := filepath.Join(o.mirror.dir, filepath.Base(location))
+	f, err := o.openFile(location)
+	if err != nil {
+		return errors.Join(fmt.Errorf("failed to mirror file '%s' to '%s'", location, target), err)
+	}
+	defer f.Close()
+	if err := os.MkdirAll(o.mirror.dir, 0740); err != nil {
+		return errors.Join(fmt.Errorf("failed to mirror file '%s' to '%s'", location, target), err)
+	}
+	err = writeFileAtomic(target, func(w io.Writer) error {
+		_, err := io.Copy(w, f)
+		return err
+	})
+	if err != nil {
+		return errors.Join(fmt.Errorf("failed to mirror file '%s' to '%s'", location, target), err)
+	}
+	return nil
+}
+
+// waitForMirror waits until the running copies of the mirror of the store, if any, are done.
+func waitForMirror(store lockable) {
+	if o := optionsOf(store); o != nil && o.mirror != nil {
+		o.mirror.running.Wait()
+	}
+}
@@ -0,0 +1,1013 @@
+package speicher
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// msgpackCodec persists data as MessagePack.
+//
+// Values are mapped like encoding/json maps them, so the same types can be stored in both formats:
+// struct fields follow their json tags, map keys are strings, types implementing
+// encoding.TextMarshaler are stored as strings and types implementing only json.Marshaler
+// are stored as the MessagePack form of their JSON output.
+// Numbers decoded into an interface value are int64, uint64 or float64.
+type msgpackCodec struct {
+	// strict rejects unknown fields, floats in integer fields and excess array elements.
+	strict bool
+}
+
+func (msgpackCodec) encode(w io.Writer, v any) error {
+	var e msgpackEncoder
+	if err := e.encode(reflect.ValueOf(v)); err != nil {
+		return err
+	}
+	_, err := w.Write(e.buf)
+	return err
+}
+
+func (c msgpackCodec) decode(r io.Reader, v any) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() {
+		return fmt.Errorf("msgpack: decode requires a non-nil pointer")
+	}
+	d := msgpackDecoder{data: data, strict: c.strict}
+	if err := d.decode(rv.Elem()); err != nil {
+		return err
+	}
+	if d.pos != len(d.data) {
+		return fmt.Errorf("msgpack: %d unexpected bytes after value", len(d.data)-d.pos)
+	}
+	return nil
+}
+
+var (
+	jsonMarshalerType   = reflect.TypeFor[json.Marshaler]()
+	jsonUnmarshalerType = reflect.TypeFor[json.Unmarshaler]()
+	textMarshalerType   = reflect.TypeFor[encoding.TextMarshaler]()
+	textUnmarshalerType = reflect.TypeFor[encoding.TextUnmarshaler]()
+)
+
+// msgpackField is a struct field that is encoded as a map entry.
+type msgpackField struct {
+	name      string
+	index     []int
+	omitEmpty bool
+}
+
+// msgpackFieldCache holds the []msgpackField of every struct type seen so far.
+var msgpackFieldCache sync.Map
+
+// msgpackFields returns the encoded fields of the struct type t following the rules of encoding/json.
+// Fields of embedded structs without a name tag are promoted; shallower fields win on conflicts.
+func msgpackFields(t reflect.Type) []msgpackField {
+	if fields, ok := msgpackFieldCache.Load(t); ok {
+		return fields.([]msgpackField)
+	}
+	var fields []msgpackField
+	seen := make(map[string]bool)
+	type level struct {
+		t     reflect.Type
+		index []int
+	}
+	current := []level{{t: t}}
+	for len(current) > 0 {
+		var next []level
+		for _, l := range current {
+			for i := range l.t.NumField() {
+				sf := l.t.Field(i)
+				tag := sf.Tag.Get("json")
+				if tag == "-" {
+					continue
+				}
+				name, opts, _ := strings.Cut(tag, ",")
+				index := append(append([]int(nil), l.index...), i)
+				if sf.Anonymous && name == "" {
+					ft := sf.Type
+					if ft.Kind() == reflect.Pointer {
+						ft = ft.Elem()
+					}
+					if ft.Kind() == reflect.Struct {
+						next = append(next, level{t: ft, index: index})
+						continue
+					}
+				}
+				if !sf.IsExported() {
+					continue
+				}
+				if name == "" {
+					name = sf.Name
+				}
+				if seen[name] {
+					continue
+				}
+				seen[name] = true
+				fields = append(fields, msgpackField{
+					name:      name,
+					index:     index,
+					omitEmpty: strings.Contains(","+opts+",", ",omitempty,"),
+				})
+			}
+		}
+		current = next
+	}
+	msgpackFieldCache.Store(t, fields)
+	return fields
+}
+
+// msgpackEncoder appends the MessagePack encoding of values to buf.
+type msgpackEncoder struct {
+	buf []byte
+}
+
+func (e *msgpackEncoder) encode(v reflect.Value) error {
+	if !v.IsValid() {
+		e.buf = append(e.buf, 0xc0)
+		return nil
+	}
+	if (v.Kind() == reflect.Pointer || v.Kind() == reflect.Interface) && v.IsNil() {
+		e.buf = append(e.buf, 0xc0)
+		return nil
+	}
+
+	t := v.Type()
+	if t.Implements(textMarshalerType) {
+		text, err := v.Interface().(encoding.TextMarshaler).MarshalText()
+		if err != nil {
+			return err
+		}
+		e.encodeString(string(text))
+		return nil
+	}
+	if t.Implements(jsonMarshalerType) {
+		return e.encodeJSONMarshaler(v.Interface().(json.Marshaler))
+	}
+	if v.CanAddr() {
+		if pt := reflect.PointerTo(t); pt.Implements(textMarshalerType) || pt.Implements(jsonMarshalerType) {
+			return e.encode(v.Addr())
+		}
+	}
+
+	switch v.Kind() {
+	case reflect.Bool:
+		if v.Bool() {
+			e.buf = append(e.buf, 0xc3)
+		} else {
+			e.buf = append(e.buf, 0xc2)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		e.encodeInt(v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		e.encodeUint(v.Uint())
+	case reflect.Float32:
+		e.buf = append(e.buf, 0xca)
+		e.buf = binary.BigEndian.AppendUint32(e.buf, math.Float32bits(float32(v.Float())))
+	case reflect.Float64:
+		e.buf = append(e.buf, 0xcb)
+		e.buf = binary.BigEndian.AppendUint64(e.buf, math.Float64bits(v.Float()))
+	case reflect.String:
+		e.encodeString(v.String())
+	case reflect.Pointer, reflect.Interface:
+		return e.encode(v.Elem())
+	case reflect.Slice:
+		if v.IsNil() {
+			e.buf = append(e.buf, 0xc0)
+			return nil
+		}
+		if t.Elem().Kind() == reflect.Uint8 {
+			e.encodeBytes(v.Bytes())
+			return nil
+		}
+		return e.encodeArray(v)
+	case reflect.Array:
+		return e.encodeArray(v)
+	case reflect.Map:
+		if v.IsNil() {
+			e.buf = append(e.buf, 0xc0)
+			return nil
+		}
+		return e.encodeMap(v)
+	case reflect.Struct:
+		return e.encodeStruct(v)
+	default:
+		return fmt.Errorf("msgpack: unsupported type %s", t)
+	}
+	return nil
+}
+
+func (e *msgpackEncoder) encodeInt(i int64) {
+	switch {
+	case i >= 0:
+		e.encodeUint(uint64(i))
+	case i >= -32:
+		e.buf = append(e.buf, byte(i))
+	case i >= math.MinInt8:
+		e.buf = append(e.buf, 0xd0, byte(i))
+	case i >= math.MinInt16:
+		e.buf = append(e.buf, 0xd1)
+		e.buf = binary.BigEndian.AppendUint16(e.buf, uint16(i))
+	case i >= math.MinInt32:
+		e.buf = append(e.buf, 0xd2)
+		e.buf = binary.BigEndian.AppendUint32(e.buf, uint32(i))
+	default:
+		e.buf = append(e.buf, 0xd3)
+		e.buf = binary.BigEndian.AppendUint64(e.buf, uint64(i))
+	}
+}
+
+func (e *msgpackEncoder) encodeUint(u uint64) {
+	switch {
+	case u <= 0x7f:
+		e.buf = append(e.buf, byte(u))
+	case u <= math.MaxUint8:
+		e.buf = append(e.buf, 0xcc, byte(u))
+	case u <= math.MaxUint16:
+		e.buf = append(e.buf, 0xcd)
+		e.buf = binary.BigEndian.AppendUint16(e.buf, uint16(u))
+	case u <= math.MaxUint32:
+		e.buf = append(e.buf, 0xce)
+		e.buf = binary.BigEndian.AppendUint32(e.buf, uint32(u))
+	default:
+		e.buf = append(e.buf, 0xcf)
+		e.buf = binary.BigEndian.AppendUint64(e.buf, u)
+	}
+}
+
+// encodeHeader appends the header of a value with n elements,
+// using the fix format if n is below fixLimit and the 8, 16 or 32 bit formats otherwise.
+// A zero code8 means the type has no 8 bit format.
+func (e *msgpackEncoder) encodeHeader(n int, fix byte, fixLimit int, code8, code16, code32 byte) {
+	switch {
+	case n < fixLimit:
+		e.buf = append(e.buf, fix|byte(n))
+	case code8 != 0 && n <= math.MaxUint8:
+		e.buf = append(e.buf, code8, byte(n))
+	case n <= math.MaxUint16:
+		e.buf = append(e.buf, code16)
+		e.buf = binary.BigEndian.AppendUint16(e.buf, uint16(n))
+	default:
+		e.buf = append(e.buf, code32)
+		e.buf = binary.BigEndian.AppendUint32(e.buf, uint32(n))
+	}
+}
+
+func (e *msgpackEncoder) encodeString(s string) {
+	e.encodeHeader(len(s), 0xa0, 32, 0xd9, 0xda, 0xdb)
+	e.buf = append(e.buf, s...)
+}
+
+func (e *msgpackEncoder) encodeBytes(b []byte) {
+	e.encodeHeader(len(b), 0, 0, 0xc4, 0xc5, 0xc6)
+	e.buf = append(e.buf, b...)
+}
+
+func (e *msgpackEncoder) encodeArray(v reflect.Value) error {
+	n := v.Len()
+	e.encodeHeader(n, 0x90, 16, 0, 0xdc, 0xdd)
+	for i := range n {
+		if err := e.encode(v.Index(i)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *msgpackEncoder) encodeMap(v reflect.Value) error {
+	e.encodeHeader(v.Len(), 0x80, 16, 0, 0xde, 0xdf)
+	// Keys are sorted like encoding/json does, so equal maps always encode to the same bytes
+	keys := make([]string, 0, v.Len())
+	values := make(map[string]reflect.Value, v.Len())
+	iter := v.MapRange()
+	for iter.Next() {
+		key, err := msgpackMapKey(iter.Key())
+		if err != nil {
+			return err
+		}
+		keys = append(keys, key)
+		values[key] = iter.Value()
+	}
+	slices.Sort(keys)
+	for _, key := range keys {
+		e.encodeString(key)
+		if err := e.encode(values[key]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// msgpackMapKey converts a map key to a string like encoding/json does.
+func msgpackMapKey(k reflect.Value) (string, error) {
+	if k.Kind() == reflect.String {
+		return k.String(), nil
+	}
+	if m, ok := k.Interface().(encoding.TextMarshaler); ok {
+		text, err := m.MarshalText()
+		return string(text), err
+	}
+	switch k.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(k.Int(), 10), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return strconv.FormatUint(k.Uint(), 10), nil
+	}
+	return "", fmt.Errorf("msgpack: unsupported map key type %s", k.Type())
+}
+
+func (e *msgpackEncoder) encodeStruct(v reflect.Value) error {
+	type entry struct {
+		name  string
+		value reflect.Value
+	}
+	var entries []entry
+	for _, f := range msgpackFields(v.Type()) {
+		fv, ok := fieldByIndex(v, f.index)
+		if !ok || f.omitEmpty && isEmptyValue(fv) {
+			continue
+		}
+		entries = append(entries, entry{f.name, fv})
+	}
+	e.encodeHeader(len(entries), 0x80, 16, 0, 0xde, 0xdf)
+	for _, en := range entries {
+		e.encodeString(en.name)
+		if err := e.encode(en.value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// encodeJSONMarshaler encodes the JSON output of m as MessagePack.
+// The order of object keys is kept.
+func (e *msgpackEncoder) encodeJSONMarshaler(m json.Marshaler) error {
+	raw, err := m.MarshalJSON()
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	return e.encodeJSON(dec)
+}
+
+// encodeJSON encodes the next JSON value of dec as MessagePack.
+func (e *msgpackEncoder) encodeJSON(dec *json.Decoder) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	switch tok := tok.(type) {
+	case nil:
+		e.buf = append(e.buf, 0xc0)
+	case bool:
+		return e.encode(reflect.ValueOf(tok))
+	case string:
+		e.encodeString(tok)
+	case json.Number:
+		if i, err := tok.Int64(); err == nil {
+			e.encodeInt(i)
+			return nil
+		}
+		f, err := tok.Float64()
+		if err != nil {
+			return err
+		}
+		return e.encode(reflect.ValueOf(f))
+	case json.Delim:
+		// Encode the elements first, since the header needs their number
+		outer := e.buf
+		e.buf = nil
+		n := 0
+		for dec.More() {
+			if tok == '{' {
+				key, err := dec.Token()
+				if err != nil {
+					return err
+				}
+				e.encodeString(key.(string))
+			}
+			if err := e.encodeJSON(dec); err != nil {
+				return err
+			}
+			n++
+		}
+		if _, err := dec.Token(); err != nil {
+			return err
+		}
+		elements := e.buf
+		e.buf = outer
+		if tok == '{' {
+			e.encodeHeader(n, 0x80, 16, 0, 0xde, 0xdf)
+		} else {
+			e.encodeHeader(n, 0x90, 16, 0, 0xdc, 0xdd)
+		}
+		e.buf = append(e.buf, elements...)
+	}
+	return nil
+}
+
+// fieldByIndex returns the nested field of v, reporting false if it is behind a nil pointer.
+func fieldByIndex(v reflect.Value, index []int) (reflect.Value, bool) {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Pointer {
+			if v.IsNil() {
+				return reflect.Value{}, false
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v, true
+}
+
+// fieldByIndexAlloc returns the nested field of v, allocating nil embedded pointers on the way.
+func fieldByIndexAlloc(v reflect.Value, index []int) reflect.Value {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Pointer {
+			if v.IsNil() {
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v
+}
+
+// isEmptyValue reports whether v is empty in the sense of the json omitempty option.
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64,
+		reflect.Interface, reflect.Pointer:
+		return v.IsZero()
+	}
+	return false
+}
+
+// msgpackDecoder decodes MessagePack values from data.
+type msgpackDecoder struct {
+	data   []byte
+	pos    int
+	strict bool
+}
+
+var errMsgpackShort = errors.New("msgpack: unexpected end of data")
+
+func (d *msgpackDecoder) peek() (byte, error) {
+	if d.pos >= len(d.data) {
+		return 0, errMsgpackShort
+	}
+	return d.data[d.pos], nil
+}
+
+func (d *msgpackDecoder) read(n int) ([]byte, error) {
+	if n < 0 || len(d.data)-d.pos < n {
+		return nil, errMsgpackShort
+	}
+	b := d.data[d.pos : d.pos+n]
+	d.pos += n
+	return b, nil
+}
+
+// readUint reads a big endian unsigned integer of n bytes.
+func (d *msgpackDecoder) readUint(n int) (uint64, error) {
+	b, err := d.read(n)
+	if err != nil {
+		return 0, err
+	}
+	var u uint64
+	for _, x := range b {
+		u = u<<8 | uint64(x)
+	}
+	return u, nil
+}
+
+// readLength reads the length of a str, bin, array or map header with a length field of n bytes.
+func (d *msgpackDecoder) readLength(n int) (int, error) {
+	u, err := d.readUint(n)
+	return int(u), err
+}
+
+// msgpackKind is the kind of the next value in the data.
+type msgpackKind int
+
+const (
+	msgpackNil msgpackKind = iota
+	msgpackBool
+	msgpackInt
+	msgpackUint
+	msgpackFloat
+	msgpackString
+	msgpackBinary
+	msgpackArray
+	msgpackMap
+)
+
+// msgpackToken is the header of a single value.
+// For strings and binaries, raw holds the content.
+// For arrays and maps, n holds the number of elements.
+type msgpackToken struct {
+	kind msgpackKind
+	b    bool
+	i    int64
+	u    uint64
+	f    float64
+	raw  []byte
+	n    int
+}
+
+func (d *msgpackDecoder) next() (msgpackToken, error) {
+	var t msgpackToken
+	c, err := d.peek()
+	if err != nil {
+		return t, err
+	}
+	d.pos++
+	n := -1
+	switch {
+	case c <= 0x7f:
+		t.kind, t.u = msgpackUint, uint64(c)
+	case c >= 0xe0:
+		t.kind, t.i = msgpackInt, int64(int8(c))
+	case c >= 0x80 && c <= 0x8f:
+		t.kind, t.n = msgpackMap, int(c&0x0f)
+	case c >= 0x90 && c <= 0x9f:
+		t.kind, t.n = msgpackArray, int(c&0x0f)
+	case c >= 0xa0 && c <= 0xbf:
+		t.kind, n = msgpackString, int(c&0x1f)
+	case c == 0xc0:
+		t.kind = msgpackNil
+	case c == 0xc2 || c == 0xc3:
+		t.kind, t.b = msgpackBool, c == 0xc3
+	case c >= 0xc4 && c <= 0xc6:
+		t.kind = msgpackBinary
+		n, err = d.readLength(1 << (c - 0xc4))
+	case c == 0xca:
+		var u uint64
+		u, err = d.readUint(4)
+		t.kind, t.f = msgpackFloat, float64(math.Float32frombits(uint32(u)))
+	case c == 0xcb:
+		var u uint64
+		u, err = d.readUint(8)
+		t.kind, t.f = msgpackFloat, math.Float64frombits(u)
+	case c >= 0xcc && c <= 0xcf:
+		t.kind = msgpackUint
+		t.u, err = d.readUint(1 << (c - 0xcc))
+	case c >= 0xd0 && c <= 0xd3:
+		size := 1 << (c - 0xd0)
+		var u uint64
+		u, err = d.readUint(size)
+		// Sign extend the value from size bytes
+		shift := 64 - 8*size
+		t.kind, t.i = msgpackInt, int64(u<<shift)>>shift
+	case c >= 0xd9 && c <= 0xdb:
+		t.kind = msgpackString
+		n, err = d.readLength(1 << (c - 0xd9))
+	case c == 0xdc || c == 0xdd:
+		t.kind = msgpackArray
+		t.n, err = d.readLength(2 << (c - 0xdc))
+	case c == 0xde || c == 0xdf:
+		t.kind = msgpackMap
+		t.n, err = d.readLength(2 << (c - 0xde))
+	default:
+		return t, fmt.Errorf("msgpack: unsupported format 0x%02x", c)
+	}
+	if err != nil {
+		return t, err
+	}
+	if n >= 0 {
+		t.raw, err = d.read(n)
+	}
+	return t, err
+}
+
+func (d *msgpackDecoder) decode(v reflect.Value) error {
+	c, err := d.peek()
+	if err != nil {
+		return err
+	}
+	if c == 0xc0 {
+		d.pos++
+		switch v.Kind() {
+		case reflect.Interface, reflect.Pointer, reflect.Map, reflect.Slice:
+			v.SetZero()
+		}
+		return nil
+	}
+
+	if v.Kind() == reflect.Pointer {
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return d.decode(v.Elem())
+	}
+	if v.CanAddr() {
+		pt := reflect.PointerTo(v.Type())
+		if pt.Implements(textUnmarshalerType) && (c >= 0xa0 && c <= 0xbf || c >= 0xd9 && c <= 0xdb) {
+			t, err := d.next()
+			if err != nil {
+				return err
+			}
+			return v.Addr().Interface().(encoding.TextUnmarshaler).UnmarshalText(t.raw)
+		}
+		if pt.Implements(jsonUnmarshalerType) {
+			raw, err := d.appendJSON(nil)
+			if err != nil {
+				return err
+			}
+			return v.Addr().Interface().(json.Unmarshaler).UnmarshalJSON(raw)
+		}
+	}
+	if v.Kind() == reflect.Interface {
+		if v.NumMethod() != 0 {
+			return fmt.Errorf("msgpack: cannot decode into non-empty interface %s", v.Type())
+		}
+		generic, err := d.decodeAny()
+		if err != nil {
+			return err
+		}
+		if generic != nil {
+			v.Set(reflect.ValueOf(generic))
+		} else {
+			v.SetZero()
+		}
+		return nil
+	}
+
+	t, err := d.next()
+	if err != nil {
+		return err
+	}
+	switch t.kind {
+	case msgpackBool:
+		if v.Kind() != reflect.Bool {
+			return d.typeError("bool", v)
+		}
+		v.SetBool(t.b)
+	case msgpackInt, msgpackUint, msgpackFloat:
+		return d.setNumber(t, v)
+	case msgpackString:
+		switch {
+		case v.Kind() == reflect.String:
+			v.SetString(string(t.raw))
+		case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8:
+			v.SetBytes([]byte(string(t.raw)))
+		default:
+			return d.typeError("string", v)
+		}
+	case msgpackBinary:
+		if v.Kind() != reflect.Slice || v.Type().Elem().Kind() != reflect.Uint8 {
+			return d.typeError("binary", v)
+		}
+		v.SetBytes(append([]byte(nil), t.raw...))
+	case msgpackArray:
+		return d.decodeArray(t.n, v)
+	case msgpackMap:
+		return d.decodeMap(t.n, v)
+	}
+	return nil
+}
+
+func (d *msgpackDecoder) typeError(what string, v reflect.Value) error {
+	return fmt.Errorf("msgpack: cannot decode %s into %s", what, v.Type())
+}
+
+func (d *msgpackDecoder) setNumber(t msgpackToken, v reflect.Value) error {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		var i int64
+		switch t.kind {
+		case msgpackInt:
+			i = t.i
+		case msgpackUint:
+			if t.u > math.MaxInt64 {
+				return fmt.Errorf("msgpack: %d overflows %s", t.u, v.Type())
+			}
+			i = int64(t.u)
+		default:
+			if d.strict || t.f != math.Trunc(t.f) {
+				return d.typeError("float", v)
+			}
+			i = int64(t.f)
+		}
+		if v.OverflowInt(i) {
+			return fmt.Errorf("msgpack: %d overflows %s", i, v.Type())
+		}
+		v.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		var u uint64
+		switch t.kind {
+		case msgpackUint:
+			u = t.u
+		case msgpackInt:
+			if t.i < 0 {
+				return fmt.Errorf("msgpack: %d overflows %s", t.i, v.Type())
+			}
+			u = uint64(t.i)
+		default:
+			if d.strict || t.f != math.Trunc(t.f) || t.f < 0 {
+				return d.typeError("float", v)
+			}
+			u = uint64(t.f)
+		}
+		if v.OverflowUint(u) {
+			return fmt.Errorf("msgpack: %d overflows %s", u, v.Type())
+		}
+		v.SetUint(u)
+	case reflect.Float32, reflect.Float64:
+		switch t.kind {
+		case msgpackInt:
+			v.SetFloat(float64(t.i))
+		case msgpackUint:
+			v.SetFloat(float64(t.u))
+		default:
+			v.SetFloat(t.f)
+		}
+	default:
+		return d.typeError("number", v)
+	}
+	return nil
+}
+
+func (d *msgpackDecoder) decodeArray(n int, v reflect.Value) error {
+	switch v.Kind() {
+	case reflect.Slice:
+		if v.IsNil() || v.Cap() < n {
+			v.Set(reflect.MakeSlice(v.Type(), n, n))
+		} else {
+			v.SetLen(n)
+		}
+		for i := range n {
+			if err := d.decode(v.Index(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Array:
+		if d.strict && n > v.Len() {
+			return fmt.Errorf("msgpack: %d elements don't fit into %s", n, v.Type())
+		}
+		for i := range n {
+			if i >= v.Len() {
+				if _, err := d.decodeAny(); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := d.decode(v.Index(i)); err != nil {
+				return err
+			}
+		}
+		for i := n; i < v.Len(); i++ {
+			v.Index(i).SetZero()
+		}
+	default:
+		return d.typeError("array", v)
+	}
+	return nil
+}
+
+func (d *msgpackDecoder) decodeMap(n int, v reflect.Value) error {
+	switch v.Kind() {
+	case reflect.Map:
+		if v.IsNil() {
+			v.Set(reflect.MakeMapWithSize(v.Type(), n))
+		}
+		kt, vt := v.Type().Key(), v.Type().Elem()
+		for range n {
+			key, err := d.decodeKey()
+			if err != nil {
+				return err
+			}
+			kv := reflect.New(kt).Elem()
+			if err := setMapKey(key, kv); err != nil {
+				return err
+			}
+			ev := reflect.New(vt).Elem()
+			if err := d.decode(ev); err != nil {
+				return err
+			}
+			v.SetMapIndex(kv, ev)
+		}
+	case reflect.Struct:
+		fields := msgpackFields(v.Type())
+		// decoded holds the fields set by their current name, which win over their aliases
+		var decoded map[string]bool
+		if len(fieldAliases(v.Type())) > 0 {
+			decoded = make(map[string]bool)
+		}
+		for range n {
+			key, err := d.decodeKey()
+			if err != nil {
+				return err
+			}
+			f := findField(fields, key)
+			if decoded != nil {
+				if f != nil {
+					decoded[f.name] = true
+				} else if af, a := aliasedField(v.Type(), fields, key); af != nil && !decoded[af.name] {
+					f = af
+					recordAlias(v.Type(), a)
+				}
+			}
+			if f == nil {
+				if d.strict {
+					return fmt.Errorf("msgpack: unknown field %q in %s", key, v.Type())
+				}
+				if _, err := d.decodeAny(); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := d.decode(fieldByIndexAlloc(v, f.index)); err != nil {
+				return err
+			}
+		}
+	default:
+		return d.typeError("map", v)
+	}
+	return nil
+}
+
+// findField returns the field with the given name, preferring an exact match over a case-insensitive one.
+func findField(fields []msgpackField, name string) *msgpackField {
+	var fold *msgpackField
+	for i := range fields {
+		if fields[i].name == name {
+			return &fields[i]
+		}
+		if fold == nil && strings.EqualFold(fields[i].name, name) {
+			fold = &fields[i]
+		}
+	}
+	return fold
+}
+
+// decodeKey decodes a map key, which must be a string.
+func (d *msgpackDecoder) decodeKey() (string, error) {
+	t, err := d.next()
+	if err != nil {
+		return "", err
+	}
+	if t.kind != msgpackString {
+		return "", fmt.Errorf("msgpack: map keys must be strings")
+	}
+	return string(t.raw), nil
+}
+
+// setMapKey converts a string map key to the key type of a map like encoding/json does.
+func setMapKey(key string, kv reflect.Value) error {
+	if kv.Kind() == reflect.String {
+		kv.SetString(key)
+		return nil
+	}
+	if u, ok := kv.Addr().Interface().(encoding.TextUnmarshaler); ok {
+		return u.UnmarshalText([]byte(key))
+	}
+	switch kv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := strconv.ParseInt(key, 10, 64)
+		if err != nil || kv.OverflowInt(i) {
+			return fmt.Errorf("msgpack: invalid map key '%s' for %s", key, kv.Type())
+		}
+		kv.SetInt(i)
+		return nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		u, err := strconv.ParseUint(key, 10, 64)
+		if err != nil || kv.OverflowUint(u) {
+			return fmt.Errorf("msgpack: invalid map key '%s' for %s", key, kv.Type())
+		}
+		kv.SetUint(u)
+		return nil
+	}
+	return fmt.Errorf("msgpack: unsupported map key type %s", kv.Type())
+}
+
+// decodeAny decodes the next value into its generic Go representation.
+func (d *msgpackDecoder) decodeAny() (any, error) {
+	t, err := d.next()
+	if err != nil {
+		return nil, err
+	}
+	switch t.kind {
+	case msgpackBool:
+		return t.b, nil
+	case msgpackInt:
+		return t.i, nil
+	case msgpackUint:
+		if t.u <= math.MaxInt64 {
+			return int64(t.u), nil
+		}
+		return t.u, nil
+	case msgpackFloat:
+		return t.f, nil
+	case msgpackString:
+		return string(t.raw), nil
+	case msgpackBinary:
+		return append([]byte(nil), t.raw...), nil
+	case msgpackArray:
+		values := make([]any, t.n)
+		for i := range values {
+			if values[i], err = d.decodeAny(); err != nil {
+				return nil, err
+			}
+		}
+		return values, nil
+	case msgpackMap:
+		values := make(map[string]any, t.n)
+		for range t.n {
+			key, err := d.decodeKey()
+			if err != nil {
+				return nil, err
+			}
+			if values[key], err = d.decodeAny(); err != nil {
+				return nil, err
+			}
+		}
+		return values, nil
+	}
+	return nil, nil
+}
+
+// appendJSON appends the next value as JSON to buf.
+// The order of map keys is kept.
+func (d *msgpackDecoder) appendJSON(buf []byte) ([]byte, error) {
+	t, err := d.next()
+	if err != nil {
+		return nil, err
+	}
+	switch t.kind {
+	case msgpackNil:
+		return append(buf, "null"...), nil
+	case msgpackBool:
+		return strconv.AppendBool(buf, t.b), nil
+	case msgpackInt:
+		return strconv.AppendInt(buf, t.i, 10), nil
+	case msgpackUint:
+		return strconv.AppendUint(buf, t.u, 10), nil
+	case msgpackFloat:
+		return strconv.AppendFloat(buf, t.f, 'g', -1, 64), nil
+	case msgpackString:
+		return appendJSONString(buf, string(t.raw))
+	case msgpackBinary:
+		return appendJSONString(buf, base64.StdEncoding.EncodeToString(t.raw))
+	case msgpackArray:
+		buf = append(buf, '[')
+		for i := range t.n {
+			if i > 0 {
+				buf = append(buf, ',')
+			}
+			if buf, err = d.appendJSON(buf); err != nil {
+				return nil, err
+			}
+		}
+		return append(buf, ']'), nil
+	case msgpackMap:
+		buf = append(buf, '{')
+		for i := range t.n {
+			if i > 0 {
+				buf = append(buf, ',')
+			}
+			key, err := d.decodeKey()
+			if err != nil {
+				return nil, err
+			}
+			if buf, err = appendJSONString(buf, key); err != nil {
+				return nil, err
+			}
+			buf = append(buf, ':')
+			if buf, err = d.appendJSON(buf); err != nil {
+				return nil, err
+			}
+		}
+		return append(buf, '}'), nil
+	}
+	return buf, nil
+}
+
+func appendJSONString(buf []byte, s string) ([]byte, error) {
+	quoted, err := json.Marshal(s)
+	if err != nil {
+		return nil, err
+	}
+	return append(buf, quoted...), nil
+}
@@ -0,0 +1,128 @@
+package speicher
+
+import (
+	"context"
+	"time"
+)
+
+type (
+	// Option configures a store when it is loaded.
+	Option func(o *storeOptions)
+
+	// storeOptions holds the configuration of a store.
+	storeOptions struct {
+		authz            AuthzFunc
+		insertionOrder   bool
+		encryptionKey    []byte
+		reaperInterval   time.Duration
+		segmentSize      int
+		valueCompression int
+		valueDictionary  int
+		shards           int
+		copyOnRead       bool
+		saveDebounce     time.Duration
+		maxSaveDelay     time.Duration
+		adaptiveDebounce *adaptiveDebounce
+		noAutoSave       bool
+		strictDecode     bool
+		elementIDs       bool
+		onSaveError      func(err error)
+		loadProgress     func(read, total int64)
+		cacheSize        int
+		doubleBuffer     bool
+		fileLock         FileLockMode
+		fileLockWait     bool
+		sampleRate       int
+		sampleFn         func(sample ChangeSample)
+		maxEntrySize     int
+		oversizePolicy   OversizePolicy
+		autoReload       bool
+		attached         bool
+		hllPrecision     int
+		auditLog         bool
+		uniqueIndex      bool
+		revisions        bool
+		instrumentation  Instrumentation
+		afterLoad        func(store Store)
+		beforeSave       func(store Store)
+		afterSave        func(store Store, err error)
+		hooked           Store // the store the options belong to, passed to the save hooks
+		mirror           *mirror
+		tempDir          string
+		segmentDir       string
+		scanSlots        chan struct{}
+		scanMaxWait      time.Duration
+		entryChecksums   bool
+		fileSystem       FileSystem
+		// saved is shared by all copies of the options of a store, see savedFiles.
+		saved *savedFiles
+	}
+
+	// configurable is implemented by stores that accept options.
+	configurable interface {
+		getOptions() *storeOptions
+	}
+)
+
+func newStoreOptions(opts []Option) storeOptions {
+	o := storeOptions{saved: &savedFiles{}}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// optionsOf returns the options of store or nil if the store is not configurable.
+func optionsOf(store any) *storeOptions {
+	if c, ok := store.(configurable); ok {
+		return c.getOptions()
+	}
+	return nil
+}
+
+// WithEncryption encrypts the store file at rest using AES-GCM.
+// The data is encrypted on every save with a new random nonce and decrypted on load.
+// The key must be 16, 24 or 32 bytes long to select AES-128, AES-192 or AES-256.
+func WithEncryption(key []byte) Option {
+	return func(o *storeOptions) {
+		o.encryptionKey = key
+	}
+}
+
+type (
+	// Access is the kind of access an operation needs on a store.
+	Access string
+
+	// AuthzFunc decides whether an operation may access a store.
+	// key is the key (or index) the operation targets, or empty if it targets the whole store.
+	// Returning a non-nil error denies the access.
+	AuthzFunc func(ctx context.Context, access Access, key string) error
+)
+
+const (
+	// AccessRead is used for operations that only read from a store.
+	AccessRead Access = "read"
+	// AccessWrite is used for operations that modify a store.
+	AccessWrite Access = "write"
+)
+
+// WithAuthz installs an authorization hook on the store.
+// The hook is consulted by Authorize and therefore by every context-aware operation,
+// so the same policy can protect embedded and remote access to a store.
+// Operations on the whole store, like State.LockContext and Handler, pass an empty key;
+// operations on a single element, like GetKeyContext, SetKeyContext and EntryHandler, pass its key instead.
+func WithAuthz(f AuthzFunc) Option {
+	return func(o *storeOptions) {
+		o.authz = f
+	}
+}
+
+// Authorize consults the authorization hook of store for the given access and key.
+// Returns nil if the store has no hook installed.
+func Authorize(ctx context.Context, store Store, access Access, key string) error {
+	o := optionsOf(unwrap(store))
+	if o == nil || o.authz == nil {
+		return nil
+	}
+	return o.authz(ctx, access, key)
+}
@@ -0,0 +1,426 @@
+package speicher
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"sort"
+	"time"
+)
+
+type (
+	// memoryOrderedMap is an OrderedMap implementation that keeps all elements in memory.
+	// It reuses memoryMap for storage and keeps the key order in a separate slice.
+	memoryOrderedMap[T any] struct {
+		memoryMap[T]
+		keys []string
+	}
+
+	// OrderedMap is a Map that keeps its keys in order.
+	// By default keys are sorted lexically; use WithInsertionOrder to keep them in insertion order instead.
+	// Iteration, search and the persisted JSON file follow this order,
+	// which also keeps diffs of the file small.
+	//
+	// All operations require appropriate locking via a State object, like Map.
+	OrderedMap[T any] interface {
+		Map[T]
+
+		// IterateRange calls the provided function for each element with a key k where from <= k < to,
+		// following the order of the OrderedMap. An empty to means there is no upper bound.
+		// Requires at least a read lock.
+		IterateRange(from, to string, yield func(key string, value T) bool)
+
+		// First returns the first element of the OrderedMap.
+		// If the OrderedMap is empty, the bool result will be false.
+		// Requires at least a read lock.
+		First() (key string, value T, found bool)
+
+		// Last returns the last element of the OrderedMap.
+		// If the OrderedMap is empty, the bool result will be false.
+		// Requires at least a read lock.
+		Last() (key string, value T, found bool)
+
+		// Keys returns all keys in order.
+		// Requires at least a read lock.
+		Keys() []string
+	}
+
+	// orderedEntries encodes a map as a JSON object with a given key order.
+	orderedEntries[T any] struct {
+		keys []string
+		data map[string]T
+	}
+)
+
+// WithInsertionOrder makes an OrderedMap keep its keys in insertion order instead of sorted order.
+// It has no effect on other stores.
+func WithInsertionOrder() Option {
+	return func(o *storeOptions) {
+		o.insertionOrder = true
+	}
+}
+
+func (m *memoryOrderedMap[T]) sorted() bool {
+	return !m.opts.insertionOrder
+}
+
+// indexOf returns the position of key in m.keys and whether it exists.
+// For sorted maps, the position is where the key would be inserted if it does not exist.
+func (m *memoryOrderedMap[T]) indexOf(key string) (int, bool) {
+	if m.sorted() {
+		return slices.BinarySearch(m.keys, key)
+	}
+	i := slices.Index(m.keys, key)
+	return i, i >= 0
+}
+
+func (m *memoryOrderedMap[T]) Set(key string, value T) {
+	if err := m.TrySet(key, value); err != nil {
+		m.opts.reportError(err)
+	}
+}
+
+func (m *memoryOrderedMap[T]) TrySet(key string, value T) error {
+	value, err := limitEntry(&m.opts, key, value)
+	if err != nil {
+		return err
+	}
+	if _, exists := m.data[key]; !exists {
+		if m.sorted() {
+			i, _ := m.indexOf(key)
+			m.keys = slices.Insert(m.keys, i, key)
+		} else {
+			m.keys = append(m.keys, key)
+		}
+	}
+	m.changes.record(ChangeEvent[T]{Op: ChangeSet, Key: key, Old: m.data[key], New: value})
+	m.data[key] = value
+	delete(m.expires, key)
+	return nil
+}
+
+func (m *memoryOrderedMap[T]) GetOrSet(key string, create func() T) T {
+	if value, ok := m.Get(key); ok {
+		return value
+	}
+	value := create()
+	m.Set(key, value)
+	return value
+}
+
+func (m *memoryOrderedMap[T]) Update(key string, fn func(old T, exists bool) T) T {
+	value := fn(m.Get(key))
+	m.Set(key, value)
+	return value
+}
+
+func (m *memoryOrderedMap[T]) SetWithTTL(key string, value T, ttl time.Duration) {
+	m.Set(key, value)
+	m.expire(key, ttl)
+}
+
+func (m *memoryOrderedMap[T]) DeleteExpired() int {
+	keys := m.expiredKeys()
+	for _, key := range keys {
+		m.Delete(key)
+	}
+	return len(keys)
+}
+
+func (m *memoryOrderedMap[T]) Delete(key string) {
+	old, exists := m.data[key]
+	if !exists {
+		return
+	}
+	m.changes.record(ChangeEvent[T]{Op: ChangeDelete, Key: key, Old: old})
+	if i, ok := m.indexOf(key); ok {
+		m.keys = slices.Delete(m.keys, i, i+1)
+	}
+	delete(m.data, key)
+	delete(m.expires, key)
+}
+
+// Overwrite replaces the entire data store with the provided map.
+// A Go map has no order, so the keys are sorted even when insertion order is used.
+func (m *memoryOrderedMap[T]) Overwrite(values map[string]T) {
+	m.changes.record(ChangeEvent[T]{Op: ChangeOverwrite})
+	m.data = values
+	m.expires = nil
+	m.keys = make([]string, 0, len(values))
+	for key := range values {
+		m.keys = append(m.keys, key)
+	}
+	sort.Strings(m.keys)
+}
+
+func (m *memoryOrderedMap[T]) Find(f func(T) bool) (value T, found bool) {
+	for _, key := range m.keys {
+		if m.isExpired(key) {
+			continue
+		}
+		value = m.data[key]
+		if f(value) {
+			return m.read(value), true
+		}
+	}
+	found = false
+	return
+}
+
+func (m *memoryOrderedMap[T]) FindAll(f func(T) bool) (values []T) {
+	for _, key := range m.keys {
+		if m.isExpired(key) {
+			continue
+		}
+		if value := m.data[key]; f(value) {
+			values = append(values, m.read(value))
+		}
+	}
+	return
+}
+
+func (m *memoryOrderedMap[T]) Iterate(yield func(key string, value T) bool) {
+	for _, key := range m.keys {
+		if m.isExpired(key) {
+			continue
+		}
+		if !yield(key, m.read(m.data[key])) {
+			break
+		}
+	}
+}
+
+func (m *memoryOrderedMap[T]) IterateRange(from, to string, yield func(key string, value T) bool) {
+	keys := m.keys
+	if m.sorted() {
+		start, _ := slices.BinarySearch(keys, from)
+		keys = keys[start:]
+	}
+	for _, key := range keys {
+		if key < from || m.isExpired(key) {
+			continue
+		}
+		if to != "" && key >= to {
+			if m.sorted() {
+				break
+			}
+			continue
+		}
+		if !yield(key, m.read(m.data[key])) {
+			break
+		}
+	}
+}
+
+func (m *memoryOrderedMap[T]) First() (key string, value T, found bool) {
+	for _, key = range m.keys {
+		if !m.isExpired(key) {
+			return key, m.read(m.data[key]), true
+		}
+	}
+	return "", value, false
+}
+
+func (m *memoryOrderedMap[T]) Last() (key string, value T, found bool) {
+	for i := len(m.keys) - 1; i >= 0; i-- {
+		if key = m.keys[i]; !m.isExpired(key) {
+			return key, m.read(m.data[key]), true
+		}
+	}
+	return "", value, false
+}
+
+func (m *memoryOrderedMap[T]) Values() []T {
+	values := make([]T, 0, len(m.keys))
+	for _, key := range m.keys {
+		if !m.isExpired(key) {
+			values = append(values, m.read(m.data[key]))
+		}
+	}
+	return values
+}
+
+func (m *memoryOrderedMap[T]) Keys() []string {
+	if len(m.expires) == 0 && m.expiresField == nil {
+		return slices.Clone(m.keys)
+	}
+	keys := make([]string, 0, len(m.keys))
+	for _, key := range m.keys {
+		if !m.isExpired(key) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+func (m *memoryOrderedMap[T]) RangeKV() (<-chan MapRangeEl[T], func()) {
+	ch := make(chan MapRangeEl[T], len(m.keys))
+	for key, value := range m.Iterate {
+		ch <- MapRangeEl[T]{Key: key, Value: value}
+	}
+	close(ch)
+	return ch, func() {}
+}
+
+func (m *memoryOrderedMap[T]) RangeV() (<-chan T, func()) {
+	ch := make(chan T, len(m.keys))
+	for _, value := range m.Iterate {
+		ch <- value
+	}
+	close(ch)
+	return ch, func() {}
+}
+
+func (m *memoryOrderedMap[T]) entries() orderedEntries[T] {
+	return orderedEntries[T]{keys: m.keys, data: m.data}
+}
+
+func (m *memoryOrderedMap[T]) Save() error {
+	return m.SaveCtx(context.Background())
+}
+
+func (m *memoryOrderedMap[T]) SaveCtx(ctx context.Context) error {
+	s := saveState(ctx)
+	s.RLock(m)
+	defer s.RUnlock(m)
+
+	m.verifyChecksums()
+	h := sha256.New()
+	err := m.opts.saveFile(ctx, m.location, func(w io.Writer) error {
+		return m.codec.encode(io.MultiWriter(w, h), m.entries())
+	})
+	if err != nil {
+		return errors.Join(fmt.Errorf("failed to write file '%s'", m.location), err)
+	}
+	if err := m.opts.recordHash(m.location, h.Sum(nil)); err != nil {
+		return errors.Join(fmt.Errorf("failed to update manifest for '%s'", m.location), err)
+	}
+	if err := m.saveExpiry(ctx); err != nil {
+		return err
+	}
+	return m.opts.saveRevisions(ctx, m.location, m.codec, m.changes.revs)
+}
+
+func (m *memoryOrderedMap[T]) encodeData(w io.Writer, c codec) error {
+	return c.encode(w, orderedEntries[T]{keys: m.Keys(), data: m.data})
+}
+
+func (e orderedEntries[T]) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, key := range e.keys {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		k, err := json.Marshal(key)
+		if err != nil {
+			return nil, err
+		}
+		v, err := json.Marshal(e.data[key])
+		if err != nil {
+			return nil, errors.Join(fmt.Errorf("failed to encode entry '%s'", key), err)
+		}
+		buf.Write(k)
+		buf.WriteByte(':')
+		buf.Write(v)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+func (e *orderedEntries[T]) UnmarshalJSON(b []byte) error {
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	if t, err := decoder.Token(); err != nil {
+		return err
+	} else if t == nil {
+		return nil
+	} else if t != json.Delim('{') {
+		return fmt.Errorf("expected JSON object")
+	}
+	e.data = make(map[string]T)
+	for decoder.More() {
+		t, err := decoder.Token()
+		if err != nil {
+			return err
+		}
+		key := t.(string)
+		var value T
+		if err := decoder.Decode(&value); err != nil {
+			return errors.Join(fmt.Errorf("failed to decode entry '%s'", key), err)
+		}
+		if _, exists := e.data[key]; !exists {
+			e.keys = append(e.keys, key)
+		}
+		e.data[key] = value
+	}
+	return nil
+}
+
+// LoadOrderedMap loads an OrderedMap from location.
+// If the file does not exist, an empty OrderedMap is returned.
+func LoadOrderedMap[T any](location string, opts ...Option) (OrderedMap[T], error) {
+	options := newStoreOptions(opts)
+	lock, err := lockFile(location, options)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.releaseUnclaimed()
+	c, err := resolveCodec(location, options)
+	if err != nil {
+		return nil, err
+	}
+	if m, err := loadOrderedMapFromFile[T](location, c, options); err != nil {
+		return nil, errors.Join(fmt.Errorf("unable to load ordered map from file '%s'", location), err)
+	} else {
+		opened(m, location)
+		startReaper(m, options.reaperInterval)
+		startAutoReload(m, location, options)
+		return m, nil
+	}
+}
+
+func loadOrderedMapFromFile[T any](location string, c codec, o storeOptions) (OrderedMap[T], error) {
+	m := &memoryOrderedMap[T]{
+		memoryMap: memoryMap[T]{id: newStoreID(), data: map[string]T{}, location: location, codec: c, opts: o, expiresField: expiryField(reflect.TypeFor[T]())},
+	}
+	revs, err := o.loadRevisions(location, c)
+	if err != nil {
+		return nil, err
+	}
+	m.changes.revs = revs
+	f, err := o.openFile(location)
+	if err != nil {
+		if os.IsNotExist(err) {
+			m.changes.sums = newEntrySums(o, m.data)
+			err = o.files().MkdirAll(filepath.Dir(location), 0740)
+			return m, err
+		}
+		return nil, errors.Join(fmt.Errorf("failed to open file '%s' (but exists)", location), err)
+	}
+	defer f.Close()
+	var entries orderedEntries[T]
+	if err := c.decode(f, &entries); err != nil {
+		return nil, errors.Join(fmt.Errorf("failed to decode file '%s'", location), err)
+	}
+	if entries.data != nil {
+		m.data = entries.data
+		m.keys = entries.keys
+		if m.sorted() {
+			sort.Strings(m.keys)
+		}
+	}
+	if err := m.loadExpiry(); err != nil {
+		return nil, err
+	}
+	m.DeleteExpired()
+	m.changes.sums = newEntrySums(o, m.data)
+	return m, nil
+}
@@ -0,0 +1,358 @@
+package speicher
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+type (
+	// memoryOutbox is an Outbox implementation that keeps all entries in memory.
+	memoryOutbox[T any] struct {
+		id       storeID
+		data     []OutboxEntry[T]
+		location string
+		codec    codec
+		opts     storeOptions
+		mut      sync.RWMutex
+
+		timerMut     sync.Mutex
+		saveTimer    *time.Timer
+		maxSaveTimer *time.Timer
+		saveOnce     *sync.Once
+	}
+
+	// OutboxEntry is a single task in an Outbox.
+	OutboxEntry[T any] struct {
+		// ID identifies the entry.
+		ID string
+		// Value is the payload of the task.
+		Value T
+		// Attempts counts how often the entry was leased.
+		// Together with ID, it identifies a lease for Ack, Retry and Extend.
+		Attempts int
+		// EnqueuedAt is the time the entry was added.
+		EnqueuedAt time.Time
+		// LeasedUntil is the time the current lease expires.
+		// The entry is invisible to Lease until then.
+		LeasedUntil time.Time
+		// NotBefore delays the next lease of an entry passed to Retry.
+		NotBefore time.Time
+	}
+
+	// Outbox is a thread-safe, persistent task queue with leasing.
+	//
+	// A worker leases an entry for a duration, during which the entry is invisible to other workers.
+	// The worker then either acknowledges the entry, which removes it, or hands it back via Retry.
+	// If the worker crashes, the lease expires and the entry becomes available again,
+	// so every entry is processed at least once.
+	//
+	// All operations require appropriate locking via a State object:
+	//
+	//	s := speicher.NewState()
+	//	s.Lock(outbox)
+	//	entry, ok := outbox.Lease(time.Minute)
+	//	s.Unlock(outbox)
+	Outbox[T any] interface {
+		lockable
+
+		// Enqueue adds a new entry with the given value and returns its ID.
+		// Requires a write lock.
+		Enqueue(value T) string
+
+		// Lease returns the oldest available entry and hides it from other workers for d.
+		// If no entry is available, the bool result will be false.
+		// Requires a write lock.
+		Lease(d time.Duration) (OutboxEntry[T], bool)
+
+		// Extend prolongs the lease of an entry returned by Lease to d from now.
+		// It returns false if the entry does not exist or was leased again since,
+		// for example by another worker after the lease expired.
+		// Requires a write lock.
+		Extend(entry OutboxEntry[T], d time.Duration) bool
+
+		// Ack removes an entry returned by Lease after it was processed successfully.
+		// It returns false if the entry does not exist or was leased again since.
+		// Requires a write lock.
+		Ack(entry OutboxEntry[T]) bool
+
+		// Retry releases the lease of an entry returned by Lease.
+		// The entry becomes available again after delay.
+		// It returns false if the entry does not exist or was leased again since.
+		// Requires a write lock.
+		Retry(entry OutboxEntry[T], delay time.Duration) bool
+
+		// Get returns the entry with the given ID.
+		// Requires at least a read lock.
+		Get(id string) (OutboxEntry[T], bool)
+
+		// Len returns the number of entries, including leased ones.
+		// Requires at least a read lock.
+		Len() int
+
+		// Available returns the number of entries that can be leased right now.
+		// Requires at least a read lock.
+		Available() int
+
+		// Iterate iterates over all entries in enqueue order.
+		// Requires at least a read lock.
+		Iterate(yield func(entry OutboxEntry[T]) bool)
+
+		// Save persists the current state of the Outbox to its underlying data store.
+		// It returns an error if the operation fails.
+		// This method acquires its own read lock internally.
+		Save() error
+
+		// SaveCtx persists the current state of the data store like Save,
+		// but aborts when ctx is cancelled or its deadline passes.
+		// An aborted save removes its temporary files and leaves the previous file intact.
+		// This method acquires its own read lock internally.
+		SaveCtx(ctx context.Context) error
+
+		// Close stops the automatic save and the background goroutines of the store and saves it one last time.
+		// The store must not be used afterwards.
+		// This method acquires its own read lock internally.
+		Close() error
+	}
+)
+
+// available reports whether the entry can be leased at the time now.
+func (e *OutboxEntry[T]) available(now time.Time) bool {
+	return !now.Before(e.LeasedUntil) && !now.Before(e.NotBefore)
+}
+
+func (o *memoryOutbox[T]) index(id string) int {
+	return slices.IndexFunc(o.data, func(e OutboxEntry[T]) bool {
+		return e.ID == id
+	})
+}
+
+// leased returns the index of entry as Lease returned it, or -1 if it doesn't exist or was leased again since.
+func (o *memoryOutbox[T]) leased(entry OutboxEntry[T]) int {
+	i := o.index(entry.ID)
+	if i < 0 || o.data[i].Attempts != entry.Attempts {
+		return -1
+	}
+	return i
+}
+
+func (o *memoryOutbox[T]) Enqueue(value T) string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	id := hex.EncodeToString(b)
+	o.data = append(o.data, OutboxEntry[T]{
+		ID:         id,
+		Value:      value,
+		EnqueuedAt: time.Now(),
+	})
+	return id
+}
+
+func (o *memoryOutbox[T]) Lease(d time.Duration) (OutboxEntry[T], bool) {
+	now := time.Now()
+	for i := range o.data {
+		e := &o.data[i]
+		if e.available(now) {
+			e.Attempts++
+			e.LeasedUntil = now.Add(d)
+			return *e, true
+		}
+	}
+	return OutboxEntry[T]{}, false
+}
+
+func (o *memoryOutbox[T]) Extend(entry OutboxEntry[T], d time.Duration) bool {
+	i := o.leased(entry)
+	if i < 0 {
+		return false
+	}
+	o.data[i].LeasedUntil = time.Now().Add(d)
+	return true
+}
+
+func (o *memoryOutbox[T]) Ack(entry OutboxEntry[T]) bool {
+	i := o.leased(entry)
+	if i < 0 {
+		return false
+	}
+	o.data = slices.Delete(o.data, i, i+1)
+	return true
+}
+
+func (o *memoryOutbox[T]) Retry(entry OutboxEntry[T], delay time.Duration) bool {
+	i := o.leased(entry)
+	if i < 0 {
+		return false
+	}
+	o.data[i].LeasedUntil = time.Time{}
+	o.data[i].NotBefore = time.Now().Add(delay)
+	return true
+}
+
+func (o *memoryOutbox[T]) Get(id string) (OutboxEntry[T], bool) {
+	i := o.index(id)
+	if i < 0 {
+		return OutboxEntry[T]{}, false
+	}
+	return o.data[i], true
+}
+
+func (o *memoryOutbox[T]) Len() int {
+	return len(o.data)
+}
+
+func (o *memoryOutbox[T]) Available() int {
+	now := time.Now()
+	n := 0
+	for i := range o.data {
+		if o.data[i].available(now) {
+			n++
+		}
+	}
+	return n
+}
+
+func (o *memoryOutbox[T]) Iterate(yield func(entry OutboxEntry[T]) bool) {
+	for _, e := range o.data {
+		if !yield(e) {
+			break
+		}
+	}
+}
+
+func (o *memoryOutbox[T]) getStoreID() storeID {
+	return o.id
+}
+
+func (o *memoryOutbox[T]) getMutex() *sync.RWMutex {
+	return &o.mut
+}
+
+func (o *memoryOutbox[T]) getOptions() *storeOptions {
+	return &o.opts
+}
+
+func (o *memoryOutbox[T]) Save() error {
+	return o.SaveCtx(context.Background())
+}
+
+func (o *memoryOutbox[T]) SaveCtx(ctx context.Context) error {
+	s := saveState(ctx)
+	s.RLock(o)
+	defer s.RUnlock(o)
+
+	h := sha256.New()
+	err := o.opts.saveFile(ctx, o.location, func(w io.Writer) error {
+		return o.codec.encode(io.MultiWriter(w, h), o.data)
+	})
+	if err != nil {
+		return errors.Join(fmt.Errorf("failed to write file '%s'", o.location), err)
+	}
+	if err := o.opts.recordHash(o.location, h.Sum(nil)); err != nil {
+		return errors.Join(fmt.Errorf("failed to update manifest for '%s'", o.location), err)
+	}
+	return nil
+}
+
+func (o *memoryOutbox[T]) encodeData(w io.Writer, c codec) error {
+	return c.encode(w, o.data)
+}
+
+func (o *memoryOutbox[T]) decodedEquals(r io.Reader, c codec) (bool, error) {
+	var data []OutboxEntry[T]
+	if err := c.decode(r, &data); err != nil {
+		return false, err
+	}
+	return sameData(o.data, data)
+}
+
+// LoadOutbox loads an Outbox from location.
+// Leases recorded in the file stay valid, so entries leased before a restart
+// become available again once their lease expires.
+// If the file does not exist, an empty Outbox is returned.
+func LoadOutbox[T any](location string, opts ...Option) (Outbox[T], error) {
+	options := newStoreOptions(opts)
+	lock, err := lockFile(location, options)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.releaseUnclaimed()
+	c, err := resolveCodec(location, options)
+	if err != nil {
+		return nil, err
+	}
+	if o, err := loadOutboxFromFile[T](location, c, options); err != nil {
+		return nil, errors.Join(fmt.Errorf("unable to load outbox from file '%s'", location), err)
+	} else {
+		opened(o, location)
+		return o, nil
+	}
+}
+
+func loadOutboxFromFile[T any](location string, c codec, opts storeOptions) (Outbox[T], error) {
+	o := &memoryOutbox[T]{
+		id:       newStoreID(),
+		location: location,
+		codec:    c,
+		opts:     opts,
+		data:     make([]OutboxEntry[T], 0),
+	}
+	f, err := o.opts.openFile(location)
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = o.opts.files().MkdirAll(filepath.Dir(location), 0740)
+			return o, err
+		}
+		return nil, errors.Join(fmt.Errorf("failed to open file '%s' (file exists)", location), err)
+	}
+	defer f.Close()
+	if err := c.decode(f, &o.data); err != nil {
+		return nil, errors.Join(fmt.Errorf("failed to decode file '%s'", location), err)
+	}
+	return o, nil
+}
+
+func (o *memoryOutbox[T]) getSaveTimer() *time.Timer {
+	o.timerMut.Lock()
+	defer o.timerMut.Unlock()
+	return o.saveTimer
+}
+
+func (o *memoryOutbox[T]) setSaveTimer(t *time.Timer) {
+	o.timerMut.Lock()
+	defer o.timerMut.Unlock()
+	o.saveTimer = t
+}
+
+func (o *memoryOutbox[T]) getMaxSaveTimer() *time.Timer {
+	o.timerMut.Lock()
+	defer o.timerMut.Unlock()
+	return o.maxSaveTimer
+}
+
+func (o *memoryOutbox[T]) setMaxSaveTimer(t *time.Timer) {
+	o.timerMut.Lock()
+	defer o.timerMut.Unlock()
+	o.maxSaveTimer = t
+}
+
+func (o *memoryOutbox[T]) getSaveOnce() *sync.Once {
+	o.timerMut.Lock()
+	defer o.timerMut.Unlock()
+	return o.saveOnce
+}
+
+func (o *memoryOutbox[T]) setSaveOnce(once *sync.Once) {
+	o.timerMut.Lock()
+	defer o.timerMut.Unlock()
+	o.saveOnce = once
+}
@@ -0,0 +1,41 @@
+package speicher
+
+import "path/filepath"
+
+// WithTempDir makes the store create the temporary files of its saves in dir instead of next to its files,
+// for example on a scratch volume, so saves that fail or are cancelled never take up space on the data volume.
+// Files are still replaced atomically: if dir is on another volume, the finished file is copied
+// next to the store file before it replaces it, since files can only be renamed atomically within a volume.
+// Stores loaded with WithFileSystem ignore it.
+func WithTempDir(dir string) Option {
+	return func(o *storeOptions) {
+		o.tempDir = dir
+	}
+}
+
+// WithSegmentDir places the segment files of a disk-backed Map or a segmented List (see WithSegments)
+// in dir instead of next to the store file, for example on a larger volume.
+// Segments keep their names, so the directory can be shared by several stores with different file names.
+// The store must always be loaded with the same directory, or it won't find its segments.
+// Other stores ignore it.
+func WithSegmentDir(dir string) Option {
+	return func(o *storeOptions) {
+		o.segmentDir = dir
+	}
+}
+
+// segmentBase returns the location the segment files of the store at location are named after.
+func (o storeOptions) segmentBase(location string) string {
+	if o.segmentDir == "" {
+		return location
+	}
+	return filepath.Join(o.segmentDir, filepath.Base(location))
+}
+
+// prepareSegmentDir creates the directory set with WithSegmentDir, if any.
+func (o storeOptions) prepareSegmentDir() error {
+	if o.segmentDir == "" {
+		return nil
+	}
+	return o.files().MkdirAll(o.segmentDir, 0740)
+}
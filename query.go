@@ -0,0 +1,241 @@
+package speicher
+
+import (
+	"container/heap"
+	"slices"
+)
+
+type (
+	// Query filters, sorts and paginates the elements of a store.
+	// Create one with the Query method of a Map or List, configure it and call Collect or Count.
+	// The store must be at least read locked while Collect or Count runs.
+	//
+	//	s.RLock(users)
+	//	page := users.Query().
+	//		Where(func(u User) bool { return u.Active }).
+	//		SortBy(func(a, b User) bool { return a.Name < b.Name }).
+	//		Offset(100).
+	//		Limit(20).
+	//		Collect()
+	//	s.RUnlock(users)
+	//
+	// Without SortBy, elements are returned in the iteration order of the store,
+	// which is random for a Map. Use SortBy to paginate a Map consistently.
+	Query[T any] struct {
+		source func(yield func(T) bool)
+		where  []func(T) bool
+		less   func(a, b T) bool
+		offset int
+		limit  int
+	}
+
+	// queryItem is a match of a sorted Query with its position in the iteration order,
+	// which breaks ties so that equal elements keep their order.
+	queryItem[T any] struct {
+		value T
+		seq   int
+	}
+
+	// queryHeap keeps the smallest matches of a sorted Query with the largest on top.
+	queryHeap[T any] struct {
+		items []queryItem[T]
+		less  func(a, b T) bool
+	}
+)
+
+// newQuery returns a Query over the elements yielded by source.
+func newQuery[T any](source func(yield func(T) bool)) *Query[T] {
+	return &Query[T]{source: source, limit: -1}
+}
+
+// Where only keeps elements for which pred returns true.
+// Multiple calls are combined, so all predicates must match.
+func (q *Query[T]) Where(pred func(T) bool) *Query[T] {
+	q.where = append(q.where, pred)
+	return q
+}
+
+// SortBy sorts the elements so that a comes before b if less(a, b) is true.
+// Equal elements keep their iteration order.
+func (q *Query[T]) SortBy(less func(a, b T) bool) *Query[T] {
+	q.less = less
+	return q
+}
+
+// Offset skips the first n matching elements.
+func (q *Query[T]) Offset(n int) *Query[T] {
+	q.offset = max(n, 0)
+	return q
+}
+
+// Limit returns at most n elements. A negative n removes the limit.
+func (q *Query[T]) Limit(n int) *Query[T] {
+	q.limit = n
+	return q
+}
+
+// Collect runs the query and returns the selected elements.
+// Requires at least a read lock on the store.
+func (q *Query[T]) Collect() []T {
+	if q.limit == 0 {
+		return nil
+	}
+	if q.less == nil {
+		return q.collectUnsorted()
+	}
+	return q.collectSorted()
+}
+
+// Count runs the query and returns the number of matching elements, ignoring Offset and Limit.
+// Requires at least a read lock on the store.
+func (q *Query[T]) Count() int {
+	n := 0
+	q.source(func(value T) bool {
+		if q.matches(value) {
+			n++
+		}
+		return true
+	})
+	return n
+}
+
+func (q *Query[T]) matches(value T) bool {
+	for _, pred := range q.where {
+		if !pred(value) {
+			return false
+		}
+	}
+	return true
+}
+
+// collectUnsorted returns the matches in iteration order and stops as soon as the page is full.
+func (q *Query[T]) collectUnsorted() []T {
+	var values []T
+	skipped := 0
+	q.source(func(value T) bool {
+		if !q.matches(value) {
+			return true
+		}
+		if skipped < q.offset {
+			skipped++
+			return true
+		}
+		values = append(values, value)
+		return q.limit < 0 || len(values) < q.limit
+	})
+	return values
+}
+
+// collectSorted sorts the matches.
+// With a limit only the first offset+limit matches are kept while iterating.
+func (q *Query[T]) collectSorted() []T {
+	h := &queryHeap[T]{less: q.less}
+	keep := q.offset + q.limit
+	seq := 0
+	q.source(func(value T) bool {
+		if !q.matches(value) {
+			return true
+		}
+		item := queryItem[T]{value: value, seq: seq}
+		seq++
+		if q.limit < 0 || len(h.items) < keep {
+			h.items = append(h.items, item)
+			if q.limit >= 0 && len(h.items) == keep {
+				heap.Init(h)
+			}
+		} else if h.before(item, h.items[0]) {
+			h.items[0] = item
+			heap.Fix(h, 0)
+		}
+		return true
+	})
+
+	slices.SortFunc(h.items, func(a, b queryItem[T]) int {
+		switch {
+		case h.before(a, b):
+			return -1
+		case h.before(b, a):
+			return 1
+		}
+		return 0
+	})
+	if q.offset >= len(h.items) {
+		return nil
+	}
+	items := h.items[q.offset:]
+	if q.limit >= 0 && len(items) > q.limit {
+		items = items[:q.limit]
+	}
+	values := make([]T, len(items))
+	for i, item := range items {
+		values[i] = item.value
+	}
+	return values
+}
+
+// before reports whether a is sorted before b.
+func (h *queryHeap[T]) before(a, b queryItem[T]) bool {
+	if h.less(a.value, b.value) {
+		return true
+	}
+	if h.less(b.value, a.value) {
+		return false
+	}
+	return a.seq < b.seq
+}
+
+func (h *queryHeap[T]) Len() int {
+	return len(h.items)
+}
+
+func (h *queryHeap[T]) Less(i, j int) bool {
+	return h.before(h.items[j], h.items[i])
+}
+
+func (h *queryHeap[T]) Swap(i, j int) {
+	h.items[i], h.items[j] = h.items[j], h.items[i]
+}
+
+func (h *queryHeap[T]) Push(x any) {
+	h.items = append(h.items, x.(queryItem[T]))
+}
+
+func (h *queryHeap[T]) Pop() any {
+	item := h.items[len(h.items)-1]
+	h.items = h.items[:len(h.items)-1]
+	return item
+}
+
+func (m *memoryMap[T]) Query() *Query[T] {
+	return newQuery(func(yield func(T) bool) {
+		for _, value := range m.Iterate {
+			if !yield(value) {
+				return
+			}
+		}
+	})
+}
+
+func (m *memoryOrderedMap[T]) Query() *Query[T] {
+	return newQuery(func(yield func(T) bool) {
+		for _, value := range m.Iterate {
+			if !yield(value) {
+				return
+			}
+		}
+	})
+}
+
+func (m *shardedMap[T]) Query() *Query[T] {
+	return newQuery(func(yield func(T) bool) {
+		for _, value := range m.Iterate {
+			if !yield(value) {
+				return
+			}
+		}
+	})
+}
+
+func (l *memoryList[T]) Query() *Query[T] {
+	return newQuery(l.Iterate)
+}
@@ -0,0 +1,293 @@
+package speicher
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+type (
+	// memoryQueue is a Queue implementation that keeps all elements in memory.
+	memoryQueue[T any] struct {
+		id       storeID
+		data     []T
+		location string
+		codec    codec
+		opts     storeOptions
+		mut      sync.RWMutex
+
+		// pushed is closed by the next Push to wake up PopWait, nil while nobody waits
+		pushMut sync.Mutex
+		pushed  chan struct{}
+
+		timerMut     sync.Mutex
+		saveTimer    *time.Timer
+		maxSaveTimer *time.Timer
+		saveOnce     *sync.Once
+	}
+
+	// Queue is a thread-safe, persistent first-in, first-out queue.
+	// Unlike an Outbox, popped elements are gone, so an element is processed at most once.
+	//
+	// All operations except PopWait require appropriate locking via a State object:
+	//
+	//	s := speicher.NewState()
+	//	s.Lock(queue)
+	//	job, ok := queue.Pop()
+	//	s.Unlock(queue)
+	Queue[T any] interface {
+		lockable
+
+		// Push adds the value to the end of the Queue.
+		// Requires a write lock.
+		Push(value T)
+
+		// Pop removes and returns the first element of the Queue.
+		// If the Queue is empty, the bool result will be false.
+		// Requires a write lock.
+		Pop() (value T, found bool)
+
+		// PopWait removes and returns the first element of the Queue like Pop,
+		// but waits for an element to be pushed if the Queue is empty.
+		// It returns the error of ctx if ctx is done first.
+		// This method acquires its own write lock internally, so the caller must not hold a lock on the Queue.
+		PopWait(ctx context.Context) (T, error)
+
+		// Peek returns the first element of the Queue without removing it.
+		// If the Queue is empty, the bool result will be false.
+		// Requires at least a read lock.
+		Peek() (value T, found bool)
+
+		// Len returns the number of elements in the Queue.
+		// Requires at least a read lock.
+		Len() int
+
+		// Iterate iterates over the elements of the Queue from first to last.
+		// Requires at least a read lock.
+		Iterate(yield func(v T) bool)
+
+		// Save persists the current state of the Queue to its underlying data store.
+		// It returns an error if the operation fails.
+		// This method acquires its own read lock internally.
+		Save() error
+
+		// SaveCtx persists the current state of the data store like Save,
+		// but aborts when ctx is cancelled or its deadline passes.
+		// An aborted save removes its temporary files and leaves the previous file intact.
+		// This method acquires its own read lock internally.
+		SaveCtx(ctx context.Context) error
+
+		// Close stops the automatic save and the background goroutines of the store and saves it one last time.
+		// The store must not be used afterwards.
+		// This method acquires its own read lock internally.
+		Close() error
+	}
+)
+
+func (q *memoryQueue[T]) Push(value T) {
+	q.data = append(q.data, value)
+	q.pushMut.Lock()
+	defer q.pushMut.Unlock()
+	if q.pushed != nil {
+		close(q.pushed)
+		q.pushed = nil
+	}
+}
+
+func (q *memoryQueue[T]) Pop() (value T, found bool) {
+	if len(q.data) == 0 {
+		return
+	}
+	value = q.data[0]
+	// Clear the slot, so the backing array doesn't keep the value alive
+	var zero T
+	q.data[0] = zero
+	q.data = q.data[1:]
+	return value, true
+}
+
+func (q *memoryQueue[T]) PopWait(ctx context.Context) (T, error) {
+	s := borrowState()
+	defer returnState(s)
+	for {
+		// Fetched before looking at the Queue, so a Push in between isn't missed
+		next := q.next()
+		if err := s.LockContext(ctx, q); err != nil {
+			var zero T
+			return zero, err
+		}
+		value, ok := q.Pop()
+		s.Unlock(q)
+		if ok {
+			return value, nil
+		}
+		select {
+		case <-next:
+		case <-ctx.Done():
+			var zero T
+			return zero, ctx.Err()
+		}
+	}
+}
+
+// next returns a channel that is closed by the next Push.
+func (q *memoryQueue[T]) next() <-chan struct{} {
+	q.pushMut.Lock()
+	defer q.pushMut.Unlock()
+	if q.pushed == nil {
+		q.pushed = make(chan struct{})
+	}
+	return q.pushed
+}
+
+func (q *memoryQueue[T]) Peek() (value T, found bool) {
+	if len(q.data) == 0 {
+		return
+	}
+	return q.data[0], true
+}
+
+func (q *memoryQueue[T]) Len() int {
+	return len(q.data)
+}
+
+func (q *memoryQueue[T]) Iterate(yield func(v T) bool) {
+	for _, value := range q.data {
+		if !yield(value) {
+			break
+		}
+	}
+}
+
+func (q *memoryQueue[T]) getStoreID() storeID {
+	return q.id
+}
+
+func (q *memoryQueue[T]) getMutex() *sync.RWMutex {
+	return &q.mut
+}
+
+func (q *memoryQueue[T]) getOptions() *storeOptions {
+	return &q.opts
+}
+
+func (q *memoryQueue[T]) Save() error {
+	return q.SaveCtx(context.Background())
+}
+
+func (q *memoryQueue[T]) SaveCtx(ctx context.Context) error {
+	s := saveState(ctx)
+	s.RLock(q)
+	defer s.RUnlock(q)
+
+	h := sha256.New()
+	err := q.opts.saveFile(ctx, q.location, func(w io.Writer) error {
+		return q.codec.encode(io.MultiWriter(w, h), q.data)
+	})
+	if err != nil {
+		return errors.Join(fmt.Errorf("failed to write file '%s'", q.location), err)
+	}
+	if err := q.opts.recordHash(q.location, h.Sum(nil)); err != nil {
+		return errors.Join(fmt.Errorf("failed to update manifest for '%s'", q.location), err)
+	}
+	return nil
+}
+
+func (q *memoryQueue[T]) encodeData(w io.Writer, c codec) error {
+	return c.encode(w, q.data)
+}
+
+func (q *memoryQueue[T]) decodedEquals(r io.Reader, c codec) (bool, error) {
+	var data []T
+	if err := c.decode(r, &data); err != nil {
+		return false, err
+	}
+	return sameData(q.data, data)
+}
+
+// LoadQueue loads a Queue from location. The file has the same format as the file of a List,
+// so a List can be turned into a Queue by loading its file.
+// If the file does not exist, an empty Queue is returned.
+func LoadQueue[T any](location string, opts ...Option) (Queue[T], error) {
+	options := newStoreOptions(opts)
+	lock, err := lockFile(location, options)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.releaseUnclaimed()
+	c, err := resolveCodec(location, options)
+	if err != nil {
+		return nil, err
+	}
+	if q, err := loadQueueFromFile[T](location, c, options); err != nil {
+		return nil, errors.Join(fmt.Errorf("unable to load queue from file '%s'", location), err)
+	} else {
+		opened(q, location)
+		return q, nil
+	}
+}
+
+func loadQueueFromFile[T any](location string, c codec, opts storeOptions) (Queue[T], error) {
+	q := &memoryQueue[T]{
+		id:       newStoreID(),
+		location: location,
+		codec:    c,
+		opts:     opts,
+		data:     make([]T, 0),
+	}
+	f, err := q.opts.openFile(location)
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = q.opts.files().MkdirAll(filepath.Dir(location), 0740)
+			return q, err
+		}
+		return nil, errors.Join(fmt.Errorf("failed to open file '%s' (file exists)", location), err)
+	}
+	defer f.Close()
+	if err := c.decode(q.opts.withProgress(f), &q.data); err != nil {
+		return nil, errors.Join(fmt.Errorf("failed to decode file '%s'", location), err)
+	}
+	return q, nil
+}
+
+func (q *memoryQueue[T]) getSaveTimer() *time.Timer {
+	q.timerMut.Lock()
+	defer q.timerMut.Unlock()
+	return q.saveTimer
+}
+
+func (q *memoryQueue[T]) setSaveTimer(t *time.Timer) {
+	q.timerMut.Lock()
+	defer q.timerMut.Unlock()
+	q.saveTimer = t
+}
+
+func (q *memoryQueue[T]) getMaxSaveTimer() *time.Timer {
+	q.timerMut.Lock()
+	defer q.timerMut.Unlock()
+	return q.maxSaveTimer
+}
+
+func (q *memoryQueue[T]) setMaxSaveTimer(t *time.Timer) {
+	q.timerMut.Lock()
+	defer q.timerMut.Unlock()
+	q.maxSaveTimer = t
+}
+
+func (q *memoryQueue[T]) getSaveOnce() *sync.Once {
+	q.timerMut.Lock()
+	defer q.timerMut.Unlock()
+	return q.saveOnce
+}
+
+func (q *memoryQueue[T]) setSaveOnce(once *sync.Once) {
+	q.timerMut.Lock()
+	defer q.timerMut.Unlock()
+	q.saveOnce = once
+}
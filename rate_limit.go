@@ -0,0 +1,108 @@
+package speicher
+
+import "time"
+
+// RateBucket is the persisted token bucket of one client of a RateLimiter.
+type RateBucket struct {
+	// Tokens is the number of tokens left at Updated.
+	Tokens float64 `json:"tokens"`
+	// Updated is when Tokens was last computed.
+	Updated time.Time `json:"updated"`
+}
+
+// RateLimiter limits how often each client may do something with a token bucket per client, kept in a Map,
+// so the limits survive restarts. Every client starts with burst tokens and gets one token back every interval,
+// up to burst. Each allowed event takes one token.
+//
+// Buckets expire once they are full again, so the Map only holds clients that were active recently.
+//
+// All methods acquire their own locks internally.
+type RateLimiter struct {
+	buckets Map[RateBucket]
+	every   time.Duration
+	burst   int
+}
+
+// LoadRateLimiter loads the buckets stored at location and returns a RateLimiter
+// that refills one token every interval up to burst.
+// Unless opts contain WithExpiryReaper, full buckets are removed every minute.
+func LoadRateLimiter(location string, every time.Duration, burst int, opts ...Option) (*RateLimiter, error) {
+	opts = append([]Option{WithExpiryReaper(time.Minute)}, opts...)
+	m, err := LoadMap[RateBucket](location, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return NewRateLimiter(m, every, burst), nil
+}
+
+// NewRateLimiter returns a RateLimiter that keeps the buckets in m, keyed by client,
+// and refills one token every interval up to burst.
+// For a ShardedMap, only the shard holding the client is locked.
+func NewRateLimiter(m Map[RateBucket], every time.Duration, burst int) *RateLimiter {
+	return &RateLimiter{buckets: m, every: every, burst: burst}
+}
+
+// Map returns the Map holding the buckets.
+func (l *RateLimiter) Map() Map[RateBucket] {
+	return l.buckets
+}
+
+// Allow reports whether key may do one event now and takes a token if so.
+func (l *RateLimiter) Allow(key string) bool {
+	return l.AllowN(key, 1)
+}
+
+// AllowN reports whether key may do n events now and takes n tokens if so.
+// If not, no tokens are taken.
+func (l *RateLimiter) AllowN(key string, n int) bool {
+	store := keyLock(l.buckets, key)
+	s := borrowState()
+	defer returnState(s)
+	s.Lock(store)
+	defer s.Unlock(store)
+
+	now := time.Now()
+	tokens := l.tokens(key, now)
+	if tokens < float64(n) {
+		return false
+	}
+	tokens -= float64(n)
+	l.buckets.SetWithTTL(key, RateBucket{Tokens: tokens, Updated: now}, l.refillTime(tokens))
+	return true
+}
+
+// Tokens returns the number of tokens key has left now.
+func (l *RateLimiter) Tokens(key string) float64 {
+	store := keyLock(l.buckets, key)
+	s := borrowState()
+	defer returnState(s)
+	s.RLock(store)
+	defer s.RUnlock(store)
+	return l.tokens(key, time.Now())
+}
+
+// Reset refills the bucket of key.
+func (l *RateLimiter) Reset(key string) {
+	DeleteKey(l.buckets, key)
+}
+
+// tokens returns the number of tokens of key at now, including the ones refilled since the last update.
+// Requires at least a read lock.
+func (l *RateLimiter) tokens(key string, now time.Time) float64 {
+	b, ok := l.buckets.Get(key)
+	if !ok || l.every <= 0 {
+		return float64(l.burst)
+	}
+	b.Tokens += float64(now.Sub(b.Updated)) / float64(l.every)
+	return min(b.Tokens, float64(l.burst))
+}
+
+// refillTime returns how long a bucket with the given number of tokens takes to be full.
+func (l *RateLimiter) refillTime(tokens float64) time.Duration {
+	return time.Duration((float64(l.burst) - tokens) * float64(l.every))
+}
+
+// Close closes the Map holding the buckets, saving it one last time.
+func (l *RateLimiter) Close() error {
+	return l.buckets.Close()
+}
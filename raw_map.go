@@ -0,0 +1,71 @@
+package speicher
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// LoadRawMap loads a Map of undecoded JSON values from location, for components that store documents
+// they don't fully model, like a gateway that routes them by a few fields.
+// Values are kept exactly as they were stored, including fields no caller knows about,
+// and are only decoded on read into the type a caller needs with DecodeEntry or DecodeField.
+//
+// Store values with SetEntry, which checks that they are valid JSON; invalid values set directly
+// make the next save fail. Files in a MessagePack format hold the values as JSON text.
+func LoadRawMap(location string, opts ...Option) (Map[json.RawMessage], error) {
+	return LoadMap[json.RawMessage](location, opts...)
+}
+
+// DecodeEntry decodes the value associated with the given key into T, which only needs to declare
+// the fields the caller reads. The bool result is false if the key doesn't exist.
+// Returns an error if the value can't be decoded into T.
+// Requires at least a read lock.
+func DecodeEntry[T any](m Map[json.RawMessage], key string) (value T, found bool, err error) {
+	raw, ok := m.Get(key)
+	if !ok {
+		return value, false, nil
+	}
+	if err := json.Unmarshal(raw, &value); err != nil {
+		return value, true, errors.Join(fmt.Errorf("failed to decode entry '%s'", key), err)
+	}
+	return value, true, nil
+}
+
+// DecodeField decodes a single field of the value associated with the given key into T.
+// path addresses the field like a Document path, with object keys and array indices separated by dots,
+// like "customer.address.city" or "items.0.sku". The bool result is false if the key or the field doesn't exist.
+// Returns an error if the value isn't valid JSON or the field can't be decoded into T.
+// Requires at least a read lock.
+func DecodeField[T any](m Map[json.RawMessage], key, path string) (value T, found bool, err error) {
+	raw, ok := m.Get(key)
+	if !ok {
+		return value, false, nil
+	}
+	var tree any
+	if err := json.Unmarshal(raw, &tree); err != nil {
+		return value, false, errors.Join(fmt.Errorf("failed to decode entry '%s'", key), err)
+	}
+	node, ok := lookupPath(tree, path)
+	if !ok {
+		return value, false, nil
+	}
+	// The tree only holds values decoded from JSON, which always encode
+	b, _ := json.Marshal(node)
+	if err := json.Unmarshal(b, &value); err != nil {
+		return value, true, errors.Join(fmt.Errorf("failed to decode field '%s' of entry '%s'", path, key), err)
+	}
+	return value, true, nil
+}
+
+// SetEntry encodes value as JSON and stores it with the given key like TrySet.
+// A json.RawMessage value is checked and stored in its compact form.
+// Returns an error if value can't be encoded.
+// Requires a write lock.
+func SetEntry(m Map[json.RawMessage], key string, value any) error {
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return errors.Join(fmt.Errorf("failed to encode entry '%s'", key), err)
+	}
+	return m.TrySet(key, raw)
+}
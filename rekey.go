@@ -0,0 +1,88 @@
+package speicher
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// rekeyed returns data and expires with every key replaced by the one fn returns for it.
+// It also returns the new key of each old key. Expired elements are dropped.
+// If two elements get the same key, an error is returned.
+func rekeyed[T any](data map[string]T, expires map[string]time.Time, isExpired func(key string) bool, fn func(oldKey string, value T) string) (map[string]T, map[string]time.Time, map[string]string, error) {
+	newData := make(map[string]T, len(data))
+	var newExpires map[string]time.Time
+	renamed := make(map[string]string, len(data))
+	from := make(map[string]string, len(data))
+	for key, value := range data {
+		if isExpired(key) {
+			continue
+		}
+		newKey := fn(key, value)
+		if other, exists := from[newKey]; exists {
+			if other > key {
+				other, key = key, other
+			}
+			return nil, nil, nil, fmt.Errorf("keys '%s' and '%s' are both renamed to '%s'", other, key, newKey)
+		}
+		from[newKey] = key
+		renamed[key] = newKey
+		newData[newKey] = value
+		if t, ok := expires[key]; ok {
+			if newExpires == nil {
+				newExpires = make(map[string]time.Time)
+			}
+			newExpires[newKey] = t
+		}
+	}
+	return newData, newExpires, renamed, nil
+}
+
+func (m *memoryMap[T]) Rekey(fn func(oldKey string, value T) string) error {
+	data, expires, _, err := rekeyed(m.data, m.expires, m.isExpired, fn)
+	if err != nil {
+		return err
+	}
+	m.changes.record(ChangeEvent[T]{Op: ChangeOverwrite})
+	m.data = data
+	m.expires = expires
+	return nil
+}
+
+func (m *memoryOrderedMap[T]) Rekey(fn func(oldKey string, value T) string) error {
+	data, expires, renamed, err := rekeyed(m.data, m.expires, m.isExpired, fn)
+	if err != nil {
+		return err
+	}
+	m.changes.record(ChangeEvent[T]{Op: ChangeOverwrite})
+	keys := make([]string, 0, len(data))
+	for _, key := range m.keys {
+		if newKey, ok := renamed[key]; ok {
+			keys = append(keys, newKey)
+		}
+	}
+	if m.sorted() {
+		sort.Strings(keys)
+	}
+	m.data = data
+	m.expires = expires
+	m.keys = keys
+	return nil
+}
+
+func (m *shardedMap[T]) Rekey(fn func(oldKey string, value T) string) error {
+	merged := m.merged()
+	data, expires, _, err := rekeyed(merged.data, merged.expires, merged.isExpired, fn)
+	if err != nil {
+		return err
+	}
+	m.Overwrite(data)
+	for key, t := range expires {
+		shard := m.shardOf(key)
+		if shard.expires == nil {
+			shard.expires = make(map[string]time.Time)
+		}
+		shard.expires[key] = t
+	}
+	return nil
+}
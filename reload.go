@@ -0,0 +1,192 @@
+package speicher
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+)
+
+// autoReloadInterval is how often a store loaded with WithAutoReload checks its file.
+const autoReloadInterval = time.Second
+
+// reloadable is implemented by stores that can replace their data with the content of their file.
+type reloadable interface {
+	lockable
+	// reload replaces the data with the decoded file content and reports whether it differed.
+	// The caller must hold a write lock.
+	reload(data []byte) (bool, error)
+}
+
+// WithAutoReload checks the file of the store every second and reloads the data if it was changed
+// by another program, for example when editing fixture files by hand during development.
+// Watchers receive a ChangeOverwrite event for every reload. Saves of the store itself don't trigger a reload.
+// If the file can't be decoded, the error is reported like a failed automatic save (see WithSaveErrorHandler)
+// and the data is kept.
+//
+// It applies to Map, OrderedMap and unsegmented List stores; other stores ignore it.
+// Expiry times are dropped on reload.
+func WithAutoReload() Option {
+	return func(o *storeOptions) {
+		o.autoReload = true
+	}
+}
+
+// startAutoReload reloads store from location whenever the file changes until the store is closed.
+// Does nothing if WithAutoReload is not set or the store can't be reloaded.
+func startAutoReload(store any, location string, o storeOptions) {
+	r, ok := store.(reloadable)
+	if !ok || !o.autoReload {
+		return
+	}
+	done := closedChan(r.getStoreID())
+	go func() {
+		ticker := time.NewTicker(autoReloadInterval)
+		defer ticker.Stop()
+		last := o.fileVersion(location) + o.revisionVersion(location)
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			version := o.fileVersion(location)
+			if version == "" {
+				continue
+			}
+			own := o.saved.wrote(location, version)
+			version += o.revisionVersion(location)
+			if version == last {
+				continue
+			}
+			last = version
+			if own {
+				continue
+			}
+			if err := reloadStore(r, location, o); err != nil {
+				o.reportError(errors.Join(fmt.Errorf("failed to reload file '%s'", location), err))
+			}
+		}
+	}()
+}
+
+// fileVersion returns a string that changes whenever the file at location changes, or "" if it doesn't exist.
+// The file system of the operating system is checked by modification time and size, others by content.
+func (o storeOptions) fileVersion(location string) string {
+	if o.doubleBuffer {
+		location = pointerLocation(location)
+	}
+	if o.fileSystem == nil {
+		info, err := os.Stat(location)
+		if err != nil {
+			return ""
+		}
+		return fmt.Sprintf("%d/%d", info.ModTime().UnixNano(), info.Size())
+	}
+	f, err := o.files().Open(location)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// reloadStore reads the file of store and replaces its data under a write lock if it differs.
+// It locks the store directly instead of using a State, so the reload doesn't trigger an automatic save.
+func reloadStore(store reloadable, location string, o storeOptions) error {
+	// The revisions are saved after the data, so reading them first never yields a revision newer than the data
+	var revs *revisions
+	if revisionsOf(store) != nil {
+		c, err := resolveCodec(location, o)
+		if err != nil {
+			return err
+		}
+		if revs, err = o.loadRevisions(location, c); err != nil {
+			return err
+		}
+	}
+	f, err := o.openFile(location)
+	if err != nil {
+		return err
+	}
+	data, err := io.ReadAll(f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	mut := store.getMutex()
+	mut.Lock()
+	// The store may have saved since the file was read, and its data may have changed since
+	if o.saved.wrote(location, o.fileVersion(location)) {
+		mut.Unlock()
+		return nil
+	}
+	changed, err := store.reload(data)
+	if revs != nil && err == nil {
+		revisionsOf(store).adopt(revs, changed)
+	}
+	if changed && o.afterLoad != nil {
+		o.afterLoad(store)
+	}
+	flushAudit(store, "")
+	mut.Unlock()
+	if p, ok := store.(publisher); ok && changed {
+		p.publishChanges()
+	}
+	return err
+}
+
+func (m *memoryMap[T]) reload(data []byte) (bool, error) {
+	fresh := &memoryMap[T]{data: map[string]T{}, opts: m.opts}
+	if err := fresh.decodeData(bytes.NewReader(data), m.codec); err != nil {
+		return false, err
+	}
+	if equal, err := sameData(m.data, fresh.data); err != nil || equal {
+		return false, err
+	}
+	m.Overwrite(fresh.data)
+	return true, nil
+}
+
+func (m *memoryOrderedMap[T]) reload(data []byte) (bool, error) {
+	var entries orderedEntries[T]
+	if err := m.codec.decode(bytes.NewReader(data), &entries); err != nil {
+		return false, err
+	}
+	if entries.data == nil {
+		entries.data = map[string]T{}
+	}
+	if m.sorted() {
+		sort.Strings(entries.keys)
+	}
+	if equal, err := sameData(m.entries(), entries); err != nil || equal {
+		return false, err
+	}
+	m.changes.record(ChangeEvent[T]{Op: ChangeOverwrite})
+	m.data, m.keys, m.expires = entries.data, entries.keys, nil
+	return true, nil
+}
+
+func (l *memoryList[T]) reload(data []byte) (bool, error) {
+	if l.segments != nil {
+		return false, nil
+	}
+	var values []T
+	if err := l.codec.decode(bytes.NewReader(data), &values); err != nil {
+		return false, err
+	}
+	if equal, err := sameData(l.data, values); err != nil || equal {
+		return false, err
+	}
+	l.Overwrite(values)
+	return true, nil
+}
@@ -0,0 +1,331 @@
+package speicher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"sync"
+)
+
+// ErrRevisionMismatch is returned by SetIfRevision if the element was changed since the given revision.
+var ErrRevisionMismatch = errors.New("revision mismatch")
+
+// errNoRevisions is returned by SetIfRevision for stores loaded without WithRevisions.
+var errNoRevisions = errors.New("revisions are not enabled, see WithRevisions")
+
+type (
+	// revisions tracks the revision of every element of a store.
+	// Every change increments the revision of the store and sets the revision of the changed element to it,
+	// so an element never gets a revision it had before, even if it is deleted and added again.
+	revisions struct {
+		mut  sync.Mutex
+		file revisionsFile
+		// advanced is closed on the next change, see next.
+		advanced chan struct{}
+	}
+
+	// revisionsFile is the persisted form of revisions.
+	revisionsFile struct {
+		// Revision is the revision of the latest change.
+		Revision uint64 `json:"revision"`
+		// Base is the revision of all elements that are not in Keys,
+		// which weren't changed since the store was overwritten or loaded without revisions.
+		Base uint64 `json:"base"`
+		// Keys holds the revision of every element changed since.
+		Keys map[string]uint64 `json:"keys,omitempty"`
+	}
+
+	// revisioned is implemented by stores that can track revisions.
+	revisioned interface {
+		// getRevisions returns the revisions of the store, or nil if it was loaded without WithRevisions.
+		getRevisions() *revisions
+	}
+)
+
+// WithRevisions tracks a revision number for every element of a Map, which changes whenever the element does.
+// Read an element with GetWithRevision and write it back with SetIfRevision to detect that another writer
+// changed it in the meantime, for example between showing a form to a user and saving it.
+// Revisions are persisted in the sidecar file location.rev.
+//
+// It applies to Map, OrderedMap, ShardedMap and disk-backed Map stores; other stores ignore it.
+func WithRevisions() Option {
+	return func(o *storeOptions) {
+		o.revisions = true
+	}
+}
+
+// RevisionHeader is the HTTP header carrying the revision of a store, see Handler.
+const RevisionHeader = "Speicher-Revision"
+
+// Revision returns the revision of the latest change of store, or 0 if it was loaded without WithRevisions.
+// The revision only grows, so it can be handed to clients as a consistency token after a write:
+// a replica of the store that has reached the same revision (see WaitForRevision) contains the write.
+// Requires at least a read lock.
+func Revision(store Store) uint64 {
+	r := revisionsOf(store)
+	if r == nil {
+		return 0
+	}
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	return r.file.Revision
+}
+
+// WaitForRevision blocks until store has reached at least revision rev (see Revision)
+// or ctx is done, for example to read your own writes from a replica that follows the file
+// of another process with WithAutoReload. Returns an error if store was loaded without WithRevisions.
+//
+// This function acquires its own read locks on store.
+func WaitForRevision(ctx context.Context, store Store, rev uint64) error {
+	r := revisionsOf(store)
+	if r == nil {
+		return errNoRevisions
+	}
+	s := borrowState()
+	defer returnState(s)
+	for {
+		next := r.next()
+		if err := s.RLockContext(ctx, store); err != nil {
+			return err
+		}
+		current := Revision(store)
+		s.RUnlock(store)
+		if current >= rev {
+			return nil
+		}
+		select {
+		case <-next:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// revisionsOf returns the revisions of store, or nil if it doesn't track any.
+func revisionsOf(store any) *revisions {
+	if r, ok := store.(revisioned); ok {
+		return r.getRevisions()
+	}
+	return nil
+}
+
+// revisionLocation returns the location of the sidecar file holding the revisions of a store.
+func revisionLocation(location string) string {
+	return location + ".rev"
+}
+
+func newRevisions() *revisions {
+	return &revisions{file: revisionsFile{Revision: 1, Base: 1}}
+}
+
+// changed records a change of the store.
+func (r *revisions) changed(op ChangeOp, key string) {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	r.file.Revision++
+	switch op {
+	case ChangeOverwrite:
+		r.file.Base = r.file.Revision
+		r.file.Keys = nil
+	case ChangeDelete:
+		delete(r.file.Keys, key)
+	default:
+		if r.file.Keys == nil {
+			r.file.Keys = make(map[string]uint64)
+		}
+		r.file.Keys[key] = r.file.Revision
+	}
+	r.advance()
+}
+
+// adopt replaces the revisions with the ones read from the sidecar file after the store was reloaded.
+// Unless the reload changed the data, only newer revisions are adopted,
+// so reloading a save of the store itself doesn't roll back changes made since.
+func (r *revisions) adopt(loaded *revisions, changed bool) {
+	loaded.mut.Lock()
+	file := loaded.file
+	loaded.mut.Unlock()
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	if !changed && file.Revision <= r.file.Revision {
+		return
+	}
+	r.file = file
+	r.advance()
+}
+
+// advance wakes up everybody waiting for the next change.
+// The caller must hold r.mut.
+func (r *revisions) advance() {
+	if r.advanced != nil {
+		close(r.advanced)
+		r.advanced = nil
+	}
+}
+
+// next returns a channel that is closed on the next change of the revisions.
+func (r *revisions) next() <-chan struct{} {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	if r.advanced == nil {
+		r.advanced = make(chan struct{})
+	}
+	return r.advanced
+}
+
+// of returns the revision of the element with the given key, which must exist.
+func (r *revisions) of(key string) uint64 {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	if rev, ok := r.file.Keys[key]; ok {
+		return rev
+	}
+	return r.file.Base
+}
+
+// snapshot captures the revisions and returns a function that restores them.
+func (r *revisions) snapshot() func() {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	file := r.file
+	file.Keys = maps.Clone(r.file.Keys)
+	return func() {
+		r.mut.Lock()
+		defer r.mut.Unlock()
+		r.file = file
+	}
+}
+
+// snapshotRevisions captures the revisions of the feed, if it tracks any, and returns a function that restores them.
+func (f *changeFeed[T]) snapshotRevisions() func() {
+	if f.revs == nil {
+		return func() {}
+	}
+	return f.revs.snapshot()
+}
+
+// withRevision returns the revision of an element that was looked up, or 0 if it wasn't found
+// or the store has no revisions.
+func withRevision[T any](r *revisions, key string, value T, found bool) (T, uint64, bool) {
+	if !found || r == nil {
+		return value, 0, found
+	}
+	return value, r.of(key), true
+}
+
+// setIfRevision calls set if the element with the given key has revision rev,
+// which is 0 if it must not exist.
+func setIfRevision(r *revisions, key string, exists bool, rev uint64, set func() error) error {
+	if r == nil {
+		return errNoRevisions
+	}
+	var current uint64
+	if exists {
+		current = r.of(key)
+	}
+	if current != rev {
+		return errors.Join(fmt.Errorf("element '%s' has revision %d, not %d", key, current, rev), ErrRevisionMismatch)
+	}
+	return set()
+}
+
+// loadRevisions reads the revisions of the store at location, if it tracks revisions.
+// A store without the sidecar file starts with all elements at the same revision.
+func (o storeOptions) loadRevisions(location string, c codec) (*revisions, error) {
+	if !o.revisions {
+		return nil, nil
+	}
+	r := newRevisions()
+	f, err := o.files().Open(revisionLocation(location))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return r, nil
+		}
+		return nil, errors.Join(fmt.Errorf("failed to open file '%s' (file exists)", revisionLocation(location)), err)
+	}
+	defer f.Close()
+	if err := c.decode(f, &r.file); err != nil {
+		return nil, errors.Join(fmt.Errorf("failed to decode file '%s'", revisionLocation(location)), err)
+	}
+	return r, nil
+}
+
+// revisionVersion returns a string that changes whenever the revisions of the store at location are saved,
+// or "" if it doesn't track revisions.
+func (o storeOptions) revisionVersion(location string) string {
+	if !o.revisions {
+		return ""
+	}
+	// The sidecar file is written directly even for double-buffered stores
+	o.doubleBuffer = false
+	return o.fileVersion(revisionLocation(location))
+}
+
+// saveRevisions writes the revisions of the store at location, if it tracks any.
+func (o storeOptions) saveRevisions(ctx context.Context, location string, c codec, r *revisions) error {
+	if r == nil {
+		return nil
+	}
+	r.mut.Lock()
+	file := r.file
+	file.Keys = maps.Clone(r.file.Keys)
+	r.mut.Unlock()
+	err := o.writeFileContext(ctx, revisionLocation(location), func(w io.Writer) error {
+		return c.encode(w, file)
+	})
+	if err != nil {
+		return errors.Join(fmt.Errorf("failed to write file '%s'", revisionLocation(location)), err)
+	}
+	return nil
+}
+
+func (m *memoryMap[T]) getRevisions() *revisions {
+	return m.changes.revs
+}
+
+func (m *shardedMap[T]) getRevisions() *revisions {
+	return m.shards[0].changes.revs
+}
+
+func (m *diskMap[T]) getRevisions() *revisions {
+	return m.changes.revs
+}
+
+func (m *memoryMap[T]) GetWithRevision(key string) (T, uint64, bool) {
+	value, found := m.Get(key)
+	return withRevision(m.changes.revs, key, value, found)
+}
+
+func (m *memoryMap[T]) SetIfRevision(key string, value T, rev uint64) error {
+	return setIfRevision(m.changes.revs, key, m.Has(key), rev, func() error {
+		return m.TrySet(key, value)
+	})
+}
+
+func (m *memoryOrderedMap[T]) SetIfRevision(key string, value T, rev uint64) error {
+	return setIfRevision(m.changes.revs, key, m.Has(key), rev, func() error {
+		return m.TrySet(key, value)
+	})
+}
+
+func (m *shardedMap[T]) GetWithRevision(key string) (T, uint64, bool) {
+	return m.shardOf(key).GetWithRevision(key)
+}
+
+func (m *shardedMap[T]) SetIfRevision(key string, value T, rev uint64) error {
+	return m.shardOf(key).SetIfRevision(key, value, rev)
+}
+
+func (m *diskMap[T]) GetWithRevision(key string) (T, uint64, bool) {
+	value, found := m.Get(key)
+	return withRevision(m.changes.revs, key, value, found)
+}
+
+func (m *diskMap[T]) SetIfRevision(key string, value T, rev uint64) error {
+	return setIfRevision(m.changes.revs, key, m.Has(key), rev, func() error {
+		return m.TrySet(key, value)
+	})
+}
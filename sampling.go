@@ -0,0 +1,103 @@
+package speicher
+
+import (
+	"encoding/json"
+	"math/rand/v2"
+	"time"
+)
+
+type (
+	// ChangeSample describes a change of a store picked by WithChangeSampling.
+	ChangeSample struct {
+		// Location is the location the store was loaded from.
+		Location string
+		// Op is the kind of change.
+		Op ChangeOp
+		// Key is the key of the changed Map element or the index of the changed List element.
+		Key string
+		// Size is the size of the new value encoded as JSON in bytes, or of the old value for ChangeDelete.
+		// It is 0 for ChangeOverwrite.
+		Size int
+		// Rate is the sampling rate, so each sample stands for Rate changes on average.
+		Rate int
+		// Time is when the change was made.
+		Time time.Time
+	}
+
+	// changeSampler picks changes of a store at random and reports them.
+	changeSampler struct {
+		location string
+		rate     int
+		fn       func(sample ChangeSample)
+	}
+
+	// sampledStore is implemented by stores that can report samples of their changes.
+	sampledStore interface {
+		setChangeSampler(s *changeSampler)
+	}
+)
+
+// WithChangeSampling reports one in rate changes of the store at random to fn, with the size of the changed value,
+// so the write load of busy stores can be profiled in production without reporting every change.
+// Only the picked changes are encoded to measure their size.
+// fn is called once the write lock of the change is released, on the goroutine releasing it, so it should return quickly.
+// It applies to Map, OrderedMap, ShardedMap, KeyedMap and List stores; other stores ignore it.
+func WithChangeSampling(rate int, fn func(sample ChangeSample)) Option {
+	return func(o *storeOptions) {
+		o.sampleRate = max(rate, 1)
+		o.sampleFn = fn
+	}
+}
+
+// sampleChanges installs the change sampler configured with WithChangeSampling on store.
+func sampleChanges(store lockable, location string) {
+	o := optionsOf(store)
+	s, ok := store.(sampledStore)
+	if o == nil || o.sampleFn == nil || !ok {
+		return
+	}
+	s.setChangeSampler(&changeSampler{location: location, rate: o.sampleRate, fn: o.sampleFn})
+}
+
+// sample returns a ChangeSample for event if it is picked.
+func sample[T any](s *changeSampler, event ChangeEvent[T]) (ChangeSample, bool) {
+	if s.rate > 1 && rand.IntN(s.rate) != 0 {
+		return ChangeSample{}, false
+	}
+	cs := ChangeSample{Location: s.location, Op: event.Op, Key: event.Key, Rate: s.rate, Time: time.Now()}
+	switch event.Op {
+	case ChangeOverwrite:
+	case ChangeDelete:
+		cs.Size = encodedSize(event.Old)
+	default:
+		cs.Size = encodedSize(event.New)
+	}
+	return cs, true
+}
+
+// encodedSize returns the size of value encoded as JSON, or 0 if it can't be encoded.
+func encodedSize(value any) int {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return 0
+	}
+	return len(data)
+}
+
+func (m *memoryMap[T]) setChangeSampler(s *changeSampler) {
+	m.changes.sampler = s
+}
+
+func (m *shardedMap[T]) setChangeSampler(s *changeSampler) {
+	for _, shard := range m.shards {
+		shard.setChangeSampler(s)
+	}
+}
+
+func (l *memoryList[T]) setChangeSampler(s *changeSampler) {
+	l.changes.sampler = s
+}
+
+func (m *diskMap[T]) setChangeSampler(s *changeSampler) {
+	m.changes.sampler = s
+}
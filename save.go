@@ -7,6 +7,7 @@ import (
 )
 
 type savable interface {
+	lockable
 	Save() error
 	getSaveTimer() *time.Timer
 	setSaveTimer(*time.Timer)
@@ -16,6 +17,100 @@ type savable interface {
 	setSaveOnce(*sync.Once)
 }
 
+const (
+	// defaultSaveDebounce is how long a store waits for further changes before saving automatically.
+	defaultSaveDebounce = 2 * time.Second
+	// defaultMaxSaveDelay is how long a store waits at most after a change before saving automatically.
+	defaultMaxSaveDelay = 10 * time.Second
+)
+
+// WithSaveDebounce sets how long the store waits after a change for further changes before it saves automatically.
+// Every change restarts the wait, up to the limit set by WithMaxSaveDelay. The default is 2 seconds.
+func WithSaveDebounce(d time.Duration) Option {
+	return func(o *storeOptions) {
+		o.saveDebounce = d
+	}
+}
+
+// adaptiveDebounce estimates the write rate of a store for WithAdaptiveSaveDebounce.
+type adaptiveDebounce struct {
+	mut sync.Mutex
+	min time.Duration
+	// last is the time of the previous change, gap the moving average of the time between changes
+	last time.Time
+	gap  time.Duration
+}
+
+// WithAdaptiveSaveDebounce makes the wait before an automatic save follow the write rate of the store,
+// instead of the fixed wait set by WithSaveDebounce: under light load the store saves min after a change,
+// under sustained load the wait grows with the number of changes per min, up to the limit set by WithMaxSaveDelay.
+// For example, with a min of 500ms, a store that changes every 100ms on average waits 2.5 seconds.
+// The rate is a moving average of the time between write locks that changed the store,
+// so a burst like an import stretches the wait within a few changes and it shrinks again once the burst is over.
+func WithAdaptiveSaveDebounce(min time.Duration) Option {
+	return func(o *storeOptions) {
+		if min > 0 {
+			o.adaptiveDebounce = &adaptiveDebounce{min: min}
+		}
+	}
+}
+
+// next records a change and returns how long to wait for further changes, at most maxDelay.
+func (a *adaptiveDebounce) next(maxDelay time.Duration) time.Duration {
+	a.mut.Lock()
+	defer a.mut.Unlock()
+	now := time.Now()
+	last := a.last
+	a.last = now
+	if last.IsZero() {
+		return a.min
+	}
+	if gap := now.Sub(last); a.gap == 0 {
+		a.gap = gap
+	} else {
+		a.gap += (gap - a.gap) / 5
+	}
+	if a.gap >= a.min {
+		return a.min
+	}
+	if a.gap <= 0 {
+		return maxDelay
+	}
+	return min(time.Duration(float64(a.min)*float64(a.min)/float64(a.gap)), maxDelay)
+}
+
+// WithMaxSaveDelay sets how long the store waits at most after the first unsaved change before it saves automatically,
+// even if changes keep coming in. The default is 10 seconds.
+func WithMaxSaveDelay(d time.Duration) Option {
+	return func(o *storeOptions) {
+		o.maxSaveDelay = d
+	}
+}
+
+// WithoutAutoSave disables automatic saving, so the store is only persisted by calling Save or SaveCtx.
+// Dirty and PendingSaveAt don't track such stores.
+func WithoutAutoSave() Option {
+	return func(o *storeOptions) {
+		o.noAutoSave = true
+	}
+}
+
+// WithSaveErrorHandler sets a function that is called when an automatic save of the store fails,
+// for example because the disk is full, so the application can alert and retry.
+// It also receives values rejected by WithMaxEntrySize in operations without an error result.
+// The store stays dirty (see Dirty), so FlushAll retries the save.
+// Without a handler, the error is sent to the channel returned by Err or printed.
+func WithSaveErrorHandler(fn func(err error)) Option {
+	return func(o *storeOptions) {
+		o.onSaveError = fn
+	}
+}
+
+// partOf is implemented by stores that are persisted as part of another store.
+type partOf interface {
+	owner() savable
+}
+
 var errChan chan error = nil
 
 // Err returns the error channel used when saving the data stores to disk.
@@ -34,9 +129,50 @@ func log(err error) {
 	}
 }
 
+// saveFailed reports an error of an automatic save of s.
+func saveFailed(s savable, err error) {
+	if o := optionsOf(s); o != nil {
+		o.reportError(err)
+		return
+	}
+	log(err)
+}
+
+// saverOf returns the store that persists the changes made to store.
+func saverOf(store lockable) (savable, bool) {
+	if p, ok := store.(partOf); ok {
+		return p.owner(), true
+	}
+	sav, ok := store.(savable)
+	return sav, ok
+}
+
 func notifyChanged(s savable) {
-	const debounceDelay = 2 * time.Second
-	const maxDelay = 10 * time.Second
+	debounceDelay, maxDelay := defaultSaveDebounce, defaultMaxSaveDelay
+	if o := optionsOf(s); o != nil {
+		if o.noAutoSave {
+			if l := debugLogger(); l != nil {
+				l.Debug("speicher: change not saved automatically, the store was loaded WithoutAutoSave", "location", locationOf(s))
+			}
+			return
+		}
+		if o.saveDebounce > 0 {
+			debounceDelay = o.saveDebounce
+		}
+		if o.maxSaveDelay > 0 {
+			maxDelay = o.maxSaveDelay
+		}
+		if o.adaptiveDebounce != nil {
+			debounceDelay = o.adaptiveDebounce.next(maxDelay)
+		}
+	}
+
+	// Stores of a Group are saved together, so the Group schedules the save
+	if g := groupOf(s.getStoreID()); g != nil {
+		s = g
+	}
+
+	markDirty(s.getStoreID(), debounceDelay, maxDelay)
 
 	// Ensure that we have a "once" for the current burst.
 	once := s.getSaveOnce()
@@ -55,9 +191,14 @@ func notifyChanged(s savable) {
 			s.setMaxSaveTimer(nil)
 			s.setSaveOnce(nil)
 
-			if err := s.Save(); err != nil {
-				log(err)
+			changes := startSave(s.getStoreID())
+			err := s.Save()
+			recordSave(s, err)
+			if err != nil {
+				saveFailed(s, err)
+				return
 			}
+			finishSave(s.getStoreID(), changes)
 		})
 	}
 
@@ -80,5 +221,8 @@ func notifyChanged(s savable) {
 	if tmax == nil {
 		newMaxTimer := time.AfterFunc(maxDelay, callback)
 		s.setMaxSaveTimer(newMaxTimer)
+		if l := debugLogger(); l != nil {
+			l.Debug("speicher: automatic save scheduled", "location", locationOf(s), "debounce", debounceDelay, "max_delay", maxDelay)
+		}
 	}
 }
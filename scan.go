@@ -0,0 +1,80 @@
+package speicher
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ErrScanLimit is returned when a scan of a store loaded with WithScanLimit
+// waited longer than the maximum wait for a free slot.
+var ErrScanLimit = errors.New("timed out waiting for a free scan slot")
+
+// WithScanLimit allows at most n expensive read operations, like FindAll, Query or ExportWhere,
+// to run on the store at once, so a burst of scans can't starve writers that wait for the write lock.
+// Further scans queue up in order until a slot is free, or fail with ErrScanLimit after maxWait.
+// A maxWait of 0 waits until the context of the scan is done.
+//
+// Slots are taken before the read lock, so queued scans don't hold up writers.
+// That is only possible for operations that acquire their own lock: Scan, ExportWhere and StreamHandler.
+// FindAll and Query are limited when they run inside Scan; called under a lock of the caller, they are not.
+// Other stores ignore it.
+func WithScanLimit(n int, maxWait time.Duration) Option {
+	return func(o *storeOptions) {
+		if n > 0 {
+			o.scanSlots = make(chan struct{}, n)
+			o.scanMaxWait = maxWait
+		}
+	}
+}
+
+// Scan waits for a free scan slot of store (see WithScanLimit), then calls fn with a read lock on store,
+// for example to run FindAll or Query:
+//
+//	err := speicher.Scan(ctx, users, func(users speicher.Map[User]) error {
+//		inactive = users.FindAll(func(u User) bool { return !u.Active })
+//		return nil
+//	})
+//
+// It returns the error of fn, ErrScanLimit or the error of ctx if it is done before the scan started.
+// Without WithScanLimit, fn runs as soon as the read lock is acquired.
+//
+// This function acquires its own read lock on store.
+func Scan[S Store](ctx context.Context, store S, fn func(store S) error) error {
+	release, err := acquireScan(ctx, store)
+	if err != nil {
+		return err
+	}
+	defer release()
+	s := borrowState()
+	defer returnState(s)
+	if err := s.RLockContext(ctx, store); err != nil {
+		return err
+	}
+	defer s.RUnlock(store)
+	return fn(store)
+}
+
+// acquireScan waits for a free scan slot of store, if it has a limit, and returns a function that frees it.
+func acquireScan(ctx context.Context, store any) (release func(), err error) {
+	o := optionsOf(store)
+	if o == nil || o.scanSlots == nil {
+		return func() {}, nil
+	}
+	wait := ctx
+	if o.scanMaxWait > 0 {
+		var cancel context.CancelFunc
+		wait, cancel = context.WithTimeout(ctx, o.scanMaxWait)
+		defer cancel()
+	}
+	slots := o.scanSlots
+	select {
+	case slots <- struct{}{}:
+		return func() { <-slots }, nil
+	case <-wait.Done():
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		return nil, ErrScanLimit
+	}
+}
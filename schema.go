@@ -0,0 +1,194 @@
+package speicher
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Migration upgrades the data of a store file by one schema version.
+// data is the whole content of the file as JSON, independent of the file format of the store.
+// The returned JSON replaces it.
+type Migration func(data json.RawMessage) (json.RawMessage, error)
+
+// MigrateValues returns a Migration for Map files that converts every value from From to To by calling fn,
+// for example to move a field into a nested struct. From and To are usually
+// the old and new shape of the value type, From can also be map[string]any.
+func MigrateValues[From, To any](fn func(key string, old From) (To, error)) Migration {
+	return func(data json.RawMessage) (json.RawMessage, error) {
+		var old map[string]From
+		if err := json.Unmarshal(data, &old); err != nil {
+			return nil, err
+		}
+		values := make(map[string]To, len(old))
+		for key, value := range old {
+			v, err := fn(key, value)
+			if err != nil {
+				return nil, errors.Join(fmt.Errorf("failed to migrate entry '%s'", key), err)
+			}
+			values[key] = v
+		}
+		return json.Marshal(values)
+	}
+}
+
+// schemaFile is the content of the sidecar file holding the schema version of a store.
+type schemaFile struct {
+	Version int `json:"version"`
+}
+
+// versionLocation returns the location of the sidecar file holding the schema version of a store.
+func versionLocation(location string) string {
+	return location + ".version"
+}
+
+// SchemaVersion returns the schema version of the store file at location,
+// as recorded by LoadMapWithMigrations. Files without a recorded version have version 0.
+func SchemaVersion(location string, opts ...Option) (int, error) {
+	return newStoreOptions(opts).schemaVersion(location)
+}
+
+func (o storeOptions) schemaVersion(location string) (int, error) {
+	f, err := o.files().Open(versionLocation(location))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, errors.Join(fmt.Errorf("failed to open file '%s' (file exists)", versionLocation(location)), err)
+	}
+	defer f.Close()
+	var s schemaFile
+	if err := json.NewDecoder(f).Decode(&s); err != nil {
+		return 0, errors.Join(fmt.Errorf("failed to decode file '%s'", versionLocation(location)), err)
+	}
+	return s.Version, nil
+}
+
+func (o storeOptions) setSchemaVersion(location string, version int) error {
+	err := o.writeFile(versionLocation(location), func(w io.Writer) error {
+		return json.NewEncoder(w).Encode(schemaFile{Version: version})
+	})
+	if err != nil {
+		return errors.Join(fmt.Errorf("failed to write file '%s'", versionLocation(location)), err)
+	}
+	return nil
+}
+
+// LoadMapWithMigrations loads a Map like LoadMap, upgrading the file to the current schema first.
+//
+// The schema version of the file is stored in the sidecar file location.version.
+// The current version is len(migrations): migrations[i] upgrades a file from version i to i+1,
+// so new migrations are appended to the end and existing ones must never change.
+// Files without a recorded version are at version 0, new files start at the current version.
+//
+// When the file is older, the pending migrations run in order on its raw data,
+// which is then checked to decode into T and written back before the version is updated.
+// A file recording a newer version than the migrations know about is not loaded.
+// If the process crashes between writing the data and the version, the last migration runs again
+// on the next load, so migrations should leave already migrated data unchanged.
+//
+// Migrations don't apply to the expiry times of entries and can't be combined with WithValueCompression.
+func LoadMapWithMigrations[T any](location string, migrations []Migration, opts ...Option) (Map[T], error) {
+	options := newStoreOptions(opts)
+	lock, err := lockFile(location, options)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.releaseUnclaimed()
+	c, err := resolveCodec(location, options)
+	if err != nil {
+		return nil, err
+	}
+	if err := migrateFile[T](location, c, options, migrations); err != nil {
+		return nil, errors.Join(fmt.Errorf("unable to migrate file '%s'", location), err)
+	}
+	if m, err := loadMapFromFile[T](location, c, options); err != nil {
+		return nil, errors.Join(fmt.Errorf("unable to load map from file '%s'", location), err)
+	} else {
+		opened(m, location)
+		startReaper(m, options.reaperInterval)
+		startAutoReload(m, location, options)
+		return m, nil
+	}
+}
+
+// migrateFile runs the migrations the Map file at location is missing and records the new schema version.
+func migrateFile[T any](location string, c codec, o storeOptions, migrations []Migration) error {
+	if o.valueCompression > 0 {
+		return fmt.Errorf("migrations are not supported with value compression")
+	}
+	version, err := o.schemaVersion(location)
+	if err != nil {
+		return err
+	}
+	current := len(migrations)
+	if version > current {
+		return fmt.Errorf("file has schema version %d, but only %d migrations are known", version, current)
+	}
+
+	f, err := o.openFile(location)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return errors.Join(fmt.Errorf("failed to open file '%s' (but exists)", location), err)
+		}
+		if version == current || o.readOnly() {
+			return nil
+		}
+		if err := o.files().MkdirAll(filepath.Dir(location), 0740); err != nil {
+			return err
+		}
+		return o.setSchemaVersion(location, current)
+	}
+	if version == current {
+		_ = f.Close()
+		return nil
+	}
+	var data json.RawMessage
+	err = c.decode(f, &data)
+	_ = f.Close()
+	if err != nil {
+		return errors.Join(fmt.Errorf("failed to decode file '%s'", location), err)
+	}
+	if o.readOnly() {
+		return errReadOnly(location)
+	}
+
+	for i := version; i < current; i++ {
+		if data, err = migrations[i](data); err != nil {
+			return errors.Join(fmt.Errorf("migration from schema version %d to %d failed", i, i+1), err)
+		}
+	}
+	var values map[string]T
+	if err := decodeJSON(bytes.NewReader(data), &values, o.strictDecode); err != nil {
+		return errors.Join(fmt.Errorf("migrated data doesn't match the type of the map"), err)
+	}
+
+	var buf bytes.Buffer
+	if err := c.encode(&buf, values); err != nil {
+		return errors.Join(fmt.Errorf("failed to encode file '%s'", location), err)
+	}
+	write := func(w io.Writer) error {
+		_, err := w.Write(buf.Bytes())
+		return err
+	}
+	// Replace the old file atomically, so a failed write leaves it intact at its old version
+	if o.doubleBuffer {
+		err = o.saveDoubleBuffered(context.Background(), location, write)
+	} else {
+		err = o.writeFile(location, write)
+	}
+	if err != nil {
+		return errors.Join(fmt.Errorf("failed to write file '%s'", location), err)
+	}
+	sum := sha256.Sum256(buf.Bytes())
+	if err := o.recordHash(location, sum[:]); err != nil {
+		return errors.Join(fmt.Errorf("failed to update manifest for '%s'", location), err)
+	}
+	return o.setSchemaVersion(location, current)
+}
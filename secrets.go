@@ -0,0 +1,311 @@
+package speicher
+
+import (
+	"context"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+type (
+	// memorySecrets is a Secrets implementation that keeps all values encrypted in memory.
+	memorySecrets struct {
+		id       storeID
+		data     map[string][]byte
+		location string
+		opts     storeOptions
+		mut      sync.RWMutex
+
+		// memAEAD encrypts the values held in memory with a random per-process key.
+		memAEAD cipher.AEAD
+		// fileAEAD encrypts the values written to disk with the key passed to LoadSecrets.
+		fileAEAD cipher.AEAD
+
+		timerMut     sync.Mutex
+		saveTimer    *time.Timer
+		maxSaveTimer *time.Timer
+		saveOnce     *sync.Once
+	}
+
+	// Secrets is a thread-safe store for sensitive values such as API tokens.
+	//
+	// Values are kept encrypted in memory and are only decrypted while the store is locked,
+	// so they don't appear in plain text in core dumps or heap inspections.
+	// The file on disk is encrypted using AES-GCM with the key passed to LoadSecrets.
+	//
+	// All operations require appropriate locking via a State object:
+	//
+	//	s := speicher.NewState()
+	//	s.RLock(secrets)
+	//	defer s.RUnlock(secrets)
+	//	secrets.Use("github", func(token []byte) {
+	//		// use token
+	//	})
+	Secrets interface {
+		lockable
+
+		// Use decrypts the secret with the given name and passes it to f.
+		// The buffer is zeroed after f returns and must not be retained.
+		// It returns false if no secret with that name exists.
+		// Requires at least a read lock.
+		Use(name string, f func(secret []byte)) bool
+
+		// Get returns a decrypted copy of the secret with the given name.
+		// The caller owns the returned buffer and should zero it (e.g. using clear) when done.
+		// Requires at least a read lock.
+		Get(name string) ([]byte, bool)
+
+		// Set encrypts and stores the secret under the given name.
+		// The provided buffer is not retained and can be zeroed by the caller afterward.
+		// Requires a write lock.
+		Set(name string, secret []byte) error
+
+		// Delete removes the secret with the given name.
+		// Requires a write lock.
+		Delete(name string)
+
+		// Has checks if a secret with the given name exists.
+		// Requires at least a read lock.
+		Has(name string) bool
+
+		// Names returns the sorted names of all secrets.
+		// Requires at least a read lock.
+		Names() []string
+
+		// Len returns the number of secrets.
+		// Requires at least a read lock.
+		Len() int
+
+		// Save persists the encrypted secrets to disk.
+		// It returns an error if the operation fails.
+		// This method acquires its own read lock internally.
+		Save() error
+
+		// SaveCtx persists the current state of the data store like Save,
+		// but aborts when ctx is cancelled or its deadline passes.
+		// An aborted save removes its temporary files and leaves the previous file intact.
+		// This method acquires its own read lock internally.
+		SaveCtx(ctx context.Context) error
+
+		// Close stops the automatic save and the background goroutines of the store and saves it one last time.
+		// The store must not be used afterwards.
+		// This method acquires its own read lock internally.
+		Close() error
+	}
+)
+
+func (s *memorySecrets) Use(name string, f func(secret []byte)) bool {
+	secret, ok := s.Get(name)
+	if !ok {
+		return false
+	}
+	defer clear(secret)
+	f(secret)
+	return true
+}
+
+func (s *memorySecrets) Get(name string) ([]byte, bool) {
+	sealed, ok := s.data[name]
+	if !ok {
+		return nil, false
+	}
+	secret, err := unseal(s.memAEAD, sealed)
+	if err != nil {
+		// The in-memory key never changes, so this can only happen on memory corruption.
+		panic(fmt.Sprintf("speicher: failed to decrypt secret '%s': %v", name, err))
+	}
+	return secret, true
+}
+
+func (s *memorySecrets) Set(name string, secret []byte) error {
+	sealed, err := seal(s.memAEAD, secret)
+	if err != nil {
+		return err
+	}
+	s.data[name] = sealed
+	return nil
+}
+
+func (s *memorySecrets) Delete(name string) {
+	if sealed, ok := s.data[name]; ok {
+		clear(sealed)
+		delete(s.data, name)
+	}
+}
+
+func (s *memorySecrets) Has(name string) bool {
+	_, ok := s.data[name]
+	return ok
+}
+
+func (s *memorySecrets) Names() []string {
+	names := make([]string, 0, len(s.data))
+	for name := range s.data {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (s *memorySecrets) Len() int {
+	return len(s.data)
+}
+
+func (s *memorySecrets) getStoreID() storeID {
+	return s.id
+}
+
+func (s *memorySecrets) getMutex() *sync.RWMutex {
+	return &s.mut
+}
+
+func (s *memorySecrets) getOptions() *storeOptions {
+	return &s.opts
+}
+
+func (s *memorySecrets) Save() error {
+	return s.SaveCtx(context.Background())
+}
+
+func (s *memorySecrets) SaveCtx(ctx context.Context) error {
+	st := saveState(ctx)
+	st.RLock(s)
+	defer st.RUnlock(s)
+
+	// Re-encrypt every value with the file key, one at a time,
+	// so the full set of plain text secrets never exists in memory.
+	file := make(map[string][]byte, len(s.data))
+	for name := range s.data {
+		secret, _ := s.Get(name)
+		sealed, err := seal(s.fileAEAD, secret)
+		clear(secret)
+		if err != nil {
+			return errors.Join(fmt.Errorf("failed to encrypt secret '%s'", name), err)
+		}
+		file[name] = sealed
+	}
+
+	h := sha256.New()
+	err := s.opts.instrumentSave(s.location, func(w io.Writer) error {
+		return json.NewEncoder(io.MultiWriter(w, h)).Encode(file)
+	}, func(write func(w io.Writer) error) error {
+		return s.opts.writeFileContext(ctx, s.location, write)
+	})
+	if err != nil {
+		return errors.Join(fmt.Errorf("failed to write file '%s'", s.location), err)
+	}
+	s.opts.mirrorSave(s.location)
+	if err := s.opts.recordHash(s.location, h.Sum(nil)); err != nil {
+		return errors.Join(fmt.Errorf("failed to update manifest for '%s'", s.location), err)
+	}
+	return nil
+}
+
+// LoadSecrets loads an encrypted Secrets store from location.
+// The key must be 16, 24 or 32 bytes long to select AES-128, AES-192 or AES-256.
+// If the file does not exist, an empty store is returned.
+func LoadSecrets(location string, key []byte, opts ...Option) (Secrets, error) {
+	options := newStoreOptions(opts)
+	lock, err := lockFile(location, options)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.releaseUnclaimed()
+	fileAEAD, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	memKey := make([]byte, 32)
+	if _, err := rand.Read(memKey); err != nil {
+		return nil, errors.Join(fmt.Errorf("failed to generate memory key"), err)
+	}
+	memAEAD, err := newAEAD(memKey)
+	clear(memKey)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &memorySecrets{
+		id:       newStoreID(),
+		data:     make(map[string][]byte),
+		location: location,
+		opts:     options,
+		memAEAD:  memAEAD,
+		fileAEAD: fileAEAD,
+	}
+
+	f, err := s.opts.files().Open(location)
+	if err != nil {
+		if os.IsNotExist(err) {
+			if err := s.opts.files().MkdirAll(filepath.Dir(location), 0740); err != nil {
+				return nil, err
+			}
+			opened(s, location)
+			return s, nil
+		}
+		return nil, errors.Join(fmt.Errorf("failed to open file '%s' (file exists)", location), err)
+	}
+	defer f.Close()
+	var file map[string][]byte
+	if err := json.NewDecoder(f).Decode(&file); err != nil {
+		return nil, errors.Join(fmt.Errorf("failed to decode file '%s'", location), err)
+	}
+	for name, sealed := range file {
+		secret, err := unseal(fileAEAD, sealed)
+		if err != nil {
+			return nil, errors.Join(fmt.Errorf("failed to decrypt secret '%s' in file '%s'", name, location), err)
+		}
+		err = s.Set(name, secret)
+		clear(secret)
+		if err != nil {
+			return nil, err
+		}
+	}
+	opened(s, location)
+	return s, nil
+}
+
+func (s *memorySecrets) getSaveTimer() *time.Timer {
+	s.timerMut.Lock()
+	defer s.timerMut.Unlock()
+	return s.saveTimer
+}
+
+func (s *memorySecrets) setSaveTimer(t *time.Timer) {
+	s.timerMut.Lock()
+	defer s.timerMut.Unlock()
+	s.saveTimer = t
+}
+
+func (s *memorySecrets) getMaxSaveTimer() *time.Timer {
+	s.timerMut.Lock()
+	defer s.timerMut.Unlock()
+	return s.maxSaveTimer
+}
+
+func (s *memorySecrets) setMaxSaveTimer(t *time.Timer) {
+	s.timerMut.Lock()
+	defer s.timerMut.Unlock()
+	s.maxSaveTimer = t
+}
+
+func (s *memorySecrets) getSaveOnce() *sync.Once {
+	s.timerMut.Lock()
+	defer s.timerMut.Unlock()
+	return s.saveOnce
+}
+
+func (s *memorySecrets) setSaveOnce(o *sync.Once) {
+	s.timerMut.Lock()
+	defer s.timerMut.Unlock()
+	s.saveOnce = o
+}
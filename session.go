@@ -0,0 +1,122 @@
+package speicher
+
+import (
+	"context"
+	"time"
+)
+
+// SessionStore persists HTTP sessions in a Map, letting each session expire with its TTL.
+//
+// It implements the Store, IterableStore, CtxStore and IterableCtxStore interfaces of
+// github.com/alexedwards/scs/v2 without depending on it, so it can be used as
+// the Store of a scs.SessionManager directly.
+//
+// All methods acquire their own locks internally.
+type SessionStore struct {
+	sessions Map[[]byte]
+}
+
+// NewSessionStore returns a SessionStore that keeps the sessions in m, keyed by their token.
+// Expired sessions are never returned, but they are only removed from the file
+// if m is loaded with WithExpiryReaper.
+func NewSessionStore(m Map[[]byte]) *SessionStore {
+	return &SessionStore{sessions: m}
+}
+
+// LoadSessionStore loads the Map at location and returns a SessionStore on top of it.
+// Unless opts contain WithExpiryReaper, expired sessions are removed every minute.
+func LoadSessionStore(location string, opts ...Option) (*SessionStore, error) {
+	opts = append([]Option{WithExpiryReaper(time.Minute)}, opts...)
+	m, err := LoadMap[[]byte](location, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return NewSessionStore(m), nil
+}
+
+// Map returns the Map holding the sessions.
+func (s *SessionStore) Map() Map[[]byte] {
+	return s.sessions
+}
+
+// Find returns the data of the session with the given token.
+// The bool result is false if the session doesn't exist or has expired.
+func (s *SessionStore) Find(token string) ([]byte, bool, error) {
+	return s.FindCtx(context.Background(), token)
+}
+
+// Commit stores the data of the session with the given token and lets it expire at expiry.
+func (s *SessionStore) Commit(token string, b []byte, expiry time.Time) error {
+	return s.CommitCtx(context.Background(), token, b, expiry)
+}
+
+// Delete removes the session with the given token.
+// Deleting a session that doesn't exist is not an error.
+func (s *SessionStore) Delete(token string) error {
+	return s.DeleteCtx(context.Background(), token)
+}
+
+// All returns the data of all sessions that haven't expired, keyed by their token.
+func (s *SessionStore) All() (map[string][]byte, error) {
+	return s.AllCtx(context.Background())
+}
+
+// FindCtx returns the data of the session with the given token like Find,
+// but gives up waiting for the lock when ctx is done.
+func (s *SessionStore) FindCtx(ctx context.Context, token string) ([]byte, bool, error) {
+	state := borrowState()
+	defer returnState(state)
+	if err := state.RLockContext(ctx, s.sessions); err != nil {
+		return nil, false, err
+	}
+	defer state.RUnlock(s.sessions)
+	b, found := s.sessions.Get(token)
+	return b, found, nil
+}
+
+// CommitCtx stores the data of the session with the given token like Commit,
+// but gives up waiting for the lock when ctx is done.
+func (s *SessionStore) CommitCtx(ctx context.Context, token string, b []byte, expiry time.Time) error {
+	state := borrowState()
+	defer returnState(state)
+	if err := state.LockContext(ctx, s.sessions); err != nil {
+		return err
+	}
+	defer state.Unlock(s.sessions)
+	s.sessions.SetWithTTL(token, b, time.Until(expiry))
+	return nil
+}
+
+// DeleteCtx removes the session with the given token like Delete,
+// but gives up waiting for the lock when ctx is done.
+func (s *SessionStore) DeleteCtx(ctx context.Context, token string) error {
+	state := borrowState()
+	defer returnState(state)
+	if err := state.LockContext(ctx, s.sessions); err != nil {
+		return err
+	}
+	defer state.Unlock(s.sessions)
+	s.sessions.Delete(token)
+	return nil
+}
+
+// AllCtx returns the data of all sessions like All,
+// but gives up waiting for the lock when ctx is done.
+func (s *SessionStore) AllCtx(ctx context.Context) (map[string][]byte, error) {
+	state := borrowState()
+	defer returnState(state)
+	if err := state.RLockContext(ctx, s.sessions); err != nil {
+		return nil, err
+	}
+	defer state.RUnlock(s.sessions)
+	sessions := make(map[string][]byte)
+	for token, b := range s.sessions.Iterate {
+		sessions[token] = b
+	}
+	return sessions, nil
+}
+
+// Close closes the Map holding the sessions, saving it one last time.
+func (s *SessionStore) Close() error {
+	return s.sessions.Close()
+}
@@ -0,0 +1,332 @@
+package speicher
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+type (
+	// memorySet is a Set implementation that keeps all elements in memory.
+	memorySet[T comparable] struct {
+		id       storeID
+		data     map[T]struct{}
+		location string
+		codec    codec
+		opts     storeOptions
+		mut      sync.RWMutex
+
+		timerMut     sync.Mutex
+		saveTimer    *time.Timer
+		maxSaveTimer *time.Timer
+		saveOnce     *sync.Once
+	}
+
+	// Set is a thread-safe set data store interface that holds unique values
+	// and provides basic set algebra and iteration functionality.
+	// The set is persisted as a JSON array.
+	//
+	// All operations require appropriate locking via a State object:
+	//
+	//	s := speicher.NewState()
+	//	s.Lock(mySet)
+	//	defer s.Unlock(mySet)
+	//	mySet.Add(value)
+	Set[T comparable] interface {
+		lockable
+
+		// Add inserts the value into the Set.
+		// It returns true if the value was added and false if it was already present.
+		// Requires a write lock.
+		Add(value T) bool
+
+		// Remove deletes the value from the Set.
+		// It returns true if the value was present.
+		// Requires a write lock.
+		Remove(value T) bool
+
+		// Contains checks if the value is present in the Set.
+		// Requires at least a read lock.
+		Contains(value T) bool
+
+		// Len returns the number of values in the Set.
+		// Requires at least a read lock.
+		Len() int
+
+		// Values returns all values of the Set in no particular order.
+		// Requires at least a read lock.
+		Values() []T
+
+		// Overwrite replaces the entire Set with the provided values.
+		// Duplicates are removed.
+		// Requires a write lock.
+		Overwrite([]T)
+
+		// Union returns all values that are in this Set or in other.
+		// Requires at least a read lock on both sets.
+		Union(other Set[T]) []T
+
+		// Intersect returns all values that are in both this Set and other.
+		// Requires at least a read lock on both sets.
+		Intersect(other Set[T]) []T
+
+		// Difference returns all values that are in this Set but not in other.
+		// Requires at least a read lock on both sets.
+		Difference(other Set[T]) []T
+
+		// Iterate iterates over the Set and calls the provided function for each value.
+		// Requires at least a read lock.
+		Iterate(yield func(v T) bool)
+
+		// Save persists the current state of the Set to its underlying data store.
+		// It returns an error if the operation fails.
+		// This method acquires its own read lock internally.
+		Save() error
+
+		// SaveCtx persists the current state of the data store like Save,
+		// but aborts when ctx is cancelled or its deadline passes.
+		// An aborted save removes its temporary files and leaves the previous file intact.
+		// This method acquires its own read lock internally.
+		SaveCtx(ctx context.Context) error
+
+		// Close stops the automatic save and the background goroutines of the store and saves it one last time.
+		// The store must not be used afterwards.
+		// This method acquires its own read lock internally.
+		Close() error
+	}
+)
+
+func (s *memorySet[T]) Add(value T) bool {
+	if _, ok := s.data[value]; ok {
+		return false
+	}
+	s.data[value] = struct{}{}
+	return true
+}
+
+func (s *memorySet[T]) Remove(value T) bool {
+	if _, ok := s.data[value]; !ok {
+		return false
+	}
+	delete(s.data, value)
+	return true
+}
+
+func (s *memorySet[T]) Contains(value T) bool {
+	_, ok := s.data[value]
+	return ok
+}
+
+func (s *memorySet[T]) Len() int {
+	return len(s.data)
+}
+
+func (s *memorySet[T]) Values() []T {
+	values := make([]T, 0, len(s.data))
+	for value := range s.data {
+		values = append(values, value)
+	}
+	return values
+}
+
+// sortedValues returns the values in a fixed order, so an unchanged Set always encodes to the same file.
+func (s *memorySet[T]) sortedValues() []T {
+	values := s.Values()
+	keys := make(map[T]string, len(values))
+	for _, value := range values {
+		keys[value] = fmt.Sprintf("%#v", value)
+	}
+	slices.SortFunc(values, func(a, b T) int {
+		return strings.Compare(keys[a], keys[b])
+	})
+	return values
+}
+
+func (s *memorySet[T]) Overwrite(values []T) {
+	s.data = make(map[T]struct{}, len(values))
+	for _, value := range values {
+		s.data[value] = struct{}{}
+	}
+}
+
+func (s *memorySet[T]) Union(other Set[T]) []T {
+	values := s.Values()
+	for value := range other.Iterate {
+		if !s.Contains(value) {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+func (s *memorySet[T]) Intersect(other Set[T]) []T {
+	var values []T
+	for value := range s.data {
+		if other.Contains(value) {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+func (s *memorySet[T]) Difference(other Set[T]) []T {
+	var values []T
+	for value := range s.data {
+		if !other.Contains(value) {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+func (s *memorySet[T]) Iterate(yield func(v T) bool) {
+	for value := range s.data {
+		if !yield(value) {
+			break
+		}
+	}
+}
+
+func (s *memorySet[T]) getStoreID() storeID {
+	return s.id
+}
+
+func (s *memorySet[T]) getMutex() *sync.RWMutex {
+	return &s.mut
+}
+
+func (s *memorySet[T]) getOptions() *storeOptions {
+	return &s.opts
+}
+
+func (s *memorySet[T]) Save() error {
+	return s.SaveCtx(context.Background())
+}
+
+func (s *memorySet[T]) SaveCtx(ctx context.Context) error {
+	st := saveState(ctx)
+	st.RLock(s)
+	defer st.RUnlock(s)
+
+	h := sha256.New()
+	err := s.opts.saveFile(ctx, s.location, func(w io.Writer) error {
+		return s.codec.encode(io.MultiWriter(w, h), s.sortedValues())
+	})
+	if err != nil {
+		return errors.Join(fmt.Errorf("failed to write file '%s'", s.location), err)
+	}
+	if err := s.opts.recordHash(s.location, h.Sum(nil)); err != nil {
+		return errors.Join(fmt.Errorf("failed to update manifest for '%s'", s.location), err)
+	}
+	return nil
+}
+
+func (s *memorySet[T]) encodeData(w io.Writer, c codec) error {
+	return c.encode(w, s.sortedValues())
+}
+
+func (s *memorySet[T]) decodedEquals(r io.Reader, c codec) (bool, error) {
+	var values []T
+	if err := c.decode(r, &values); err != nil {
+		return false, err
+	}
+	if len(values) != len(s.data) {
+		return false, nil
+	}
+	for _, value := range values {
+		if !s.Contains(value) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// LoadSet loads a Set from location.
+// If the file does not exist, an empty Set is returned.
+func LoadSet[T comparable](location string, opts ...Option) (Set[T], error) {
+	options := newStoreOptions(opts)
+	lock, err := lockFile(location, options)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.releaseUnclaimed()
+	c, err := resolveCodec(location, options)
+	if err != nil {
+		return nil, err
+	}
+	if s, err := loadSetFromFile[T](location, c, options); err != nil {
+		return nil, errors.Join(fmt.Errorf("unable to load set from file '%s'", location), err)
+	} else {
+		opened(s, location)
+		return s, nil
+	}
+}
+
+func loadSetFromFile[T comparable](location string, c codec, o storeOptions) (Set[T], error) {
+	s := &memorySet[T]{
+		id:       newStoreID(),
+		location: location,
+		codec:    c,
+		opts:     o,
+		data:     make(map[T]struct{}),
+	}
+	f, err := o.openFile(location)
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = o.files().MkdirAll(filepath.Dir(location), 0740)
+			return s, err
+		}
+		return nil, errors.Join(fmt.Errorf("failed to open file '%s' (file exists)", location), err)
+	}
+	defer f.Close()
+	var values []T
+	if err := c.decode(f, &values); err != nil {
+		return nil, errors.Join(fmt.Errorf("failed to decode file '%s'", location), err)
+	}
+	s.Overwrite(values)
+	return s, nil
+}
+
+func (s *memorySet[T]) getSaveTimer() *time.Timer {
+	s.timerMut.Lock()
+	defer s.timerMut.Unlock()
+	return s.saveTimer
+}
+
+func (s *memorySet[T]) setSaveTimer(t *time.Timer) {
+	s.timerMut.Lock()
+	defer s.timerMut.Unlock()
+	s.saveTimer = t
+}
+
+func (s *memorySet[T]) getMaxSaveTimer() *time.Timer {
+	s.timerMut.Lock()
+	defer s.timerMut.Unlock()
+	return s.maxSaveTimer
+}
+
+func (s *memorySet[T]) setMaxSaveTimer(t *time.Timer) {
+	s.timerMut.Lock()
+	defer s.timerMut.Unlock()
+	s.maxSaveTimer = t
+}
+
+func (s *memorySet[T]) getSaveOnce() *sync.Once {
+	s.timerMut.Lock()
+	defer s.timerMut.Unlock()
+	return s.saveOnce
+}
+
+func (s *memorySet[T]) setSaveOnce(o *sync.Once) {
+	s.timerMut.Lock()
+	defer s.timerMut.Unlock()
+	s.saveOnce = o
+}
@@ -0,0 +1,406 @@
+package speicher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"reflect"
+	"sync"
+	"time"
+)
+
+type (
+	// mapShard is a part of a shardedMap with its own lock.
+	// It is persisted by the shardedMap it belongs to.
+	mapShard[T any] struct {
+		*memoryMap[T]
+		parent *shardedMap[T]
+	}
+
+	// shardedMap is a ShardedMap implementation that spreads its elements over memoryMap shards.
+	shardedMap[T any] struct {
+		id       storeID
+		shards   []*mapShard[T]
+		location string
+		codec    codec
+		opts     storeOptions
+		mut      sync.RWMutex
+
+		timerMut     sync.Mutex
+		saveTimer    *time.Timer
+		maxSaveTimer *time.Timer
+		saveOnce     *sync.Once
+	}
+
+	// ShardedMap is a Map that spreads its elements over shards with their own locks,
+	// so writers touching keys in different shards don't wait for each other.
+	// The file is the same as the one of a Map and can be loaded with either.
+	//
+	// Locking the ShardedMap locks all shards, which every operation allows.
+	// Operations on a single key (Get, Has, Set, GetOrSet, Update, SetWithTTL, ExpiresAt and Delete)
+	// only need the lock of the shard holding the key:
+	//
+	//	s := speicher.NewState()
+	//	shard := users.Shard(id)
+	//	s.Lock(shard)
+	//	defer s.Unlock(shard)
+	//	users.Set(id, user)
+	ShardedMap[T any] interface {
+		Map[T]
+
+		// Shard returns the store to lock for operations on key.
+		// Does not require a lock.
+		Shard(key string) Store
+	}
+)
+
+// defaultShards is the number of shards of a ShardedMap without WithShards.
+const defaultShards = 32
+
+// WithShards sets the number of shards of a ShardedMap.
+// Other stores ignore it.
+func WithShards(n int) Option {
+	return func(o *storeOptions) {
+		o.shards = n
+	}
+}
+
+// LoadShardedMap loads a ShardedMap from location.
+// If the file does not exist, an empty ShardedMap is returned.
+func LoadShardedMap[T any](location string, opts ...Option) (ShardedMap[T], error) {
+	options := newStoreOptions(opts)
+	lock, err := lockFile(location, options)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.releaseUnclaimed()
+	if options.shards <= 0 {
+		options.shards = defaultShards
+	}
+	c, err := resolveCodec(location, options)
+	if err != nil {
+		return nil, err
+	}
+	loaded, err := loadMapFromFile[T](location, c, options)
+	if err != nil {
+		return nil, errors.Join(fmt.Errorf("unable to load sharded map from file '%s'", location), err)
+	}
+	m := &shardedMap[T]{id: newStoreID(), location: location, codec: c, opts: options}
+	m.shards = make([]*mapShard[T], options.shards)
+	for i := range m.shards {
+		m.shards[i] = &mapShard[T]{
+			memoryMap: &memoryMap[T]{id: newStoreID(), data: map[string]T{}, location: location, codec: c, opts: options, expiresField: expiryField(reflect.TypeFor[T]())},
+			parent:    m,
+		}
+		// All shards share the revisions, so revisions are unique across the whole map
+		m.shards[i].changes.revs = loaded.(*memoryMap[T]).changes.revs
+	}
+	for key, value := range loaded.(*memoryMap[T]).data {
+		m.shardOf(key).data[key] = value
+	}
+	for key, t := range loaded.(*memoryMap[T]).expires {
+		shard := m.shardOf(key)
+		if shard.expires == nil {
+			shard.expires = make(map[string]time.Time)
+		}
+		shard.expires[key] = t
+	}
+	for _, shard := range m.shards {
+		shard.changes.sums = newEntrySums(options, shard.data)
+	}
+	opened(m, location)
+	startReaper(m, options.reaperInterval)
+	return m, nil
+}
+
+// shardIndex returns the index of the shard holding key.
+func (m *shardedMap[T]) shardIndex(key string) int {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	return int(h.Sum32() % uint32(len(m.shards)))
+}
+
+// shardOf returns the shard holding key.
+func (m *shardedMap[T]) shardOf(key string) *mapShard[T] {
+	return m.shards[m.shardIndex(key)]
+}
+
+func (m *shardedMap[T]) Shard(key string) Store {
+	return m.shardOf(key)
+}
+
+func (m *shardedMap[T]) parts() []lockable {
+	parts := make([]lockable, len(m.shards))
+	for i, shard := range m.shards {
+		parts[i] = shard
+	}
+	return parts
+}
+
+// merged returns a memoryMap holding the elements of all shards.
+// The caller must hold at least a read lock on all shards.
+func (m *shardedMap[T]) merged() *memoryMap[T] {
+	merged := &memoryMap[T]{id: newStoreID(), data: map[string]T{}, location: m.location, codec: m.codec, opts: m.opts, expiresField: m.shards[0].expiresField}
+	for _, shard := range m.shards {
+		for key, value := range shard.data {
+			merged.data[key] = value
+		}
+		for key, t := range shard.expires {
+			if merged.expires == nil {
+				merged.expires = make(map[string]time.Time)
+			}
+			merged.expires[key] = t
+		}
+	}
+	return merged
+}
+
+func (m *shardedMap[T]) Get(key string) (T, bool) {
+	return m.shardOf(key).Get(key)
+}
+
+func (m *shardedMap[T]) Find(f func(T) bool) (value T, found bool) {
+	for _, shard := range m.shards {
+		if value, found = shard.Find(f); found {
+			return
+		}
+	}
+	return
+}
+
+func (m *shardedMap[T]) FindAll(f func(T) bool) (values []T) {
+	for _, shard := range m.shards {
+		values = append(values, shard.FindAll(f)...)
+	}
+	return
+}
+
+func (m *shardedMap[T]) Has(key string) bool {
+	return m.shardOf(key).Has(key)
+}
+
+func (m *shardedMap[T]) Set(key string, value T) {
+	m.shardOf(key).Set(key, value)
+}
+
+func (m *shardedMap[T]) TrySet(key string, value T) error {
+	return m.shardOf(key).TrySet(key, value)
+}
+
+func (m *shardedMap[T]) GetOrSet(key string, create func() T) T {
+	return m.shardOf(key).GetOrSet(key, create)
+}
+
+func (m *shardedMap[T]) Update(key string, fn func(old T, exists bool) T) T {
+	return m.shardOf(key).Update(key, fn)
+}
+
+func (m *shardedMap[T]) SetWithTTL(key string, value T, ttl time.Duration) {
+	m.shardOf(key).SetWithTTL(key, value, ttl)
+}
+
+func (m *shardedMap[T]) ExpiresAt(key string) (time.Time, bool) {
+	return m.shardOf(key).ExpiresAt(key)
+}
+
+func (m *shardedMap[T]) hasExpired() bool {
+	for _, shard := range m.shards {
+		if shard.hasExpired() {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *shardedMap[T]) DeleteExpired() int {
+	n := 0
+	for _, shard := range m.shards {
+		n += shard.DeleteExpired()
+	}
+	return n
+}
+
+func (m *shardedMap[T]) Delete(key string) {
+	m.shardOf(key).Delete(key)
+}
+
+func (m *shardedMap[T]) Overwrite(values map[string]T) {
+	data := make([]map[string]T, len(m.shards))
+	for i := range data {
+		data[i] = map[string]T{}
+	}
+	for key, value := range values {
+		data[m.shardIndex(key)][key] = value
+	}
+	// Report a single ChangeOverwrite to watchers, which reload the whole map anyway
+	m.shards[0].Overwrite(data[0])
+	for i, shard := range m.shards[1:] {
+		shard.data = data[i+1]
+		shard.expires = nil
+		shard.changes.sums.invalidate()
+	}
+}
+
+func (m *shardedMap[T]) RangeKV() (<-chan MapRangeEl[T], func()) {
+	return m.merged().RangeKV()
+}
+
+func (m *shardedMap[T]) RangeV() (<-chan T, func()) {
+	return m.merged().RangeV()
+}
+
+func (m *shardedMap[T]) Len() int {
+	n := 0
+	for _, shard := range m.shards {
+		n += shard.Len()
+	}
+	return n
+}
+
+func (m *shardedMap[T]) Keys() []string {
+	var keys []string
+	for _, shard := range m.shards {
+		keys = append(keys, shard.Keys()...)
+	}
+	return keys
+}
+
+func (m *shardedMap[T]) Values() []T {
+	var values []T
+	for _, shard := range m.shards {
+		values = append(values, shard.Values()...)
+	}
+	return values
+}
+
+func (m *shardedMap[T]) Iterate(yield func(key string, value T) bool) {
+	for _, shard := range m.shards {
+		for key, value := range shard.Iterate {
+			if !yield(key, value) {
+				return
+			}
+		}
+	}
+}
+
+func (m *shardedMap[T]) Watch(ctx context.Context) <-chan ChangeEvent[T] {
+	ch := make(chan ChangeEvent[T])
+	var wg sync.WaitGroup
+	for _, shard := range m.shards {
+		events := shard.Watch(ctx)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for event := range events {
+				select {
+				case <-ctx.Done():
+					return
+				case ch <- event:
+				}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(ch)
+	}()
+	return ch
+}
+
+func (m *shardedMap[T]) getStoreID() storeID {
+	return m.id
+}
+
+// getMutex returns a mutex that is not used for locking; State locks the shards instead.
+func (m *shardedMap[T]) getMutex() *sync.RWMutex {
+	return &m.mut
+}
+
+func (m *shardedMap[T]) getOptions() *storeOptions {
+	return &m.opts
+}
+
+func (m *shardedMap[T]) Save() error {
+	return m.SaveCtx(context.Background())
+}
+
+func (m *shardedMap[T]) SaveCtx(ctx context.Context) error {
+	s := saveState(ctx)
+	s.RLock(m)
+	defer s.RUnlock(m)
+	for _, shard := range m.shards {
+		shard.verifyChecksums()
+	}
+	merged := m.merged()
+	merged.changes.revs = m.shards[0].changes.revs
+	return merged.SaveCtx(ctx)
+}
+
+func (m *shardedMap[T]) snapshot() func() {
+	restores := make([]func(), len(m.shards))
+	for i, shard := range m.shards {
+		restores[i] = shard.snapshot()
+	}
+	return func() {
+		for _, restore := range restores {
+			restore()
+		}
+	}
+}
+
+func (m *shardedMap[T]) entryCount() int {
+	n := 0
+	for _, shard := range m.shards {
+		n += len(shard.data)
+	}
+	return n
+}
+
+func (s *mapShard[T]) owner() savable {
+	return s.parent
+}
+
+func (s *mapShard[T]) Save() error {
+	return s.parent.Save()
+}
+
+func (s *mapShard[T]) SaveCtx(ctx context.Context) error {
+	return s.parent.SaveCtx(ctx)
+}
+
+func (m *shardedMap[T]) getSaveTimer() *time.Timer {
+	m.timerMut.Lock()
+	defer m.timerMut.Unlock()
+	return m.saveTimer
+}
+
+func (m *shardedMap[T]) setSaveTimer(t *time.Timer) {
+	m.timerMut.Lock()
+	defer m.timerMut.Unlock()
+	m.saveTimer = t
+}
+
+func (m *shardedMap[T]) getMaxSaveTimer() *time.Timer {
+	m.timerMut.Lock()
+	defer m.timerMut.Unlock()
+	return m.maxSaveTimer
+}
+
+func (m *shardedMap[T]) setMaxSaveTimer(t *time.Timer) {
+	m.timerMut.Lock()
+	defer m.timerMut.Unlock()
+	m.maxSaveTimer = t
+}
+
+func (m *shardedMap[T]) getSaveOnce() *sync.Once {
+	m.timerMut.Lock()
+	defer m.timerMut.Unlock()
+	return m.saveOnce
+}
+
+func (m *shardedMap[T]) setSaveOnce(o *sync.Once) {
+	m.timerMut.Lock()
+	defer m.timerMut.Unlock()
+	m.saveOnce = o
+}
@@ -0,0 +1,82 @@
+package speicher
+
+import (
+	"bytes"
+	"errors"
+	"hash"
+	"io"
+	"sync"
+)
+
+type (
+	// savedFiles remembers the content a store last wrote to each of its files,
+	// so a save that would write the same content again can be skipped.
+	savedFiles struct {
+		mut   sync.Mutex
+		files map[string]savedFile
+	}
+
+	// savedFile describes the content a store last wrote to a file.
+	savedFile struct {
+		// sum is nil for stores using WithDoubleBuffer, which always write their file.
+		sum []byte
+		// version is the fileVersion of the file right after it was written.
+		version string
+	}
+)
+
+// errUnchanged aborts writing a file whose content equals what the store last saved to it.
+var errUnchanged = errors.New("file content unchanged")
+
+// unchangedWrite returns a write function that hashes what write writes into h and,
+// once write is done, fails with errUnchanged if the store saved the same content to the file
+// at location last and the file wasn't modified since. The file is written to a temporary file
+// and the error keeps it from replacing location, so unchanged stores don't rewrite their files.
+func (o storeOptions) unchangedWrite(location string, h hash.Hash, write func(w io.Writer) error) func(w io.Writer) error {
+	return func(w io.Writer) error {
+		if err := write(io.MultiWriter(w, h)); err != nil {
+			return err
+		}
+		if o.saved.unchanged(o, location, h.Sum(nil)) {
+			return errUnchanged
+		}
+		return nil
+	}
+}
+
+// unchanged reports whether the file at location holds the content with the given sum, as the store saved it last.
+func (s *savedFiles) unchanged(o storeOptions, location string, sum []byte) bool {
+	s.mut.Lock()
+	last, ok := s.files[location]
+	s.mut.Unlock()
+	return ok && bytes.Equal(last.sum, sum) && last.version == o.fileVersion(location)
+}
+
+// remember records that the file at location now holds the content with the given sum.
+func (s *savedFiles) remember(o storeOptions, location string, sum []byte) {
+	version := o.fileVersion(location)
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	if s.files == nil {
+		s.files = make(map[string]savedFile)
+	}
+	s.files[location] = savedFile{sum: sum, version: version}
+}
+
+// wrote reports whether the file at location is at version, as the store saved it last.
+func (s *savedFiles) wrote(location, version string) bool {
+	if s == nil {
+		return false
+	}
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	last, ok := s.files[location]
+	return ok && last.version == version
+}
+
+// forget drops what is known about the content of the file at location, after a failed save.
+func (s *savedFiles) forget(location string) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	delete(s.files, location)
+}
@@ -0,0 +1,78 @@
+package speicher
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// WriteSnapshot writes a point-in-time copy of store to location, for example for analytics jobs
+// that read the file directly. The format is chosen by the suffix of location like for a store file,
+// and opts like WithEncryption configure it.
+//
+// The data is encoded in memory while holding a read lock, so writers are only held up
+// for the encoding and not for the disk write. The copy replaces location atomically,
+// so readers never observe a partially written snapshot. Expired elements are left out,
+// and the expiry times of the others are written to a sidecar file next to location like a save writes them.
+// The live file, the auto-save schedule and Dirty are not affected.
+//
+// This function acquires its own read lock on store.
+func WriteSnapshot(store Store, location string, opts ...Option) error {
+	m, ok := store.(migratable)
+	if !ok {
+		return fmt.Errorf("store does not support snapshots")
+	}
+	c, err := resolveCodec(location, newStoreOptions(opts))
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	var expiry []byte
+	var carries bool
+	err = func() error {
+		s := NewState()
+		s.RLock(m)
+		defer s.RUnlock(m)
+		if err := m.encodeData(&buf, c); err != nil {
+			return err
+		}
+		expiry, carries, err = encodeExpiryOf(m, c)
+		return err
+	}()
+	if err != nil {
+		return errors.Join(fmt.Errorf("failed to encode snapshot '%s'", location), err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(location), 0740); err != nil {
+		return errors.Join(fmt.Errorf("failed to create directory for '%s'", location), err)
+	}
+	if carries {
+		if err := writeExpiryFile(location, expiry); err != nil {
+			return err
+		}
+	}
+	err = writeFileAtomic(location, func(w io.Writer) error {
+		_, err := buf.WriteTo(w)
+		return err
+	})
+	if err != nil {
+		return errors.Join(fmt.Errorf("failed to write snapshot '%s'", location), err)
+	}
+	return nil
+}
+
+func (m *shardedMap[T]) encodeData(w io.Writer, c codec) error {
+	return m.merged().encodeData(w, c)
+}
+
+func (m *shardedMap[T]) decodedEquals(r io.Reader, c codec) (bool, error) {
+	return m.merged().decodedEquals(r, c)
+}
+
+func (m *shardedMap[T]) encodeExpiry(w io.Writer, c codec) (bool, error) {
+	return m.merged().encodeExpiry(w, c)
+}
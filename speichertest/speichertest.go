@@ -0,0 +1,92 @@
+// Package speichertest helps tests seed speicher stores with fixture data.
+//
+//	func TestUsers(t *testing.T) {
+//		fixtures := speichertest.Load(t, "testdata/fixtures/")
+//		users := speichertest.Map[User](fixtures, "users.json")
+//		// ...
+//	}
+//
+// Fixtures are copied to a temporary directory, so tests can change the stores freely
+// without touching the files in testdata.
+package speichertest
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/bloodmagesoftware/speicher/v2"
+)
+
+// Manager holds the copy of a fixture directory and closes the stores loaded from it
+// when the test finishes.
+type Manager struct {
+	t   testing.TB
+	dir string
+
+	mut    sync.Mutex
+	stores map[string]any
+}
+
+// Load copies the fixture directory dir, including its subdirectories, to a temporary directory
+// and returns a Manager for the copy. The test fails immediately if dir can't be copied.
+// Every file is loaded with the codec matching its extension, like store files: .json, .json.gz,
+// .msgpack or .msgpack.gz.
+//
+// The stores loaded from the Manager are closed and the temporary directory is removed when the test finishes.
+func Load(t testing.TB, dir string) *Manager {
+	t.Helper()
+	tmp := t.TempDir()
+	if err := os.CopyFS(tmp, os.DirFS(dir)); err != nil {
+		t.Fatalf("speichertest: failed to copy fixtures from '%s': %v", dir, err)
+	}
+	return &Manager{t: t, dir: tmp, stores: make(map[string]any)}
+}
+
+// Path returns the location of the fixture file with the given name in the temporary directory,
+// for example to load a store with a loader that has no helper in this package.
+func (m *Manager) Path(name string) string {
+	return filepath.Join(m.dir, filepath.FromSlash(name))
+}
+
+// Store loads the fixture file with the given name using load and closes the store when the test finishes.
+// If the file doesn't exist, load starts an empty store like it does for any other location.
+// Loading the same name again returns the same store. The test fails immediately if the store can't be loaded.
+//
+//	board := speichertest.Store(fixtures, "scores.json", speicher.LoadLeaderboard)
+func Store[S interface{ Close() error }](m *Manager, name string, load func(location string, opts ...speicher.Option) (S, error), opts ...speicher.Option) S {
+	m.t.Helper()
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	if store, ok := m.stores[name]; ok {
+		s, ok := store.(S)
+		if !ok {
+			m.t.Fatalf("speichertest: fixture '%s' was already loaded as %T", name, store)
+		}
+		return s
+	}
+	store, err := load(m.Path(name), opts...)
+	if err != nil {
+		m.t.Fatalf("speichertest: failed to load fixture '%s': %v", name, err)
+	}
+	m.stores[name] = store
+	m.t.Cleanup(func() {
+		if err := store.Close(); err != nil {
+			m.t.Errorf("speichertest: failed to close fixture '%s': %v", name, err)
+		}
+	})
+	return store
+}
+
+// Map loads the fixture file with the given name as a Map like Store.
+func Map[T any](m *Manager, name string, opts ...speicher.Option) speicher.Map[T] {
+	m.t.Helper()
+	return Store(m, name, speicher.LoadMap[T], opts...)
+}
+
+// List loads the fixture file with the given name as a List like Store.
+func List[T any](m *Manager, name string, opts ...speicher.Option) speicher.List[T] {
+	m.t.Helper()
+	return Store(m, name, speicher.LoadList[T], opts...)
+}
@@ -0,0 +1,470 @@
+package speichertest
+
+import (
+	"context"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bloodmagesoftware/speicher/v2"
+)
+
+// Call is a method call recorded by a SpyMap or SpyList.
+type Call struct {
+	// Method is the name of the called method, like "Set".
+	Method string
+	// Key is the key, index or ID the method was called with, or "" if it takes none.
+	// Methods that take several keys record them separated by commas.
+	Key string
+	// ReadLocked and WriteLocked report which lock was held on the store during the call, see speicher.Locked.
+	ReadLocked, WriteLocked bool
+}
+
+// Locked reports whether any lock was held on the store during the call.
+func (c Call) Locked() bool {
+	return c.ReadLocked || c.WriteLocked
+}
+
+// recorder records the calls of a spy and holds the error its saves fail with.
+type recorder struct {
+	mut     sync.Mutex
+	calls   []Call
+	saveErr error
+}
+
+func (r *recorder) record(store speicher.Store, method, key string) {
+	read, write := speicher.Locked(store)
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	r.calls = append(r.calls, Call{Method: method, Key: key, ReadLocked: read, WriteLocked: write})
+}
+
+func (r *recorder) recorded() []Call {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	return slices.Clone(r.calls)
+}
+
+func (r *recorder) reset() {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	r.calls = nil
+}
+
+func (r *recorder) failSave(err error) {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	r.saveErr = err
+}
+
+func (r *recorder) saveFailure() error {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	return r.saveErr
+}
+
+// SpyMap wraps a speicher.Map and records every call of its methods, along with the lock held during the call,
+// so tests can assert how code uses a store:
+//
+//	users := speichertest.NewSpyMap(speicher.NewMemoryMap[User]())
+//	register(users, "alice")
+//	for _, c := range users.Calls() {
+//		if c.Method == "Set" && !c.WriteLocked {
+//			t.Errorf("Set(%q) called without a write lock", c.Key)
+//		}
+//	}
+//
+// States lock the wrapped Map when they lock the SpyMap, so automatic saves and watchers keep working.
+// Calls the wrapped Map makes on itself, and its automatic saves, are not recorded.
+type SpyMap[T any] struct {
+	speicher.Map[T]
+	rec recorder
+}
+
+// NewSpyMap returns a SpyMap that wraps m.
+func NewSpyMap[T any](m speicher.Map[T]) *SpyMap[T] {
+	return &SpyMap[T]{Map: m}
+}
+
+// Unwrap returns the wrapped Map.
+func (m *SpyMap[T]) Unwrap() speicher.Store {
+	return m.Map
+}
+
+// Calls returns the calls recorded so far, in order.
+func (m *SpyMap[T]) Calls() []Call {
+	return m.rec.recorded()
+}
+
+// Reset forgets the calls recorded so far.
+func (m *SpyMap[T]) Reset() {
+	m.rec.reset()
+}
+
+// FailSave makes Save and SaveCtx return err instead of saving the Map, for example to test error handling.
+// Pass nil to save the Map again. Automatic saves and Close are not affected.
+func (m *SpyMap[T]) FailSave(err error) {
+	m.rec.failSave(err)
+}
+
+func (m *SpyMap[T]) Get(key string) (T, bool) {
+	m.rec.record(m.Map, "Get", key)
+	return m.Map.Get(key)
+}
+
+func (m *SpyMap[T]) GetMany(keys ...string) map[string]T {
+	m.rec.record(m.Map, "GetMany", joinKeys(keys))
+	return m.Map.GetMany(keys...)
+}
+
+func (m *SpyMap[T]) Find(pred func(T) bool) (T, bool) {
+	m.rec.record(m.Map, "Find", "")
+	return m.Map.Find(pred)
+}
+
+func (m *SpyMap[T]) FindAll(pred func(T) bool) []T {
+	m.rec.record(m.Map, "FindAll", "")
+	return m.Map.FindAll(pred)
+}
+
+func (m *SpyMap[T]) Query() *speicher.Query[T] {
+	m.rec.record(m.Map, "Query", "")
+	return m.Map.Query()
+}
+
+func (m *SpyMap[T]) Has(key string) bool {
+	m.rec.record(m.Map, "Has", key)
+	return m.Map.Has(key)
+}
+
+func (m *SpyMap[T]) Len() int {
+	m.rec.record(m.Map, "Len", "")
+	return m.Map.Len()
+}
+
+func (m *SpyMap[T]) Keys() []string {
+	m.rec.record(m.Map, "Keys", "")
+	return m.Map.Keys()
+}
+
+func (m *SpyMap[T]) Values() []T {
+	m.rec.record(m.Map, "Values", "")
+	return m.Map.Values()
+}
+
+func (m *SpyMap[T]) Set(key string, value T) {
+	m.rec.record(m.Map, "Set", key)
+	m.Map.Set(key, value)
+}
+
+func (m *SpyMap[T]) TrySet(key string, value T) error {
+	m.rec.record(m.Map, "TrySet", key)
+	return m.Map.TrySet(key, value)
+}
+
+func (m *SpyMap[T]) SetMany(values map[string]T) {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	m.rec.record(m.Map, "SetMany", joinKeys(keys))
+	m.Map.SetMany(values)
+}
+
+func (m *SpyMap[T]) GetWithRevision(key string) (T, uint64, bool) {
+	m.rec.record(m.Map, "GetWithRevision", key)
+	return m.Map.GetWithRevision(key)
+}
+
+func (m *SpyMap[T]) SetIfRevision(key string, value T, revision uint64) error {
+	m.rec.record(m.Map, "SetIfRevision", key)
+	return m.Map.SetIfRevision(key, value, revision)
+}
+
+func (m *SpyMap[T]) SetCloned(key string, value T) {
+	m.rec.record(m.Map, "SetCloned", key)
+	m.Map.SetCloned(key, value)
+}
+
+func (m *SpyMap[T]) GetOrSet(key string, create func() T) T {
+	m.rec.record(m.Map, "GetOrSet", key)
+	return m.Map.GetOrSet(key, create)
+}
+
+func (m *SpyMap[T]) Update(key string, fn func(old T, exists bool) T) T {
+	m.rec.record(m.Map, "Update", key)
+	return m.Map.Update(key, fn)
+}
+
+func (m *SpyMap[T]) SetWithTTL(key string, value T, ttl time.Duration) {
+	m.rec.record(m.Map, "SetWithTTL", key)
+	m.Map.SetWithTTL(key, value, ttl)
+}
+
+func (m *SpyMap[T]) ExpiresAt(key string) (time.Time, bool) {
+	m.rec.record(m.Map, "ExpiresAt", key)
+	return m.Map.ExpiresAt(key)
+}
+
+func (m *SpyMap[T]) DeleteExpired() int {
+	m.rec.record(m.Map, "DeleteExpired", "")
+	return m.Map.DeleteExpired()
+}
+
+func (m *SpyMap[T]) Delete(key string) {
+	m.rec.record(m.Map, "Delete", key)
+	m.Map.Delete(key)
+}
+
+func (m *SpyMap[T]) DeleteMany(keys ...string) {
+	m.rec.record(m.Map, "DeleteMany", joinKeys(keys))
+	m.Map.DeleteMany(keys...)
+}
+
+func (m *SpyMap[T]) Overwrite(data map[string]T) {
+	m.rec.record(m.Map, "Overwrite", "")
+	m.Map.Overwrite(data)
+}
+
+func (m *SpyMap[T]) Rekey(fn func(oldKey string, value T) (newKey string)) error {
+	m.rec.record(m.Map, "Rekey", "")
+	return m.Map.Rekey(fn)
+}
+
+func (m *SpyMap[T]) RangeKV() (<-chan speicher.MapRangeEl[T], func()) {
+	m.rec.record(m.Map, "RangeKV", "")
+	return m.Map.RangeKV()
+}
+
+func (m *SpyMap[T]) RangeV() (<-chan T, func()) {
+	m.rec.record(m.Map, "RangeV", "")
+	return m.Map.RangeV()
+}
+
+func (m *SpyMap[T]) Iterate(yield func(key string, value T) bool) {
+	m.rec.record(m.Map, "Iterate", "")
+	m.Map.Iterate(yield)
+}
+
+func (m *SpyMap[T]) Watch(ctx context.Context) <-chan speicher.ChangeEvent[T] {
+	m.rec.record(m.Map, "Watch", "")
+	return m.Map.Watch(ctx)
+}
+
+func (m *SpyMap[T]) Save() error {
+	m.rec.record(m.Map, "Save", "")
+	if err := m.rec.saveFailure(); err != nil {
+		return err
+	}
+	return m.Map.Save()
+}
+
+func (m *SpyMap[T]) SaveCtx(ctx context.Context) error {
+	m.rec.record(m.Map, "SaveCtx", "")
+	if err := m.rec.saveFailure(); err != nil {
+		return err
+	}
+	return m.Map.SaveCtx(ctx)
+}
+
+func (m *SpyMap[T]) Close() error {
+	m.rec.record(m.Map, "Close", "")
+	return m.Map.Close()
+}
+
+// SpyList wraps a speicher.List and records every call of its methods like SpyMap.
+// Methods that take an index or ID record it as the key of the Call.
+type SpyList[T any] struct {
+	speicher.List[T]
+	rec recorder
+}
+
+// NewSpyList returns a SpyList that wraps l.
+func NewSpyList[T any](l speicher.List[T]) *SpyList[T] {
+	return &SpyList[T]{List: l}
+}
+
+// Unwrap returns the wrapped List.
+func (l *SpyList[T]) Unwrap() speicher.Store {
+	return l.List
+}
+
+// Calls returns the calls recorded so far, in order.
+func (l *SpyList[T]) Calls() []Call {
+	return l.rec.recorded()
+}
+
+// Reset forgets the calls recorded so far.
+func (l *SpyList[T]) Reset() {
+	l.rec.reset()
+}
+
+// FailSave makes Save and SaveCtx return err instead of saving the List, for example to test error handling.
+// Pass nil to save the List again. Automatic saves and Close are not affected.
+func (l *SpyList[T]) FailSave(err error) {
+	l.rec.failSave(err)
+}
+
+func (l *SpyList[T]) Get(index int) (T, bool) {
+	l.rec.record(l.List, "Get", strconv.Itoa(index))
+	return l.List.Get(index)
+}
+
+func (l *SpyList[T]) Find(pred func(T) bool) (T, bool) {
+	l.rec.record(l.List, "Find", "")
+	return l.List.Find(pred)
+}
+
+func (l *SpyList[T]) FindAll(pred func(T) bool) []T {
+	l.rec.record(l.List, "FindAll", "")
+	return l.List.FindAll(pred)
+}
+
+func (l *SpyList[T]) Query() *speicher.Query[T] {
+	l.rec.record(l.List, "Query", "")
+	return l.List.Query()
+}
+
+func (l *SpyList[T]) IDOf(index int) (uint64, bool) {
+	l.rec.record(l.List, "IDOf", strconv.Itoa(index))
+	return l.List.IDOf(index)
+}
+
+func (l *SpyList[T]) IndexOfID(id uint64) (int, bool) {
+	l.rec.record(l.List, "IndexOfID", strconv.FormatUint(id, 10))
+	return l.List.IndexOfID(id)
+}
+
+func (l *SpyList[T]) GetByID(id uint64) (T, bool) {
+	l.rec.record(l.List, "GetByID", strconv.FormatUint(id, 10))
+	return l.List.GetByID(id)
+}
+
+func (l *SpyList[T]) RemoveByID(id uint64) bool {
+	l.rec.record(l.List, "RemoveByID", strconv.FormatUint(id, 10))
+	return l.List.RemoveByID(id)
+}
+
+func (l *SpyList[T]) Append(value T) {
+	l.rec.record(l.List, "Append", "")
+	l.List.Append(value)
+}
+
+func (l *SpyList[T]) TryAppend(value T) error {
+	l.rec.record(l.List, "TryAppend", "")
+	return l.List.TryAppend(value)
+}
+
+func (l *SpyList[T]) AppendMany(values []T) {
+	l.rec.record(l.List, "AppendMany", "")
+	l.List.AppendMany(values)
+}
+
+func (l *SpyList[T]) AppendUnique(value T, equal func(a, b T) bool) bool {
+	l.rec.record(l.List, "AppendUnique", "")
+	return l.List.AppendUnique(value, equal)
+}
+
+func (l *SpyList[T]) Set(index int, value T) error {
+	l.rec.record(l.List, "Set", strconv.Itoa(index))
+	return l.List.Set(index, value)
+}
+
+func (l *SpyList[T]) Insert(index int, value T) error {
+	l.rec.record(l.List, "Insert", strconv.Itoa(index))
+	return l.List.Insert(index, value)
+}
+
+func (l *SpyList[T]) InsertSorted(value T, less func(a, b T) bool) {
+	l.rec.record(l.List, "InsertSorted", "")
+	l.List.InsertSorted(value, less)
+}
+
+func (l *SpyList[T]) Sort(less func(a, b T) bool) {
+	l.rec.record(l.List, "Sort", "")
+	l.List.Sort(less)
+}
+
+func (l *SpyList[T]) Remove(index int) error {
+	l.rec.record(l.List, "Remove", strconv.Itoa(index))
+	return l.List.Remove(index)
+}
+
+func (l *SpyList[T]) RemoveWhere(pred func(T) bool) int {
+	l.rec.record(l.List, "RemoveWhere", "")
+	return l.List.RemoveWhere(pred)
+}
+
+func (l *SpyList[T]) Pop() (T, bool) {
+	l.rec.record(l.List, "Pop", "")
+	return l.List.Pop()
+}
+
+func (l *SpyList[T]) Shift() (T, bool) {
+	l.rec.record(l.List, "Shift", "")
+	return l.List.Shift()
+}
+
+func (l *SpyList[T]) Overwrite(data []T) {
+	l.rec.record(l.List, "Overwrite", "")
+	l.List.Overwrite(data)
+}
+
+func (l *SpyList[T]) Len() int {
+	l.rec.record(l.List, "Len", "")
+	return l.List.Len()
+}
+
+func (l *SpyList[T]) Range() (<-chan T, func()) {
+	l.rec.record(l.List, "Range", "")
+	return l.List.Range()
+}
+
+func (l *SpyList[T]) Iterate(yield func(v T) bool) {
+	l.rec.record(l.List, "Iterate", "")
+	l.List.Iterate(yield)
+}
+
+func (l *SpyList[T]) IterateSegments(yield func(segment int, values []T) bool) {
+	l.rec.record(l.List, "IterateSegments", "")
+	l.List.IterateSegments(yield)
+}
+
+func (l *SpyList[T]) PruneSegments(keep int) int {
+	l.rec.record(l.List, "PruneSegments", strconv.Itoa(keep))
+	return l.List.PruneSegments(keep)
+}
+
+func (l *SpyList[T]) Watch(ctx context.Context) <-chan speicher.ChangeEvent[T] {
+	l.rec.record(l.List, "Watch", "")
+	return l.List.Watch(ctx)
+}
+
+func (l *SpyList[T]) Save() error {
+	l.rec.record(l.List, "Save", "")
+	if err := l.rec.saveFailure(); err != nil {
+		return err
+	}
+	return l.List.Save()
+}
+
+func (l *SpyList[T]) SaveCtx(ctx context.Context) error {
+	l.rec.record(l.List, "SaveCtx", "")
+	if err := l.rec.saveFailure(); err != nil {
+		return err
+	}
+	return l.List.SaveCtx(ctx)
+}
+
+func (l *SpyList[T]) Close() error {
+	l.rec.record(l.List, "Close", "")
+	return l.List.Close()
+}
+
+// joinKeys joins keys for the Key of a Call.
+func joinKeys(keys []string) string {
+	return strings.Join(keys, ",")
+}
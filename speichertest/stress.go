@@ -0,0 +1,142 @@
+package speichertest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/bloodmagesoftware/speicher/v2"
+)
+
+const (
+	// stressGrace is how long Stress waits for running operations after the duration passed
+	// before it reports them as deadlocked.
+	stressGrace = 10 * time.Second
+	// maxStressSaveInterval is the longest pause between two saves of Stress.
+	maxStressSaveInterval = 10 * time.Millisecond
+)
+
+// Op is an operation that Stress runs on a store at random.
+type Op[S speicher.Store] struct {
+	// Name identifies the operation in errors.
+	Name string
+	// Write runs the operation with a write lock instead of a read lock.
+	Write bool
+	// Run performs the operation using rnd for random keys and values.
+	// Read operations should check the invariants of the store and return an error if one is violated.
+	Run func(store S, rnd *rand.Rand) error
+}
+
+// Stress runs ops on store from several goroutines at once for duration, picking them at random,
+// while another goroutine saves the store over and over, to validate stores and their usage under contention.
+// Operations that reload or replace the data, for example with Overwrite, are ordinary write operations.
+// Run the test with the race detector to catch unsynchronized access as well.
+//
+// After the duration, the store is saved one last time and every read operation is run once more
+// to verify the final state. Stress returns the first error or panic of an operation or save,
+// or an error if the operations don't finish within a grace period, which hints at a deadlock.
+//
+// This function acquires its own locks on store.
+func Stress[S speicher.Store](store S, ops []Op[S], duration time.Duration) error {
+	if len(ops) == 0 {
+		return errors.New("speichertest: no operations to run")
+	}
+	saver, ok := any(store).(interface{ Save() error })
+	if !ok {
+		return fmt.Errorf("speichertest: %T can't be saved", store)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), duration)
+	defer cancel()
+	workers := max(4, runtime.GOMAXPROCS(0))
+	// Every goroutine reports at most one error, so none of them blocks on a full channel
+	errs := make(chan error, workers+1)
+	var wg sync.WaitGroup
+	for i := range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rnd := rand.New(rand.NewPCG(rand.Uint64(), uint64(i)))
+			s := speicher.NewState()
+			for ctx.Err() == nil {
+				if err := runOp(s, store, ops[rnd.IntN(len(ops))], rnd); err != nil {
+					errs <- err
+					cancel()
+					return
+				}
+			}
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(rand.N(maxStressSaveInterval)):
+			}
+			if err := saver.Save(); err != nil {
+				errs <- errors.Join(errors.New("speichertest: save failed"), err)
+				cancel()
+				return
+			}
+		}
+	}()
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(duration + stressGrace):
+		return fmt.Errorf("speichertest: operations still running %s after the stress test ended, they may be deadlocked", stressGrace)
+	}
+	select {
+	case err := <-errs:
+		return err
+	default:
+	}
+
+	if err := saver.Save(); err != nil {
+		return errors.Join(errors.New("speichertest: final save failed"), err)
+	}
+	s := speicher.NewState()
+	rnd := rand.New(rand.NewPCG(rand.Uint64(), rand.Uint64()))
+	for _, op := range ops {
+		if op.Write {
+			continue
+		}
+		if err := runOp(s, store, op, rnd); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runOp runs op with the lock it needs and turns a panic into an error.
+func runOp[S speicher.Store](s *speicher.State, store S, op Op[S], rnd *rand.Rand) (err error) {
+	if op.Write {
+		s.Lock(store)
+		defer s.Unlock(store)
+	} else {
+		s.RLock(store)
+		defer s.RUnlock(store)
+	}
+	// Deferred after the unlock, so it runs first and the lock is released afterwards
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("speichertest: operation '%s' panicked: %v", op.Name, p)
+		}
+	}()
+	if err := op.Run(store, rnd); err != nil {
+		return errors.Join(fmt.Errorf("speichertest: operation '%s' failed", op.Name), err)
+	}
+	return nil
+}
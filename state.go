@@ -1,8 +1,11 @@
 package speicher
 
 import (
+	"context"
+	"fmt"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
 // storeID is a unique identifier for each store instance.
@@ -20,10 +23,35 @@ type lockable interface {
 	getMutex() *sync.RWMutex
 }
 
+// wrapper is implemented by stores that wrap another store, like the spies of the speichertest package.
+// States lock the wrapped store instead, so its automatic saves, watchers and audit log keep working.
+type wrapper interface {
+	Unwrap() Store
+}
+
+// unwrap returns the innermost store wrapped by store, or store itself if it wraps none.
+func unwrap(store lockable) lockable {
+	for {
+		w, ok := store.(wrapper)
+		if !ok {
+			return store
+		}
+		store = w.Unwrap()
+	}
+}
+
+// composite is implemented by stores whose data is guarded by the locks of other stores.
+// State locks and unlocks all parts in order instead of the store itself.
+type composite interface {
+	parts() []lockable
+}
+
 // lockState tracks the lock counts for a single store within a State.
 type lockState struct {
 	readCount  int
 	writeCount int
+	// since is when the mutex was acquired, if the store is instrumented (see WithInstrumentation).
+	since time.Time
 }
 
 // State manages lock state for multiple stores within a single goroutine.
@@ -39,32 +67,95 @@ type lockState struct {
 //	defer s.Unlock(myMap)
 //	myMap.Set("key", value)
 type State struct {
-	locks map[storeID]*lockState
+	// first holds the lock state of the first store the State locks, which avoids allocating
+	// the locks map in the common case of locking a single store.
+	first   lockState
+	firstID storeID
+	locks   map[storeID]*lockState
+	actor   string
 }
 
 // NewState creates a new State for managing locks.
 // Each goroutine should have its own State instance.
 func NewState() *State {
-	return &State{
-		locks: make(map[storeID]*lockState),
+	return &State{}
+}
+
+// statePool recycles the States of helpers that lock a single store for one operation,
+// so they don't allocate.
+var statePool = sync.Pool{
+	New: func() any {
+		return NewState()
+	},
+}
+
+// borrowState returns a State from statePool. Pass it to returnState once all its locks are released.
+func borrowState() *State {
+	return statePool.Get().(*State)
+}
+
+// returnState puts s back into statePool, unless it still holds locks.
+func returnState(s *State) {
+	if s.first.readCount > 0 || s.first.writeCount > 0 {
+		return
+	}
+	for _, ls := range s.locks {
+		if ls.readCount > 0 || ls.writeCount > 0 {
+			return
+		}
 	}
+	s.first = lockState{}
+	s.firstID = 0
+	s.actor = ""
+	clear(s.locks)
+	statePool.Put(s)
 }
 
 func (s *State) getLockState(id storeID) *lockState {
-	ls, ok := s.locks[id]
-	if !ok {
-		ls = &lockState{}
-		s.locks[id] = ls
+	if ls, ok := s.lookup(id); ok {
+		return ls
+	}
+	if s.firstID == 0 {
+		s.firstID = id
+		return &s.first
+	}
+	if s.locks == nil {
+		s.locks = make(map[storeID]*lockState)
 	}
+	ls := &lockState{}
+	s.locks[id] = ls
 	return ls
 }
 
+// lookup returns the lock state of the store with the given id, if the State ever locked it.
+func (s *State) lookup(id storeID) (*lockState, bool) {
+	if s.firstID == id && id != 0 {
+		return &s.first, true
+	}
+	ls, ok := s.locks[id]
+	return ls, ok
+}
+
+// SetActor sets who makes the changes under the write locks of s, for example the name of the authenticated user.
+// It is recorded with the changes in audit logs (see WithAuditLog).
+func (s *State) SetActor(actor string) {
+	s.actor = actor
+}
+
 // Lock acquires a write lock on the store.
 // If the State already holds a write lock on this store, the lock count is incremented.
 // If the State holds read locks, they are upgraded to a write lock.
 //
 // Multiple calls to Lock must be balanced with equal calls to Unlock.
 func (s *State) Lock(store lockable) {
+	store = unwrap(store)
+	if c, ok := store.(composite); ok {
+		for _, part := range c.parts() {
+			s.Lock(part)
+		}
+		return
+	}
+
 	id := store.getStoreID()
 	mut := store.getMutex()
 	ls := s.getLockState(id)
@@ -77,11 +168,135 @@ func (s *State) Lock(store lockable) {
 
 	if ls.readCount > 0 {
 		// Need to upgrade: release read lock first, then acquire write lock
+		if l := debugLogger(); l != nil {
+			l.Debug("speicher: upgrading read lock to write lock", "location", locationOf(store))
+		}
 		mut.RUnlock()
+		s.released(store, ls, false)
+	}
+
+	s.acquire(store, ls, true, mut.TryLock, mut.Lock)
+	ls.writeCount++
+}
+
+// LockContext acquires a write lock on the store like Lock,
+// but gives up when ctx is cancelled or its deadline passes.
+// The authorization hook of the store (see WithAuthz) is consulted before waiting.
+//
+// If an error is returned, the lock was not acquired and Unlock must not be called.
+// A read lock the State holds on the store can't be upgraded: giving it up for the write lock
+// could leave the State waiting past the deadline to get it back, so an error is returned right away
+// and the read lock is still held. Use Lock to upgrade it.
+func (s *State) LockContext(ctx context.Context, store lockable) error {
+	store = unwrap(store)
+	if err := Authorize(ctx, store, AccessWrite, ""); err != nil {
+		return err
+	}
+	return s.lockContext(ctx, store)
+}
+
+// lockContext acquires a write lock like LockContext without consulting the authorization hook.
+func (s *State) lockContext(ctx context.Context, store lockable) error {
+	if c, ok := store.(composite); ok {
+		parts := c.parts()
+		for i, part := range parts {
+			if err := s.lockContext(ctx, part); err != nil {
+				for j := i - 1; j >= 0; j-- {
+					s.Unlock(parts[j])
+				}
+				return err
+			}
+		}
+		return nil
 	}
 
-	mut.Lock()
+	id := store.getStoreID()
+	mut := store.getMutex()
+	ls := s.getLockState(id)
+
+	if ls.writeCount > 0 {
+		ls.writeCount++
+		return nil
+	}
+
+	if ls.readCount > 0 {
+		// Getting the read lock back after a failed upgrade would wait behind the abandoned write lock
+		return fmt.Errorf("can't upgrade the read lock on '%s' to a write lock with a context", locationOf(store))
+	}
+
+	start := time.Now()
+	if err := acquireContext(ctx, mut.Lock, mut.Unlock); err != nil {
+		return err
+	}
+	s.acquired(store, ls, true, time.Since(start))
 	ls.writeCount++
+	return nil
+}
+
+// RLockContext acquires a read lock on the store like RLock,
+// but gives up when ctx is cancelled or its deadline passes.
+// The authorization hook of the store (see WithAuthz) is consulted before waiting.
+//
+// If an error is returned, the lock was not acquired and RUnlock must not be called.
+func (s *State) RLockContext(ctx context.Context, store lockable) error {
+	store = unwrap(store)
+	if err := Authorize(ctx, store, AccessRead, ""); err != nil {
+		return err
+	}
+	return s.rLockContext(ctx, store)
+}
+
+// rLockContext acquires a read lock like RLockContext without consulting the authorization hook.
+func (s *State) rLockContext(ctx context.Context, store lockable) error {
+	if c, ok := store.(composite); ok {
+		parts := c.parts()
+		for i, part := range parts {
+			if err := s.rLockContext(ctx, part); err != nil {
+				for j := i - 1; j >= 0; j-- {
+					s.RUnlock(parts[j])
+				}
+				return err
+			}
+		}
+		return nil
+	}
+
+	id := store.getStoreID()
+	mut := store.getMutex()
+	ls := s.getLockState(id)
+
+	if ls.writeCount == 0 && ls.readCount == 0 {
+		start := time.Now()
+		if err := acquireContext(ctx, mut.RLock, mut.RUnlock); err != nil {
+			return err
+		}
+		s.acquired(store, ls, false, time.Since(start))
+	}
+	ls.readCount++
+	return nil
+}
+
+// acquireContext calls lock and waits until it returns or ctx is done.
+// If ctx is done first, the lock is released via unlock as soon as it is acquired.
+func acquireContext(ctx context.Context, lock, unlock func()) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	acquired := make(chan struct{})
+	go func() {
+		lock()
+		close(acquired)
+	}()
+	select {
+	case <-acquired:
+		return nil
+	case <-ctx.Done():
+		go func() {
+			<-acquired
+			unlock()
+		}()
+		return ctx.Err()
+	}
 }
 
 // Unlock releases a write lock on the store.
@@ -93,6 +308,15 @@ func (s *State) Lock(store lockable) {
 //
 // Panics if called without a matching Lock call.
 func (s *State) Unlock(store lockable) {
+	store = unwrap(store)
+	if c, ok := store.(composite); ok {
+		parts := c.parts()
+		for i := len(parts) - 1; i >= 0; i-- {
+			s.Unlock(parts[i])
+		}
+		return
+	}
+
 	id := store.getStoreID()
 	mut := store.getMutex()
 	ls := s.getLockState(id)
@@ -104,21 +328,35 @@ func (s *State) Unlock(store lockable) {
 	ls.writeCount--
 
 	if ls.writeCount == 0 {
+		// Record the changes before other writers can make theirs
+		flushAudit(store, s.actor)
+
 		// Release the write lock
 		mut.Unlock()
+		s.released(store, ls, true)
 
-		// Notify that the store was changed (triggers auto-save)
-		if sav, ok := store.(savable); ok {
-			notifyChanged(sav)
-		}
+		written(store)
 
 		// If we had read locks before upgrading, re-acquire read lock
 		if ls.readCount > 0 {
-			mut.RLock()
+			s.acquire(store, ls, false, mut.TryRLock, mut.RLock)
 		}
 	}
 }
 
+// written is called when the last write lock on store was released.
+func written(store lockable) {
+	// Notify that the store was changed (triggers auto-save)
+	if sav, ok := saverOf(store); ok {
+		notifyChanged(sav)
+	}
+
+	// Hand the changes made under the lock to watchers
+	if p, ok := store.(publisher); ok {
+		p.publishChanges()
+	}
+}
+
 // RLock acquires a read lock on the store.
 // If the State already holds a write lock, the read is implicitly satisfied
 // without additional mutex operations.
@@ -126,6 +364,14 @@ func (s *State) Unlock(store lockable) {
 //
 // Multiple calls to RLock must be balanced with equal calls to RUnlock.
 func (s *State) RLock(store lockable) {
+	store = unwrap(store)
+	if c, ok := store.(composite); ok {
+		for _, part := range c.parts() {
+			s.RLock(part)
+		}
+		return
+	}
+
 	id := store.getStoreID()
 	mut := store.getMutex()
 	ls := s.getLockState(id)
@@ -138,7 +384,7 @@ func (s *State) RLock(store lockable) {
 
 	if ls.readCount == 0 {
 		// First read lock, acquire it
-		mut.RLock()
+		s.acquire(store, ls, false, mut.TryRLock, mut.RLock)
 	}
 
 	ls.readCount++
@@ -149,6 +395,15 @@ func (s *State) RLock(store lockable) {
 //
 // Panics if called without a matching RLock call.
 func (s *State) RUnlock(store lockable) {
+	store = unwrap(store)
+	if c, ok := store.(composite); ok {
+		parts := c.parts()
+		for i := len(parts) - 1; i >= 0; i-- {
+			s.RUnlock(parts[i])
+		}
+		return
+	}
+
 	id := store.getStoreID()
 	mut := store.getMutex()
 	ls := s.getLockState(id)
@@ -164,13 +419,23 @@ func (s *State) RUnlock(store lockable) {
 	// - No write locks (if there's a write lock, it owns the mutex)
 	if ls.readCount == 0 && ls.writeCount == 0 {
 		mut.RUnlock()
+		s.released(store, ls, false)
 	}
 }
 
 // HasReadLock returns true if the State holds at least one read lock on the store.
 func (s *State) HasReadLock(store lockable) bool {
-	id := store.getStoreID()
-	ls, ok := s.locks[id]
+	store = unwrap(store)
+	if c, ok := store.(composite); ok {
+		for _, part := range c.parts() {
+			if !s.HasReadLock(part) {
+				return false
+			}
+		}
+		return true
+	}
+
+	ls, ok := s.lookup(store.getStoreID())
 	if !ok {
 		return false
 	}
@@ -179,11 +444,49 @@ func (s *State) HasReadLock(store lockable) bool {
 
 // HasWriteLock returns true if the State holds at least one write lock on the store.
 func (s *State) HasWriteLock(store lockable) bool {
-	id := store.getStoreID()
-	ls, ok := s.locks[id]
+	store = unwrap(store)
+	if c, ok := store.(composite); ok {
+		for _, part := range c.parts() {
+			if !s.HasWriteLock(part) {
+				return false
+			}
+		}
+		return true
+	}
+
+	ls, ok := s.lookup(store.getStoreID())
 	if !ok {
 		return false
 	}
 	return ls.writeCount > 0
 }
 
+// Locked reports whether any State holds a read or a write lock on store,
+// for example to assert in tests that code only touches a store while it is locked.
+// The result is a snapshot that may be outdated as soon as it is returned.
+// A writer waiting for the lock blocks new readers, so a held read lock may be reported as a write lock then.
+// A composite store like a ShardedMap counts as write-locked if all of its parts are write-locked,
+// and as read-locked otherwise if any of its parts is locked.
+func Locked(store Store) (read, write bool) {
+	store = unwrap(store)
+	if c, ok := store.(composite); ok {
+		write = true
+		for _, part := range c.parts() {
+			r, w := Locked(part)
+			read = read || r || w
+			write = write && w
+		}
+		return read && !write, write
+	}
+
+	mut := store.getMutex()
+	if mut.TryLock() {
+		mut.Unlock()
+		return false, false
+	}
+	if mut.TryRLock() {
+		mut.RUnlock()
+		return true, false
+	}
+	return false, true
+}
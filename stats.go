@@ -0,0 +1,179 @@
+package speicher
+
+import (
+	"expvar"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type (
+	// storeStats holds the counters of a single store published by EnableExpvar.
+	storeStats struct {
+		store     lockable
+		location  string
+		saves     atomic.Int64
+		errors    atomic.Int64
+		lockWaits atomic.Int64
+		waitNanos atomic.Int64
+		// instr receives the measurements of the store, see WithInstrumentation.
+		instr Instrumentation
+		// part is set for the parts of a composite store, which are only tracked for instr.
+		part bool
+	}
+
+	// counted is implemented by stores that can report their number of entries.
+	counted interface {
+		lockable
+		// entryCount returns the number of entries.
+		// The caller must hold at least a read lock.
+		entryCount() int
+	}
+)
+
+var (
+	statsEnabled atomic.Bool
+	statsOnce    sync.Once
+	statsMut     sync.RWMutex
+	statsByStore = make(map[storeID]*storeStats)
+)
+
+// EnableExpvar publishes counters of every store loaded afterwards under the expvar variable "speicher",
+// so they are served by the expvar handler at /debug/vars.
+// For each store location it reports the number of entries, automatic saves, failed automatic saves,
+// lock acquisitions that had to wait and the total time spent waiting in milliseconds.
+// Stores loaded before EnableExpvar was called are not tracked.
+func EnableExpvar() {
+	statsOnce.Do(func() {
+		expvar.Publish("speicher", expvar.Func(statsSnapshot))
+		statsEnabled.Store(true)
+	})
+}
+
+// trackStats starts collecting counters for store if EnableExpvar was called or it has an Instrumentation.
+func trackStats(store lockable, location string) {
+	var instr Instrumentation
+	if o := optionsOf(store); o != nil {
+		instr = o.instrumentation
+	}
+	if instr != nil {
+		instrumented.Store(true)
+	} else if !statsEnabled.Load() {
+		return
+	}
+	statsMut.Lock()
+	defer statsMut.Unlock()
+	statsByStore[store.getStoreID()] = &storeStats{store: store, location: location, instr: instr}
+	// The locks of a composite store are taken on its parts
+	if c, ok := store.(composite); ok && instr != nil {
+		for _, part := range c.parts() {
+			statsByStore[part.getStoreID()] = &storeStats{store: part, location: location, instr: instr, part: true}
+		}
+	}
+}
+
+// statsOf returns the counters of store or nil if it is not tracked.
+func statsOf(store lockable) *storeStats {
+	if !statsEnabled.Load() && !instrumented.Load() {
+		return nil
+	}
+	statsMut.RLock()
+	defer statsMut.RUnlock()
+	return statsByStore[store.getStoreID()]
+}
+
+// recordSave counts an automatic save of store and whether it failed.
+func recordSave(store lockable, err error) {
+	if st := statsOf(store); st != nil {
+		st.saves.Add(1)
+		if err != nil {
+			st.errors.Add(1)
+		}
+	}
+}
+
+// statsSnapshot returns the current counters of all tracked stores keyed by location.
+func statsSnapshot() any {
+	statsMut.RLock()
+	stats := make([]*storeStats, 0, len(statsByStore))
+	for _, st := range statsByStore {
+		if !st.part {
+			stats = append(stats, st)
+		}
+	}
+	statsMut.RUnlock()
+
+	result := make(map[string]map[string]int64, len(stats))
+	for _, st := range stats {
+		values := map[string]int64{
+			"saves":        st.saves.Load(),
+			"save_errors":  st.errors.Load(),
+			"lock_waits":   st.lockWaits.Load(),
+			"lock_wait_ms": st.waitNanos.Load() / int64(time.Millisecond),
+		}
+		if c, ok := st.store.(counted); ok {
+			s := NewState()
+			s.RLock(c)
+			values["entries"] = int64(c.entryCount())
+			s.RUnlock(c)
+		}
+		result[st.location] = values
+	}
+	return result
+}
+
+func (m *memoryMap[T]) entryCount() int {
+	return len(m.data)
+}
+
+func (l *memoryList[T]) entryCount() int {
+	return len(l.data)
+}
+
+func (s *memorySet[T]) entryCount() int {
+	return len(s.data)
+}
+
+func (g *memoryGraph[N, E]) entryCount() int {
+	return len(g.nodes)
+}
+
+func (b *memoryBitmap) entryCount() int {
+	return b.Len()
+}
+
+func (b *memoryLeaderboard) entryCount() int {
+	return len(b.scores)
+}
+
+func (h *memoryHyperLogLog) entryCount() int {
+	return len(h.sketches)
+}
+
+func (m *memoryMetrics) entryCount() int {
+	return len(m.data)
+}
+
+func (o *memoryOutbox[T]) entryCount() int {
+	return len(o.data)
+}
+
+func (d *memoryDocument) entryCount() int {
+	return len(d.data)
+}
+
+func (ts *memoryTimeSeries[T]) entryCount() int {
+	return len(ts.data)
+}
+
+func (h *memoryHeap[T]) entryCount() int {
+	return len(h.data.values)
+}
+
+func (q *memoryQueue[T]) entryCount() int {
+	return len(q.data)
+}
+
+func (s *memorySecrets) entryCount() int {
+	return len(s.data)
+}
@@ -0,0 +1,132 @@
+package speicher
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"reflect"
+)
+
+// progressReader reports the number of bytes read from a file being loaded.
+type progressReader struct {
+	r     io.Reader
+	read  int64
+	total int64
+	fn    func(read, total int64)
+}
+
+// WithLoadProgress sets a function that is called while a Map or List file is loaded,
+// with the number of bytes read so far and the size of the file (0 if unknown),
+// for example to show the progress of loading a multi-gigabyte file at startup.
+// Other stores ignore it.
+func WithLoadProgress(fn func(read, total int64)) Option {
+	return func(o *storeOptions) {
+		o.loadProgress = fn
+	}
+}
+
+// withProgress wraps f to report the progress of reading it, if WithLoadProgress is set.
+func (o *storeOptions) withProgress(f io.Reader) io.Reader {
+	if o.loadProgress == nil {
+		return f
+	}
+	p := &progressReader{r: f, fn: o.loadProgress}
+	if st, ok := f.(interface{ Stat() (fs.FileInfo, error) }); ok {
+		if info, err := st.Stat(); err == nil {
+			p.total = info.Size()
+		}
+	}
+	return p
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	if n > 0 {
+		p.read += int64(n)
+		p.fn(p.read, p.total)
+	}
+	return n, err
+}
+
+// canStream reports whether c can decode the elements of a map or list one at a time with streamDecode.
+func canStream(c codec) bool {
+	switch c := c.(type) {
+	case jsonCodec:
+		return true
+	case gzipCodec:
+		return canStream(c.inner)
+	}
+	return false
+}
+
+// streamDecode decodes the JSON object (or array, if object is false) in r element by element
+// instead of reading the whole file into memory first, calling elem for every element.
+// key is empty for array elements. decode must be called exactly once to decode the element.
+// A JSON null contains no elements. c must be a codec for which canStream returns true.
+func streamDecode(c codec, r io.Reader, object bool, elem func(key string, decode func(v any) error) error) error {
+	switch c := c.(type) {
+	case gzipCodec:
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		return streamDecode(c.inner, zr, object, elem)
+	case jsonCodec:
+		return streamJSON(r, c.strict, object, elem)
+	}
+	return fmt.Errorf("codec %T can't stream", c)
+}
+
+func streamJSON(r io.Reader, strict bool, object bool, elem func(key string, decode func(v any) error) error) error {
+	dec := json.NewDecoder(r)
+	if strict {
+		dec.DisallowUnknownFields()
+	}
+	start, end, kind := json.Delim('['), json.Delim(']'), "array"
+	if object {
+		start, end, kind = json.Delim('{'), json.Delim('}'), "object"
+	}
+	t, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if t == nil {
+		return nil
+	}
+	if t != start {
+		return fmt.Errorf("expected JSON %s", kind)
+	}
+	decode := func(v any) error {
+		if t := reflect.TypeOf(v); t == nil || t.Kind() != reflect.Pointer || !hasAliases(t.Elem()) {
+			return dec.Decode(v)
+		}
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			return err
+		}
+		return decodeJSON(bytes.NewReader(raw), v, strict)
+	}
+	for dec.More() {
+		var key string
+		if object {
+			t, err := dec.Token()
+			if err != nil {
+				return err
+			}
+			key = t.(string)
+		}
+		if err := elem(key, decode); err != nil {
+			return err
+		}
+	}
+	if t, err := dec.Token(); err != nil {
+		return err
+	} else if t != end {
+		return fmt.Errorf("expected end of JSON %s", kind)
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package speicher
+
+import (
+	"context"
+	"time"
+)
+
+type (
+	// TierRule decides whether an entry of the primary store of a Tiering is moved to the archive.
+	TierRule[T any] func(key string, value T) bool
+
+	// Tiering moves entries matching its rules from a primary Map to an archive Map.
+	// The archive can be any Map, for example one loaded from a ".json.gz" file to keep cold data compressed.
+	Tiering[T any] struct {
+		primary Map[T]
+		archive Map[T]
+		rules   []TierRule[T]
+	}
+)
+
+// OlderThan returns a TierRule that matches entries whose time, as returned by at, is more than age ago.
+func OlderThan[T any](age time.Duration, at func(value T) time.Time) TierRule[T] {
+	return func(_ string, value T) bool {
+		return time.Since(at(value)) > age
+	}
+}
+
+// NewTiering returns a Tiering that moves entries from primary to archive
+// if any of the rules matches them. Entries are only moved by Run or StartTiering.
+func NewTiering[T any](primary, archive Map[T], rules ...TierRule[T]) *Tiering[T] {
+	return &Tiering[T]{primary: primary, archive: archive, rules: rules}
+}
+
+// StartTiering creates a Tiering like NewTiering and runs it every interval until ctx is done.
+func StartTiering[T any](ctx context.Context, interval time.Duration, primary, archive Map[T], rules ...TierRule[T]) *Tiering[T] {
+	t := NewTiering(primary, archive, rules...)
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				t.Run()
+			}
+		}
+	}()
+	return t
+}
+
+// Run moves all entries of the primary store that match a rule to the archive
+// and returns how many were moved. Both stores are changed in one step like with MoveEntries.
+//
+// This method acquires its own write locks on both stores.
+func (t *Tiering[T]) Run() int {
+	return transferEntries(t.primary, t.archive, nil, true, t.matches)
+}
+
+func (t *Tiering[T]) matches(key string, value T) bool {
+	for _, rule := range t.rules {
+		if rule(key, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// Get retrieves the element associated with key from the primary store
+// and falls through to the archive if the primary store doesn't have it.
+//
+// This method acquires its own read locks on the stores.
+func (t *Tiering[T]) Get(key string) (T, bool) {
+	s := NewState()
+	s.RLock(t.primary)
+	value, ok := t.primary.Get(key)
+	s.RUnlock(t.primary)
+	if ok {
+		return value, true
+	}
+	// An entry moved in between is found in the archive, which is only read after the primary store.
+	s.RLock(t.archive)
+	defer s.RUnlock(t.archive)
+	return t.archive.Get(key)
+}
@@ -0,0 +1,332 @@
+package speicher
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+type (
+	// TimePoint is a single value of a TimeSeries at a point in time.
+	TimePoint[T any] struct {
+		Time  time.Time
+		Value T
+	}
+
+	// number is the set of types DownsampleMean can average.
+	number interface {
+		integer | ~float32 | ~float64
+	}
+
+	// memoryTimeSeries is a TimeSeries implementation that keeps all points in memory, ordered by time.
+	memoryTimeSeries[T any] struct {
+		id        storeID
+		data      []TimePoint[T]
+		retention time.Duration
+		location  string
+		codec     codec
+		opts      storeOptions
+		mut       sync.RWMutex
+
+		timerMut     sync.Mutex
+		saveTimer    *time.Timer
+		maxSaveTimer *time.Timer
+		saveOnce     *sync.Once
+	}
+
+	// TimeSeries is a thread-safe store of values ordered by time, like sensor samples,
+	// that drops points once they are older than its retention (see LoadTimeSeries).
+	//
+	// All operations require appropriate locking via a State object:
+	//
+	//	s := speicher.NewState()
+	//	s.Lock(temperatures)
+	//	temperatures.Append(time.Now(), 21.5)
+	//	s.Unlock(temperatures)
+	TimeSeries[T any] interface {
+		lockable
+
+		// Append adds a point with the value at time t and removes the points that are older than the retention.
+		// Points may be appended out of order; they are inserted at their place in time,
+		// after the points with the same time.
+		// Requires a write lock.
+		Append(t time.Time, value T)
+
+		// Range returns the points within [from, to), in chronological order.
+		// Requires at least a read lock.
+		Range(from, to time.Time) []TimePoint[T]
+
+		// Latest returns the most recent point.
+		// If the TimeSeries is empty, the bool result will be false.
+		// Requires at least a read lock.
+		Latest() (point TimePoint[T], found bool)
+
+		// Len returns the number of points.
+		// Requires at least a read lock.
+		Len() int
+
+		// Iterate iterates over all points in chronological order.
+		// Requires at least a read lock.
+		Iterate(yield func(point TimePoint[T]) bool)
+
+		// Prune removes all points before the given time and returns how many were removed.
+		// Requires a write lock.
+		Prune(before time.Time) int
+
+		// Save persists the current state of the TimeSeries to its underlying data store.
+		// It returns an error if the operation fails.
+		// This method acquires its own read lock internally.
+		Save() error
+
+		// SaveCtx persists the current state of the data store like Save,
+		// but aborts when ctx is cancelled or its deadline passes.
+		// An aborted save removes its temporary files and leaves the previous file intact.
+		// This method acquires its own read lock internally.
+		SaveCtx(ctx context.Context) error
+
+		// Close stops the automatic save and the background goroutines of the store and saves it one last time.
+		// The store must not be used afterwards.
+		// This method acquires its own read lock internally.
+		Close() error
+	}
+)
+
+// search returns the index of the first point that is not before t.
+func (ts *memoryTimeSeries[T]) search(t time.Time) int {
+	return sort.Search(len(ts.data), func(i int) bool {
+		return !ts.data[i].Time.Before(t)
+	})
+}
+
+func (ts *memoryTimeSeries[T]) Append(t time.Time, value T) {
+	point := TimePoint[T]{Time: t, Value: value}
+	if n := len(ts.data); n == 0 || !t.Before(ts.data[n-1].Time) {
+		ts.data = append(ts.data, point)
+	} else {
+		i := sort.Search(n, func(i int) bool {
+			return ts.data[i].Time.After(t)
+		})
+		ts.data = slices.Insert(ts.data, i, point)
+	}
+	ts.pruneRetention()
+}
+
+// pruneRetention removes the points that are older than the retention, if any.
+func (ts *memoryTimeSeries[T]) pruneRetention() {
+	if ts.retention > 0 {
+		ts.Prune(time.Now().Add(-ts.retention))
+	}
+}
+
+func (ts *memoryTimeSeries[T]) Range(from, to time.Time) []TimePoint[T] {
+	start, end := ts.search(from), ts.search(to)
+	if start >= end {
+		return nil
+	}
+	return slices.Clone(ts.data[start:end])
+}
+
+func (ts *memoryTimeSeries[T]) Latest() (point TimePoint[T], found bool) {
+	if len(ts.data) == 0 {
+		return
+	}
+	return ts.data[len(ts.data)-1], true
+}
+
+func (ts *memoryTimeSeries[T]) Len() int {
+	return len(ts.data)
+}
+
+func (ts *memoryTimeSeries[T]) Iterate(yield func(point TimePoint[T]) bool) {
+	for _, point := range ts.data {
+		if !yield(point) {
+			break
+		}
+	}
+}
+
+func (ts *memoryTimeSeries[T]) Prune(before time.Time) int {
+	n := ts.search(before)
+	if n == 0 {
+		return 0
+	}
+	// Clear the removed points, so the backing array doesn't keep their values alive
+	clear(ts.data[:n])
+	ts.data = ts.data[n:]
+	return n
+}
+
+// Downsample groups points into intervals of the given width, aligned like time.Time.Truncate,
+// and folds the points of every interval into a single point at the start of the interval,
+// for example to chart a long range. The points must be in chronological order, like the result of Range.
+// Intervals without points are left out.
+func Downsample[T, R any](points []TimePoint[T], interval time.Duration, fold func(points []TimePoint[T]) R) []TimePoint[R] {
+	var result []TimePoint[R]
+	for i := 0; i < len(points); {
+		start := points[i].Time.Truncate(interval)
+		end := start.Add(interval)
+		j := i + 1
+		for j < len(points) && points[j].Time.Before(end) {
+			j++
+		}
+		result = append(result, TimePoint[R]{Time: start, Value: fold(points[i:j])})
+		i = j
+	}
+	return result
+}
+
+// DownsampleMean downsamples points like Downsample to the mean value of every interval.
+func DownsampleMean[T number](points []TimePoint[T], interval time.Duration) []TimePoint[float64] {
+	return Downsample(points, interval, func(points []TimePoint[T]) float64 {
+		var sum float64
+		for _, p := range points {
+			sum += float64(p.Value)
+		}
+		return sum / float64(len(points))
+	})
+}
+
+func (ts *memoryTimeSeries[T]) getStoreID() storeID {
+	return ts.id
+}
+
+func (ts *memoryTimeSeries[T]) getMutex() *sync.RWMutex {
+	return &ts.mut
+}
+
+func (ts *memoryTimeSeries[T]) getOptions() *storeOptions {
+	return &ts.opts
+}
+
+func (ts *memoryTimeSeries[T]) Save() error {
+	return ts.SaveCtx(context.Background())
+}
+
+func (ts *memoryTimeSeries[T]) SaveCtx(ctx context.Context) error {
+	s := saveState(ctx)
+	s.RLock(ts)
+	defer s.RUnlock(ts)
+
+	h := sha256.New()
+	err := ts.opts.saveFile(ctx, ts.location, func(w io.Writer) error {
+		return ts.codec.encode(io.MultiWriter(w, h), ts.data)
+	})
+	if err != nil {
+		return errors.Join(fmt.Errorf("failed to write file '%s'", ts.location), err)
+	}
+	if err := ts.opts.recordHash(ts.location, h.Sum(nil)); err != nil {
+		return errors.Join(fmt.Errorf("failed to update manifest for '%s'", ts.location), err)
+	}
+	return nil
+}
+
+func (ts *memoryTimeSeries[T]) encodeData(w io.Writer, c codec) error {
+	return c.encode(w, ts.data)
+}
+
+func (ts *memoryTimeSeries[T]) decodedEquals(r io.Reader, c codec) (bool, error) {
+	var data []TimePoint[T]
+	if err := c.decode(r, &data); err != nil {
+		return false, err
+	}
+	return sameData(ts.data, data)
+}
+
+// LoadTimeSeries loads a TimeSeries from location that keeps its points for the given retention.
+// Points older than the retention are removed whenever a point is appended and when the store is loaded.
+// A retention of 0 keeps all points until they are pruned with Prune.
+// If the file does not exist, an empty TimeSeries is returned.
+func LoadTimeSeries[T any](location string, retention time.Duration, opts ...Option) (TimeSeries[T], error) {
+	if retention < 0 {
+		return nil, fmt.Errorf("retention must not be negative")
+	}
+	options := newStoreOptions(opts)
+	lock, err := lockFile(location, options)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.releaseUnclaimed()
+	c, err := resolveCodec(location, options)
+	if err != nil {
+		return nil, err
+	}
+	if ts, err := loadTimeSeriesFromFile[T](location, retention, c, options); err != nil {
+		return nil, errors.Join(fmt.Errorf("unable to load time series from file '%s'", location), err)
+	} else {
+		opened(ts, location)
+		return ts, nil
+	}
+}
+
+func loadTimeSeriesFromFile[T any](location string, retention time.Duration, c codec, o storeOptions) (TimeSeries[T], error) {
+	ts := &memoryTimeSeries[T]{
+		id:        newStoreID(),
+		data:      make([]TimePoint[T], 0),
+		retention: retention,
+		location:  location,
+		codec:     c,
+		opts:      o,
+	}
+	f, err := o.openFile(location)
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = o.files().MkdirAll(filepath.Dir(location), 0740)
+			return ts, err
+		}
+		return nil, errors.Join(fmt.Errorf("failed to open file '%s' (file exists)", location), err)
+	}
+	defer f.Close()
+	if err := c.decode(o.withProgress(f), &ts.data); err != nil {
+		return nil, errors.Join(fmt.Errorf("failed to decode file '%s'", location), err)
+	}
+	// Files edited by hand may not be in order
+	slices.SortStableFunc(ts.data, func(a, b TimePoint[T]) int {
+		return a.Time.Compare(b.Time)
+	})
+	ts.pruneRetention()
+	return ts, nil
+}
+
+func (ts *memoryTimeSeries[T]) getSaveTimer() *time.Timer {
+	ts.timerMut.Lock()
+	defer ts.timerMut.Unlock()
+	return ts.saveTimer
+}
+
+func (ts *memoryTimeSeries[T]) setSaveTimer(t *time.Timer) {
+	ts.timerMut.Lock()
+	defer ts.timerMut.Unlock()
+	ts.saveTimer = t
+}
+
+func (ts *memoryTimeSeries[T]) getMaxSaveTimer() *time.Timer {
+	ts.timerMut.Lock()
+	defer ts.timerMut.Unlock()
+	return ts.maxSaveTimer
+}
+
+func (ts *memoryTimeSeries[T]) setMaxSaveTimer(t *time.Timer) {
+	ts.timerMut.Lock()
+	defer ts.timerMut.Unlock()
+	ts.maxSaveTimer = t
+}
+
+func (ts *memoryTimeSeries[T]) getSaveOnce() *sync.Once {
+	ts.timerMut.Lock()
+	defer ts.timerMut.Unlock()
+	return ts.saveOnce
+}
+
+func (ts *memoryTimeSeries[T]) setSaveOnce(once *sync.Once) {
+	ts.timerMut.Lock()
+	defer ts.timerMut.Unlock()
+	ts.saveOnce = once
+}
@@ -0,0 +1,301 @@
+package speicher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"sort"
+)
+
+type (
+	// Tx is a transaction over multiple stores started by Transaction.
+	// All stores of the transaction are write locked while it runs.
+	Tx struct {
+		state  *State
+		stores []Store
+	}
+
+	// snapshotter is implemented by stores that can take part in a transaction.
+	snapshotter interface {
+		lockable
+		// snapshot captures the current data of the store and returns a function that restores it.
+		// The caller must hold a write lock.
+		snapshot() (restore func())
+	}
+)
+
+// State returns the State holding the locks of the transaction.
+// Use it for helpers that lock the stores themselves;
+// locking them with another State inside the transaction deadlocks.
+func (tx *Tx) State() *State {
+	return tx.state
+}
+
+// Stores returns the stores taking part in the transaction in locking order.
+func (tx *Tx) Stores() []Store {
+	return slices.Clone(tx.stores)
+}
+
+// Transaction write locks all stores, calls f and commits or rolls back the changes f made to them.
+// The stores are locked in a deterministic order, so concurrent transactions over overlapping stores can't deadlock.
+// Modify the stores directly inside f; they are already locked.
+//
+// If f returns nil, the locks are released and all stores are saved right away in place of their automatic saves,
+// stores of a Group by saving the Group. Save errors are joined and returned.
+// If f returns an error or panics, the data of every store is restored to the state before the transaction
+// and the error (or panic) is passed on. Values changed through pointers held in a store are not restored.
+//
+// To be able to roll back, the transaction copies the data of every store when it starts,
+// which costs time and memory in proportion to the size of the stores, even if f changes a single element.
+// Keep large stores out of transactions that don't need to change them.
+func Transaction(f func(tx *Tx) error, stores ...Store) (err error) {
+	tx := &Tx{state: NewState()}
+	seen := make(map[storeID]bool, len(stores))
+	for _, store := range stores {
+		if _, ok := store.(snapshotter); !ok {
+			return fmt.Errorf("store %T does not support transactions", store)
+		}
+		if !seen[store.getStoreID()] {
+			seen[store.getStoreID()] = true
+			tx.stores = append(tx.stores, store)
+		}
+	}
+	sort.Slice(tx.stores, func(i, j int) bool {
+		return tx.stores[i].getStoreID() < tx.stores[j].getStoreID()
+	})
+
+	restores := make([]func(), 0, len(tx.stores))
+	for _, store := range tx.stores {
+		tx.state.Lock(store)
+		restores = append(restores, store.(snapshotter).snapshot())
+	}
+
+	committed := false
+	defer func() {
+		if !committed {
+			for _, restore := range restores {
+				restore()
+			}
+		}
+		for i := len(tx.stores) - 1; i >= 0; i-- {
+			tx.state.Unlock(tx.stores[i])
+		}
+		if !committed {
+			return
+		}
+		// Saving now replaces the automatic saves that releasing the locks scheduled, so no file is written twice
+		var errs []error
+		saved := make(map[storeID]bool, len(tx.stores))
+		for _, store := range tx.stores {
+			sav, ok := store.(savable)
+			if !ok {
+				continue
+			}
+			if g := groupOf(store.getStoreID()); g != nil {
+				sav = g
+			}
+			if saved[sav.getStoreID()] {
+				continue
+			}
+			saved[sav.getStoreID()] = true
+			if err := flush(context.Background(), sav); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		if len(errs) > 0 {
+			err = errors.Join(append([]error{fmt.Errorf("transaction committed but not all stores were saved")}, errs...)...)
+		}
+	}()
+
+	if err := f(tx); err != nil {
+		return err
+	}
+	committed = true
+	return nil
+}
+
+// feedMark is the number of recorded events and audit entries of a changeFeed that were not published yet.
+type feedMark struct {
+	events int
+	audits int
+}
+
+// discardSince drops the events and audit entries recorded after n.
+func (f *changeFeed[T]) discardSince(n feedMark) {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	if n.events < len(f.pending) {
+		f.pending = f.pending[:n.events]
+	}
+	if n.audits < len(f.audits) {
+		f.audits = f.audits[:n.audits]
+	}
+}
+
+// pendingLen returns the number of recorded events and audit entries that were not published yet.
+func (f *changeFeed[T]) pendingLen() feedMark {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	return feedMark{events: len(f.pending), audits: len(f.audits)}
+}
+
+func (m *memoryMap[T]) snapshot() func() {
+	data, expires, pending := maps.Clone(m.data), maps.Clone(m.expires), m.changes.pendingLen()
+	restoreRevisions := m.changes.snapshotRevisions()
+	return func() {
+		m.data, m.expires = data, expires
+		m.changes.discardSince(pending)
+		restoreRevisions()
+		m.changes.sums.invalidate()
+	}
+}
+
+func (m *memoryOrderedMap[T]) snapshot() func() {
+	restore, keys := m.memoryMap.snapshot(), slices.Clone(m.keys)
+	return func() {
+		restore()
+		m.keys = keys
+	}
+}
+
+func (l *memoryList[T]) snapshot() func() {
+	data, pending := slices.Clone(l.data), l.changes.pendingLen()
+	var ids *listIDs
+	if l.ids != nil {
+		ids = &listIDs{IDs: slices.Clone(l.ids.IDs), Next: l.ids.Next}
+	}
+	var segments listSegments
+	if l.segments != nil {
+		segments = listSegments{
+			size:      l.segments.size,
+			first:     l.segments.first,
+			dirtyFrom: l.segments.dirtyFrom,
+			stale:     slices.Clone(l.segments.stale),
+			persisted: l.segments.persisted,
+			legacy:    l.segments.legacy,
+		}
+	}
+	return func() {
+		l.data = data
+		l.ids = ids
+		l.unique = nil
+		l.changes.discardSince(pending)
+		if l.segments != nil {
+			l.segments.first = segments.first
+			l.segments.dirtyFrom = segments.dirtyFrom
+			l.segments.stale = segments.stale
+			l.segments.persisted = segments.persisted
+			l.segments.legacy = segments.legacy
+		}
+	}
+}
+
+func (s *memorySet[T]) snapshot() func() {
+	data := maps.Clone(s.data)
+	return func() {
+		s.data = data
+	}
+}
+
+func (b *memoryLeaderboard) snapshot() func() {
+	scores := maps.Clone(b.scores)
+	return func() {
+		b.Overwrite(scores)
+	}
+}
+
+func (h *memoryHyperLogLog) snapshot() func() {
+	sketches := make(map[string][]byte, len(h.sketches))
+	for key, sketch := range h.sketches {
+		sketches[key] = slices.Clone(sketch)
+	}
+	return func() {
+		h.sketches = sketches
+	}
+}
+
+func (g *memoryGraph[N, E]) snapshot() func() {
+	nodes := maps.Clone(g.nodes)
+	out := make(map[string]map[string]E, len(g.out))
+	for from, edges := range g.out {
+		out[from] = maps.Clone(edges)
+	}
+	in := make(map[string]map[string]struct{}, len(g.in))
+	for to, edges := range g.in {
+		in[to] = maps.Clone(edges)
+	}
+	return func() {
+		g.nodes, g.out, g.in = nodes, out, in
+	}
+}
+
+func (b *memoryBitmap) snapshot() func() {
+	containers := make(map[uint16]*bitmapContainer, len(b.containers))
+	for key, c := range b.containers {
+		containers[key] = &bitmapContainer{
+			array:  slices.Clone(c.array),
+			bitset: slices.Clone(c.bitset),
+			card:   c.card,
+		}
+	}
+	return func() {
+		b.containers = containers
+	}
+}
+
+func (m *memoryMetrics) snapshot() func() {
+	data := make(map[string][]MetricBucket, len(m.data))
+	for name, buckets := range m.data {
+		data[name] = slices.Clone(buckets)
+	}
+	return func() {
+		m.data = data
+	}
+}
+
+func (o *memoryOutbox[T]) snapshot() func() {
+	data := slices.Clone(o.data)
+	return func() {
+		o.data = data
+	}
+}
+
+func (d *memoryDocument) snapshot() func() {
+	data := cloneTree(d.data).(map[string]any)
+	return func() {
+		d.data = data
+	}
+}
+
+func (ts *memoryTimeSeries[T]) snapshot() func() {
+	data := slices.Clone(ts.data)
+	return func() {
+		ts.data = data
+	}
+}
+
+func (h *memoryHeap[T]) snapshot() func() {
+	values := slices.Clone(h.data.values)
+	return func() {
+		h.data.values = values
+	}
+}
+
+func (q *memoryQueue[T]) snapshot() func() {
+	data := slices.Clone(q.data)
+	return func() {
+		q.data = data
+	}
+}
+
+func (s *memorySecrets) snapshot() func() {
+	data := make(map[string][]byte, len(s.data))
+	for name, sealed := range s.data {
+		data[name] = slices.Clone(sealed)
+	}
+	return func() {
+		s.data = data
+	}
+}
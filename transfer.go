@@ -0,0 +1,78 @@
+package speicher
+
+import "time"
+
+// CopyEntries copies the entries with the given keys from src to dst, overwriting existing entries in dst.
+// Without keys, all entries of src are copied. Keys that don't exist in src are skipped.
+// Expiry times set with SetWithTTL are copied along with the values.
+// Returns the number of copied entries.
+//
+// This function acquires its own locks: a read lock on src and a write lock on dst.
+// Both are acquired in a fixed order, so concurrent transfers between the same stores can't deadlock.
+func CopyEntries[T any](src, dst Map[T], keys ...string) int {
+	return transferEntries(src, dst, keys, false, nil)
+}
+
+// MoveEntries moves the entries with the given keys from src to dst like CopyEntries
+// and deletes them from src in the same step, so no reader observes an entry in both stores or in neither.
+// Returns the number of moved entries.
+//
+// This function acquires its own write locks on src and dst.
+func MoveEntries[T any](src, dst Map[T], keys ...string) int {
+	return transferEntries(src, dst, keys, true, nil)
+}
+
+// transferEntries copies or moves the entries with the given keys, or all entries without keys,
+// from src to dst. If match is not nil, only entries it returns true for are transferred.
+func transferEntries[T any](src, dst Map[T], keys []string, move bool, match func(key string, value T) bool) int {
+	if src.getStoreID() == dst.getStoreID() {
+		return 0
+	}
+
+	s := NewState()
+	lockSrc := func() {
+		if move {
+			s.Lock(src)
+		} else {
+			s.RLock(src)
+		}
+	}
+	if src.getStoreID() < dst.getStoreID() {
+		lockSrc()
+		s.Lock(dst)
+	} else {
+		s.Lock(dst)
+		lockSrc()
+	}
+	defer func() {
+		s.Unlock(dst)
+		if move {
+			s.Unlock(src)
+		} else {
+			s.RUnlock(src)
+		}
+	}()
+
+	if len(keys) == 0 {
+		for key := range src.Iterate {
+			keys = append(keys, key)
+		}
+	}
+	n := 0
+	for _, key := range keys {
+		value, ok := src.Get(key)
+		if !ok || (match != nil && !match(key, value)) {
+			continue
+		}
+		if expires, ok := src.ExpiresAt(key); ok {
+			dst.SetWithTTL(key, value, time.Until(expires))
+		} else {
+			dst.Set(key, value)
+		}
+		if move {
+			src.Delete(key)
+		}
+		n++
+	}
+	return n
+}
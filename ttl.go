@@ -0,0 +1,318 @@
+package speicher
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// expiring is implemented by stores with entries that can expire.
+type expiring interface {
+	lockable
+	hasExpired() bool
+	DeleteExpired() int
+}
+
+// WithExpiryReaper starts a background goroutine that removes expired entries every interval.
+// Removing entries triggers an auto-save like any other write.
+// Without a reaper, expired entries are hidden from reads and removed lazily by DeleteExpired.
+func WithExpiryReaper(interval time.Duration) Option {
+	return func(o *storeOptions) {
+		o.reaperInterval = interval
+	}
+}
+
+// expiryCarrier is implemented by stores whose expiry times Migrate and WriteSnapshot write
+// to the sidecar file next to the destination, see expiryLocation.
+type expiryCarrier interface {
+	// encodeExpiry encodes the expiry times of the elements to w and reports false if no element has one.
+	encodeExpiry(w io.Writer, c codec) (bool, error)
+}
+
+// expiryLocation returns the location of the sidecar file holding the expiry times of a store.
+func expiryLocation(location string) string {
+	return location + ".expiry"
+}
+
+// expiryFieldCache holds the index of the expiry field of every struct type seen so far, see expiryField.
+var expiryFieldCache sync.Map
+
+// expiryField returns the index of the field of t, a struct or a pointer to one, that holds the expiry time
+// of a value: a time.Time or *time.Time field tagged `speicher:"expiresAt"`. Returns nil if t has none.
+func expiryField(t reflect.Type) []int {
+	if t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return nil
+	}
+	if index, ok := expiryFieldCache.Load(t); ok {
+		return index.([]int)
+	}
+	var index []int
+	timeType := reflect.TypeFor[time.Time]()
+	for _, f := range reflect.VisibleFields(t) {
+		if !f.IsExported() || (f.Type != timeType && f.Type != reflect.PointerTo(timeType)) {
+			continue
+		}
+		if slices.Contains(strings.Split(f.Tag.Get("speicher"), ","), "expiresAt") {
+			index = f.Index
+			break
+		}
+	}
+	expiryFieldCache.Store(t, index)
+	return index
+}
+
+// valueExpiry returns the expiry time held by the field with the given index of value.
+// The bool result is false if the time is zero or nil.
+func valueExpiry(value any, index []int) (time.Time, bool) {
+	v := reflect.ValueOf(value)
+	if v.Kind() == reflect.Pointer {
+		if v.IsNil() {
+			return time.Time{}, false
+		}
+		v = v.Elem()
+	}
+	// Fails if the field is promoted through a nil embedded pointer
+	f, err := v.FieldByIndexErr(index)
+	if err != nil {
+		return time.Time{}, false
+	}
+	if f.Kind() == reflect.Pointer {
+		if f.IsNil() {
+			return time.Time{}, false
+		}
+		f = f.Elem()
+	}
+	t := f.Interface().(time.Time)
+	return t, !t.IsZero()
+}
+
+// expiry returns the expiry time of key set with SetWithTTL or, if there is none, the one held by its value.
+func (m *memoryMap[T]) expiry(key string) (time.Time, bool) {
+	if t, ok := m.expires[key]; ok {
+		return t, true
+	}
+	if m.expiresField == nil {
+		return time.Time{}, false
+	}
+	value, ok := m.data[key]
+	if !ok {
+		return time.Time{}, false
+	}
+	return valueExpiry(value, m.expiresField)
+}
+
+// isExpired reports whether key has an expiry time that has passed.
+func (m *memoryMap[T]) isExpired(key string) bool {
+	if len(m.expires) == 0 && m.expiresField == nil {
+		return false
+	}
+	t, ok := m.expiry(key)
+	return ok && !time.Now().Before(t)
+}
+
+// expire sets the expiry time of key to ttl from now.
+func (m *memoryMap[T]) expire(key string, ttl time.Duration) {
+	if m.expires == nil {
+		m.expires = make(map[string]time.Time)
+	}
+	m.expires[key] = time.Now().Add(ttl)
+}
+
+func (m *memoryMap[T]) SetWithTTL(key string, value T, ttl time.Duration) {
+	m.Set(key, value)
+	m.expire(key, ttl)
+}
+
+func (m *memoryMap[T]) ExpiresAt(key string) (time.Time, bool) {
+	return m.expiry(key)
+}
+
+func (m *memoryMap[T]) hasExpired() bool {
+	now := time.Now()
+	for _, t := range m.expires {
+		if !now.Before(t) {
+			return true
+		}
+	}
+	if m.expiresField != nil {
+		for key := range m.data {
+			if m.isExpired(key) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// expiredKeys returns all keys whose expiry time has passed.
+func (m *memoryMap[T]) expiredKeys() []string {
+	var keys []string
+	now := time.Now()
+	for key, t := range m.expires {
+		if !now.Before(t) {
+			keys = append(keys, key)
+		}
+	}
+	if m.expiresField != nil {
+		for key := range m.data {
+			if _, ok := m.expires[key]; !ok && m.isExpired(key) {
+				keys = append(keys, key)
+			}
+		}
+	}
+	return keys
+}
+
+func (m *memoryMap[T]) DeleteExpired() int {
+	keys := m.expiredKeys()
+	for _, key := range keys {
+		m.Delete(key)
+	}
+	return len(keys)
+}
+
+// saveExpiry writes the expiry times next to the store file using the store codec.
+// If no entry has an expiry time, the sidecar file is removed.
+// The caller must hold at least a read lock.
+func (m *memoryMap[T]) saveExpiry(ctx context.Context) error {
+	location := expiryLocation(m.location)
+	if len(m.expires) == 0 {
+		if err := m.opts.files().Remove(location); err != nil && !os.IsNotExist(err) {
+			return errors.Join(fmt.Errorf("failed to remove file '%s'", location), err)
+		}
+		return nil
+	}
+	err := m.opts.writeFileContext(ctx, location, func(w io.Writer) error {
+		return m.codec.encode(w, m.expires)
+	})
+	if err != nil {
+		return errors.Join(fmt.Errorf("failed to write file '%s'", location), err)
+	}
+	return nil
+}
+
+// liveData returns the elements that haven't expired.
+// The caller must hold at least a read lock.
+func (m *memoryMap[T]) liveData() map[string]T {
+	if len(m.expires) == 0 && m.expiresField == nil {
+		return m.data
+	}
+	data := make(map[string]T, len(m.data))
+	for key, value := range m.data {
+		if !m.isExpired(key) {
+			data[key] = value
+		}
+	}
+	return data
+}
+
+// encodeExpiry encodes the expiry times that the sidecar file holds for the elements to w.
+// Times of elements that expired are kept, in case they expired after the data was encoded,
+// and are removed with their elements when the destination is loaded.
+// The caller must hold at least a read lock.
+func (m *memoryMap[T]) encodeExpiry(w io.Writer, c codec) (bool, error) {
+	expires := make(map[string]time.Time, len(m.expires))
+	for key, t := range m.expires {
+		if _, ok := m.data[key]; ok {
+			expires[key] = t
+		}
+	}
+	if len(expires) == 0 {
+		return false, nil
+	}
+	return true, c.encode(w, expires)
+}
+
+// encodeExpiryOf encodes the expiry times of store with c for the sidecar file of a copy of it,
+// or returns nil if no element has one. Reports false if store has no expiry times at all.
+// The caller must hold at least a read lock on store.
+func encodeExpiryOf(store any, c codec) ([]byte, bool, error) {
+	e, ok := store.(expiryCarrier)
+	if !ok {
+		return nil, false, nil
+	}
+	var buf bytes.Buffer
+	if ok, err := e.encodeExpiry(&buf, c); err != nil || !ok {
+		return nil, true, err
+	}
+	return buf.Bytes(), true, nil
+}
+
+// writeExpiryFile replaces the sidecar file next to location with expiry,
+// or removes it if expiry is nil, so a copy never keeps the expiry times of a previous file.
+func writeExpiryFile(location string, expiry []byte) error {
+	location = expiryLocation(location)
+	if expiry == nil {
+		if err := os.Remove(location); err != nil && !os.IsNotExist(err) {
+			return errors.Join(fmt.Errorf("failed to remove file '%s'", location), err)
+		}
+		return nil
+	}
+	err := writeFileAtomic(location, func(w io.Writer) error {
+		_, err := w.Write(expiry)
+		return err
+	})
+	if err != nil {
+		return errors.Join(fmt.Errorf("failed to write file '%s'", location), err)
+	}
+	return nil
+}
+
+// loadExpiry reads the expiry times written by saveExpiry, if any.
+func (m *memoryMap[T]) loadExpiry() error {
+	location := expiryLocation(m.location)
+	f, err := m.opts.files().Open(location)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return errors.Join(fmt.Errorf("failed to open file '%s' (file exists)", location), err)
+	}
+	defer f.Close()
+	if err := m.codec.decode(f, &m.expires); err != nil {
+		return errors.Join(fmt.Errorf("failed to decode file '%s'", location), err)
+	}
+	return nil
+}
+
+// startReaper removes expired entries from store every interval until the store is closed.
+// Does nothing if interval is not positive or the store does not support expiring entries.
+func startReaper(store any, interval time.Duration) {
+	e, ok := store.(expiring)
+	if !ok || interval <= 0 {
+		return
+	}
+	done := closedChan(e.getStoreID())
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			s := NewState()
+			s.RLock(e)
+			expired := e.hasExpired()
+			s.RUnlock(e)
+			if !expired {
+				continue
+			}
+			s.Lock(e)
+			e.DeleteExpired()
+			s.Unlock(e)
+		}
+	}()
+}
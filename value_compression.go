@@ -0,0 +1,137 @@
+package speicher
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// compressedValuesFile is the persisted representation of a Map that uses WithValueCompression.
+type compressedValuesFile struct {
+	// Values holds the values that are below the threshold as plain JSON.
+	Values map[string]json.RawMessage `json:"values"`
+	// CompressedValues holds the gzip-compressed JSON of all other values.
+	CompressedValues map[string][]byte `json:"compressedValues"`
+}
+
+// WithValueCompression stores every Map value whose JSON encoding is larger than threshold bytes
+// gzip-compressed inside the store file, so a few huge values don't dominate the file size.
+// Values are decompressed when the Map is loaded, so reads are not affected.
+//
+// The store file uses a different layout with this option, which can only be read with the option set.
+// An existing file without compressed values is still loaded and converted on the next save.
+// OrderedMap ignores this option.
+func WithValueCompression(threshold int) Option {
+	return func(o *storeOptions) {
+		o.valueCompression = threshold
+	}
+}
+
+// compressValues builds the persisted representation of data with all values larger than threshold compressed.
+func compressValues[T any](data map[string]T, threshold int) (compressedValuesFile, error) {
+	file := compressedValuesFile{
+		Values:           make(map[string]json.RawMessage, len(data)),
+		CompressedValues: make(map[string][]byte),
+	}
+	var buf bytes.Buffer
+	for key, value := range data {
+		raw, err := json.Marshal(value)
+		if err != nil {
+			return file, errors.Join(fmt.Errorf("failed to encode value of key '%s'", key), err)
+		}
+		if len(raw) <= threshold {
+			file.Values[key] = raw
+			continue
+		}
+		buf.Reset()
+		zw := gzip.NewWriter(&buf)
+		if _, err := zw.Write(raw); err != nil {
+			return file, errors.Join(fmt.Errorf("failed to compress value of key '%s'", key), err)
+		}
+		if err := zw.Close(); err != nil {
+			return file, errors.Join(fmt.Errorf("failed to compress value of key '%s'", key), err)
+		}
+		file.CompressedValues[key] = bytes.Clone(buf.Bytes())
+	}
+	return file, nil
+}
+
+// decompressValues decodes raw into data.
+// raw is either a compressedValuesFile or a plain map of values.
+// If strict is set, values with unknown fields are rejected.
+func decompressValues[T any](raw map[string]json.RawMessage, data map[string]T, strict bool) error {
+	_, hasValues := raw["values"]
+	_, hasCompressed := raw["compressedValues"]
+	if len(raw) != 2 || !hasValues || !hasCompressed {
+		for key, value := range raw {
+			var v T
+			if err := decodeJSON(bytes.NewReader(value), &v, strict); err != nil {
+				return errors.Join(fmt.Errorf("failed to decode value of key '%s'", key), err)
+			}
+			data[key] = v
+		}
+		return nil
+	}
+
+	var file compressedValuesFile
+	if err := json.Unmarshal(raw["values"], &file.Values); err != nil {
+		return err
+	}
+	if err := json.Unmarshal(raw["compressedValues"], &file.CompressedValues); err != nil {
+		return err
+	}
+	for key, value := range file.Values {
+		var v T
+		if err := decodeJSON(bytes.NewReader(value), &v, strict); err != nil {
+			return errors.Join(fmt.Errorf("failed to decode value of key '%s'", key), err)
+		}
+		data[key] = v
+	}
+	for key, compressed := range file.CompressedValues {
+		zr, err := gzip.NewReader(bytes.NewReader(compressed))
+		if err != nil {
+			return errors.Join(fmt.Errorf("failed to decompress value of key '%s'", key), err)
+		}
+		var v T
+		err = decodeJSON(zr, &v, strict)
+		_ = zr.Close()
+		if err != nil {
+			return errors.Join(fmt.Errorf("failed to decode value of key '%s'", key), err)
+		}
+		data[key] = v
+	}
+	return nil
+}
+
+// fileData returns what is persisted for the data of the Map.
+func (m *memoryMap[T]) fileData() (any, error) {
+	if m.opts.valueCompression <= 0 {
+		return m.data, nil
+	}
+	return compressValues(m.data, m.opts.valueCompression)
+}
+
+// decodeData decodes the data of the Map written by Save.
+func (m *memoryMap[T]) decodeData(r io.Reader, c codec) error {
+	if m.opts.valueCompression <= 0 && canStream(c) {
+		return streamDecode(c, r, true, func(key string, decode func(v any) error) error {
+			var value T
+			if err := decode(&value); err != nil {
+				return errors.Join(fmt.Errorf("failed to decode entry '%s'", key), err)
+			}
+			m.data[key] = value
+			return nil
+		})
+	}
+	if m.opts.valueCompression <= 0 {
+		return c.decode(r, &m.data)
+	}
+	var raw map[string]json.RawMessage
+	if err := c.decode(r, &raw); err != nil {
+		return err
+	}
+	return decompressValues(raw, m.data, m.opts.strictDecode)
+}
@@ -0,0 +1,182 @@
+package speicher
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+)
+
+const (
+	// maxDictionarySize is the largest useful dictionary, the window of DEFLATE.
+	maxDictionarySize = 32 << 10
+	// dictionarySampleSize is how much value data a dictionary is trained on at most.
+	dictionarySampleSize = 256 << 10
+	// minDictionaryData is the size of the segments of a disk-backed Map
+	// from which a dictionary is trained before the Map is compacted for the first time.
+	minDictionaryData = 64 << 10
+	// dictionaryGram is the length of the substrings whose frequency dictionary training counts.
+	dictionaryGram = 8
+)
+
+// WithValueDictionary compresses the values of a Map loaded with LoadMapOnDisk one by one with DEFLATE,
+// using a dictionary of up to size bytes (at most 32 KiB) trained on the values of the Map.
+// Generic compression does poorly on tiny records, since a single record has nothing to refer back to;
+// the dictionary holds the strings that the values share, like field names and common values,
+// so even small JSON values shrink considerably. Values that don't get smaller are stored as they are.
+//
+// The dictionary is trained whenever the Map is compacted, and once before that when the data on disk
+// reaches 64 KiB, and is kept in a file next to the segments. Values written before the first training
+// are stored uncompressed until the next compaction.
+// A Map loaded without the option still reads compressed values, but stores them uncompressed again
+// when it is compacted. Other stores ignore it.
+func WithValueDictionary(size int) Option {
+	return func(o *storeOptions) {
+		o.valueDictionary = min(size, maxDictionarySize)
+	}
+}
+
+// dictionaryLocation returns the location of the dictionary trained when the given segment was written.
+func (m *diskMap[T]) dictionaryLocation(segment int) string {
+	return fmt.Sprintf("%s.%d.dict", m.opts.segmentBase(m.location), segment)
+}
+
+// loadDictionary reads the dictionary listed in the manifest, if any.
+func (m *diskMap[T]) loadDictionary() error {
+	if m.manifest.Dictionary == 0 {
+		return nil
+	}
+	location := m.dictionaryLocation(m.manifest.Dictionary)
+	f, err := m.opts.files().Open(location)
+	if err != nil {
+		return fmt.Errorf("failed to open file '%s': %w", location, err)
+	}
+	defer f.Close()
+	if m.dict, err = io.ReadAll(f); err != nil {
+		return fmt.Errorf("failed to read file '%s': %w", location, err)
+	}
+	return nil
+}
+
+// plainValue returns the JSON value of record, decompressing it with dict if needed.
+func plainValue(record diskRecord, dict []byte) (json.RawMessage, error) {
+	if record.Compressed == nil {
+		return record.Value, nil
+	}
+	if dict == nil {
+		return nil, fmt.Errorf("value is compressed, but there is no dictionary")
+	}
+	zr := flate.NewReaderDict(bytes.NewReader(record.Compressed), dict)
+	defer zr.Close()
+	return io.ReadAll(zr)
+}
+
+// valueCompressor compresses values with a dictionary, reusing its DEFLATE state for all of them.
+type valueCompressor struct {
+	buf bytes.Buffer
+	zw  *flate.Writer
+}
+
+func newValueCompressor(dict []byte) *valueCompressor {
+	c := &valueCompressor{}
+	// Only fails for an invalid level
+	c.zw, _ = flate.NewWriterDict(&c.buf, flate.BestCompression, dict)
+	return c
+}
+
+// compress stores raw in record, compressed if that makes the record smaller.
+func (c *valueCompressor) compress(record *diskRecord, raw json.RawMessage) error {
+	record.Value, record.Compressed = raw, nil
+	c.buf.Reset()
+	c.zw.Reset(&c.buf)
+	if _, err := c.zw.Write(raw); err != nil {
+		return err
+	}
+	if err := c.zw.Close(); err != nil {
+		return err
+	}
+	// Compressed values are encoded as quoted base64 in the JSON lines
+	if (c.buf.Len()+2)/3*4+2 < len(raw) {
+		record.Value, record.Compressed = nil, bytes.Clone(c.buf.Bytes())
+	}
+	return nil
+}
+
+// trainDictionary builds a DEFLATE dictionary of up to size bytes from the strings that many samples share.
+// It counts in how many samples every substring of dictionaryGram bytes occurs, joins overlapping common ones
+// into longer strings and picks those that save the most. The most valuable strings go last,
+// where they are closest to the data and cheapest to refer to. Returns nil if the samples share nothing.
+func trainDictionary(samples [][]byte, size int) []byte {
+	if size <= 0 {
+		return nil
+	}
+	frequency := make(map[string]int)
+	for _, sample := range samples {
+		seen := make(map[string]bool)
+		for i := 0; i+dictionaryGram <= len(sample); i++ {
+			gram := string(sample[i : i+dictionaryGram])
+			if !seen[gram] {
+				seen[gram] = true
+				frequency[gram]++
+			}
+		}
+	}
+	// Substrings that only a few samples share would crowd out the useful ones
+	minCount := max(2, len(samples)/50)
+	common := func(sample []byte, i int) bool {
+		return i+dictionaryGram <= len(sample) && frequency[string(sample[i:i+dictionaryGram])] >= minCount
+	}
+
+	candidates := make(map[string]int)
+	for _, sample := range samples {
+		seen := make(map[string]bool)
+		for i := 0; i+dictionaryGram <= len(sample); i++ {
+			if !common(sample, i) {
+				continue
+			}
+			j := i
+			for common(sample, j+1) {
+				j++
+			}
+			candidate := string(sample[i : j+dictionaryGram])
+			if !seen[candidate] {
+				seen[candidate] = true
+				candidates[candidate]++
+			}
+			i = j
+		}
+	}
+
+	ranked := make([]string, 0, len(candidates))
+	for candidate, n := range candidates {
+		if n >= minCount {
+			ranked = append(ranked, candidate)
+		}
+	}
+	slices.SortFunc(ranked, func(a, b string) int {
+		if sa, sb := candidates[a]*len(a), candidates[b]*len(b); sa != sb {
+			return sb - sa
+		}
+		return strings.Compare(a, b)
+	})
+	var picked []string
+	var joined []byte
+	for _, candidate := range ranked {
+		if len(joined)+len(candidate) > size || bytes.Contains(joined, []byte(candidate)) {
+			continue
+		}
+		picked = append(picked, candidate)
+		joined = append(joined, candidate...)
+	}
+	if len(picked) == 0 {
+		return nil
+	}
+	dict := make([]byte, 0, len(joined))
+	for _, candidate := range slices.Backward(picked) {
+		dict = append(dict, candidate...)
+	}
+	return dict
+}
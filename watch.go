@@ -0,0 +1,192 @@
+package speicher
+
+import (
+	"context"
+	"sync"
+)
+
+type (
+	// ChangeOp is the kind of change reported by a ChangeEvent.
+	ChangeOp string
+
+	// ChangeEvent describes a single change of a store.
+	ChangeEvent[T any] struct {
+		// Op is the kind of change.
+		Op ChangeOp
+		// Key is the key of the changed Map element or the index of the changed List element.
+		// It is empty for ChangeOverwrite.
+		Key string
+		// Old is the value before the change.
+		// It is the zero value if the element did not exist or for ChangeOverwrite.
+		Old T
+		// New is the value after the change.
+		// It is the zero value for ChangeDelete and ChangeOverwrite.
+		New T
+	}
+
+	// Watchable is implemented by stores that report their changes as typed events, like Map and List.
+	// Use it to write subscribers that work with any of them without type assertions.
+	Watchable[T any] interface {
+		// Watch returns a channel that receives a ChangeEvent for every change of the store
+		// and is closed when ctx is done.
+		Watch(ctx context.Context) <-chan ChangeEvent[T]
+	}
+
+	// publisher is implemented by stores that report changes to watchers.
+	publisher interface {
+		publishChanges()
+	}
+
+	// changeFeed collects the changes of a store while it is write locked
+	// and hands them to all watchers once the write lock is released.
+	changeFeed[T any] struct {
+		mut      sync.Mutex
+		pending  []ChangeEvent[T]
+		watchers map[*watcher[T]]struct{}
+		// sampler picks changes for WithChangeSampling, samples holds the picked ones until they are published.
+		sampler *changeSampler
+		samples []ChangeSample
+		// audit is the log of WithAuditLog, audits holds the entries recorded until the write lock is released.
+		audit  *auditLog
+		audits []AuditEntry
+		// revs tracks the revision of every element for WithRevisions.
+		revs *revisions
+		// sums holds the checksums of the elements for WithEntryChecksums.
+		sums *entrySums[T]
+	}
+
+	// watcher queues events for a single Watch channel so that writers never block on slow readers.
+	watcher[T any] struct {
+		mut    sync.Mutex
+		queue  []ChangeEvent[T]
+		signal chan struct{}
+	}
+)
+
+const (
+	// ChangeSet is reported when an element is added or updated.
+	ChangeSet ChangeOp = "set"
+	// ChangeInsert is reported when an element is inserted into a List, moving later elements back.
+	ChangeInsert ChangeOp = "insert"
+	// ChangeDelete is reported when an element is removed.
+	ChangeDelete ChangeOp = "delete"
+	// ChangeOverwrite is reported when the whole store is replaced.
+	// Watchers should reload the store instead of applying the event.
+	ChangeOverwrite ChangeOp = "overwrite"
+)
+
+// record queues an event until the write lock is released.
+// Does nothing if nobody watches the store and the event is not sampled.
+// The caller must hold a write lock on the store.
+func (f *changeFeed[T]) record(event ChangeEvent[T]) {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	if f.sampler != nil {
+		if s, ok := sample(f.sampler, event); ok {
+			f.samples = append(f.samples, s)
+		}
+	}
+	if f.audit != nil {
+		f.audits = append(f.audits, auditEntry(event))
+	}
+	if f.revs != nil {
+		f.revs.changed(event.Op, event.Key)
+	}
+	if f.sums != nil {
+		f.sums.changed(event.Op, event.Key, event.New)
+	}
+	if len(f.watchers) == 0 {
+		return
+	}
+	f.pending = append(f.pending, event)
+}
+
+// watched reports whether anybody watches the store or its changes are audited,
+// so stores can skip looking up the old value of a change that is not recorded.
+func (f *changeFeed[T]) watched() bool {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	return len(f.watchers) > 0 || f.audit != nil
+}
+
+func (f *changeFeed[T]) publishChanges() {
+	f.mut.Lock()
+	samples := f.samples
+	f.samples = nil
+	f.mut.Unlock()
+	for _, s := range samples {
+		f.sampler.fn(s)
+	}
+
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	if len(f.pending) == 0 {
+		return
+	}
+	for w := range f.watchers {
+		w.mut.Lock()
+		w.queue = append(w.queue, f.pending...)
+		w.mut.Unlock()
+		select {
+		case w.signal <- struct{}{}:
+		default:
+		}
+	}
+	f.pending = nil
+}
+
+// watch registers a new watcher that delivers events until ctx is done.
+func (f *changeFeed[T]) watch(ctx context.Context) <-chan ChangeEvent[T] {
+	w := &watcher[T]{signal: make(chan struct{}, 1)}
+	f.mut.Lock()
+	if f.watchers == nil {
+		f.watchers = make(map[*watcher[T]]struct{})
+	}
+	f.watchers[w] = struct{}{}
+	f.mut.Unlock()
+
+	ch := make(chan ChangeEvent[T])
+	go func() {
+		defer close(ch)
+		defer func() {
+			f.mut.Lock()
+			delete(f.watchers, w)
+			f.mut.Unlock()
+		}()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-w.signal:
+			}
+			w.mut.Lock()
+			events := w.queue
+			w.queue = nil
+			w.mut.Unlock()
+			for _, event := range events {
+				select {
+				case <-ctx.Done():
+					return
+				case ch <- event:
+				}
+			}
+		}
+	}()
+	return ch
+}
+
+// OnChange calls fn for every change of store until ctx is done.
+// fn is called on a separate goroutine, one event at a time and in the order the changes were made.
+// OnChange returns immediately.
+//
+//	speicher.OnChange(ctx, users, func(e speicher.ChangeEvent[User]) {
+//		log.Printf("%s %s: %s -> %s", e.Op, e.Key, e.Old.Name, e.New.Name)
+//	})
+func OnChange[T any](ctx context.Context, store Watchable[T], fn func(event ChangeEvent[T])) {
+	events := store.Watch(ctx)
+	go func() {
+		for event := range events {
+			fn(event)
+		}
+	}()
+}